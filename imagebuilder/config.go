@@ -0,0 +1,79 @@
+/*
+Copyright 2016 The Kubernetes Authors All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"text/tabwriter"
+
+	"github.com/golang/glog"
+	"k8s.io/kube-deploy/imagebuilder/pkg/imagebuilder"
+)
+
+// runConfig prints the effective config (config view), returning the exit code
+func runConfig(args []string) int {
+	fs := newCommandFlags("config")
+	args = parseCommandFlags(fs, args)
+	if len(args) != 1 || args[0] != "view" {
+		glog.Exitf("usage: imagebuilder --config <config> [--config <config>...] config view")
+	}
+
+	l, err := loadLayeredConfig()
+	if err != nil {
+		glog.Exitf("Error loading config: %v", err)
+	}
+
+	// Without a known cloud, we can only show the common config
+	config, err := newCloudConfig(l.Cloud())
+	if err != nil {
+		common := &imagebuilder.Config{}
+		common.InitDefaults()
+		config = common
+	}
+	if err := loadConfig(config); err != nil {
+		glog.Exitf("Error loading config: %v", err)
+	}
+
+	values, err := l.Describe(config)
+	if err != nil {
+		glog.Exitf("%v", err)
+	}
+
+	if *flagOutput == "json" {
+		printJSON(values)
+		return 0
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+	// Values can be long (e.g. SetupCommands), so they go last
+	fmt.Fprintf(w, "KEY\tSOURCE\tVALUE\n")
+	for _, v := range values {
+		value, ok := v.Value.(string)
+		if !ok {
+			data, err := json.Marshal(v.Value)
+			if err != nil {
+				glog.Exitf("error serializing %s: %v", v.Key, err)
+			}
+			value = string(data)
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\n", v.Key, v.Source, value)
+	}
+	w.Flush()
+	return 0
+}
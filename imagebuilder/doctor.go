@@ -0,0 +1,159 @@
+/*
+Copyright 2016 The Kubernetes Authors All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"fmt"
+	"os"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/golang/glog"
+	"k8s.io/kube-deploy/imagebuilder/pkg/imagebuilder"
+)
+
+// runDoctor checks the config and the cloud account before anything is launched, returning the exit code
+func runDoctor(args []string) int {
+	fs := newCommandFlags("doctor", []string{"state"})
+	if len(parseCommandFlags(fs, args)) != 0 {
+		glog.Exitf("doctor does not take arguments")
+	}
+
+	config := &imagebuilder.Config{}
+	config.InitDefaults()
+	err := loadConfig(config)
+	if err != nil {
+		glog.Exitf("Error loading config: %v", err)
+	}
+	config.BaseImagePinFile = configPath("BaseImagePinFile", config.BaseImagePinFile)
+
+	var checks []*imagebuilder.Check
+	if errs := config.Validate(); len(errs) != 0 {
+		var messages []string
+		for _, err := range errs {
+			messages = append(messages, err.Error())
+		}
+		checks = append(checks, &imagebuilder.Check{
+			Name:    "config",
+			Status:  imagebuilder.CheckFail,
+			Message: strings.Join(messages, "; "),
+			Fix:     "Fix the config; imagebuilder validate reports the problems in detail",
+		})
+	} else {
+		checks = append(checks, &imagebuilder.Check{Name: "config", Status: imagebuilder.CheckPass, Message: flagConfig.String()})
+	}
+
+	var cloud imagebuilder.Cloud
+	switch config.Cloud {
+	case "gce":
+		// initGCE fails if we can't build the clients, which we report as a check
+		_, gceCloud, err := initGCE()
+		if err != nil {
+			checks = append(checks, &imagebuilder.Check{
+				Name:    "credentials",
+				Status:  imagebuilder.CheckFail,
+				Message: err.Error(),
+				Fix:     "Run gcloud auth application-default login (or set GOOGLE_APPLICATION_CREDENTIALS), and check the GCE config",
+			})
+		} else {
+			cloud = gceCloud
+		}
+	case "aws", "container":
+		cloud = loadCloud().cloud
+	}
+	if q, ok := cloud.(imagebuilder.BaseImageQuerier); ok {
+		checks = append(checks, doctorBaseImageQuery(q, config.BaseImagePinFile)...)
+	}
+	if doctor, ok := cloud.(imagebuilder.Doctor); ok {
+		checks = append(checks, doctor.Doctor()...)
+	}
+
+	if *flagState != "" {
+		checks = append(checks, imagebuilder.CheckWriteAccess("state", *flagState))
+	}
+
+	exitCode := 0
+	for _, check := range checks {
+		if check.Status == imagebuilder.CheckFail {
+			exitCode = 1
+		}
+	}
+
+	if *flagOutput == "json" {
+		printJSON(checks)
+		return exitCode
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+	fmt.Fprintf(w, "CHECK\tSTATUS\tMESSAGE\n")
+	for _, check := range checks {
+		// Cloud errors can span lines, which would break the table
+		message := strings.Join(strings.Fields(check.Message), " ")
+		fmt.Fprintf(w, "%s\t%s\t%s\n", check.Name, strings.ToUpper(string(check.Status)), message)
+	}
+	w.Flush()
+
+	var fixes []string
+	for _, check := range checks {
+		if check.Fix != "" {
+			fixes = append(fixes, fmt.Sprintf("  %s: %s", check.Name, check.Fix))
+		}
+	}
+	if len(fixes) != 0 {
+		fmt.Printf("\nTo fix:\n%s\n", strings.Join(fixes, "\n"))
+	}
+	return exitCode
+}
+
+// doctorBaseImageQuery checks the pinned image, or runs the base image query (without pinning the result),
+// and sets the base image so that the cloud's checks check the image the build would use
+func doctorBaseImageQuery(q imagebuilder.BaseImageQuerier, pinFile string) []*imagebuilder.Check {
+	key, query := q.BaseImageQuery()
+	if key == "" {
+		return nil
+	}
+
+	image, err := imagebuilder.PinnedBaseImage(q, pinFile)
+	if err != nil {
+		return []*imagebuilder.Check{{
+			Name:    "base image pin",
+			Status:  imagebuilder.CheckFail,
+			Message: err.Error(),
+			Fix:     "Pass --update-pins to the build to pin the image the new query finds",
+		}}
+	}
+	if image != "" {
+		q.SetBaseImage(image)
+		return []*imagebuilder.Check{{Name: "base image pin", Status: imagebuilder.CheckPass, Message: fmt.Sprintf("%s is pinned to %s", key, image)}}
+	}
+
+	image, err = q.FindBaseImage()
+	if err != nil {
+		return []*imagebuilder.Check{{
+			Name:    "base image query",
+			Status:  imagebuilder.CheckFail,
+			Message: err.Error(),
+			Fix:     "Check that the base image query (" + query + ") matches an image that the account can use",
+		}}
+	}
+	q.SetBaseImage(image)
+	check := &imagebuilder.Check{Name: "base image query", Status: imagebuilder.CheckPass, Message: fmt.Sprintf("%s found %s", query, image)}
+	if pinFile != "" {
+		check.Message += " (not pinned yet; the build will pin it)"
+	}
+	return []*imagebuilder.Check{check}
+}
@@ -0,0 +1,265 @@
+/*
+Copyright 2016 The Kubernetes Authors All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/golang/glog"
+	"k8s.io/kube-deploy/imagebuilder/pkg/imagebuilder"
+)
+
+// runList lists our images, returning the exit code
+func runList(args []string) int {
+	fs := newCommandFlags("list")
+	family := fs.String("family", "", "Only list images whose name starts with this prefix")
+	tags := make(varsFlag)
+	fs.Var(tags, "tag", "Only list images with this tag (k=v, can be repeated)")
+	if len(parseCommandFlags(fs, args)) != 0 {
+		glog.Exitf("list does not take arguments")
+	}
+
+	cloud := loadCloud().cloud
+	images, err := cloud.ListImages(imagebuilder.ImageFilter{Family: *family, Tags: tags})
+	if err != nil {
+		glog.Exitf("error listing images: %v", err)
+	}
+
+	if *flagOutput == "json" {
+		if images == nil {
+			images = []*imagebuilder.ImageInfo{}
+		}
+		printJSON(images)
+		return 0
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+	fmt.Fprintf(w, "NAME\tCREATED\tREGIONS\tPUBLIC\n")
+	for _, image := range images {
+		fmt.Fprintf(w, "%s\t%s\t%d\t%v\n", image.Name, image.Created, len(image.Regions), image.Public())
+	}
+	w.Flush()
+	return 0
+}
+
+// runShow prints the image's ID, state and launch permissions in each region, returning the exit code
+func runShow(args []string) int {
+	fs := newCommandFlags("show")
+	args = parseCommandFlags(fs, args)
+	if len(args) != 1 {
+		glog.Exitf("show takes the name of an image")
+	}
+	name := args[0]
+
+	cloud := loadCloud().cloud
+	image, err := cloud.DescribeImage(name)
+	if err != nil {
+		glog.Exitf("error describing image %q: %v", name, err)
+	}
+	if image == nil {
+		glog.Exitf("image %q not found", name)
+	}
+
+	if *flagOutput == "json" {
+		printJSON(image)
+		return 0
+	}
+
+	fmt.Printf("Name:     %s\n", image.Name)
+	fmt.Printf("Created:  %s\n", image.Created)
+	if len(image.Tags) != 0 {
+		var keys []string
+		for k := range image.Tags {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		fmt.Printf("Tags:\n")
+		for _, k := range keys {
+			fmt.Printf("  %s=%s\n", k, image.Tags[k])
+		}
+	}
+	fmt.Println()
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+	fmt.Fprintf(w, "REGION\tID\tSTATE\tPUBLIC\tLAUNCH PERMISSIONS\n")
+	for _, r := range image.Regions {
+		region := r.Region
+		if region == "" {
+			region = "-"
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\t%v\t%s\n", region, r.ID, r.State, r.Public, strings.Join(r.LaunchPermissions, ","))
+	}
+	w.Flush()
+	return 0
+}
+
+// findImage finds an existing image by name, exiting if it is not found
+func findImage(cloud imagebuilder.Cloud, name string) imagebuilder.Image {
+	image, err := cloud.FindImage(name)
+	if err != nil {
+		glog.Exitf("error finding image %q: %v", name, err)
+	}
+	if image == nil {
+		glog.Exitf("image %q not found", name)
+	}
+	return image
+}
+
+// runPublish makes an existing image public (in the configured region), returning the exit code
+func runPublish(args []string) int {
+	fs := newCommandFlags("publish")
+	args = parseCommandFlags(fs, args)
+	if len(args) != 1 {
+		glog.Exitf("publish takes the name of an image")
+	}
+	name := args[0]
+
+	cloud := loadCloud().cloud
+	image := findImage(cloud, name)
+
+	glog.Infof("Making image public: %v", image)
+	err := image.EnsurePublic()
+	if err != nil {
+		glog.Exitf("error making image public %q: %v", name, err)
+	}
+
+	if *flagOutput == "json" {
+		printJSON(map[string]string{"name": name, "image": fmt.Sprintf("%v", image)})
+	} else {
+		fmt.Printf("Made image public: %v\n", image)
+	}
+	return 0
+}
+
+// runReplicate copies an existing image to all regions, returning the exit code
+func runReplicate(args []string) int {
+	fs := newCommandFlags("replicate")
+	public := fs.Bool("public", false, "Set to make the copies (and the image) public")
+	args = parseCommandFlags(fs, args)
+	if len(args) != 1 {
+		glog.Exitf("replicate takes the name of an image")
+	}
+	name := args[0]
+
+	cloud := loadCloud().cloud
+	image := findImage(cloud, name)
+
+	glog.Infof("Copying image to all regions: %v", image)
+	images, err := image.ReplicateImage(*public, nil)
+	if err != nil {
+		glog.Exitf("error replicating image %q: %v", name, err)
+	}
+
+	regions := make(map[string]string)
+	for region, imageID := range images {
+		regions[region] = fmt.Sprintf("%v", imageID)
+	}
+
+	if *flagOutput == "json" {
+		printJSON(map[string]interface{}{"name": name, "regions": regions})
+		return 0
+	}
+
+	var keys []string
+	for k := range regions {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+	fmt.Fprintf(w, "REGION\tIMAGE\n")
+	for _, k := range keys {
+		fmt.Fprintf(w, "%s\t%s\n", k, regions[k])
+	}
+	w.Flush()
+	return 0
+}
+
+// runGC deletes all but the newest images in a family, returning the exit code
+func runGC(args []string) int {
+	fs := newCommandFlags("gc")
+	family := fs.String("family", "", "Delete old images whose name starts with this prefix (required)")
+	keep := fs.Int("keep", 3, "Number of the newest images in the family to keep")
+	dryRun := fs.Bool("dry-run", false, "Set to print the images that would be deleted, without deleting them")
+	includePublic := fs.Bool("include-public", false, "Set to also delete public images")
+	if len(parseCommandFlags(fs, args)) != 0 {
+		glog.Exitf("gc does not take arguments")
+	}
+	if *family == "" {
+		glog.Exitf("--family must be specified")
+	}
+	if *keep < 1 {
+		glog.Exitf("--keep must be at least 1")
+	}
+
+	cloud := loadCloud().cloud
+	images, err := cloud.ListImages(imagebuilder.ImageFilter{Family: *family})
+	if err != nil {
+		glog.Exitf("error listing images: %v", err)
+	}
+
+	// Newest first
+	sort.SliceStable(images, func(i, j int) bool { return images[i].Created > images[j].Created })
+
+	type gcResult struct {
+		Name    string `json:"name"`
+		Created string `json:"created,omitempty"`
+		Action  string `json:"action"`
+	}
+	var results []*gcResult
+	exitCode := 0
+	for i, image := range images {
+		r := &gcResult{Name: image.Name, Created: image.Created}
+		results = append(results, r)
+		switch {
+		case i < *keep:
+			r.Action = "keep"
+		case image.Public() && !*includePublic:
+			r.Action = "keep (public)"
+		case *dryRun:
+			r.Action = "would delete"
+		default:
+			err := cloud.DeleteImage(image.Name)
+			if err != nil {
+				glog.Errorf("error deleting image %q: %v", image.Name, err)
+				r.Action = "error"
+				exitCode = 1
+			} else {
+				r.Action = "deleted"
+			}
+		}
+	}
+
+	if *flagOutput == "json" {
+		if results == nil {
+			results = []*gcResult{}
+		}
+		printJSON(results)
+		return exitCode
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+	fmt.Fprintf(w, "NAME\tCREATED\tACTION\n")
+	for _, r := range results {
+		fmt.Fprintf(w, "%s\t%s\t%s\n", r.Name, r.Created, r.Action)
+	}
+	w.Flush()
+	return exitCode
+}
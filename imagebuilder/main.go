@@ -17,13 +17,13 @@ limitations under the License.
 package main
 
 import (
+	"encoding/json"
 	"flag"
 	"fmt"
+	"io"
 	"math/rand"
 	"time"
 
-	"golang.org/x/crypto/ssh"
-
 	"github.com/aws/aws-sdk-go/aws"
 	"github.com/aws/aws-sdk-go/aws/session"
 	"github.com/aws/aws-sdk-go/service/ec2"
@@ -31,18 +31,20 @@ import (
 	"github.com/golang/glog"
 	"golang.org/x/net/context"
 	"golang.org/x/oauth2/google"
+	computebeta "google.golang.org/api/compute/v0.beta"
 	"google.golang.org/api/compute/v1"
 	"google.golang.org/api/storage/v1"
-	"io/ioutil"
 	"k8s.io/kube-deploy/imagebuilder/pkg/imagebuilder"
 	"k8s.io/kube-deploy/imagebuilder/pkg/imagebuilder/executor"
-	"net/url"
 	"os"
 	"path"
+	"path/filepath"
+	"reflect"
+	"sort"
 	"strings"
 )
 
-var flagConfig = flag.String("config", "", "Config file to load")
+var flagConfig filesFlag
 
 //var flagRegion = flag.String("region", "", "Cloud region to use")
 //var flagImage = flag.String("image", "", "Image to use as builder")
@@ -60,19 +62,170 @@ var flagReplicate = flag.Bool("replicate", true, "Set to copy the image to all r
 var flagDown = flag.Bool("down", true, "Set to shut down instance (if found)")
 
 var flagLocalhost = flag.Bool("localhost", false, "Set to use local machine for execution")
+var flagDocker = flag.Bool("docker", false, "Set to build in a privileged docker container on the local machine")
+
+var flagResult = flag.String("result", "", "Set to write a JSON description of the image to the file")
+var flagForce = flag.Bool("force", false, "Set to build even if an image with the same content hash exists (but not over an image with the same name)")
+var flagArtifacts = flag.String("artifacts", "", "Set to copy the build logs and other artifacts to the directory")
+
+var flagUpdatePins = flag.Bool("update-pins", false, "Set to run the base image query again, and update the image pinned in BaseImagePinFile")
+
+var flagState = flag.String("state", "", "Set to record the progress of the build in this file (or s3://bucket/key or gs://bucket/object), so it can be resumed")
+
+var flagOutput = flag.String("output", "text", "Output format: text or json")
+
+var flagEvents = flag.String("events", "", "Set to report build progress events: console (to stderr) or jsonl (JSON lines, to stdout or --events-file)")
+var flagEventsFile = flag.String("events-file", "", "Set to append the --events=jsonl events to this file, instead of writing them to stdout")
+var flagBuildName = flag.String("build-name", "", "Set to label the build's events, e.g. with a CI job name")
+
+var flagStrict = flag.Bool("strict", false, "Set to fail on references to undefined keys in the template")
+var flagSet = make(varsFlag)
+
+func init() {
+	flag.Var(&flagConfig, "config", "Config file to load (can be repeated; later files override earlier ones)")
+	flag.Var(flagSet, "set", "Set a template variable declared in TemplateVars, or a config key (k=v, can be repeated)")
+}
+
+// filesFlag collects the values of a repeated flag, in order
+type filesFlag []string
+
+func (f *filesFlag) String() string {
+	return strings.Join(*f, ",")
+}
+
+func (f *filesFlag) Set(p string) error {
+	*f = append(*f, p)
+	return nil
+}
+
+// varsFlag collects k=v values from repeated flags
+type varsFlag map[string]string
+
+func (f varsFlag) String() string {
+	var kvs []string
+	for k, v := range f {
+		kvs = append(kvs, k+"="+v)
+	}
+	return strings.Join(kvs, ",")
+}
+
+func (f varsFlag) Set(kv string) error {
+	tokens := strings.SplitN(kv, "=", 2)
+	if len(tokens) != 2 || tokens[0] == "" {
+		return fmt.Errorf("expected k=v, was %q", kv)
+	}
+	f[tokens[0]] = tokens[1]
+	return nil
+}
+
+// layeredConfig is the config from the --config files, IMAGEBUILDER_* environment variables and --set flags
+var layeredConfig *imagebuilder.LayeredConfig
+
+// templateVarOverrides are the --set flags for variables declared in TemplateVars
+var templateVarOverrides map[string]string
+
+// loadLayeredConfig loads and merges the config layers, the first time it is called
+func loadLayeredConfig() (*imagebuilder.LayeredConfig, error) {
+	if layeredConfig != nil {
+		return layeredConfig, nil
+	}
+
+	l := imagebuilder.NewLayeredConfig()
+	for _, p := range flagConfig {
+		if err := l.AddFile(p); err != nil {
+			return nil, err
+		}
+	}
+	l.AddEnv(os.Environ())
+
+	// --set sets a template variable if it is declared in TemplateVars, and otherwise a config key
+	declared := &imagebuilder.Config{}
+	if err := l.Decode(declared); err != nil {
+		return nil, err
+	}
+	var keys []string
+	for k := range flagSet {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	templateVarOverrides = make(map[string]string)
+	for _, k := range keys {
+		if _, found := declared.TemplateVars[k]; found {
+			templateVarOverrides[k] = flagSet[k]
+			continue
+		}
+		if err := l.CheckKey(k); err != nil {
+			return nil, fmt.Errorf("--set %s: %v, and is not a template variable declared in TemplateVars", k, err)
+		}
+		l.Set(k, flagSet[k], "--set "+k)
+	}
+
+	// The region can also come from the environment, as for other AWS tools
+	if l.Cloud() == "aws" {
+		for _, name := range []string{"AWS_REGION", "AWS_DEFAULT_REGION"} {
+			if region := os.Getenv(name); region != "" {
+				l.AddDefault("Region", region, "$"+name)
+				break
+			}
+		}
+	}
+
+	if err := l.Merge(); err != nil {
+		return nil, err
+	}
+	layeredConfig = l
+	return l, nil
+}
 
-func loadConfig(dest interface{}, src string) error {
-	data, err := ioutil.ReadFile(src)
+// loadConfig decodes the config layers into dest, overriding the defaults already set in dest
+func loadConfig(dest interface{}) error {
+	l, err := loadLayeredConfig()
 	if err != nil {
-		return fmt.Errorf("error reading file %q: %v", src, err)
+		return err
 	}
+	return l.Decode(dest)
+}
+
+// configPath resolves a local path set by the config key, relative to the config file that set it
+func configPath(key string, p string) string {
+	if p == "" || path.IsAbs(p) || layeredConfig == nil {
+		return p
+	}
+	return path.Join(layeredConfig.Dir(key), p)
+}
 
-	err = yaml.Unmarshal(data, dest)
+// awsRegion returns the region the config sets, which selects the default ImageID
+func awsRegion() (string, error) {
+	l, err := loadLayeredConfig()
 	if err != nil {
-		return fmt.Errorf("error parsing file %q: %v", src, err)
+		return "", err
 	}
+	v, _, err := l.Lookup("Region")
+	if err != nil {
+		return "", err
+	}
+	region, _ := v.(string)
+	return region, nil
+}
 
-	return nil
+// commands are the subcommands; each returns the exit code
+var commands = map[string]func(args []string) int{
+	"build":            runBuild,
+	"list":             runList,
+	"show":             runShow,
+	"publish":          runPublish,
+	"replicate":        runReplicate,
+	"gc":               runGC,
+	"validate":         func(args []string) int { return runValidate("validate", args) },
+	"config":           runConfig,
+	"matrix":           runMatrix,
+	"lint":             func(args []string) int { return runValidate("lint", args) },
+	"render":           runRender,
+	"resume":           runResume,
+	"doctor":           runDoctor,
+	"pin":              runPin,
+	"setup-network":    runSetupNetwork,
+	"teardown-network": runTeardownNetwork,
 }
 
 func main() {
@@ -81,40 +234,209 @@ func main() {
 	flag.Set("alsologtostderr", "true")
 	flag.Parse()
 
-	if *flagConfig == "" {
+	// build is the default, for compatibility with the flags-only CLI
+	command := "build"
+	args := flag.Args()
+	if len(args) != 0 {
+		command = args[0]
+		args = args[1:]
+	}
+
+	run := commands[command]
+	if run == nil {
+		glog.Exitf("Unknown command %q", command)
+	}
+	os.Exit(run(args))
+}
+
+// Flags are defined once, but each command accepts only the global flags (and glog's) and its own groups of flags.
+// All of them can also be given before the command, because build (the default) was originally the only command.
+var (
+	// globalFlags are accepted by every command
+	globalFlags = []string{"config", "set", "output"}
+	// phaseFlags select the phases of a build
+	phaseFlags = []string{"up", "build", "tag", "publish", "replicate", "down"}
+	// buildFlags are the other flags for a build
+	buildFlags = []string{"localhost", "docker", "result", "force", "artifacts", "update-pins", "state", "events", "events-file", "build-name", "strict"}
+)
+
+// newCommandFlags returns the flags for a subcommand: the global flags, and the groups of flags it accepts
+func newCommandFlags(name string, groups ...[]string) *flag.FlagSet {
+	ours := make(map[string]bool)
+	for _, group := range [][]string{globalFlags, phaseFlags, buildFlags} {
+		for _, f := range group {
+			ours[f] = true
+		}
+	}
+	accepted := make(map[string]bool)
+	for _, group := range append([][]string{globalFlags}, groups...) {
+		for _, f := range group {
+			accepted[f] = true
+		}
+	}
+
+	fs := flag.NewFlagSet(name, flag.ExitOnError)
+	flag.VisitAll(func(f *flag.Flag) {
+		// Flags that are not ours are glog's, which every command accepts
+		if accepted[f.Name] || !ours[f.Name] {
+			fs.Var(f.Value, f.Name, f.Usage)
+		}
+	})
+	return fs
+}
+
+// parseCommandFlags parses the subcommand's flags, checks the global flags, and returns the arguments
+func parseCommandFlags(fs *flag.FlagSet, args []string) []string {
+	args = parseFlags(fs, args)
+	if len(flagConfig) == 0 {
 		glog.Exitf("--config must be specified")
 	}
+	return args
+}
 
+// parseFlags is parseCommandFlags for subcommands that don't need --config
+func parseFlags(fs *flag.FlagSet, args []string) []string {
+	// Flags given before the command must also be flags of the command
+	flag.Visit(func(f *flag.Flag) {
+		if own := fs.Lookup(f.Name); own == nil || !sameFlagValue(own.Value, f.Value) {
+			glog.Exitf("--%s is not a flag of the %s command", f.Name, fs.Name())
+		}
+	})
+	fs.Parse(args)
+
+	switch *flagOutput {
+	case "text", "json":
+	default:
+		glog.Exitf("--output must be text or json, was %q", *flagOutput)
+	}
+
+	switch *flagEvents {
+	case "", "console":
+		if *flagEventsFile != "" {
+			glog.Exitf("--events-file can only be used with --events=jsonl")
+		}
+	case "jsonl":
+		if *flagEventsFile == "" && *flagOutput == "json" {
+			glog.Exitf("--events=jsonl and --output=json both write to stdout; use --events-file")
+		}
+	default:
+		glog.Exitf("--events must be console or jsonl, was %q", *flagEvents)
+	}
+	return fs.Args()
+}
+
+// sameFlagValue returns true if a and b are the same flag variable.
+// (Some flags, such as --set, are maps, so we can't compare them with ==.)
+func sameFlagValue(a, b flag.Value) bool {
+	return reflect.ValueOf(a).Pointer() == reflect.ValueOf(b).Pointer()
+}
+
+// newEvents returns the Events for --events, or nil if events are not reported
+func newEvents() (*imagebuilder.Events, error) {
+	events := &imagebuilder.Events{Build: *flagBuildName}
+	switch *flagEvents {
+	case "console":
+		events.Subscribe(imagebuilder.NewConsoleSubscriber(os.Stderr))
+	case "jsonl":
+		w := io.Writer(os.Stdout)
+		if *flagEventsFile != "" {
+			// We append, so that the builds in a matrix can share a file
+			f, err := os.OpenFile(*flagEventsFile, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+			if err != nil {
+				return nil, fmt.Errorf("error opening events file %q: %v", *flagEventsFile, err)
+			}
+			w = f
+		}
+		events.Subscribe(imagebuilder.NewJSONLSubscriber(w))
+	default:
+		return nil, nil
+	}
+	return events, nil
+}
+
+// printJSON writes v to stdout as indented JSON
+func printJSON(v interface{}) {
+	data, err := json.MarshalIndent(v, "", "  ")
+	if err != nil {
+		glog.Fatalf("error serializing output: %v", err)
+	}
+	fmt.Println(string(data))
+}
+
+// loadedCloud is the config, and the cloud it specifies
+type loadedCloud struct {
+	config          *imagebuilder.Config
+	templateContext interface{}
+	cloud           imagebuilder.Cloud
+	// baseImage is the image the build runs on, which is part of the content hash
+	baseImage string
+}
+
+// loadCloud loads the config, resolving local paths relative to the config file, and connects to the cloud
+func loadCloud() *loadedCloud {
 	var templateContext interface{}
 
 	config := &imagebuilder.Config{}
 	config.InitDefaults()
-	err := loadConfig(config, *flagConfig)
+	err := loadConfig(config)
 	if err != nil {
 		glog.Exitf("Error loading config: %v", err)
 	}
 
+	// Local files are relative to the config file that sets them
+	for k, v := range config.Files {
+		config.Files[k] = configPath("Files."+k, v)
+	}
+	config.BootstrapVZPath = configPath("BootstrapVZPath", config.BootstrapVZPath)
+	if !strings.Contains(config.BootstrapVZTarball, "://") {
+		config.BootstrapVZTarball = configPath("BootstrapVZTarball", config.BootstrapVZTarball)
+	}
+	config.BaseImagePinFile = configPath("BaseImagePinFile", config.BaseImagePinFile)
+	for i := range config.ProvisionSteps {
+		step := &config.ProvisionSteps[i]
+		step.File = configPath("ProvisionSteps", step.File)
+	}
+
 	var cloud imagebuilder.Cloud
+	// baseImage is the image the build runs on, which is part of the content hash
+	var baseImage string
 	switch config.Cloud {
 	case "aws":
-		awsConfig, awsCloud, err := initAWS(*flagLocalhost)
+		awsConfig, awsCloud, err := initAWS(*flagLocalhost || *flagDocker)
 		if err != nil {
 			glog.Exitf("%v", err)
 		}
 		templateContext = awsConfig
 		cloud = awsCloud
+		baseImage = awsConfig.ImageID
 
 	case "gce":
-		if *flagPublish {
-			glog.Exitf("Publishing images is not supported on gce (pass --publish=false)")
+		// Only the aws cloud has a local mode; on gce we would still launch (and leave running) a real instance
+		if *flagLocalhost || *flagDocker {
+			glog.Exitf("--localhost and --docker are not supported with the gce cloud")
 		}
-
 		gceConfig, gceCloud, err := initGCE()
 		if err != nil {
 			glog.Exitf("%v", err)
 		}
+		err = gceCloud.CheckGCSDestination()
+		if err != nil {
+			glog.Exitf("%v", err)
+		}
 		templateContext = gceConfig
 		cloud = gceCloud
+		baseImage = gceConfig.Image
+
+	case "container":
+		containerConfig := &imagebuilder.ContainerConfig{}
+		containerConfig.InitDefaults()
+		err := loadConfig(containerConfig)
+		if err != nil {
+			glog.Exitf("Error loading container config: %v", err)
+		}
+		containerConfig.OutputDir = configPath("OutputDir", containerConfig.OutputDir)
+		templateContext = containerConfig
+		cloud = imagebuilder.NewContainerCloud(containerConfig)
 
 	case "":
 		glog.Exitf("Cloud not set")
@@ -122,202 +444,530 @@ func main() {
 		glog.Exitf("Unknown cloud: %q", config.Cloud)
 	}
 
-	if *flagBuild && config.TemplatePath == "" {
-		glog.Fatalf("TemplatePath must be provided")
+	return &loadedCloud{
+		config:          config,
+		templateContext: templateContext,
+		cloud:           cloud,
+		baseImage:       baseImage,
 	}
+}
 
-	var bvzTemplate *imagebuilder.BootstrapVzTemplate
-	var imageName string
-	if config.TemplatePath != "" {
-		templateResolved := path.Join(path.Dir(*flagConfig), config.TemplatePath)
+// resolveBaseImage runs the cloud's base image query, if it has one, pinning the result in the BaseImagePinFile
+func resolveBaseImage(c *loadedCloud) error {
+	q, ok := c.cloud.(imagebuilder.BaseImageQuerier)
+	if !ok {
+		return nil
+	}
+	if key, _ := q.BaseImageQuery(); key == "" {
+		return nil
+	}
 
-		templateRaw, err := imagebuilder.ReadFile(templateResolved)
-		if err != nil {
-			glog.Fatalf("error reading template: %v", err)
-		}
+	// A resumed build keeps the base image it started with, even if the query would now find a newer one
+	if resumeState != nil && resumeState.BaseImage != "" {
+		q.SetBaseImage(resumeState.BaseImage)
+		c.baseImage = resumeState.BaseImage
+		return nil
+	}
 
-		templateString, err := imagebuilder.ExpandTemplate(templateResolved, string(templateRaw), templateContext)
-		if err != nil {
-			glog.Fatalf("error executing template: %v", err)
-		}
+	image, err := imagebuilder.ResolveBaseImage(q, c.config.BaseImagePinFile, *flagUpdatePins, time.Now())
+	if err != nil {
+		return err
+	}
+	c.baseImage = image
+	return nil
+}
 
-		bvzTemplate, err = imagebuilder.NewBootstrapVzTemplate(templateString)
-		if err != nil {
-			glog.Fatalf("error parsing template: %v", err)
-		}
+// pinFlags are the flags of the pin command; --localhost and --docker select how the AWS cloud is set up, as for build
+var pinFlags = []string{"localhost", "docker", "update-pins"}
 
-		imageName, err = bvzTemplate.BuildImageName()
-		if err != nil {
-			glog.Fatalf("error inferring image name: %v", err)
-		}
+// runPin runs the base image query (unless it is pinned), and pins the result in the BaseImagePinFile, returning the exit code
+func runPin(args []string) int {
+	fs := newCommandFlags("pin", pinFlags)
+	if len(parseCommandFlags(fs, args)) != 0 {
+		glog.Exitf("pin does not take arguments")
+	}
 
-		glog.Infof("Parsed template %q; will build image with name %s", config.TemplatePath, imageName)
+	c := loadCloud()
+	if c.config.BaseImagePinFile == "" {
+		glog.Infof("BaseImagePinFile is not set; nothing to pin")
+		return 0
+	}
+	if err := resolveBaseImage(c); err != nil {
+		glog.Exitf("error resolving base image: %v", err)
 	}
 
-	instance, err := cloud.GetInstance()
-	if err != nil {
-		glog.Fatalf("error getting instance: %v", err)
+	if *flagOutput == "json" {
+		printJSON(map[string]string{"baseImage": c.baseImage})
+	} else if c.baseImage != "" {
+		fmt.Println(c.baseImage)
 	}
+	return 0
+}
 
-	if instance == nil && *flagUp {
-		instance, err = cloud.CreateInstance()
-		if err != nil {
-			glog.Fatalf("error creating instance: %v", err)
+// runBuild builds (or finds) the image, and then tags, publishes and replicates it, returning the exit code
+func runBuild(args []string) int {
+	fs := newCommandFlags("build", phaseFlags, buildFlags)
+	if len(parseCommandFlags(fs, args)) != 0 {
+		glog.Exitf("build does not take arguments")
+	}
+
+	c := loadCloud()
+	config := c.config
+
+	if *flagPublish {
+		switch config.Cloud {
+		case "gce":
+			glog.Exitf("Publishing images is not supported on gce (pass --publish=false)")
+		case "container":
+			glog.Exitf("Publishing images is not supported for containers (pass --publish=false)")
 		}
 	}
 
-	image, err := cloud.FindImage(imageName)
-	if err != nil {
-		glog.Fatalf("error finding image %q: %v", imageName, err)
+	if *flagLocalhost || *flagDocker {
+		switch config.Backend {
+		case imagebuilder.BackendProvision:
+			glog.Exitf("The %s backend saves the builder instance as the image, so can't be used with --localhost or --docker", config.Backend)
+		case imagebuilder.BackendEBS:
+			glog.Exitf("The %s backend attaches a volume to the builder instance, so can't be used with --localhost or --docker", config.Backend)
+		}
 	}
 
-	if image != nil {
-		glog.Infof("found existing image %q", image)
+	err := templateConfig(c.templateContext).ResolveTemplateVars(templateVarOverrides)
+	if err != nil {
+		glog.Exitf("%v", err)
 	}
 
-	if *flagBuild && image == nil {
-		if instance == nil {
-			glog.Fatalf("Instance was not found (specify --up?)")
+	// With --docker the build runs in DockerImage, not on the cloud's base image
+	if !*flagDocker {
+		if err := resolveBaseImage(c); err != nil {
+			glog.Exitf("%v", err)
 		}
+	}
 
-		sshConfig := &ssh.ClientConfig{
-			User: config.SSHUsername,
+	p := &imagebuilder.Pipeline{
+		Config:          config,
+		TemplateContext: c.templateContext,
+		ConfigDir:       layeredConfig.Dir("TemplatePath"),
+		BaseImage:       c.baseImage,
+		Cloud:           c.cloud,
+		Options: imagebuilder.PipelineOptions{
+			Up:              *flagUp,
+			Build:           *flagBuild,
+			Tag:             *flagTag,
+			Publish:         *flagPublish,
+			Replicate:       *flagReplicate,
+			Down:            *flagDown,
+			Force:           *flagForce,
+			StrictTemplates: *flagStrict,
+			ArtifactsDir:    *flagArtifacts,
+		},
+	}
+	if *flagDocker {
+		p.BaseImage = config.DockerImage
+		p.Dial = func(instance imagebuilder.Instance) (executor.Executor, error) {
+			x, err := executor.NewDocker(config.DockerSocket, config.DockerImage)
+			if err != nil {
+				return nil, fmt.Errorf("error creating docker container: %v", err)
+			}
+			return x, nil
 		}
+	}
 
-		if !*flagLocalhost {
-			if config.SSHPrivateKey == "" {
-				glog.Fatalf("SSHPublicKey is required")
-				// We used to allow the SSH agent, but probably more trouble than it is worth?
-				//sshAgent, err := net.Dial("unix", os.Getenv("SSH_AUTH_SOCK"))
-				//if err != nil {
-				//	glog.Fatalf("error connecting to SSH agent: %v", err)
-				//}
-				//
-				//sshConfig.Auth = append(sshConfig.Auth, ssh.PublicKeysCallback(agent.NewClient(sshAgent).Signers))
-			} else {
-				keyBytes, err := imagebuilder.ReadFile(config.SSHPrivateKey)
-				if err != nil {
-					glog.Exitf("error loading SSH private key: %v", err)
-				}
-				key, err := ssh.ParsePrivateKey(keyBytes)
-				if err != nil {
-					glog.Exitf("error parsing SSH private key: %v", err)
-				}
+	p.Events, err = newEvents()
+	if err != nil {
+		glog.Exitf("%v", err)
+	}
 
-				sshConfig.Auth = append(sshConfig.Auth, ssh.PublicKeys(key))
-			}
+	if resumeStore != nil {
+		p.State = resumeState
+		p.StateStore = resumeStore
+	} else if *flagState != "" {
+		store, err := imagebuilder.NewStateStore(*flagState)
+		if err != nil {
+			glog.Exitf("%v", err)
 		}
-		x, err := instance.DialSSH(sshConfig)
+		existing, err := store.Read()
 		if err != nil {
-			glog.Fatalf("error SSHing to instance: %v", err)
+			glog.Exitf("%v", err)
+		}
+		if existing != nil {
+			glog.Exitf("build state %q already exists (for build %s); use resume to continue that build", *flagState, existing.BuildID)
 		}
-		defer x.Close()
-
-		sshHelper := executor.NewTarget(x)
 
-		builder := imagebuilder.NewBuilder(config, sshHelper)
-		err = builder.RunSetupCommands()
+		state, err := imagebuilder.NewBuildState(time.Now())
 		if err != nil {
-			glog.Fatalf("error setting up instance: %v", err)
+			glog.Exitf("%v", err)
 		}
-
-		extraEnv, err := cloud.GetExtraEnv()
+		state.Dir, err = os.Getwd()
 		if err != nil {
-			glog.Fatalf("error building environment: %v", err)
+			glog.Exitf("error getting working directory: %v", err)
 		}
-
-		err = builder.BuildImage(bvzTemplate.Bytes(), extraEnv)
+		state.Args = os.Args[1:]
+		err = store.Write(state)
 		if err != nil {
-			glog.Fatalf("error building image: %v", err)
+			glog.Exitf("%v", err)
 		}
+		glog.Infof("Recording build %s in %s", state.BuildID, *flagState)
 
-		image, err = cloud.FindImage(imageName)
-		if err != nil {
-			glog.Fatalf("error finding image %q: %v", imageName, err)
+		p.State = state
+		p.StateStore = store
+	}
+
+	result, err := p.Run()
+	if err != nil {
+		if p.State != nil {
+			glog.Errorf("build %s failed; resume it with: imagebuilder resume %s", p.State.BuildID, *flagState)
 		}
+		glog.Exitf("%v", err)
+	}
+
+	imageName := result.Name
+	// No image was found (or built)
+	if result.Image == "" {
+		result = nil
+	}
 
-		if image == nil {
-			glog.Fatalf("image not found after build: %q", imageName)
+	if *flagResult != "" {
+		if result == nil {
+			glog.Exitf("image not found: %q", imageName)
+		}
+		err = result.WriteFile(*flagResult)
+		if err != nil {
+			glog.Exitf("%v", err)
 		}
 	}
 
-	if *flagTag {
-		if image == nil {
-			glog.Fatalf("image not found: %q", imageName)
+	if *flagOutput == "json" {
+		if result == nil {
+			// e.g. with --build=false, when there is no existing image
+			printJSON(struct{}{})
+		} else {
+			printJSON(result)
 		}
+	}
+	return 0
+}
 
-		glog.Infof("Tagging image %q", image)
+// resumeState and resumeStore are the build that runResume is continuing
+var resumeState *imagebuilder.BuildState
+var resumeStore imagebuilder.StateStore
 
-		tags := make(map[string]string)
-		for k, v := range config.Tags {
-			tags[k] = v
-		}
+// runResume continues the build recorded in a state file from its last completed phase, returning the exit code
+func runResume(args []string) int {
+	fs := newCommandFlags("resume", phaseFlags)
+	args = parseFlags(fs, args)
+	if len(args) != 1 {
+		glog.Exitf("resume takes the location of a build state file")
+	}
+	location := args[0]
 
-		{
-			t := time.Now().UTC().Format("20060102150405")
-			tags["k8s.io/build"] = t
+	// Phase flags given to resume override those the build was started with (e.g. --down=false)
+	overrides := make(map[string]string)
+	for _, name := range phaseFlags {
+		overrides[name] = ""
+	}
+	fs.Visit(func(f *flag.Flag) {
+		if _, isPhase := overrides[f.Name]; isPhase {
+			overrides[f.Name] = f.Value.String()
 		}
+	})
 
-		err = image.AddTags(tags)
+	// We change to the directory the build was started in, so local paths must be absolute
+	if !strings.Contains(location, "://") {
+		abs, err := filepath.Abs(location)
 		if err != nil {
-			glog.Fatalf("error tagging image %q: %v", imageName, err)
+			glog.Exitf("error resolving path %q: %v", location, err)
 		}
+		location = abs
+	}
 
-		glog.Infof("Tagged image %q", image)
+	store, err := imagebuilder.NewStateStore(location)
+	if err != nil {
+		glog.Exitf("%v", err)
+	}
+	state, err := store.Read()
+	if err != nil {
+		glog.Exitf("%v", err)
+	}
+	if state == nil {
+		glog.Exitf("build state %q not found", location)
 	}
 
-	if *flagPublish {
-		if image == nil {
-			glog.Fatalf("image not found: %q", imageName)
+	if state.Dir != "" {
+		if err := os.Chdir(state.Dir); err != nil {
+			glog.Exitf("error changing to directory %q: %v", state.Dir, err)
 		}
+	}
 
-		glog.Infof("Making image public: %v", image)
+	// Rerun the build with the flags it was started with
+	flagConfig = nil
+	for k := range flagSet {
+		delete(flagSet, k)
+	}
+	flag.CommandLine.Parse(state.Args)
+	buildArgs := flag.Args()
+	if len(buildArgs) != 0 {
+		if buildArgs[0] != "build" {
+			glog.Exitf("build state %q is for command %q, not build", location, buildArgs[0])
+		}
+		buildArgs = buildArgs[1:]
+	}
+	for name, value := range overrides {
+		if value != "" {
+			buildArgs = append(buildArgs, "--"+name+"="+value)
+		}
+	}
 
-		err = image.EnsurePublic()
-		if err != nil {
-			glog.Fatalf("error making image public %q: %v", imageName, err)
+	glog.Infof("Resuming build %s; completed phases: %v", state.BuildID, state.Phases)
+	*flagState = location
+	resumeState = state
+	resumeStore = store
+	return runBuild(buildArgs)
+}
+
+// loadValidateConfig loads the config for the validate & render commands.
+// If no clouds are specified, we default to the cloud in the config file.
+func loadValidateConfig(clouds []string) (*imagebuilder.Config, []string) {
+	config := &imagebuilder.Config{}
+	config.InitDefaults()
+	err := loadConfig(config)
+	if err != nil {
+		glog.Exitf("Error loading config: %v", err)
+	}
+	if len(clouds) == 0 {
+		if config.Cloud == "" {
+			glog.Exitf("Cloud not set")
 		}
+		clouds = []string{config.Cloud}
+	}
+	return config, clouds
+}
+
+// validateMessage is a problem found by validate
+type validateMessage struct {
+	File     string `json:"file"`
+	Line     int    `json:"line,omitempty"`
+	Severity string `json:"severity"`
+	Cloud    string `json:"cloud,omitempty"`
+	Message  string `json:"message"`
+}
 
-		glog.Infof("Made image public: %v", image)
+func (m *validateMessage) String() string {
+	s := m.File
+	if m.Line != 0 {
+		s += fmt.Sprintf(":%d", m.Line)
 	}
+	s += ": " + m.Severity + ": "
+	if m.Cloud != "" {
+		s += "[" + m.Cloud + "] "
+	}
+	return s + m.Message
+}
+
+// runValidate checks the config, and loads the template for each cloud and lints it, returning the exit code.
+// name is the command it was run as (validate or lint), for usage and errors.
+func runValidate(name string, args []string) int {
+	fs := newCommandFlags(name, []string{"strict"})
+	config, clouds := loadValidateConfig(parseCommandFlags(fs, args))
+
+	var messages []*validateMessage
+	for _, err := range config.Validate() {
+		messages = append(messages, &validateMessage{File: flagConfig.String(), Severity: imagebuilder.LintError, Message: err.Error()})
+	}
+
+	// The provision backend doesn't use a template
+	if config.Backend != imagebuilder.BackendProvision && config.TemplatePath != "" {
+		templateResolved := configPath("TemplatePath", config.TemplatePath)
 
-	if *flagReplicate {
-		if image == nil {
-			glog.Fatalf("image not found: %q", imageName)
+		if *flagOutput == "text" {
+			fmt.Printf("Validating %s against the %s manifest schema\n", templateResolved, imagebuilder.ManifestSchemaVersion)
 		}
 
-		glog.Infof("Copying image to all regions: %v", image)
+		for _, cloud := range clouds {
+			templateContext, err := loadTemplateContext(cloud)
+			if err != nil {
+				glog.Exitf("%v", err)
+			}
+
+			strict := *flagStrict || config.StrictTemplates
+			template, err := imagebuilder.LoadTemplate(templateResolved, templateContext, strict)
+			if err != nil {
+				m := &validateMessage{File: templateResolved, Severity: imagebuilder.LintError, Cloud: cloud, Message: err.Error()}
+				if parseError, ok := err.(*imagebuilder.TemplateParseError); ok {
+					m.File = parseError.Path
+					m.Line = parseError.Line
+					m.Message = parseError.Err.Error()
+				}
+				messages = append(messages, m)
+				continue
+			}
 
-		images, err := image.ReplicateImage(*flagPublish)
-		if err != nil {
-			glog.Fatalf("error replicating image %q: %v", imageName, err)
+			lintMessages, err := imagebuilder.LintTemplate(template, cloud)
+			if err != nil {
+				glog.Exitf("error validating template: %v", err)
+			}
+			for _, m := range lintMessages {
+				messages = append(messages, &validateMessage{File: m.File, Line: m.Line, Severity: m.Severity, Cloud: cloud, Message: m.Message})
+			}
 		}
+	}
 
-		for region, imageID := range images {
-			glog.Infof("Image in region %q: %q", region, imageID)
+	errorCount := 0
+	for _, m := range messages {
+		if m.Severity == imagebuilder.LintError {
+			errorCount++
 		}
 	}
 
-	if *flagDown {
-		if instance == nil {
-			glog.Infof("Instance not found / already shutdown")
+	if *flagOutput == "json" {
+		if messages == nil {
+			messages = []*validateMessage{}
+		}
+		printJSON(struct {
+			Valid    bool               `json:"valid"`
+			Clouds   []string           `json:"clouds"`
+			Messages []*validateMessage `json:"messages"`
+		}{
+			Valid:    errorCount == 0,
+			Clouds:   clouds,
+			Messages: messages,
+		})
+	} else {
+		for _, m := range messages {
+			fmt.Println(m)
+		}
+		if errorCount != 0 {
+			fmt.Printf("%d error(s) found\n", errorCount)
 		} else {
-			err := instance.Shutdown()
-			if err != nil {
-				glog.Fatalf("error terminating instance: %v", err)
-			}
+			fmt.Printf("Config and template are valid for %s\n", strings.Join(clouds, ", "))
 		}
 	}
+
+	if errorCount != 0 {
+		return 1
+	}
+	return 0
+}
+
+// runRender prints the fully merged manifest for a cloud (with ExtraPackages & ExtraCommands), returning the exit code
+func runRender(args []string) int {
+	fs := newCommandFlags("render", []string{"strict"})
+	args = parseCommandFlags(fs, args)
+	if len(args) > 1 {
+		glog.Exitf("render takes at most one cloud")
+	}
+	config, clouds := loadValidateConfig(args)
+	if config.TemplatePath == "" {
+		glog.Exitf("TemplatePath must be provided")
+	}
+	templateResolved := configPath("TemplatePath", config.TemplatePath)
+
+	templateContext, err := loadTemplateContext(clouds[0])
+	if err != nil {
+		glog.Exitf("%v", err)
+	}
+
+	strict := *flagStrict || config.StrictTemplates
+	template, err := imagebuilder.LoadTemplate(templateResolved, templateContext, strict)
+	if err != nil {
+		glog.Errorf("error loading template: %v", err)
+		return 1
+	}
+
+	bvzTemplate, err := imagebuilder.NewBootstrapVzTemplate(template.Manifest)
+	if err != nil {
+		glog.Errorf("error parsing template: %v", err)
+		return 1
+	}
+	bvzTemplate, err = bvzTemplate.WithExtras(config.ExtraPackages, config.ExtraCommands)
+	if err != nil {
+		glog.Errorf("error adding ExtraPackages and ExtraCommands to template: %v", err)
+		return 1
+	}
+
+	if *flagOutput == "json" {
+		data, err := yaml.YAMLToJSON(bvzTemplate.Bytes())
+		if err != nil {
+			glog.Errorf("error converting manifest to JSON: %v", err)
+			return 1
+		}
+		fmt.Println(string(data))
+		return 0
+	}
+
+	fmt.Print(string(bvzTemplate.Bytes()))
+	return 0
+}
+
+// newCloudConfig returns the config for the cloud, with its defaults
+func newCloudConfig(cloud string) (interface{}, error) {
+	switch cloud {
+	case "aws":
+		region, err := awsRegion()
+		if err != nil {
+			return nil, err
+		}
+		awsConfig := &imagebuilder.AWSConfig{}
+		awsConfig.InitDefaults(region)
+		return awsConfig, nil
+	case "gce":
+		gceConfig := &imagebuilder.GCEConfig{}
+		gceConfig.InitDefaults()
+		return gceConfig, nil
+	case "container":
+		containerConfig := &imagebuilder.ContainerConfig{}
+		containerConfig.InitDefaults()
+		return containerConfig, nil
+	default:
+		return nil, fmt.Errorf("Unknown cloud: %q", cloud)
+	}
+}
+
+// loadTemplateContext loads the config for the specified cloud, for use in template expansion
+func loadTemplateContext(cloud string) (interface{}, error) {
+	config, err := newCloudConfig(cloud)
+	if err != nil {
+		return nil, err
+	}
+
+	err = loadConfig(config)
+	if err != nil {
+		return nil, fmt.Errorf("Error loading %s config: %v", cloud, err)
+	}
+
+	// We may be validating for a different cloud than the config file specifies
+	templateConfig(config).Cloud = cloud
+
+	err = templateConfig(config).ResolveTemplateVars(templateVarOverrides)
+	if err != nil {
+		return nil, err
+	}
+	return config, nil
+}
+
+// templateConfig returns the Config embedded in the cloud-specific config
+func templateConfig(templateContext interface{}) *imagebuilder.Config {
+	switch c := templateContext.(type) {
+	case *imagebuilder.AWSConfig:
+		return &c.Config
+	case *imagebuilder.GCEConfig:
+		return &c.Config
+	case *imagebuilder.ContainerConfig:
+		return &c.Config
+	default:
+		glog.Fatalf("unexpected template context type %T", templateContext)
+		return nil
+	}
 }
 
 func initAWS(useLocalhost bool) (*imagebuilder.AWSConfig, *imagebuilder.AWSCloud, error) {
-	region := os.Getenv("AWS_REGION")
-	if region == "" {
-		region = os.Getenv("AWS_DEFAULT_REGION")
+	region, err := awsRegion()
+	if err != nil {
+		glog.Exitf("Error loading AWS config: %v", err)
 	}
 	awsConfig := &imagebuilder.AWSConfig{}
 	awsConfig.InitDefaults(region)
-	err := loadConfig(awsConfig, *flagConfig)
+	err = loadConfig(awsConfig)
 	if err != nil {
 		glog.Exitf("Error loading AWS config: %v", err)
 	}
@@ -335,7 +985,7 @@ func initAWS(useLocalhost bool) (*imagebuilder.AWSConfig, *imagebuilder.AWSCloud
 func initGCE() (*imagebuilder.GCEConfig, *imagebuilder.GCECloud, error) {
 	config := &imagebuilder.GCEConfig{}
 	config.InitDefaults()
-	err := loadConfig(config, *flagConfig)
+	err := loadConfig(config)
 	if err != nil {
 		return nil, nil, fmt.Errorf("Error loading GCE config: %v", err)
 	}
@@ -380,25 +1030,17 @@ func initGCE() (*imagebuilder.GCEConfig, *imagebuilder.GCECloud, error) {
 	if err != nil {
 		return nil, nil, fmt.Errorf("error building compute API client: %v", err)
 	}
+	computeBetaService, err := computebeta.New(client)
+	if err != nil {
+		return nil, nil, fmt.Errorf("error building compute beta API client: %v", err)
+	}
 
 	storageService, err := storage.New(client)
 	if err != nil {
 		return nil, nil, fmt.Errorf("error building compute API client: %v", err)
 	}
-	u, err := url.Parse(config.GCSDestination)
-	if err != nil {
-		return nil, nil, fmt.Errorf("GCSDestination %q is not a well-formed URL: %v", config.GCSDestination, err)
-	}
-	glog.Infof("Checking for bucket %q", u.Host)
-	_, err = storageService.Buckets.Get(u.Host).Do()
-	if err != nil {
-		if imagebuilder.IsGCENotFound(err) {
-			return nil, nil, fmt.Errorf("GCS bucket does not exist: %v", config.GCSDestination)
-		}
-		return nil, nil, fmt.Errorf("Error checking that bucket exists: %v", err)
-	}
 
-	cloud := imagebuilder.NewGCECloud(computeService, config)
+	cloud := imagebuilder.NewGCECloud(client, computeService, computeBetaService, storageService, config)
 
 	return config, cloud, nil
 }
@@ -0,0 +1,416 @@
+/*
+Copyright 2016 The Kubernetes Authors All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"text/tabwriter"
+	"time"
+
+	"github.com/golang/glog"
+	"k8s.io/kube-deploy/imagebuilder/pkg/imagebuilder"
+)
+
+// matrixOwnFlags are the global flags that the matrix sets for each build, rather than passing them through
+var matrixOwnFlags = map[string]bool{
+	"config":      true,
+	"set":         true,
+	"result":      true,
+	"state":       true,
+	"output":      true,
+	"artifacts":   true,
+	"dry-run":     true,
+	"build-name":  true,
+	"events-file": true,
+}
+
+// matrixReport is the result of a matrix run
+type matrixReport struct {
+	Succeeded int                 `json:"succeeded"`
+	Failed    int                 `json:"failed"`
+	Builds    []*matrixCellResult `json:"builds"`
+}
+
+// matrixCellResult is the outcome of one build in the matrix
+type matrixCellResult struct {
+	*imagebuilder.MatrixCell
+	// Status is succeeded or failed
+	Status   string `json:"status"`
+	Error    string `json:"error,omitempty"`
+	Duration string `json:"duration"`
+	// Result is the build's --result, if it succeeded
+	Result *imagebuilder.BuildResult `json:"result,omitempty"`
+}
+
+// runMatrix runs the builds in a matrix file, each in its own imagebuilder process, returning the exit code
+func runMatrix(args []string) int {
+	fs := newCommandFlags("matrix", phaseFlags, buildFlags)
+	dryRun := fs.Bool("dry-run", false, "Set to print the builds without running them")
+	args = parseFlags(fs, args)
+	if len(args) != 1 {
+		glog.Exitf("matrix takes the path of a matrix file")
+	}
+	if *flagState != "" {
+		glog.Exitf("--state is not supported for matrix builds")
+	}
+	// The builds' stdout is interleaved, so their events go to a file they all append to
+	if *flagEvents == "jsonl" && *flagEventsFile == "" {
+		glog.Exitf("--events=jsonl requires --events-file for matrix builds")
+	}
+
+	m, err := imagebuilder.LoadMatrix(args[0])
+	if err != nil {
+		glog.Exitf("%v", err)
+	}
+
+	// --config files are layered under every build's configs
+	var baseConfigs []string
+	for _, p := range flagConfig {
+		abs, err := filepath.Abs(p)
+		if err != nil {
+			glog.Exitf("error resolving path %q: %v", p, err)
+		}
+		baseConfigs = append(baseConfigs, abs)
+	}
+	cells, err := m.Cells(baseConfigs)
+	if err != nil {
+		glog.Exitf("%v", err)
+	}
+
+	self, err := os.Executable()
+	if err != nil {
+		glog.Exitf("error finding the imagebuilder executable: %v", err)
+	}
+	passthrough := matrixPassthroughArgs(fs)
+
+	eventsFile := *flagEventsFile
+	if eventsFile != "" {
+		eventsFile, err = filepath.Abs(eventsFile)
+		if err != nil {
+			glog.Exitf("error resolving path %q: %v", *flagEventsFile, err)
+		}
+	}
+
+	resultDir, err := ioutil.TempDir("", "imagebuilder-matrix")
+	if err != nil {
+		glog.Exitf("error creating temp directory: %v", err)
+	}
+	defer os.RemoveAll(resultDir)
+
+	commands := make([][]string, len(cells))
+	for i, cell := range cells {
+		var cmdArgs []string
+		for _, arg := range passthrough {
+			if !strings.HasPrefix(arg, "--update-pins=") {
+				cmdArgs = append(cmdArgs, arg)
+			}
+		}
+		for _, p := range cell.Configs {
+			cmdArgs = append(cmdArgs, "--config", p)
+		}
+		cmdArgs = append(cmdArgs, cell.SetArgs()...)
+		cmdArgs = append(cmdArgs, "--result", filepath.Join(resultDir, cell.Name+".json"))
+		if *flagArtifacts != "" {
+			cmdArgs = append(cmdArgs, "--artifacts", filepath.Join(*flagArtifacts, cell.Name))
+		}
+		if eventsFile != "" {
+			cmdArgs = append(cmdArgs, "--events-file", eventsFile)
+		}
+		cmdArgs = append(cmdArgs, "--build-name", cell.Name)
+		commands[i] = append(cmdArgs, "build")
+	}
+
+	if *dryRun {
+		for i, cell := range cells {
+			fmt.Printf("%s: %s %s\n", cell.Name, self, strings.Join(commands[i], " "))
+		}
+		return 0
+	}
+
+	var logMutex sync.Mutex
+	results := make([]*matrixCellResult, len(cells))
+
+	// Builds that share a BaseImagePinFile would all run the query and update the file, so we pin their base
+	// images first, one build at a time; the builds then use the pinned images.  A build that fails to pin is not run.
+	pinArgs := matrixPinArgs(passthrough)
+	for i, cell := range cells {
+		if cell.Cloud == "container" {
+			continue
+		}
+		args := append([]string{}, pinArgs...)
+		for _, p := range cell.Configs {
+			args = append(args, "--config", p)
+		}
+		args = append(append(args, cell.SetArgs()...), "pin")
+		log := &prefixWriter{mutex: &logMutex, w: os.Stderr, prefix: "[" + cell.Name + "] "}
+		if err := pinMatrixCell(self, args, log); err != nil {
+			glog.Warningf("Build %s failed to pin its base image: %v", cell.Name, err)
+			results[i] = &matrixCellResult{MatrixCell: cell, Status: "failed", Error: err.Error(), Duration: "0s"}
+		}
+	}
+
+	// Builds on each cloud are limited by its Parallelism; one build failing does not stop the others
+	semaphores := make(map[string]chan struct{})
+	for _, cell := range cells {
+		if semaphores[cell.Cloud] == nil {
+			semaphores[cell.Cloud] = make(chan struct{}, m.ParallelismFor(cell.Cloud))
+		}
+	}
+
+	var wg sync.WaitGroup
+	for i, cell := range cells {
+		if results[i] != nil {
+			continue
+		}
+		wg.Add(1)
+		go func(i int, cell *imagebuilder.MatrixCell) {
+			defer wg.Done()
+			semaphore := semaphores[cell.Cloud]
+			semaphore <- struct{}{}
+			defer func() { <-semaphore }()
+
+			log := &prefixWriter{mutex: &logMutex, w: os.Stderr, prefix: "[" + cell.Name + "] "}
+			results[i] = runMatrixCell(cell, self, commands[i], filepath.Join(resultDir, cell.Name+".json"), log)
+		}(i, cell)
+	}
+	wg.Wait()
+
+	report := &matrixReport{Builds: results}
+	for _, r := range results {
+		if r.Status == "succeeded" {
+			report.Succeeded++
+		} else {
+			report.Failed++
+		}
+	}
+
+	if *flagResult != "" {
+		data, err := json.MarshalIndent(report, "", "  ")
+		if err != nil {
+			glog.Exitf("error serializing matrix report: %v", err)
+		}
+		if err := ioutil.WriteFile(*flagResult, append(data, '\n'), 0644); err != nil {
+			glog.Exitf("error writing matrix report to %q: %v", *flagResult, err)
+		}
+	}
+
+	if *flagOutput == "json" {
+		printJSON(report)
+	} else {
+		printMatrixReport(report)
+	}
+
+	if report.Failed != 0 {
+		return 1
+	}
+	return 0
+}
+
+// matrixPassthroughArgs returns the flags that were set for the matrix, which are passed to every build
+func matrixPassthroughArgs(fs *flag.FlagSet) []string {
+	values := make(map[string]string)
+	collect := func(f *flag.Flag) {
+		if !matrixOwnFlags[f.Name] {
+			values[f.Name] = f.Value.String()
+		}
+	}
+	flag.Visit(collect)
+	fs.Visit(collect)
+
+	var names []string
+	for name := range values {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var args []string
+	for _, name := range names {
+		args = append(args, "--"+name+"="+values[name])
+	}
+
+	// --set on the matrix applies to every build, before the build's own overrides
+	var keys []string
+	for k := range flagSet {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		args = append(args, "--set", k+"="+flagSet[k])
+	}
+	return args
+}
+
+// matrixPinArgs returns the passthrough flags that the pin command accepts.
+// --update-pins is only given to the pin command: the builds use the images it pinned.
+func matrixPinArgs(passthrough []string) []string {
+	accepted := make(map[string]bool)
+	for _, name := range append(append([]string{}, globalFlags...), pinFlags...) {
+		accepted[name] = true
+	}
+	ours := make(map[string]bool)
+	for _, name := range append(append([]string{}, phaseFlags...), buildFlags...) {
+		ours[name] = true
+	}
+
+	var args []string
+	for i := 0; i < len(passthrough); i++ {
+		arg := passthrough[i]
+		if arg == "--set" {
+			// --set takes its value as the next argument
+			args = append(args, arg, passthrough[i+1])
+			i++
+			continue
+		}
+		name := strings.SplitN(strings.TrimPrefix(arg, "--"), "=", 2)[0]
+		// Flags that are not ours are glog's, which every command accepts
+		if accepted[name] || !ours[name] {
+			args = append(args, arg)
+		}
+	}
+	return args
+}
+
+// pinMatrixCell runs the pin command for a build
+func pinMatrixCell(self string, args []string, log *prefixWriter) error {
+	cmd := exec.Command(self, args...)
+	cmd.Stdout = ioutil.Discard
+	cmd.Stderr = log
+	err := cmd.Run()
+	log.Flush()
+	if err != nil && log.last != "" {
+		return fmt.Errorf("%v: %s", err, log.last)
+	}
+	return err
+}
+
+// runMatrixCell runs a build, and reads its result
+func runMatrixCell(cell *imagebuilder.MatrixCell, self string, args []string, resultPath string, log *prefixWriter) *matrixCellResult {
+	glog.Infof("Starting build %s", cell.Name)
+	start := time.Now()
+
+	cmd := exec.Command(self, args...)
+	cmd.Stdout = log
+	cmd.Stderr = log
+	err := cmd.Run()
+	log.Flush()
+
+	r := &matrixCellResult{
+		MatrixCell: cell,
+		Duration:   time.Since(start).Round(time.Second).String(),
+	}
+	if err == nil {
+		r.Result = &imagebuilder.BuildResult{}
+		data, readErr := ioutil.ReadFile(resultPath)
+		if readErr == nil {
+			readErr = json.Unmarshal(data, r.Result)
+		}
+		if readErr != nil {
+			err = fmt.Errorf("error reading build result: %v", readErr)
+			r.Result = nil
+		}
+	} else if log.last != "" {
+		// The last line is usually the error that stopped the build
+		err = fmt.Errorf("%v: %s", err, log.last)
+	}
+
+	if err != nil {
+		glog.Warningf("Build %s failed after %s: %v", cell.Name, r.Duration, err)
+		r.Status = "failed"
+		r.Error = err.Error()
+	} else {
+		glog.Infof("Build %s succeeded after %s", cell.Name, r.Duration)
+		r.Status = "succeeded"
+	}
+	return r
+}
+
+func printMatrixReport(report *matrixReport) {
+	w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+	fmt.Fprintf(w, "BUILD\tCLOUD\tREGION\tSTATUS\tIMAGE\tDURATION\n")
+	for _, r := range report.Builds {
+		image := ""
+		if r.Result != nil {
+			image = r.Result.Name
+			if r.Result.Image != "" && r.Result.Image != r.Result.Name {
+				image += " (" + r.Result.Image + ")"
+			}
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\t%s\n", r.Name, r.Cloud, r.Region, r.Status, image, r.Duration)
+	}
+	w.Flush()
+
+	for _, r := range report.Builds {
+		if r.Error != "" {
+			fmt.Printf("\n%s: %s", r.Name, r.Error)
+		}
+	}
+	if report.Failed != 0 {
+		fmt.Printf("\n\n%d of %d builds failed\n", report.Failed, len(report.Builds))
+	}
+}
+
+// prefixWriter writes whole lines with a prefix, so that the logs of concurrent builds can be told apart
+type prefixWriter struct {
+	// mutex is shared by the writers to the same output, so that lines are not interleaved
+	mutex  *sync.Mutex
+	w      io.Writer
+	prefix string
+
+	buf []byte
+	// last is the last line written
+	last string
+}
+
+func (p *prefixWriter) Write(data []byte) (int, error) {
+	p.buf = append(p.buf, data...)
+	for {
+		i := bytes.IndexByte(p.buf, '\n')
+		if i == -1 {
+			return len(data), nil
+		}
+		p.writeLine(string(p.buf[:i]))
+		p.buf = p.buf[i+1:]
+	}
+}
+
+// Flush writes any partial line
+func (p *prefixWriter) Flush() {
+	if len(p.buf) != 0 {
+		p.writeLine(string(p.buf))
+		p.buf = nil
+	}
+}
+
+func (p *prefixWriter) writeLine(line string) {
+	if strings.TrimSpace(line) != "" {
+		p.last = strings.TrimSpace(line)
+	}
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	fmt.Fprintf(p.w, "%s%s\n", p.prefix, line)
+}
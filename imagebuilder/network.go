@@ -0,0 +1,109 @@
+/*
+Copyright 2016 The Kubernetes Authors All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"text/tabwriter"
+
+	"github.com/golang/glog"
+	"k8s.io/kube-deploy/imagebuilder/pkg/imagebuilder"
+)
+
+// loadAWSCloud loads the cloud, exiting if it is not AWS
+func loadAWSCloud(command string) *imagebuilder.AWSCloud {
+	awsCloud, ok := loadCloud().cloud.(*imagebuilder.AWSCloud)
+	if !ok {
+		glog.Exitf("%s is only supported on aws", command)
+	}
+	return awsCloud
+}
+
+// runSetupNetwork creates the AWS network that builders are launched in, unless it exists, returning the exit code
+func runSetupNetwork(args []string) int {
+	fs := newCommandFlags("setup-network")
+	sshCIDR := fs.String("ssh-cidr", "", "CIDR to allow SSH from (defaults to the IPv4 address our requests come from)")
+	if len(parseCommandFlags(fs, args)) != 0 {
+		glog.Exitf("setup-network does not take arguments")
+	}
+
+	awsCloud := loadAWSCloud("setup-network")
+
+	if *sshCIDR == "" {
+		ip, err := imagebuilder.EgressIP()
+		if err != nil {
+			glog.Exitf("%v (pass --ssh-cidr)", err)
+		}
+		if net.ParseIP(ip).To4() == nil {
+			glog.Exitf("our address %s is not IPv4; pass --ssh-cidr", ip)
+		}
+		*sshCIDR = ip + "/32"
+	} else if _, _, err := net.ParseCIDR(*sshCIDR); err != nil {
+		glog.Exitf("invalid --ssh-cidr %q: %v", *sshCIDR, err)
+	}
+
+	changes, err := awsCloud.EnsureNetwork(*sshCIDR)
+	printNetworkChanges(changes)
+	if err != nil {
+		glog.Exitf("%v", err)
+	}
+	return 0
+}
+
+// runTeardownNetwork deletes the AWS network created by setup-network, returning the exit code
+func runTeardownNetwork(args []string) int {
+	fs := newCommandFlags("teardown-network")
+	if len(parseCommandFlags(fs, args)) != 0 {
+		glog.Exitf("teardown-network does not take arguments")
+	}
+
+	awsCloud := loadAWSCloud("teardown-network")
+
+	instance, err := awsCloud.GetInstance()
+	if err != nil {
+		glog.Exitf("error getting instance: %v", err)
+	}
+	if instance != nil {
+		glog.Exitf("the builder instance %s is still running in the network; shut it down first (build --up=false --build=false --tag=false --publish=false --replicate=false shuts it down)", instance.ID())
+	}
+
+	changes, err := awsCloud.DeleteNetwork()
+	printNetworkChanges(changes)
+	if err != nil {
+		glog.Exitf("%v", err)
+	}
+	return 0
+}
+
+func printNetworkChanges(changes []*imagebuilder.NetworkChange) {
+	if *flagOutput == "json" {
+		if changes == nil {
+			changes = []*imagebuilder.NetworkChange{}
+		}
+		printJSON(changes)
+		return
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+	fmt.Fprintf(w, "RESOURCE\tID\tACTION\n")
+	for _, c := range changes {
+		fmt.Fprintf(w, "%s\t%s\t%s\n", c.Kind, c.ID, c.Action)
+	}
+	w.Flush()
+}
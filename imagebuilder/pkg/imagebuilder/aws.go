@@ -22,11 +22,13 @@ package imagebuilder
 
 import (
 	"fmt"
+	"strings"
 	"time"
 
 	"golang.org/x/crypto/ssh"
 
 	"crypto/md5"
+	"encoding/base64"
 	"encoding/hex"
 	"github.com/aws/aws-sdk-go/aws"
 	"github.com/aws/aws-sdk-go/aws/awserr"
@@ -38,6 +40,9 @@ import (
 
 const tagRoleKey = "k8s.io/role/imagebuilder"
 
+// tagRoleValue is the value we set on tagRoleKey; lookups only match on the key
+const tagRoleValue = "1"
+
 // AWSInstance manages an AWS instance, used for building an image
 type AWSInstance struct {
 	instanceID string
@@ -47,31 +52,60 @@ type AWSInstance struct {
 
 var _ Instance = &AWSInstance{}
 
+// ID returns the instance ID
+func (i *AWSInstance) ID() string {
+	return i.instanceID
+}
+
 // Shutdown terminates the running instance
 func (i *AWSInstance) Shutdown() error {
 	glog.Infof("Terminating instance %q", i.instanceID)
 	return i.cloud.TerminateInstance(i.instanceID)
 }
 
+var _ ImageCreator = &AWSInstance{}
+
+// CreateImage saves the instance as an AMI, waiting until it is available.
+// AWS reboots the instance so the filesystem is consistent.
+func (i *AWSInstance) CreateImage(name string) error {
+	request := &ec2.CreateImageInput{
+		InstanceId: aws.String(i.instanceID),
+		Name:       aws.String(name),
+	}
+
+	glog.V(2).Infof("AWS CreateImage InstanceId=%q, Name=%q", i.instanceID, name)
+	response, err := i.cloud.ec2.CreateImage(request)
+	if err != nil {
+		return fmt.Errorf("error creating image from instance %q: %v", i.instanceID, err)
+	}
+
+	image := &AWSImage{
+		ec2:     i.cloud.ec2,
+		region:  i.cloud.config.Region,
+		imageID: aws.StringValue(response.ImageId),
+		events:  i.cloud.events,
+	}
+	return image.waitStatusAvailable()
+}
+
 // DialSSH establishes an SSH client connection to the instance
+// The host key is verified against the fingerprints the instance prints on its console
 func (i *AWSInstance) DialSSH(config *ssh.ClientConfig) (executor.Executor, error) {
-	publicIP, err := i.WaitPublicIP()
+	var ip string
+	var err error
+	if i.cloud.config.PrivateIP {
+		ip, err = i.WaitPrivateIP()
+	} else {
+		ip, err = i.WaitPublicIP()
+	}
 	if err != nil {
 		return nil, err
 	}
 
-	for {
-		// TODO: Timeout, check error code
-		sshClient, err := ssh.Dial("tcp", publicIP+":22", config)
-		if err != nil {
-			glog.Warningf("error connecting to SSH on server %q: %v", publicIP, err)
-			time.Sleep(5 * time.Second)
-			continue
-			//	return nil, fmt.Errorf("error connecting to SSH on server %q", publicIP)
-		}
-
-		return executor.NewSSH(sshClient), nil
+	getConsoleOutput := func() (string, error) {
+		return i.cloud.getConsoleOutput(i.instanceID)
 	}
+	return dialSSH(i.instanceID, ip+":22", &i.cloud.config.Config, config, consoleHostKeyFingerprints(getConsoleOutput))
 }
 
 // WaitPublicIP waits for the instance to get a public IP, returning it
@@ -92,10 +126,33 @@ func (i *AWSInstance) WaitPublicIP() (string, error) {
 	}
 }
 
+// WaitPrivateIP waits for the instance to get a private IP, returning it
+func (i *AWSInstance) WaitPrivateIP() (string, error) {
+	// TODO: Timeout
+	for {
+		instance, err := i.cloud.describeInstance(i.instanceID)
+		if err != nil {
+			return "", err
+		}
+		privateIP := aws.StringValue(instance.PrivateIpAddress)
+		if privateIP != "" {
+			glog.Infof("Instance private IP is %q", privateIP)
+			return privateIP, nil
+		}
+		glog.V(2).Infof("Sleeping before requerying instance for private IP: %q", i.instanceID)
+		time.Sleep(5 * time.Second)
+	}
+}
+
 type LocalhostInstance struct {
 	cloud Cloud
 }
 
+// ID returns "localhost"
+func (i *LocalhostInstance) ID() string {
+	return "localhost"
+}
+
 // Shutdown terminates the running instance
 func (i *LocalhostInstance) Shutdown() error {
 	glog.Infof("Skipping termination of localhost")
@@ -114,9 +171,12 @@ type AWSCloud struct {
 	ec2 *ec2.EC2
 
 	useLocalhost bool
+
+	events *Events
 }
 
 var _ Cloud = &AWSCloud{}
+var _ EventEmitter = &AWSCloud{}
 
 func NewAWSCloud(ec2 *ec2.EC2, config *AWSConfig, useLocalhost bool) *AWSCloud {
 	return &AWSCloud{
@@ -126,6 +186,11 @@ func NewAWSCloud(ec2 *ec2.EC2, config *AWSConfig, useLocalhost bool) *AWSCloud {
 	}
 }
 
+// SetEvents sets where the cloud sends events about its images
+func (a *AWSCloud) SetEvents(events *Events) {
+	a.events = events
+}
+
 func (a *AWSCloud) GetExtraEnv() (map[string]string, error) {
 	env := make(map[string]string)
 
@@ -171,6 +236,29 @@ func (a *AWSCloud) describeInstance(instanceID string) (*ec2.Instance, error) {
 	return nil, nil
 }
 
+// getConsoleOutput returns the (decoded) console output of the instance
+func (a *AWSCloud) getConsoleOutput(instanceID string) (string, error) {
+	request := &ec2.GetConsoleOutputInput{}
+	request.InstanceId = aws.String(instanceID)
+
+	glog.V(2).Infof("AWS GetConsoleOutput InstanceId=%q", instanceID)
+	response, err := a.ec2.GetConsoleOutput(request)
+	if err != nil {
+		return "", fmt.Errorf("error making AWS GetConsoleOutput call: %v", err)
+	}
+
+	output := aws.StringValue(response.Output)
+	if output == "" {
+		return "", nil
+	}
+
+	data, err := base64.StdEncoding.DecodeString(output)
+	if err != nil {
+		return "", fmt.Errorf("error decoding console output for instance %q: %v", instanceID, err)
+	}
+	return string(data), nil
+}
+
 // TerminateInstance terminates the specified instance
 func (a *AWSCloud) TerminateInstance(instanceID string) error {
 	if a.useLocalhost {
@@ -200,7 +288,15 @@ func (a *AWSCloud) GetInstance() (Instance, error) {
 		},
 	}
 
-	glog.V(2).Infof("AWS DescribeInstances Filter:tag-key=%s", tagRoleKey)
+	// With a MachineName, we only reuse our own builder, so that builds with different names can run at once
+	if a.config.MachineName != "" {
+		request.Filters = append(request.Filters, &ec2.Filter{
+			Name:   aws.String("tag:Name"),
+			Values: aws.StringSlice([]string{a.config.MachineName}),
+		})
+	}
+
+	glog.V(2).Infof("AWS DescribeInstances Filter:tag-key=%s, Name=%q", tagRoleKey, a.config.MachineName)
 	response, err := a.ec2.DescribeInstances(request)
 	if err != nil {
 		return nil, fmt.Errorf("error making AWS DescribeInstances call: %v", err)
@@ -353,17 +449,20 @@ func (c *AWSCloud) findSSHKey(name string) (*ec2.KeyPairInfo, error) {
 	return k, nil
 }
 
+// awsSSHKeyName is the name of the key pair we import for the public key
+func awsSSHKeyName(publicKey []byte) string {
+	// TODO: Use real OpenSSH or AWS fingerprint?
+	hashBytes := md5.Sum(publicKey)
+	return "imagebuilder-" + hex.EncodeToString(hashBytes[:])
+}
+
 func (c *AWSCloud) ensureSSHKey() (string, error) {
 	publicKey, err := ReadFile(c.config.SSHPublicKey)
 	if err != nil {
 		return "", err
 	}
 
-	// TODO: Use real OpenSSH or AWS fingerprint?
-	hashBytes := md5.Sum([]byte(publicKey))
-	hash := hex.EncodeToString(hashBytes[:])
-
-	name := "imagebuilder-" + hash
+	name := awsSSHKeyName(publicKey)
 
 	key, err := c.findSSHKey(name)
 	if err != nil {
@@ -426,7 +525,7 @@ func (c *AWSCloud) CreateInstance() (Instance, error) {
 	}
 
 	if c.config.ImageID == "" {
-		return nil, fmt.Errorf("ImageID must be specified")
+		return nil, fmt.Errorf("ImageID (or ImageQuery) must be specified")
 	}
 
 	if c.config.InstanceType == "" {
@@ -455,7 +554,7 @@ func (c *AWSCloud) CreateInstance() (Instance, error) {
 	request.NetworkInterfaces = []*ec2.InstanceNetworkInterfaceSpecification{
 		{
 			DeviceIndex:              aws.Int64(0),
-			AssociatePublicIpAddress: aws.Bool(true),
+			AssociatePublicIpAddress: aws.Bool(!c.config.PrivateIP),
 			SubnetId:                 aws.String(subnetID),
 			Groups:                   aws.StringSlice([]string{securityGroupID}),
 		},
@@ -474,9 +573,11 @@ func (c *AWSCloud) CreateInstance() (Instance, error) {
 		if instanceID == "" {
 			return nil, fmt.Errorf("AWS RunInstances call returned empty InstanceId")
 		}
-		err := c.TagResource(instanceID, &ec2.Tag{
-			Key: aws.String(tagRoleKey), Value: aws.String("'"),
-		})
+		tags := []*ec2.Tag{{Key: aws.String(tagRoleKey), Value: aws.String(tagRoleValue)}}
+		if c.config.MachineName != "" {
+			tags = append(tags, &ec2.Tag{Key: aws.String("Name"), Value: aws.String(c.config.MachineName)})
+		}
+		err := c.TagResource(instanceID, tags...)
 		if err != nil {
 			glog.Warningf("Tagging instance %q failed; will terminate to prevent leaking", instanceID)
 			e2 := c.TerminateInstance(instanceID)
@@ -516,9 +617,118 @@ func (a *AWSCloud) FindImage(imageName string) (Image, error) {
 		region:  a.config.Region,
 		image:   image,
 		imageID: imageID,
+		events:  a.events,
 	}, nil
 }
 
+// FindImageByHash finds a registered image, matching by the content hash tag
+func (a *AWSCloud) FindImageByHash(hash string) (Image, error) {
+	request := &ec2.DescribeImagesInput{}
+	request.Filters = []*ec2.Filter{
+		{
+			Name:   aws.String("tag:" + ContentHashTag),
+			Values: aws.StringSlice([]string{hash}),
+		},
+	}
+	request.Owners = aws.StringSlice([]string{"self"})
+
+	glog.V(2).Infof("AWS DescribeImages Filter:tag:%s=%q, Owner=self", ContentHashTag, hash)
+	response, err := a.ec2.DescribeImages(request)
+	if err != nil {
+		return nil, fmt.Errorf("error making AWS DescribeImages call: %v", err)
+	}
+
+	if len(response.Images) == 0 {
+		return nil, nil
+	}
+
+	// If the same contents were built more than once (e.g. with --force), use the most recent
+	image := response.Images[0]
+	for _, i := range response.Images[1:] {
+		if aws.StringValue(i.CreationDate) > aws.StringValue(image.CreationDate) {
+			image = i
+		}
+	}
+
+	return &AWSImage{
+		ec2:     a.ec2,
+		region:  a.config.Region,
+		image:   image,
+		imageID: aws.StringValue(image.ImageId),
+		events:  a.events,
+	}, nil
+}
+
+var _ BaseImageQuerier = &AWSCloud{}
+
+// BaseImageQuery describes the ImageQuery, which is pinned per region (as AMIs are regional)
+func (a *AWSCloud) BaseImageQuery() (string, string) {
+	q := a.config.ImageQuery
+	if q == nil {
+		return "", ""
+	}
+	return "aws/" + a.config.Region, fmt.Sprintf("owner=%s name=%s architecture=%s", q.Owner, q.Name, awsImageArchitecture(q))
+}
+
+func awsImageArchitecture(q *AWSImageQuery) string {
+	if q.Architecture == "" {
+		return "x86_64"
+	}
+	return q.Architecture
+}
+
+// FindBaseImage finds the newest available image matching the ImageQuery
+func (a *AWSCloud) FindBaseImage() (string, error) {
+	q := a.config.ImageQuery
+	if q == nil {
+		return "", fmt.Errorf("ImageQuery is not set")
+	}
+	if q.Owner == "" || q.Name == "" {
+		return "", fmt.Errorf("ImageQuery must set Owner and Name")
+	}
+
+	request := &ec2.DescribeImagesInput{}
+	request.Filters = []*ec2.Filter{
+		{
+			Name:   aws.String("name"),
+			Values: aws.StringSlice([]string{q.Name}),
+		},
+		{
+			Name:   aws.String("architecture"),
+			Values: aws.StringSlice([]string{awsImageArchitecture(q)}),
+		},
+		{
+			Name:   aws.String("state"),
+			Values: aws.StringSlice([]string{"available"}),
+		},
+	}
+	request.Owners = aws.StringSlice([]string{q.Owner})
+
+	glog.V(2).Infof("AWS DescribeImages Filter:Name=%q, Architecture=%q, Owner=%q", q.Name, awsImageArchitecture(q), q.Owner)
+	response, err := a.ec2.DescribeImages(request)
+	if err != nil {
+		return "", fmt.Errorf("error making AWS DescribeImages call: %v", err)
+	}
+
+	if len(response.Images) == 0 {
+		return "", fmt.Errorf("no images in %s match owner %q, name %q and architecture %q", a.config.Region, q.Owner, q.Name, awsImageArchitecture(q))
+	}
+
+	image := response.Images[0]
+	for _, i := range response.Images[1:] {
+		if aws.StringValue(i.CreationDate) > aws.StringValue(image.CreationDate) {
+			image = i
+		}
+	}
+	glog.V(2).Infof("Newest image matching the query is %s (%s, created %s)", aws.StringValue(image.ImageId), aws.StringValue(image.Name), aws.StringValue(image.CreationDate))
+	return aws.StringValue(image.ImageId), nil
+}
+
+// SetBaseImage sets the ImageID the builder is launched from
+func (a *AWSCloud) SetBaseImage(image string) {
+	a.config.ImageID = image
+}
+
 func findAWSImage(client *ec2.EC2, imageName string) (*ec2.Image, error) {
 	request := &ec2.DescribeImagesInput{}
 	request.Filters = []*ec2.Filter{
@@ -548,6 +758,157 @@ func findAWSImage(client *ec2.EC2, imageName string) (*ec2.Image, error) {
 	return image, nil
 }
 
+// regionClients returns an EC2 client for each region, starting with the configured region
+func (a *AWSCloud) regionClients() (map[string]*ec2.EC2, error) {
+	glog.V(2).Infof("AWS DescribeRegions")
+	response, err := a.ec2.DescribeRegions(&ec2.DescribeRegionsInput{})
+	if err != nil {
+		return nil, fmt.Errorf("error listing ec2 regions: %v", err)
+	}
+
+	clients := map[string]*ec2.EC2{a.config.Region: a.ec2}
+	for _, region := range response.Regions {
+		regionName := aws.StringValue(region.RegionName)
+		if clients[regionName] == nil {
+			clients[regionName] = ec2.New(session.New(), &aws.Config{Region: &regionName})
+		}
+	}
+	return clients, nil
+}
+
+// describeImages returns the images we own in every region, filtered by name (if imageName is not empty)
+func (a *AWSCloud) describeImages(imageName string) (map[string][]*ec2.Image, error) {
+	clients, err := a.regionClients()
+	if err != nil {
+		return nil, err
+	}
+
+	images := make(map[string][]*ec2.Image)
+	for region, client := range clients {
+		request := &ec2.DescribeImagesInput{}
+		request.Owners = aws.StringSlice([]string{"self"})
+		if imageName != "" {
+			request.Filters = []*ec2.Filter{
+				{
+					Name:   aws.String("name"),
+					Values: aws.StringSlice([]string{imageName}),
+				},
+			}
+		}
+
+		glog.V(2).Infof("AWS DescribeImages Region=%q Filter:Name=%q, Owner=self", region, imageName)
+		response, err := client.DescribeImages(request)
+		if err != nil {
+			return nil, fmt.Errorf("error making AWS DescribeImages call in region %q: %v", region, err)
+		}
+		images[region] = response.Images
+	}
+	return images, nil
+}
+
+// ListImages lists the AMIs we own in every region, merging the copies of each image (which have the same name)
+func (a *AWSCloud) ListImages(filter ImageFilter) ([]*ImageInfo, error) {
+	images, err := a.describeImages(filter.Name)
+	if err != nil {
+		return nil, err
+	}
+
+	infos := make(imageInfoMap)
+	for region, regionImages := range images {
+		for _, image := range regionImages {
+			name := aws.StringValue(image.Name)
+			if filter.Family != "" && !strings.HasPrefix(name, filter.Family) {
+				continue
+			}
+
+			tags := make(map[string]string)
+			for _, tag := range image.Tags {
+				tags[aws.StringValue(tag.Key)] = aws.StringValue(tag.Value)
+			}
+			infos.add(name, aws.StringValue(image.CreationDate), tags, &ImageRegionInfo{
+				Region: region,
+				ID:     aws.StringValue(image.ImageId),
+				State:  aws.StringValue(image.State),
+				Public: aws.BoolValue(image.Public),
+			}, region == a.config.Region)
+		}
+	}
+	return infos.list(&filter), nil
+}
+
+// DescribeImage describes the AMI in every region, including who can launch it
+func (a *AWSCloud) DescribeImage(imageName string) (*ImageInfo, error) {
+	images, err := a.ListImages(ImageFilter{Name: imageName})
+	if err != nil {
+		return nil, err
+	}
+	if len(images) == 0 {
+		return nil, nil
+	}
+	info := images[0]
+
+	clients, err := a.regionClients()
+	if err != nil {
+		return nil, err
+	}
+	for _, r := range info.Regions {
+		request := &ec2.DescribeImageAttributeInput{
+			ImageId:   aws.String(r.ID),
+			Attribute: aws.String(ec2.ImageAttributeNameLaunchPermission),
+		}
+		glog.V(2).Infof("AWS DescribeImageAttribute Region=%q ImageId=%q Attribute=launchPermission", r.Region, r.ID)
+		response, err := clients[r.Region].DescribeImageAttribute(request)
+		if err != nil {
+			return nil, fmt.Errorf("error getting launch permissions of image %q in region %q: %v", r.ID, r.Region, err)
+		}
+		for _, p := range response.LaunchPermissions {
+			if p.Group != nil {
+				r.LaunchPermissions = append(r.LaunchPermissions, aws.StringValue(p.Group))
+			} else {
+				r.LaunchPermissions = append(r.LaunchPermissions, aws.StringValue(p.UserId))
+			}
+		}
+	}
+	return info, nil
+}
+
+// DeleteImage deregisters the AMI in every region, and deletes its snapshots
+func (a *AWSCloud) DeleteImage(imageName string) error {
+	images, err := a.describeImages(imageName)
+	if err != nil {
+		return err
+	}
+	clients, err := a.regionClients()
+	if err != nil {
+		return err
+	}
+
+	for region, regionImages := range images {
+		client := clients[region]
+		for _, image := range regionImages {
+			imageID := aws.StringValue(image.ImageId)
+			glog.Infof("Deregistering image %q in region %q", imageID, region)
+			_, err := client.DeregisterImage(&ec2.DeregisterImageInput{ImageId: image.ImageId})
+			if err != nil {
+				return fmt.Errorf("error deregistering image %q in region %q: %v", imageID, region, err)
+			}
+
+			for _, mapping := range image.BlockDeviceMappings {
+				if mapping.Ebs == nil || mapping.Ebs.SnapshotId == nil {
+					continue
+				}
+				snapshotID := aws.StringValue(mapping.Ebs.SnapshotId)
+				glog.Infof("Deleting snapshot %q in region %q", snapshotID, region)
+				_, err := client.DeleteSnapshot(&ec2.DeleteSnapshotInput{SnapshotId: mapping.Ebs.SnapshotId})
+				if err != nil {
+					return fmt.Errorf("error deleting snapshot %q of image %q in region %q: %v", snapshotID, imageID, region, err)
+				}
+			}
+		}
+	}
+	return nil
+}
+
 // AWSImage represents an AMI on AWS
 type AWSImage struct {
 	ec2    *ec2.EC2
@@ -555,6 +916,8 @@ type AWSImage struct {
 	//cloud   *AWSCloud
 	image   *ec2.Image
 	imageID string
+
+	events *Events
 }
 
 // ID returns the AWS identifier for the image
@@ -595,6 +958,7 @@ func (i *AWSImage) AddTags(tags map[string]string) error {
 func (i *AWSImage) waitStatusAvailable() error {
 	imageID := i.imageID
 
+	lastState := ""
 	for {
 		// TODO: Timeout
 		request := &ec2.DescribeImagesInput{}
@@ -618,6 +982,10 @@ func (i *AWSImage) waitStatusAvailable() error {
 
 		state := aws.StringValue(image.State)
 		glog.V(2).Infof("image state %q", state)
+		if state != lastState {
+			i.events.Emit(&Event{Type: EventImageState, Image: imageID, Region: i.region, State: state})
+			lastState = state
+		}
 		if state == "available" {
 			return nil
 		}
@@ -651,7 +1019,7 @@ func (i *AWSImage) ensurePublic() error {
 }
 
 // ReplicateImage copies the image to all accessable AWS regions
-func (i *AWSImage) ReplicateImage(makePublic bool) (map[string]Image, error) {
+func (i *AWSImage) ReplicateImage(makePublic bool, progress ReplicationProgress) (map[string]Image, error) {
 	imagesByRegion := make(map[string]Image)
 
 	glog.V(2).Infof("AWS DescribeRegions")
@@ -669,6 +1037,7 @@ func (i *AWSImage) ReplicateImage(makePublic bool) (map[string]Image, error) {
 			continue
 		}
 
+		i.events.Emit(&Event{Type: EventRegionCopy, Region: regionName, Image: i.imageID, State: "copying"})
 		imageID, err := i.copyImageToRegion(regionName)
 		if err != nil {
 			return nil, fmt.Errorf("error copying image to region %q: %v", regionName, err)
@@ -678,6 +1047,10 @@ func (i *AWSImage) ReplicateImage(makePublic bool) (map[string]Image, error) {
 			ec2:     targetEC2,
 			region:  regionName,
 			imageID: imageID,
+			events:  i.events,
+		}
+		if progress != nil {
+			progress(regionName, imagesByRegion[regionName], false)
 		}
 	}
 
@@ -687,6 +1060,9 @@ func (i *AWSImage) ReplicateImage(makePublic bool) (map[string]Image, error) {
 			if err != nil {
 				return nil, fmt.Errorf("error making image public in region %q: %v", regionName, err)
 			}
+			if progress != nil {
+				progress(regionName, image, true)
+			}
 		}
 	}
 
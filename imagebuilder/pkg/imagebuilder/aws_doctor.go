@@ -0,0 +1,349 @@
+/*
+Copyright 2016 The Kubernetes Authors All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package imagebuilder
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/ec2"
+	"github.com/aws/aws-sdk-go/service/sts"
+	"github.com/golang/glog"
+)
+
+var _ Doctor = &AWSCloud{}
+
+// awsNetworkFix is the hint for a missing subnet or security group
+const awsNetworkFix = "Run imagebuilder setup-network, or set SubnetID and SecurityGroupID"
+
+// Doctor checks the credentials, region, base image, network, SSH access, key pair, instance type and quota
+func (c *AWSCloud) Doctor() []*Check {
+	var checks []*Check
+
+	check := c.doctorCredentials()
+	checks = append(checks, check)
+	if check.Status == CheckFail {
+		return checks
+	}
+
+	check = c.doctorRegion()
+	checks = append(checks, check)
+	if check.Status == CheckFail {
+		return checks
+	}
+
+	checks = append(checks, c.doctorBaseImage())
+
+	subnet, check := c.doctorSubnet()
+	checks = append(checks, check)
+	if subnet != nil {
+		checks = append(checks, c.doctorRouting(subnet))
+
+		sg, check := c.doctorSecurityGroup(aws.StringValue(subnet.VpcId))
+		checks = append(checks, check)
+		if sg != nil {
+			checks = append(checks, doctorAWSSSHIngress(sg))
+		}
+	}
+
+	checks = append(checks, c.doctorKeyPair())
+
+	if subnet != nil {
+		checks = append(checks, c.doctorInstanceType(aws.StringValue(subnet.AvailabilityZone)))
+	}
+	checks = append(checks, c.doctorQuota())
+
+	return checks
+}
+
+func (c *AWSCloud) doctorCredentials() *Check {
+	client := sts.New(session.New(), &aws.Config{Region: aws.String(c.config.Region)})
+	glog.V(2).Infof("AWS GetCallerIdentity")
+	response, err := client.GetCallerIdentity(&sts.GetCallerIdentityInput{})
+	if err != nil {
+		return failCheck("credentials", fmt.Sprintf("error getting caller identity: %v", err),
+			"Configure AWS credentials (AWS_ACCESS_KEY_ID and AWS_SECRET_ACCESS_KEY, ~/.aws/credentials or an instance role)")
+	}
+	return passCheck("credentials", "account %s as %s", aws.StringValue(response.Account), aws.StringValue(response.Arn))
+}
+
+func (c *AWSCloud) doctorRegion() *Check {
+	glog.V(2).Infof("AWS DescribeRegions")
+	response, err := c.ec2.DescribeRegions(&ec2.DescribeRegionsInput{})
+	if err != nil {
+		return failCheck("region", fmt.Sprintf("error listing regions in %q: %v", c.config.Region, err), "Set Region (or AWS_REGION) to a valid region")
+	}
+
+	var names []string
+	for _, r := range response.Regions {
+		name := aws.StringValue(r.RegionName)
+		if name == c.config.Region {
+			return passCheck("region", "%s", name)
+		}
+		names = append(names, name)
+	}
+	return failCheck("region", fmt.Sprintf("region %q is not available to the account", c.config.Region),
+		"Set Region (or AWS_REGION) to one of "+strings.Join(names, ", "))
+}
+
+func (c *AWSCloud) doctorBaseImage() *Check {
+	fix := "Set ImageID to a Debian AMI in " + c.config.Region + ", or select one with ImageQuery"
+	if c.config.ImageID == "" {
+		return failCheck("base image", "ImageID is not set, and there is no default for region "+c.config.Region, fix)
+	}
+
+	glog.V(2).Infof("AWS DescribeImages ImageId=%q", c.config.ImageID)
+	response, err := c.ec2.DescribeImages(&ec2.DescribeImagesInput{
+		ImageIds: aws.StringSlice([]string{c.config.ImageID}),
+	})
+	if err != nil {
+		return failCheck("base image", fmt.Sprintf("error describing image %q: %v", c.config.ImageID, err), fix)
+	}
+	if len(response.Images) == 0 {
+		return failCheck("base image", fmt.Sprintf("image %q not found in %s", c.config.ImageID, c.config.Region), fix)
+	}
+	image := response.Images[0]
+	if state := aws.StringValue(image.State); state != "available" {
+		return failCheck("base image", fmt.Sprintf("image %q is %s", c.config.ImageID, state), fix)
+	}
+	return passCheck("base image", "%s (%s)", c.config.ImageID, aws.StringValue(image.Name))
+}
+
+func (c *AWSCloud) doctorSubnet() (*ec2.Subnet, *Check) {
+	var subnet *ec2.Subnet
+	var err error
+	if c.config.SubnetID != "" {
+		subnet, err = c.describeSubnet(c.config.SubnetID)
+		if err == nil && subnet == nil {
+			return nil, failCheck("subnet", fmt.Sprintf("subnet %q not found", c.config.SubnetID), awsNetworkFix)
+		}
+	} else {
+		subnet, err = c.findSubnet()
+		if err == nil && subnet == nil {
+			return nil, failCheck("subnet", fmt.Sprintf("SubnetID is not set, and no subnet is tagged %s", tagRoleKey), awsNetworkFix)
+		}
+	}
+	if err != nil {
+		return nil, failCheck("subnet", err.Error(), awsNetworkFix)
+	}
+	return subnet, passCheck("subnet", "%s in %s (%s)", aws.StringValue(subnet.SubnetId), aws.StringValue(subnet.VpcId), aws.StringValue(subnet.AvailabilityZone))
+}
+
+// doctorRouting checks that the subnet routes to an internet gateway, so we can SSH to the builder's public IP
+func (c *AWSCloud) doctorRouting(subnet *ec2.Subnet) *Check {
+	subnetID := aws.StringValue(subnet.SubnetId)
+	if c.config.PrivateIP {
+		return passCheck("routing", "PrivateIP is set; not checking for an internet gateway")
+	}
+	fix := fmt.Sprintf("Add a 0.0.0.0/0 route to an internet gateway to the route table of %s (setup-network does this for the subnet it creates)", subnetID)
+
+	// Subnets without an explicit route table use the main route table of the VPC
+	filters := [][]*ec2.Filter{
+		{
+			{Name: aws.String("association.subnet-id"), Values: aws.StringSlice([]string{subnetID})},
+		},
+		{
+			{Name: aws.String("vpc-id"), Values: aws.StringSlice([]string{aws.StringValue(subnet.VpcId)})},
+			{Name: aws.String("association.main"), Values: aws.StringSlice([]string{"true"})},
+		},
+	}
+	var routeTable *ec2.RouteTable
+	for _, f := range filters {
+		glog.V(2).Infof("AWS DescribeRouteTables for subnet %q", subnetID)
+		response, err := c.ec2.DescribeRouteTables(&ec2.DescribeRouteTablesInput{Filters: f})
+		if err != nil {
+			return failCheck("routing", fmt.Sprintf("error listing route tables: %v", err), fix)
+		}
+		if len(response.RouteTables) != 0 {
+			routeTable = response.RouteTables[0]
+			break
+		}
+	}
+	if routeTable == nil {
+		return failCheck("routing", fmt.Sprintf("no route table found for %s", subnetID), fix)
+	}
+
+	for _, route := range routeTable.Routes {
+		if aws.StringValue(route.DestinationCidrBlock) != "0.0.0.0/0" {
+			continue
+		}
+		gateway := aws.StringValue(route.GatewayId)
+		if !strings.HasPrefix(gateway, "igw-") {
+			continue
+		}
+		if state := aws.StringValue(route.State); state != "active" {
+			return failCheck("routing", fmt.Sprintf("the route to %s in %s is %s", gateway, aws.StringValue(routeTable.RouteTableId), state), fix)
+		}
+		return passCheck("routing", "%s routes 0.0.0.0/0 to %s", aws.StringValue(routeTable.RouteTableId), gateway)
+	}
+	return failCheck("routing", fmt.Sprintf("%s has no route to an internet gateway", aws.StringValue(routeTable.RouteTableId)), fix)
+}
+
+func (c *AWSCloud) doctorSecurityGroup(vpcID string) (*ec2.SecurityGroup, *Check) {
+	if c.config.SecurityGroupID == "" {
+		sg, err := c.findSecurityGroup(vpcID)
+		if err != nil {
+			return nil, failCheck("security group", err.Error(), awsNetworkFix)
+		}
+		if sg == nil {
+			return nil, failCheck("security group", fmt.Sprintf("SecurityGroupID is not set, and no security group in %s is tagged %s", vpcID, tagRoleKey), awsNetworkFix)
+		}
+		return sg, passCheck("security group", "%s", aws.StringValue(sg.GroupId))
+	}
+
+	glog.V(2).Infof("AWS DescribeSecurityGroups ID=%q", c.config.SecurityGroupID)
+	response, err := c.ec2.DescribeSecurityGroups(&ec2.DescribeSecurityGroupsInput{
+		GroupIds: aws.StringSlice([]string{c.config.SecurityGroupID}),
+	})
+	if err != nil {
+		return nil, failCheck("security group", fmt.Sprintf("error describing security group %q: %v", c.config.SecurityGroupID, err), awsNetworkFix)
+	}
+	if len(response.SecurityGroups) == 0 {
+		return nil, failCheck("security group", fmt.Sprintf("security group %q not found", c.config.SecurityGroupID), awsNetworkFix)
+	}
+	sg := response.SecurityGroups[0]
+	if aws.StringValue(sg.VpcId) != vpcID {
+		return nil, failCheck("security group", fmt.Sprintf("security group %q is in %s, but the subnet is in %s", c.config.SecurityGroupID, aws.StringValue(sg.VpcId), vpcID), awsNetworkFix)
+	}
+	return sg, passCheck("security group", "%s", aws.StringValue(sg.GroupId))
+}
+
+// doctorAWSSSHIngress checks that the security group allows SSH
+func doctorAWSSSHIngress(sg *ec2.SecurityGroup) *Check {
+	var sources []string
+	for _, p := range sg.IpPermissions {
+		protocol := aws.StringValue(p.IpProtocol)
+		if protocol != "-1" {
+			if protocol != "tcp" && protocol != "6" {
+				continue
+			}
+			if aws.Int64Value(p.FromPort) > 22 || aws.Int64Value(p.ToPort) < 22 {
+				continue
+			}
+		}
+		for _, r := range p.IpRanges {
+			sources = append(sources, aws.StringValue(r.CidrIp))
+		}
+		for _, g := range p.UserIdGroupPairs {
+			sources = append(sources, aws.StringValue(g.GroupId))
+		}
+	}
+	if len(sources) == 0 {
+		return failCheck("ssh ingress", fmt.Sprintf("%s does not allow tcp:22", aws.StringValue(sg.GroupId)), sshIngressFix+"; setup-network allows it from our address")
+	}
+	return passCheck("ssh ingress", "tcp:22 from %s", strings.Join(sources, ", "))
+}
+
+func (c *AWSCloud) doctorKeyPair() *Check {
+	if c.config.SSHKeyName != "" {
+		key, err := c.findSSHKey(c.config.SSHKeyName)
+		if err != nil {
+			return failCheck("key pair", err.Error(), "Check the credentials can call DescribeKeyPairs")
+		}
+		if key == nil {
+			return failCheck("key pair", fmt.Sprintf("key pair %q not found in %s", c.config.SSHKeyName, c.config.Region),
+				"Import the key pair into the region, or unset SSHKeyName to import SSHPublicKey")
+		}
+		return passCheck("key pair", "%s", c.config.SSHKeyName)
+	}
+
+	publicKey, err := ReadFile(c.config.SSHPublicKey)
+	if err != nil {
+		return failCheck("key pair", err.Error(), "Set SSHKeyName to an existing key pair, or SSHPublicKey to a public key to import")
+	}
+	name := awsSSHKeyName(publicKey)
+	key, err := c.findSSHKey(name)
+	if err != nil {
+		return failCheck("key pair", err.Error(), "Check the credentials can call DescribeKeyPairs")
+	}
+	if key == nil {
+		return passCheck("key pair", "will import %s as %s", c.config.SSHPublicKey, name)
+	}
+	return passCheck("key pair", "%s (from %s)", name, c.config.SSHPublicKey)
+}
+
+// doctorInstanceType checks that the instance type is offered in the zone.
+// The vendored SDK has no instance type offerings API, so we look for a Reserved Instance offering; a type without one
+// can still be launched on demand, so not finding one is only a warning.
+func (c *AWSCloud) doctorInstanceType(zone string) *Check {
+	fix := "Set InstanceType to a type offered in " + zone + ", or use a subnet in another zone"
+
+	glog.V(2).Infof("AWS DescribeReservedInstancesOfferings InstanceType=%q AvailabilityZone=%q", c.config.InstanceType, zone)
+	response, err := c.ec2.DescribeReservedInstancesOfferings(&ec2.DescribeReservedInstancesOfferingsInput{
+		InstanceType:       aws.String(c.config.InstanceType),
+		AvailabilityZone:   aws.String(zone),
+		ProductDescription: aws.String("Linux/UNIX"),
+		IncludeMarketplace: aws.Bool(false),
+		MaxResults:         aws.Int64(5),
+	})
+	if err != nil {
+		return warnCheck("instance type", fmt.Sprintf("error checking for %s in %s: %v", c.config.InstanceType, zone, err), fix)
+	}
+	if len(response.ReservedInstancesOfferings) == 0 {
+		return warnCheck("instance type", fmt.Sprintf("%s has no Reserved Instance offering in %s, so it may not be offered there", c.config.InstanceType, zone), fix)
+	}
+	return passCheck("instance type", "%s is offered in %s", c.config.InstanceType, zone)
+}
+
+// doctorQuota checks that the account can run another instance
+func (c *AWSCloud) doctorQuota() *Check {
+	fix := "Terminate unused instances, or request a limit increase"
+
+	glog.V(2).Infof("AWS DescribeAccountAttributes max-instances")
+	attributes, err := c.ec2.DescribeAccountAttributes(&ec2.DescribeAccountAttributesInput{
+		AttributeNames: aws.StringSlice([]string{"max-instances"}),
+	})
+	if err != nil {
+		return warnCheck("quota", fmt.Sprintf("error getting instance limit: %v", err), fix)
+	}
+	max := -1
+	for _, a := range attributes.AccountAttributes {
+		for _, v := range a.AttributeValues {
+			if n, err := strconv.Atoi(aws.StringValue(v.AttributeValue)); err == nil {
+				max = n
+			}
+		}
+	}
+	if max < 0 {
+		return warnCheck("quota", "the account does not report an instance limit", fix)
+	}
+
+	running := 0
+	request := &ec2.DescribeInstancesInput{
+		Filters: []*ec2.Filter{
+			{Name: aws.String("instance-state-name"), Values: aws.StringSlice([]string{"pending", "running"})},
+		},
+	}
+	glog.V(2).Infof("AWS DescribeInstances running")
+	err = c.ec2.DescribeInstancesPages(request, func(page *ec2.DescribeInstancesOutput, lastPage bool) bool {
+		for _, r := range page.Reservations {
+			running += len(r.Instances)
+		}
+		return true
+	})
+	if err != nil {
+		return warnCheck("quota", fmt.Sprintf("error counting instances: %v", err), fix)
+	}
+
+	if running >= max {
+		return failCheck("quota", fmt.Sprintf("%d of %d instances are running", running, max), fix)
+	}
+	return passCheck("quota", "%d of %d instances are running", running, max)
+}
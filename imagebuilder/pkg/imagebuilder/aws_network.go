@@ -0,0 +1,515 @@
+/*
+Copyright 2016 The Kubernetes Authors All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package imagebuilder
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/ec2"
+	"github.com/golang/glog"
+)
+
+const (
+	// awsNetworkCIDR is the CIDR of the VPC created by EnsureNetwork
+	awsNetworkCIDR = "172.20.0.0/16"
+	// awsSubnetCIDR is the CIDR of the subnet created by EnsureNetwork
+	awsSubnetCIDR = "172.20.1.0/24"
+
+	awsSecurityGroupName = "imagebuilder"
+
+	// egressIPURL returns the caller's public IP
+	egressIPURL = "https://checkip.amazonaws.com"
+)
+
+// NetworkChange records what was done to a network resource
+type NetworkChange struct {
+	// Kind is the type of resource, e.g. vpc
+	Kind string `json:"kind"`
+	ID   string `json:"id"`
+	// Action is created, exists, updated or deleted
+	Action string `json:"action"`
+}
+
+// networkChanges collects the NetworkChanges, logging them
+type networkChanges []*NetworkChange
+
+func (c *networkChanges) record(kind string, id string, action string) {
+	glog.Infof("%s %s: %s", kind, id, action)
+	*c = append(*c, &NetworkChange{Kind: kind, ID: id, Action: action})
+}
+
+// EgressIP returns the public IP address that our requests come from
+func EgressIP() (string, error) {
+	client := &http.Client{Timeout: 30 * time.Second}
+	response, err := client.Get(egressIPURL)
+	if err != nil {
+		return "", fmt.Errorf("error getting egress IP from %s: %v", egressIPURL, err)
+	}
+	defer response.Body.Close()
+
+	body, err := ioutil.ReadAll(response.Body)
+	if err != nil {
+		return "", fmt.Errorf("error getting egress IP from %s: %v", egressIPURL, err)
+	}
+	ip := strings.TrimSpace(string(body))
+	if response.StatusCode != http.StatusOK || net.ParseIP(ip) == nil {
+		return "", fmt.Errorf("unexpected response getting egress IP from %s: %s %q", egressIPURL, response.Status, ip)
+	}
+	return ip, nil
+}
+
+// roleFilter selects the resources tagged with our role tag
+func roleFilter() *ec2.Filter {
+	return &ec2.Filter{
+		Name:   aws.String("tag-key"),
+		Values: aws.StringSlice([]string{tagRoleKey}),
+	}
+}
+
+// tagRole tags a resource we created with our role tag
+func (c *AWSCloud) tagRole(id string) error {
+	return c.TagResource(id, &ec2.Tag{Key: aws.String(tagRoleKey), Value: aws.String(tagRoleValue)})
+}
+
+// EnsureNetwork creates the VPC, subnet, internet gateway, route table and security group that builders are launched in,
+// tagged with our role tag, unless they exist.  The security group allows SSH only from sshCIDR; rules for other
+// sources are removed, so it can be rerun when our address changes.
+func (c *AWSCloud) EnsureNetwork(sshCIDR string) ([]*NetworkChange, error) {
+	var changes networkChanges
+
+	// VPC
+	glog.V(2).Infof("AWS DescribeVpcs Filter:tag-key=%s", tagRoleKey)
+	vpcs, err := c.ec2.DescribeVpcs(&ec2.DescribeVpcsInput{Filters: []*ec2.Filter{roleFilter()}})
+	if err != nil {
+		return changes, fmt.Errorf("error listing VPCs: %v", err)
+	}
+	var vpcID string
+	if len(vpcs.Vpcs) != 0 {
+		vpcID = aws.StringValue(vpcs.Vpcs[0].VpcId)
+		changes.record("vpc", vpcID, "exists")
+	} else {
+		glog.V(2).Infof("AWS CreateVpc CIDR=%s", awsNetworkCIDR)
+		response, err := c.ec2.CreateVpc(&ec2.CreateVpcInput{CidrBlock: aws.String(awsNetworkCIDR)})
+		if err != nil {
+			return changes, fmt.Errorf("error creating VPC: %v", err)
+		}
+		vpcID = aws.StringValue(response.Vpc.VpcId)
+		if err := c.tagRole(vpcID); err != nil {
+			return changes, err
+		}
+		changes.record("vpc", vpcID, "created")
+	}
+	vpcFilter := &ec2.Filter{Name: aws.String("vpc-id"), Values: aws.StringSlice([]string{vpcID})}
+
+	// Subnet
+	glog.V(2).Infof("AWS DescribeSubnets Filter:tag-key=%s,vpc-id=%s", tagRoleKey, vpcID)
+	subnets, err := c.ec2.DescribeSubnets(&ec2.DescribeSubnetsInput{Filters: []*ec2.Filter{roleFilter(), vpcFilter}})
+	if err != nil {
+		return changes, fmt.Errorf("error listing subnets: %v", err)
+	}
+	var subnetID string
+	if len(subnets.Subnets) != 0 {
+		subnetID = aws.StringValue(subnets.Subnets[0].SubnetId)
+		changes.record("subnet", subnetID, "exists")
+	} else {
+		glog.V(2).Infof("AWS CreateSubnet CIDR=%s", awsSubnetCIDR)
+		response, err := c.ec2.CreateSubnet(&ec2.CreateSubnetInput{
+			VpcId:     aws.String(vpcID),
+			CidrBlock: aws.String(awsSubnetCIDR),
+		})
+		if err != nil {
+			return changes, fmt.Errorf("error creating subnet: %v", err)
+		}
+		subnetID = aws.StringValue(response.Subnet.SubnetId)
+		if err := c.tagRole(subnetID); err != nil {
+			return changes, err
+		}
+		changes.record("subnet", subnetID, "created")
+	}
+
+	// Internet gateway
+	glog.V(2).Infof("AWS DescribeInternetGateways Filter:tag-key=%s", tagRoleKey)
+	igws, err := c.ec2.DescribeInternetGateways(&ec2.DescribeInternetGatewaysInput{Filters: []*ec2.Filter{roleFilter()}})
+	if err != nil {
+		return changes, fmt.Errorf("error listing internet gateways: %v", err)
+	}
+	var igw *ec2.InternetGateway
+	for _, g := range igws.InternetGateways {
+		// Use the gateway attached to our VPC, or else one that is not attached (a gateway can only be attached to one VPC)
+		if len(g.Attachments) == 0 && igw == nil {
+			igw = g
+		}
+		for _, a := range g.Attachments {
+			if aws.StringValue(a.VpcId) == vpcID {
+				igw = g
+			}
+		}
+	}
+	var igwID string
+	if igw != nil {
+		igwID = aws.StringValue(igw.InternetGatewayId)
+		changes.record("internet-gateway", igwID, "exists")
+	} else {
+		glog.V(2).Infof("AWS CreateInternetGateway")
+		response, err := c.ec2.CreateInternetGateway(&ec2.CreateInternetGatewayInput{})
+		if err != nil {
+			return changes, fmt.Errorf("error creating internet gateway: %v", err)
+		}
+		igw = response.InternetGateway
+		igwID = aws.StringValue(igw.InternetGatewayId)
+		if err := c.tagRole(igwID); err != nil {
+			return changes, err
+		}
+		changes.record("internet-gateway", igwID, "created")
+	}
+	attached := false
+	for _, a := range igw.Attachments {
+		if aws.StringValue(a.VpcId) == vpcID {
+			attached = true
+		}
+	}
+	if !attached {
+		glog.V(2).Infof("AWS AttachInternetGateway %s to %s", igwID, vpcID)
+		_, err := c.ec2.AttachInternetGateway(&ec2.AttachInternetGatewayInput{
+			InternetGatewayId: aws.String(igwID),
+			VpcId:             aws.String(vpcID),
+		})
+		if err != nil {
+			return changes, fmt.Errorf("error attaching internet gateway %s to %s: %v", igwID, vpcID, err)
+		}
+		changes.record("internet-gateway", igwID, "attached to "+vpcID)
+	}
+
+	// Route table
+	glog.V(2).Infof("AWS DescribeRouteTables Filter:tag-key=%s,vpc-id=%s", tagRoleKey, vpcID)
+	routeTables, err := c.ec2.DescribeRouteTables(&ec2.DescribeRouteTablesInput{Filters: []*ec2.Filter{roleFilter(), vpcFilter}})
+	if err != nil {
+		return changes, fmt.Errorf("error listing route tables: %v", err)
+	}
+	var routeTable *ec2.RouteTable
+	if len(routeTables.RouteTables) != 0 {
+		routeTable = routeTables.RouteTables[0]
+		changes.record("route-table", aws.StringValue(routeTable.RouteTableId), "exists")
+	} else {
+		glog.V(2).Infof("AWS CreateRouteTable in %s", vpcID)
+		response, err := c.ec2.CreateRouteTable(&ec2.CreateRouteTableInput{VpcId: aws.String(vpcID)})
+		if err != nil {
+			return changes, fmt.Errorf("error creating route table: %v", err)
+		}
+		routeTable = response.RouteTable
+		if err := c.tagRole(aws.StringValue(routeTable.RouteTableId)); err != nil {
+			return changes, err
+		}
+		changes.record("route-table", aws.StringValue(routeTable.RouteTableId), "created")
+	}
+	routeTableID := aws.StringValue(routeTable.RouteTableId)
+
+	associated := false
+	for _, a := range routeTable.Associations {
+		if aws.StringValue(a.SubnetId) == subnetID {
+			associated = true
+		}
+	}
+	if !associated {
+		// The subnet may be explicitly associated with another table, which we replace
+		glog.V(2).Infof("AWS DescribeRouteTables Filter:association.subnet-id=%s", subnetID)
+		existing, err := c.ec2.DescribeRouteTables(&ec2.DescribeRouteTablesInput{Filters: []*ec2.Filter{
+			{Name: aws.String("association.subnet-id"), Values: aws.StringSlice([]string{subnetID})},
+		}})
+		if err != nil {
+			return changes, fmt.Errorf("error listing route tables: %v", err)
+		}
+		var associationID string
+		for _, rt := range existing.RouteTables {
+			for _, a := range rt.Associations {
+				if aws.StringValue(a.SubnetId) == subnetID {
+					associationID = aws.StringValue(a.RouteTableAssociationId)
+				}
+			}
+		}
+		if associationID != "" {
+			glog.V(2).Infof("AWS ReplaceRouteTableAssociation %s", associationID)
+			_, err = c.ec2.ReplaceRouteTableAssociation(&ec2.ReplaceRouteTableAssociationInput{
+				AssociationId: aws.String(associationID),
+				RouteTableId:  aws.String(routeTableID),
+			})
+		} else {
+			glog.V(2).Infof("AWS AssociateRouteTable %s with %s", routeTableID, subnetID)
+			_, err = c.ec2.AssociateRouteTable(&ec2.AssociateRouteTableInput{
+				RouteTableId: aws.String(routeTableID),
+				SubnetId:     aws.String(subnetID),
+			})
+		}
+		if err != nil {
+			return changes, fmt.Errorf("error associating route table %s with %s: %v", routeTableID, subnetID, err)
+		}
+		changes.record("route-table", routeTableID, "associated with "+subnetID)
+	}
+
+	var defaultRoute *ec2.Route
+	for _, r := range routeTable.Routes {
+		if aws.StringValue(r.DestinationCidrBlock) == "0.0.0.0/0" {
+			defaultRoute = r
+		}
+	}
+	switch {
+	case defaultRoute == nil:
+		glog.V(2).Infof("AWS CreateRoute 0.0.0.0/0 via %s", igwID)
+		_, err := c.ec2.CreateRoute(&ec2.CreateRouteInput{
+			RouteTableId:         aws.String(routeTableID),
+			DestinationCidrBlock: aws.String("0.0.0.0/0"),
+			GatewayId:            aws.String(igwID),
+		})
+		if err != nil {
+			return changes, fmt.Errorf("error creating route to %s: %v", igwID, err)
+		}
+		changes.record("route", routeTableID+" 0.0.0.0/0", "created via "+igwID)
+	case aws.StringValue(defaultRoute.GatewayId) != igwID || aws.StringValue(defaultRoute.State) != "active":
+		glog.V(2).Infof("AWS ReplaceRoute 0.0.0.0/0 via %s", igwID)
+		_, err := c.ec2.ReplaceRoute(&ec2.ReplaceRouteInput{
+			RouteTableId:         aws.String(routeTableID),
+			DestinationCidrBlock: aws.String("0.0.0.0/0"),
+			GatewayId:            aws.String(igwID),
+		})
+		if err != nil {
+			return changes, fmt.Errorf("error replacing route to %s: %v", igwID, err)
+		}
+		changes.record("route", routeTableID+" 0.0.0.0/0", "updated via "+igwID)
+	default:
+		changes.record("route", routeTableID+" 0.0.0.0/0", "exists")
+	}
+
+	// Security group
+	sg, err := c.findSecurityGroup(vpcID)
+	if err != nil {
+		return changes, err
+	}
+	var sgID string
+	if sg != nil {
+		sgID = aws.StringValue(sg.GroupId)
+		changes.record("security-group", sgID, "exists")
+	} else {
+		glog.V(2).Infof("AWS CreateSecurityGroup %s in %s", awsSecurityGroupName, vpcID)
+		response, err := c.ec2.CreateSecurityGroup(&ec2.CreateSecurityGroupInput{
+			VpcId:       aws.String(vpcID),
+			GroupName:   aws.String(awsSecurityGroupName),
+			Description: aws.String("imagebuilder security group"),
+		})
+		if err != nil {
+			return changes, fmt.Errorf("error creating security group: %v", err)
+		}
+		sgID = aws.StringValue(response.GroupId)
+		if err := c.tagRole(sgID); err != nil {
+			return changes, err
+		}
+		changes.record("security-group", sgID, "created")
+		sg = &ec2.SecurityGroup{GroupId: response.GroupId}
+	}
+
+	allowed := false
+	var revoke []*ec2.IpPermission
+	for _, p := range sg.IpPermissions {
+		if aws.StringValue(p.IpProtocol) != "tcp" || aws.Int64Value(p.FromPort) != 22 || aws.Int64Value(p.ToPort) != 22 {
+			continue
+		}
+		for _, r := range p.IpRanges {
+			cidr := aws.StringValue(r.CidrIp)
+			if cidr == sshCIDR {
+				allowed = true
+				continue
+			}
+			revoke = append(revoke, &ec2.IpPermission{
+				IpProtocol: aws.String("tcp"),
+				FromPort:   aws.Int64(22),
+				ToPort:     aws.Int64(22),
+				IpRanges:   []*ec2.IpRange{{CidrIp: aws.String(cidr)}},
+			})
+		}
+	}
+	if len(revoke) != 0 {
+		glog.V(2).Infof("AWS RevokeSecurityGroupIngress %s", sgID)
+		_, err := c.ec2.RevokeSecurityGroupIngress(&ec2.RevokeSecurityGroupIngressInput{
+			GroupId:       aws.String(sgID),
+			IpPermissions: revoke,
+		})
+		if err != nil {
+			return changes, fmt.Errorf("error removing old SSH rules from %s: %v", sgID, err)
+		}
+		for _, p := range revoke {
+			changes.record("ssh-ingress", sgID+" "+aws.StringValue(p.IpRanges[0].CidrIp), "deleted")
+		}
+	}
+	if allowed {
+		changes.record("ssh-ingress", sgID+" "+sshCIDR, "exists")
+	} else {
+		glog.V(2).Infof("AWS AuthorizeSecurityGroupIngress %s tcp:22 from %s", sgID, sshCIDR)
+		_, err := c.ec2.AuthorizeSecurityGroupIngress(&ec2.AuthorizeSecurityGroupIngressInput{
+			GroupId:    aws.String(sgID),
+			IpProtocol: aws.String("tcp"),
+			FromPort:   aws.Int64(22),
+			ToPort:     aws.Int64(22),
+			CidrIp:     aws.String(sshCIDR),
+		})
+		if err != nil {
+			return changes, fmt.Errorf("error allowing SSH from %s to %s: %v", sshCIDR, sgID, err)
+		}
+		changes.record("ssh-ingress", sgID+" "+sshCIDR, "created")
+	}
+
+	return changes, nil
+}
+
+// DeleteNetwork deletes the network resources tagged with our role tag, as created by EnsureNetwork.
+// The builder instance must be terminated first.
+func (c *AWSCloud) DeleteNetwork() ([]*NetworkChange, error) {
+	var changes networkChanges
+
+	glog.V(2).Infof("AWS DescribeVpcs Filter:tag-key=%s", tagRoleKey)
+	vpcs, err := c.ec2.DescribeVpcs(&ec2.DescribeVpcsInput{Filters: []*ec2.Filter{roleFilter()}})
+	if err != nil {
+		return changes, fmt.Errorf("error listing VPCs: %v", err)
+	}
+
+	for _, vpc := range vpcs.Vpcs {
+		vpcID := aws.StringValue(vpc.VpcId)
+		vpcFilter := &ec2.Filter{Name: aws.String("vpc-id"), Values: aws.StringSlice([]string{vpcID})}
+
+		glog.V(2).Infof("AWS DescribeSecurityGroups Filter:tag-key=%s,vpc-id=%s", tagRoleKey, vpcID)
+		sgs, err := c.ec2.DescribeSecurityGroups(&ec2.DescribeSecurityGroupsInput{Filters: []*ec2.Filter{roleFilter(), vpcFilter}})
+		if err != nil {
+			return changes, fmt.Errorf("error listing security groups: %v", err)
+		}
+		for _, sg := range sgs.SecurityGroups {
+			sgID := aws.StringValue(sg.GroupId)
+			glog.V(2).Infof("AWS DeleteSecurityGroup %s", sgID)
+			_, err := c.ec2.DeleteSecurityGroup(&ec2.DeleteSecurityGroupInput{GroupId: aws.String(sgID)})
+			if err != nil {
+				return changes, fmt.Errorf("error deleting security group %s (is the builder instance still running?): %v", sgID, err)
+			}
+			changes.record("security-group", sgID, "deleted")
+		}
+
+		glog.V(2).Infof("AWS DescribeRouteTables Filter:tag-key=%s,vpc-id=%s", tagRoleKey, vpcID)
+		routeTables, err := c.ec2.DescribeRouteTables(&ec2.DescribeRouteTablesInput{Filters: []*ec2.Filter{roleFilter(), vpcFilter}})
+		if err != nil {
+			return changes, fmt.Errorf("error listing route tables: %v", err)
+		}
+		for _, rt := range routeTables.RouteTables {
+			rtID := aws.StringValue(rt.RouteTableId)
+			for _, a := range rt.Associations {
+				if aws.BoolValue(a.Main) {
+					continue
+				}
+				glog.V(2).Infof("AWS DisassociateRouteTable %s", aws.StringValue(a.RouteTableAssociationId))
+				_, err := c.ec2.DisassociateRouteTable(&ec2.DisassociateRouteTableInput{AssociationId: a.RouteTableAssociationId})
+				if err != nil {
+					return changes, fmt.Errorf("error disassociating route table %s: %v", rtID, err)
+				}
+			}
+			// The main route table is deleted with the VPC
+			if isMainRouteTable(rt) {
+				continue
+			}
+			glog.V(2).Infof("AWS DeleteRouteTable %s", rtID)
+			_, err := c.ec2.DeleteRouteTable(&ec2.DeleteRouteTableInput{RouteTableId: aws.String(rtID)})
+			if err != nil {
+				return changes, fmt.Errorf("error deleting route table %s: %v", rtID, err)
+			}
+			changes.record("route-table", rtID, "deleted")
+		}
+
+		glog.V(2).Infof("AWS DescribeInternetGateways Filter:attachment.vpc-id=%s", vpcID)
+		igws, err := c.ec2.DescribeInternetGateways(&ec2.DescribeInternetGatewaysInput{Filters: []*ec2.Filter{
+			roleFilter(),
+			{Name: aws.String("attachment.vpc-id"), Values: aws.StringSlice([]string{vpcID})},
+		}})
+		if err != nil {
+			return changes, fmt.Errorf("error listing internet gateways: %v", err)
+		}
+		for _, igw := range igws.InternetGateways {
+			igwID := aws.StringValue(igw.InternetGatewayId)
+			glog.V(2).Infof("AWS DetachInternetGateway %s", igwID)
+			_, err := c.ec2.DetachInternetGateway(&ec2.DetachInternetGatewayInput{
+				InternetGatewayId: aws.String(igwID),
+				VpcId:             aws.String(vpcID),
+			})
+			if err != nil {
+				return changes, fmt.Errorf("error detaching internet gateway %s (is the builder instance still running?): %v", igwID, err)
+			}
+			changes.record("internet-gateway", igwID, "detached from "+vpcID)
+		}
+
+		glog.V(2).Infof("AWS DescribeSubnets Filter:vpc-id=%s", vpcID)
+		subnets, err := c.ec2.DescribeSubnets(&ec2.DescribeSubnetsInput{Filters: []*ec2.Filter{roleFilter(), vpcFilter}})
+		if err != nil {
+			return changes, fmt.Errorf("error listing subnets: %v", err)
+		}
+		for _, subnet := range subnets.Subnets {
+			subnetID := aws.StringValue(subnet.SubnetId)
+			glog.V(2).Infof("AWS DeleteSubnet %s", subnetID)
+			_, err := c.ec2.DeleteSubnet(&ec2.DeleteSubnetInput{SubnetId: aws.String(subnetID)})
+			if err != nil {
+				return changes, fmt.Errorf("error deleting subnet %s (is the builder instance still running?): %v", subnetID, err)
+			}
+			changes.record("subnet", subnetID, "deleted")
+		}
+
+		glog.V(2).Infof("AWS DeleteVpc %s", vpcID)
+		_, err = c.ec2.DeleteVpc(&ec2.DeleteVpcInput{VpcId: aws.String(vpcID)})
+		if err != nil {
+			return changes, fmt.Errorf("error deleting VPC %s: %v", vpcID, err)
+		}
+		changes.record("vpc", vpcID, "deleted")
+	}
+
+	// Gateways that are no longer attached to a VPC
+	glog.V(2).Infof("AWS DescribeInternetGateways Filter:tag-key=%s", tagRoleKey)
+	igws, err := c.ec2.DescribeInternetGateways(&ec2.DescribeInternetGatewaysInput{Filters: []*ec2.Filter{roleFilter()}})
+	if err != nil {
+		return changes, fmt.Errorf("error listing internet gateways: %v", err)
+	}
+	for _, igw := range igws.InternetGateways {
+		if len(igw.Attachments) != 0 {
+			continue
+		}
+		igwID := aws.StringValue(igw.InternetGatewayId)
+		glog.V(2).Infof("AWS DeleteInternetGateway %s", igwID)
+		_, err := c.ec2.DeleteInternetGateway(&ec2.DeleteInternetGatewayInput{InternetGatewayId: aws.String(igwID)})
+		if err != nil {
+			return changes, fmt.Errorf("error deleting internet gateway %s: %v", igwID, err)
+		}
+		changes.record("internet-gateway", igwID, "deleted")
+	}
+
+	return changes, nil
+}
+
+// isMainRouteTable returns true if the route table is the main route table of its VPC
+func isMainRouteTable(rt *ec2.RouteTable) bool {
+	for _, a := range rt.Associations {
+		if aws.BoolValue(a.Main) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,87 @@
+/*
+Copyright 2016 The Kubernetes Authors All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package imagebuilder
+
+import (
+	"fmt"
+	"os"
+
+	"github.com/golang/glog"
+	"k8s.io/kube-deploy/imagebuilder/pkg/imagebuilder/executor"
+)
+
+// Names of the build backends, for Config.Backend
+const (
+	BackendBootstrapVZ = "bootstrap-vz"
+	BackendContainer   = "container"
+	BackendProvision   = "provision"
+	BackendEBS         = "ebs"
+)
+
+// BuildBackend builds an image on the builder
+type BuildBackend interface {
+	// Name returns the name of the backend, for logs
+	Name() string
+	// Prepare gets the builder ready to build, e.g. installing tools and uploading files
+	Prepare(target *executor.Target) error
+	// Build builds the image
+	Build(target *executor.Target) error
+	// CollectArtifacts copies the build's logs and other outputs from the builder to localDir
+	CollectArtifacts(target *executor.Target, localDir string) error
+	// Cleanup removes any temporary files from the builder
+	Cleanup(target *executor.Target) error
+	// ImageName returns the name of the image that is (or was) built
+	ImageName() string
+}
+
+// Build builds an image with the backend.
+// If artifactsDir is set, artifacts are copied there, even if the build fails.
+func (b *Builder) Build(backend BuildBackend, artifactsDir string) error {
+	glog.Infof("Building image %q with the %s backend", backend.ImageName(), backend.Name())
+
+	defer func() {
+		if err := backend.Cleanup(b.target); err != nil {
+			glog.Warningf("error cleaning up after build: %v", err)
+		}
+	}()
+
+	err := backend.Prepare(b.target)
+	if err != nil {
+		return fmt.Errorf("error preparing build: %v", err)
+	}
+
+	buildErr := backend.Build(b.target)
+
+	if artifactsDir != "" {
+		if err := os.MkdirAll(artifactsDir, 0755); err != nil {
+			return fmt.Errorf("error creating artifacts directory %q: %v", artifactsDir, err)
+		}
+		err := backend.CollectArtifacts(b.target, artifactsDir)
+		if err != nil {
+			if buildErr != nil {
+				// The build error is more important
+				glog.Warningf("error collecting build artifacts: %v", err)
+			} else {
+				return fmt.Errorf("error collecting build artifacts: %v", err)
+			}
+		} else {
+			glog.Infof("Copied build artifacts to %q", artifactsDir)
+		}
+	}
+
+	return buildErr
+}
@@ -0,0 +1,177 @@
+/*
+Copyright 2016 The Kubernetes Authors All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package imagebuilder
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"time"
+
+	"github.com/golang/glog"
+)
+
+// BaseImageQuerier is implemented by clouds whose base image can be selected by a query, instead of by ID
+type BaseImageQuerier interface {
+	// BaseImageQuery returns the key the query is pinned under and a description of the query,
+	// or an empty key if the base image is not selected by a query
+	BaseImageQuery() (key string, query string)
+	// FindBaseImage runs the query, returning the newest matching image
+	FindBaseImage() (string, error)
+	// SetBaseImage sets the image the builder is launched from
+	SetBaseImage(image string)
+}
+
+// BaseImagePin records the image that a base image query resolved to
+type BaseImagePin struct {
+	Query string `json:"query"`
+	Image string `json:"image"`
+	// Pinned is when the query was resolved
+	Pinned string `json:"pinned"`
+}
+
+// BaseImagePins is the content of a pin file: the pinned image for each key (the cloud, and the region on AWS)
+type BaseImagePins map[string]*BaseImagePin
+
+// ReadBaseImagePins reads the pin file p, returning no pins if it does not exist
+func ReadBaseImagePins(p string) (BaseImagePins, error) {
+	pins := make(BaseImagePins)
+	data, err := ioutil.ReadFile(p)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return pins, nil
+		}
+		return nil, fmt.Errorf("error reading base image pins %q: %v", p, err)
+	}
+	if err := json.Unmarshal(data, &pins); err != nil {
+		return nil, fmt.Errorf("error parsing base image pins %q: %v", p, err)
+	}
+	return pins, nil
+}
+
+// WriteFile writes the pins as JSON to the file p, replacing it atomically.
+// Use UpdateBaseImagePin to change a pin, so that concurrent updates are not lost.
+func (pins BaseImagePins) WriteFile(p string) error {
+	data, err := json.MarshalIndent(pins, "", "  ")
+	if err != nil {
+		return fmt.Errorf("error serializing base image pins: %v", err)
+	}
+	err = writeFileAtomic(p, append(data, '\n'), 0644)
+	if err != nil {
+		return fmt.Errorf("error writing base image pins to %q: %v", p, err)
+	}
+	return nil
+}
+
+// PinnedBaseImage returns the image pinned for the cloud's query in the pin file, or "" if it is not pinned.
+// It is an error if the query has changed since it was pinned.
+func PinnedBaseImage(q BaseImageQuerier, pinFile string) (string, error) {
+	key, query := q.BaseImageQuery()
+	if key == "" || pinFile == "" {
+		return "", nil
+	}
+	pins, err := ReadBaseImagePins(pinFile)
+	if err != nil {
+		return "", err
+	}
+	pin := pins[key]
+	if pin == nil {
+		return "", nil
+	}
+	if pin.Query != query {
+		return "", fmt.Errorf("the base image query for %s has changed since it was pinned in %s (was %q, now %q); pass --update-pins to resolve it again", key, pinFile, pin.Query, query)
+	}
+	return pin.Image, nil
+}
+
+// ResolveBaseImage runs the cloud's base image query (if it has one), and sets the base image to the result, which it returns.
+// With a pinFile, the pinned image is used if there is one; otherwise (or if update is set) the query is run, and the
+// image is pinned, so that builds use the same base image until the pins are updated.
+func ResolveBaseImage(q BaseImageQuerier, pinFile string, update bool, now time.Time) (string, error) {
+	key, query := q.BaseImageQuery()
+	if key == "" {
+		return "", nil
+	}
+
+	if !update {
+		image, err := PinnedBaseImage(q, pinFile)
+		if err != nil {
+			return "", err
+		}
+		if image != "" {
+			glog.Infof("Using base image %s, pinned in %s", image, pinFile)
+			q.SetBaseImage(image)
+			return image, nil
+		}
+	}
+
+	image, err := q.FindBaseImage()
+	if err != nil {
+		return "", err
+	}
+	glog.Infof("Base image query %s found %s", query, image)
+
+	if pinFile != "" {
+		image, err = UpdateBaseImagePin(pinFile, key, query, image, update, now)
+		if err != nil {
+			return "", err
+		}
+	}
+	q.SetBaseImage(image)
+	return image, nil
+}
+
+// UpdateBaseImagePin pins image for key in the pin file, returning the pinned image.
+// The file is re-read and updated under a lock, so that concurrent builds don't lose each other's pins.
+// Unless update is set, an image that another build pinned for the same query in the meantime is kept (and returned).
+func UpdateBaseImagePin(pinFile string, key string, query string, image string, update bool, now time.Time) (string, error) {
+	unlock, err := lockFile(pinFile)
+	if err != nil {
+		return "", err
+	}
+	defer unlock()
+
+	pins, err := ReadBaseImagePins(pinFile)
+	if err != nil {
+		return "", err
+	}
+	pin := pins[key]
+	if pin != nil && !update {
+		if pin.Query != query {
+			return "", fmt.Errorf("the base image query for %s has changed since it was pinned in %s (was %q, now %q); pass --update-pins to resolve it again", key, pinFile, pin.Query, query)
+		}
+		if pin.Image != image {
+			glog.Infof("Using base image %s, pinned in %s by another build", pin.Image, pinFile)
+		}
+		return pin.Image, nil
+	}
+	if pin != nil && pin.Image == image && pin.Query == query {
+		return image, nil
+	}
+
+	pins[key] = &BaseImagePin{
+		Query:  query,
+		Image:  image,
+		Pinned: now.UTC().Format(time.RFC3339),
+	}
+	if err := pins.WriteFile(pinFile); err != nil {
+		return "", err
+	}
+	glog.Infof("Pinned base image %s for %s in %s", image, key, pinFile)
+	return image, nil
+}
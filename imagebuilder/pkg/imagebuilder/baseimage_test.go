@@ -0,0 +1,90 @@
+/*
+Copyright 2016 The Kubernetes Authors All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package imagebuilder
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestUpdateBaseImagePinConcurrently(t *testing.T) {
+	dir, err := ioutil.TempDir("", "pins")
+	if err != nil {
+		t.Fatalf("error creating temp dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	pinFile := filepath.Join(dir, "pins.json")
+
+	// Each region pins its own key, and all of them pin the shared key
+	var wg sync.WaitGroup
+	errors := make(chan error, 40)
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			key := fmt.Sprintf("aws/region-%d", i)
+			if _, err := UpdateBaseImagePin(pinFile, key, "query", fmt.Sprintf("ami-%d", i), false, testBuildTime); err != nil {
+				errors <- err
+			}
+			if _, err := UpdateBaseImagePin(pinFile, "gce", "query", fmt.Sprintf("image-%d", i), false, testBuildTime); err != nil {
+				errors <- err
+			}
+		}(i)
+	}
+	wg.Wait()
+	close(errors)
+	for err := range errors {
+		t.Errorf("unexpected error: %v", err)
+	}
+
+	pins, err := ReadBaseImagePins(pinFile)
+	if err != nil {
+		t.Fatalf("error reading pins: %v", err)
+	}
+	if len(pins) != 21 {
+		t.Errorf("expected 21 pins, was %d: %v", len(pins), pins)
+	}
+	for i := 0; i < 20; i++ {
+		key := fmt.Sprintf("aws/region-%d", i)
+		if pins[key] == nil || pins[key].Image != fmt.Sprintf("ami-%d", i) {
+			t.Errorf("expected %s to be pinned to ami-%d, was %+v", key, i, pins[key])
+		}
+	}
+
+	// Every later build gets the image that was pinned first
+	shared := pins["gce"].Image
+	image, err := UpdateBaseImagePin(pinFile, "gce", "query", "image-new", false, testBuildTime)
+	if err != nil || image != shared {
+		t.Errorf("expected the pinned image %s to be kept, got %s (%v)", shared, image, err)
+	}
+
+	// ... unless it is updating the pins
+	image, err = UpdateBaseImagePin(pinFile, "gce", "query", "image-new", true, testBuildTime.Add(time.Hour))
+	if err != nil || image != "image-new" {
+		t.Errorf("expected the pin to be updated to image-new, got %s (%v)", image, err)
+	}
+
+	// A changed query must be resolved again explicitly
+	if _, err := UpdateBaseImagePin(pinFile, "gce", "other query", "image-other", false, testBuildTime); err == nil {
+		t.Errorf("expected an error for a changed query")
+	}
+}
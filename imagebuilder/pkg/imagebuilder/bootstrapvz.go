@@ -19,9 +19,7 @@ package imagebuilder
 import (
 	"fmt"
 	"regexp"
-	"strconv"
 	"strings"
-	"time"
 
 	"gopkg.in/yaml.v2"
 )
@@ -37,6 +35,15 @@ func NewBootstrapVzTemplate(data string) (*BootstrapVzTemplate, error) {
 	return &BootstrapVzTemplate{data: m, raw: []byte(data)}, nil
 }
 
+// NewBootstrapVzTemplateFromManifest builds a BootstrapVzTemplate from a typed manifest
+func NewBootstrapVzTemplateFromManifest(m *Manifest) (*BootstrapVzTemplate, error) {
+	data, err := m.Marshal()
+	if err != nil {
+		return nil, err
+	}
+	return NewBootstrapVzTemplate(string(data))
+}
+
 // BootstrapVzTemplate represents a bootstrap-vz template file
 type BootstrapVzTemplate struct {
 	data map[interface{}]interface{}
@@ -48,8 +55,33 @@ func (t *BootstrapVzTemplate) Bytes() []byte {
 	return t.raw
 }
 
-// BuildImageName computes the name of the image that will be built
-func (t *BootstrapVzTemplate) BuildImageName() (string, error) {
+// Manifest parses the template as a typed Manifest, which can be edited
+func (t *BootstrapVzTemplate) Manifest() (*Manifest, error) {
+	return ParseManifest(t.raw)
+}
+
+// WithExtras returns a copy of the template with the packages installed and the commands appended.
+// If there are no extras the template is returned unchanged, so it keeps its formatting and comments.
+func (t *BootstrapVzTemplate) WithExtras(packages []string, commands [][]string) (*BootstrapVzTemplate, error) {
+	if len(packages) == 0 && len(commands) == 0 {
+		return t, nil
+	}
+
+	m, err := t.Manifest()
+	if err != nil {
+		return nil, err
+	}
+	for _, p := range packages {
+		m.AddPackage(p)
+	}
+	for _, c := range commands {
+		m.AppendCommand(c)
+	}
+	return NewBootstrapVzTemplateFromManifest(m)
+}
+
+// BuildImageName computes the name of the image that will be built, expanding the template's name (see ExpandImageName)
+func (t *BootstrapVzTemplate) BuildImageName(info *BuildInfo) (string, error) {
 	name, err := t.getString("name")
 	if err != nil {
 		return "", err
@@ -57,69 +89,117 @@ func (t *BootstrapVzTemplate) BuildImageName() (string, error) {
 	if name == "" {
 		return "", fmt.Errorf("name not found in template")
 	}
-	regex := regexp.MustCompile("{([^}]*)}")
 
-	now := time.Now().UTC()
+	return ExpandImageName(name, info, t.getString)
+}
 
-	var replaceErr error
+// NameUses returns true if the name references {token}
+func (t *BootstrapVzTemplate) NameUses(token string) bool {
+	name, err := t.getString("name")
+	if err != nil {
+		return false
+	}
+	return ImageNameUses(name, token)
+}
 
-	replacer := func(path string) string {
-		// Remove { and }
-		path = path[1 : len(path)-1]
+// topLevelNameRegex matches the name line of a manifest
+var topLevelNameRegex = regexp.MustCompile(`(?m)^name:.*$`)
 
-		if path == "" {
-			return ""
-		}
+// WithName returns a copy of the template with the name replaced by the resolved image name,
+// so bootstrap-vz doesn't need to understand our build tokens, and uses the same build time.
+func (t *BootstrapVzTemplate) WithName(name string) (*BootstrapVzTemplate, error) {
+	if n := len(topLevelNameRegex.FindAllIndex(t.raw, -1)); n != 1 {
+		return nil, fmt.Errorf("expected exactly one name in template, found %d", n)
+	}
+	quoted, err := yaml.Marshal(name)
+	if err != nil {
+		return nil, fmt.Errorf("error serializing name %q: %v", name, err)
+	}
+	line := "name: " + strings.TrimSpace(string(quoted))
+	raw := topLevelNameRegex.ReplaceAllLiteral(t.raw, []byte(line))
+	return NewBootstrapVzTemplate(string(raw))
+}
 
-		if path[0] == '%' {
-			switch path {
-			case "%Y":
-				return strconv.Itoa(now.Year())
-			case "%m":
-				return fmt.Sprintf("%02d", now.Month())
-			case "%d":
-				return fmt.Sprintf("%02d", now.Day())
-			default:
-				replaceErr = fmt.Errorf("unknown template specifier: %q", path)
-				return ""
-			}
-		} else {
-			v, err := t.getString(path)
-			if err != nil {
-				replaceErr = fmt.Errorf("error replacing template spec %q: %v", path, err)
-				return ""
-			}
-			return v
+func (t *BootstrapVzTemplate) getString(path string) (string, error) {
+	v, err := t.get(path)
+	if err != nil || v == nil {
+		return "", err
+	}
+	s, ok := v.(string)
+	if !ok {
+		return "", fmt.Errorf("Expected string, found %T at %q", v, path)
+	}
+	return s, nil
+}
+
+// getStringList returns the list of strings at path, or nil if not found
+func (t *BootstrapVzTemplate) getStringList(path string) ([]string, error) {
+	v, err := t.get(path)
+	if err != nil || v == nil {
+		return nil, err
+	}
+	l, ok := v.([]interface{})
+	if !ok {
+		return nil, fmt.Errorf("Expected list, found %T at %q", v, path)
+	}
+	var strings []string
+	for _, item := range l {
+		s, ok := item.(string)
+		if !ok {
+			return nil, fmt.Errorf("Expected string, found %T in list at %q", item, path)
 		}
+		strings = append(strings, s)
 	}
+	return strings, nil
+}
 
-	name = regex.ReplaceAllStringFunc(name, replacer)
-	if replaceErr != nil {
-		return "", replaceErr
+// Commands returns the commands from the commands plugin (plugins.commands.commands)
+func (t *BootstrapVzTemplate) Commands() ([][]string, error) {
+	path := "plugins.commands.commands"
+	v, err := t.get(path)
+	if err != nil || v == nil {
+		return nil, err
+	}
+	l, ok := v.([]interface{})
+	if !ok {
+		return nil, fmt.Errorf("Expected list, found %T at %q", v, path)
 	}
-	return name, nil
+	var commands [][]string
+	for _, item := range l {
+		argv, ok := item.([]interface{})
+		if !ok {
+			return nil, fmt.Errorf("Expected list, found %T in list at %q", item, path)
+		}
+		var command []string
+		for _, arg := range argv {
+			s, ok := arg.(string)
+			if !ok {
+				return nil, fmt.Errorf("Expected string, found %T in command at %q", arg, path)
+			}
+			command = append(command, s)
+		}
+		commands = append(commands, command)
+	}
+	return commands, nil
 }
 
-func (t *BootstrapVzTemplate) getString(path string) (string, error) {
+// get returns the value at the dotted path, or nil if not found
+func (t *BootstrapVzTemplate) get(path string) (interface{}, error) {
 	tokens := strings.Split(path, ".")
 	pos := t.data
 	for i, token := range tokens {
 		next, found := pos[token]
 		if !found {
-			return "", nil
+			return nil, nil
 		}
 
 		if (i + 1) == len(tokens) {
-			s, ok := next.(string)
-			if !ok {
-				return "", fmt.Errorf("Expected string, found %T at %q", next, path)
-			}
-			return s, nil
+			return next, nil
 		}
 
 		m, ok := next.(map[interface{}]interface{})
 		if !ok {
-			return "", fmt.Errorf("Expected map, found %T at %q", next, path)
+			return nil, fmt.Errorf("Expected map, found %T at %q", next, path)
 		}
 		pos = m
 	}
@@ -0,0 +1,297 @@
+/*
+Copyright 2016 The Kubernetes Authors All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package imagebuilder
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"strings"
+
+	"github.com/golang/glog"
+	"k8s.io/kube-deploy/imagebuilder/pkg/imagebuilder/executor"
+)
+
+// BootstrapVZSource is the bootstrap-vz code that runs the build:
+// a commit of a git repo, a release tarball, or a local tree
+type BootstrapVZSource struct {
+	config *Config
+
+	// Commit is the git commit of bootstrap-vz, if known
+	Commit string
+	// Version identifies the contents of the source: the commit for a git repo,
+	// or the sha256 of a tarball or local tree (which may have local changes)
+	Version string
+
+	// tarball is the local copy of the tarball, after it has been verified
+	tarball string
+}
+
+// ResolveBootstrapVZSource determines the bootstrap-vz source from the config.
+// Branches are resolved to a commit, and tarballs are downloaded and checked against BootstrapVZTarballSHA256.
+func ResolveBootstrapVZSource(config *Config) (*BootstrapVZSource, error) {
+	s := &BootstrapVZSource{config: config}
+
+	switch {
+	case config.BootstrapVZPath != "":
+		if config.BootstrapVZTarball != "" {
+			return nil, fmt.Errorf("only one of BootstrapVZPath and BootstrapVZTarball can be set")
+		}
+		hash, err := hashTree(config.BootstrapVZPath)
+		if err != nil {
+			return nil, err
+		}
+		s.Version = "sha256:" + hash
+		s.Commit = localGitCommit(config.BootstrapVZPath)
+
+	case config.BootstrapVZTarball != "":
+		if config.BootstrapVZTarballSHA256 == "" {
+			return nil, fmt.Errorf("BootstrapVZTarballSHA256 must be set when using BootstrapVZTarball")
+		}
+		tarball, err := fetchVerified(config.BootstrapVZTarball, config.BootstrapVZTarballSHA256)
+		if err != nil {
+			return nil, err
+		}
+		s.tarball = tarball
+		s.Version = "sha256:" + strings.ToLower(config.BootstrapVZTarballSHA256)
+		// The tarball can't tell us its commit, but the user can
+		s.Commit = config.BootstrapVZCommit
+
+	default:
+		commit := config.BootstrapVZCommit
+		if commit == "" {
+			var err error
+			commit, err = ResolveBootstrapVZCommit(config.BootstrapVZRepo, config.BootstrapVZBranch)
+			if err != nil {
+				return nil, err
+			}
+		} else if !gitSHARegex.MatchString(commit) {
+			return nil, fmt.Errorf("BootstrapVZCommit must be a full (40 character) commit SHA, was %q", commit)
+		}
+		s.Commit = commit
+		s.Version = commit
+	}
+
+	return s, nil
+}
+
+// String returns a description of the source, for logs
+func (s *BootstrapVZSource) String() string {
+	switch {
+	case s.config.BootstrapVZPath != "":
+		return fmt.Sprintf("%s (%s)", s.config.BootstrapVZPath, s.Version)
+	case s.config.BootstrapVZTarball != "":
+		return fmt.Sprintf("%s (%s)", s.config.BootstrapVZTarball, s.Version)
+	default:
+		return fmt.Sprintf("%s@%s", s.config.BootstrapVZRepo, s.Commit)
+	}
+}
+
+// Install puts the bootstrap-vz source into dir on the target
+func (s *BootstrapVZSource) Install(target *executor.Target, dir string) error {
+	switch {
+	case s.config.BootstrapVZPath != "":
+		glog.Infof("Uploading bootstrap-vz from %q", s.config.BootstrapVZPath)
+		return target.PutDir(s.config.BootstrapVZPath, dir)
+
+	case s.tarball != "":
+		stat, err := os.Stat(s.tarball)
+		if err != nil {
+			return fmt.Errorf("error reading %q: %v", s.tarball, err)
+		}
+		f, err := os.Open(s.tarball)
+		if err != nil {
+			return fmt.Errorf("error opening %q: %v", s.tarball, err)
+		}
+		defer f.Close()
+
+		glog.Infof("Uploading bootstrap-vz tarball %q", s.config.BootstrapVZTarball)
+		err = target.Put(dir+".tar.gz", int(stat.Size()), f, 0644)
+		if err != nil {
+			return err
+		}
+		err = target.Mkdir(dir, 0755)
+		if err != nil {
+			return err
+		}
+		// Release tarballs have a single top-level directory
+		return target.Exec("tar", "-xzf", dir+".tar.gz", "--strip-components=1", "-C", dir)
+
+	default:
+		err := target.Exec("git", "clone", s.config.BootstrapVZRepo, dir)
+		if err != nil {
+			return err
+		}
+		return target.Exec("git", "-C", dir, "checkout", "--quiet", s.Commit)
+	}
+}
+
+// Close removes the local copy of the tarball, if we downloaded one
+func (s *BootstrapVZSource) Close() error {
+	if s.tarball != "" && s.tarball != s.config.BootstrapVZTarball {
+		return os.Remove(s.tarball)
+	}
+	return nil
+}
+
+// gitSHARegex matches a full git commit SHA
+var gitSHARegex = regexp.MustCompile("^[0-9a-f]{40}$")
+
+// ResolveBootstrapVZCommit returns the commit that the branch (or commit) of the bootstrap-vz repo refers to
+func ResolveBootstrapVZCommit(repo string, branch string) (string, error) {
+	if gitSHARegex.MatchString(branch) {
+		return branch, nil
+	}
+
+	out, err := exec.Command("git", "ls-remote", repo, branch).Output()
+	if err != nil {
+		return "", fmt.Errorf("error querying bootstrap-vz repo %q for %q: %v", repo, branch, err)
+	}
+
+	refs := make(map[string]string)
+	for _, line := range strings.Split(string(out), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) == 2 {
+			refs[fields[1]] = fields[0]
+		}
+	}
+
+	// For annotated tags, the ^{} ref is the commit (rather than the tag object)
+	for _, ref := range []string{"refs/heads/" + branch, "refs/tags/" + branch + "^{}", "refs/tags/" + branch} {
+		if sha := refs[ref]; sha != "" {
+			return sha, nil
+		}
+	}
+	return "", fmt.Errorf("branch %q not found in bootstrap-vz repo %q", branch, repo)
+}
+
+// localGitCommit returns the commit of the git tree at dir, with a -dirty suffix if there are local changes,
+// or the empty string if dir is not in a git repo
+func localGitCommit(dir string) string {
+	out, err := exec.Command("git", "-C", dir, "rev-parse", "HEAD").Output()
+	if err != nil {
+		glog.V(2).Infof("unable to determine git commit of %q: %v", dir, err)
+		return ""
+	}
+	commit := strings.TrimSpace(string(out))
+
+	status, err := exec.Command("git", "-C", dir, "status", "--porcelain").Output()
+	if err != nil || len(strings.TrimSpace(string(status))) != 0 {
+		commit += "-dirty"
+	}
+	return commit
+}
+
+// hashTree computes the hex sha256 of the paths, modes and contents of the files under dir (excluding .git)
+func hashTree(dir string) (string, error) {
+	hasher := sha256.New()
+	err := filepath.Walk(dir, func(p string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(dir, p)
+		if err != nil {
+			return err
+		}
+		if info.IsDir() {
+			if info.Name() == ".git" {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+
+		fmt.Fprintf(hasher, "%s\x00%o\x00", filepath.ToSlash(rel), info.Mode())
+		if info.Mode()&os.ModeSymlink != 0 {
+			target, err := os.Readlink(p)
+			if err != nil {
+				return err
+			}
+			fmt.Fprintf(hasher, "%s\x00", target)
+			return nil
+		}
+
+		f, err := os.Open(p)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		fmt.Fprintf(hasher, "%d\x00", info.Size())
+		_, err = io.Copy(hasher, f)
+		return err
+	})
+	if err != nil {
+		return "", fmt.Errorf("error hashing %q: %v", dir, err)
+	}
+	return hex.EncodeToString(hasher.Sum(nil)), nil
+}
+
+// fetchVerified returns the path of a local copy of the file at location (a path or http(s) URL),
+// after checking its sha256
+func fetchVerified(location string, expectedSHA256 string) (string, error) {
+	p := location
+	if strings.HasPrefix(location, "http://") || strings.HasPrefix(location, "https://") {
+		glog.Infof("Downloading %q", location)
+		response, err := http.Get(location)
+		if err != nil {
+			return "", fmt.Errorf("error downloading %q: %v", location, err)
+		}
+		defer response.Body.Close()
+		if response.StatusCode != http.StatusOK {
+			return "", fmt.Errorf("error downloading %q: %s", location, response.Status)
+		}
+
+		f, err := ioutil.TempFile("", "bootstrap-vz")
+		if err != nil {
+			return "", fmt.Errorf("error creating temp file: %v", err)
+		}
+		_, err = io.Copy(f, response.Body)
+		if closeErr := f.Close(); err == nil {
+			err = closeErr
+		}
+		if err != nil {
+			os.Remove(f.Name())
+			return "", fmt.Errorf("error downloading %q: %v", location, err)
+		}
+		p = f.Name()
+	}
+
+	f, err := os.Open(p)
+	if err != nil {
+		return "", fmt.Errorf("error opening %q: %v", p, err)
+	}
+	defer f.Close()
+	hasher := sha256.New()
+	if _, err := io.Copy(hasher, f); err != nil {
+		return "", fmt.Errorf("error reading %q: %v", p, err)
+	}
+
+	actual := hex.EncodeToString(hasher.Sum(nil))
+	if actual != strings.ToLower(expectedSHA256) {
+		if p != location {
+			os.Remove(p)
+		}
+		return "", fmt.Errorf("sha256 of %q was %s, expected %s", location, actual, expectedSHA256)
+	}
+	return p, nil
+}
@@ -3,9 +3,14 @@ package imagebuilder
 import (
 	"bytes"
 	"fmt"
+	"github.com/golang/glog"
 	"k8s.io/kube-deploy/imagebuilder/pkg/imagebuilder/executor"
 	"math/rand"
+	"os"
 	"path"
+	"sort"
+	"strings"
+	"time"
 )
 
 type Builder struct {
@@ -20,9 +25,10 @@ func NewBuilder(config *Config, target *executor.Target) *Builder {
 	}
 }
 
-func (b *Builder) RunSetupCommands() error {
-	for _, c := range b.config.SetupCommands {
-		if err := b.target.Exec(c...); err != nil {
+// runSetupCommands runs the SetupCommands on the builder
+func runSetupCommands(target *executor.Target, commands []SetupCommand) error {
+	for _, c := range commands {
+		if err := runSetupCommand(target, c); err != nil {
 			return err
 		}
 	}
@@ -30,43 +36,208 @@ func (b *Builder) RunSetupCommands() error {
 	return nil
 }
 
-func (b *Builder) BuildImage(template []byte, extraEnv map[string]string) error {
-	tmpdir := fmt.Sprintf("/tmp/imagebuilder-%d", rand.Int63())
-	err := b.target.Mkdir(tmpdir, 0755)
+// runSetupCommand runs the command, retrying according to its retry policy
+func runSetupCommand(target *executor.Target, c SetupCommand) error {
+	if len(c.Command) == 0 {
+		return fmt.Errorf("SetupCommands entry has no Command")
+	}
+
+	retryDelay := 10 * time.Second
+	if c.RetryDelay != "" {
+		d, err := time.ParseDuration(c.RetryDelay)
+		if err != nil {
+			return fmt.Errorf("invalid RetryDelay %q for command %q: %v", c.RetryDelay, c.Command, err)
+		}
+		retryDelay = d
+	}
+
+	attempt := 0
+	for {
+		err := target.Exec(c.Command...)
+		if err == nil {
+			return nil
+		}
+
+		attempt++
+		if attempt > c.Retries {
+			return err
+		}
+		glog.Warningf("Setup command %q failed (attempt %d of %d), will retry in %v: %v", c.Command, attempt, c.Retries+1, retryDelay, err)
+		time.Sleep(retryDelay)
+	}
+}
+
+// BootstrapVZBackend builds images by running bootstrap-vz with a manifest
+type BootstrapVZBackend struct {
+	config    *Config
+	template  *BootstrapVzTemplate
+	source    *BootstrapVZSource
+	imageName string
+	extraEnv  map[string]string
+
+	tmpdir string
+}
+
+var _ BuildBackend = &BootstrapVZBackend{}
+
+// NewBootstrapVZBackend builds a backend that runs bootstrap-vz from source with the template,
+// which should already have its name resolved to imageName
+func NewBootstrapVZBackend(config *Config, template *BootstrapVzTemplate, source *BootstrapVZSource, imageName string, extraEnv map[string]string) *BootstrapVZBackend {
+	return &BootstrapVZBackend{
+		config:    config,
+		template:  template,
+		source:    source,
+		imageName: imageName,
+		extraEnv:  extraEnv,
+	}
+}
+
+// Name returns the name of the backend
+func (b *BootstrapVZBackend) Name() string {
+	return BackendBootstrapVZ
+}
+
+// ImageName returns the name of the image bootstrap-vz builds
+func (b *BootstrapVZBackend) ImageName() string {
+	return b.imageName
+}
+
+// Prepare runs the setup commands, and uploads bootstrap-vz, the manifest and Files
+func (b *BootstrapVZBackend) Prepare(target *executor.Target) error {
+	err := runSetupCommands(target, b.config.SetupCommands)
 	if err != nil {
 		return err
 	}
-	defer b.target.Exec("rm", "-rf", tmpdir)
 
-	logdir := path.Join(tmpdir, "logs")
-	err = b.target.Mkdir(logdir, 0755)
+	b.tmpdir = fmt.Sprintf("/tmp/imagebuilder-%d", rand.Int63())
+	err = target.Mkdir(b.tmpdir, 0755)
 	if err != nil {
 		return err
 	}
 
-	//err = ssh.Exec("git clone https://github.com/andsens/bootstrap-vz.git " + tmpdir + "/bootstrap-vz")
-	err = b.target.Exec("git", "clone", b.config.BootstrapVZRepo, "-b", b.config.BootstrapVZBranch, tmpdir+"/bootstrap-vz")
+	err = target.Mkdir(b.logDir(), 0755)
 	if err != nil {
 		return err
 	}
 
-	err = b.target.Put(tmpdir+"/template.yml", len(template), bytes.NewReader(template), 0644)
+	glog.Infof("Using bootstrap-vz %s", b.source)
+	err = b.source.Install(target, b.tmpdir+"/bootstrap-vz")
 	if err != nil {
 		return err
 	}
 
-	// TODO: Create dir for logs, log to that dir using --log, collect logs from that dir
-	cmd := b.target.Command("./bootstrap-vz/bootstrap-vz", "--debug", "--log", logdir, "./template.yml")
-	cmd.Cwd = tmpdir
-	for k, v := range extraEnv {
+	template := b.template.Bytes()
+	err = target.Put(b.tmpdir+"/template.yml", len(template), bytes.NewReader(template), 0644)
+	if err != nil {
+		return err
+	}
+
+	return uploadFiles(target, b.config.Files, b.filesDir())
+}
+
+// Build runs bootstrap-vz
+func (b *BootstrapVZBackend) Build(target *executor.Target) error {
+	cmd := target.Command("./bootstrap-vz/bootstrap-vz", "--debug", "--log", b.logDir(), "./template.yml")
+	cmd.Cwd = b.tmpdir
+	for k, v := range b.extraEnv {
 		cmd.Env[k] = v
 	}
+	cmd.Env["IMAGEBUILDER_FILES"] = b.filesDir()
 	cmd.Sudo = true
-	err = cmd.Run()
+	// The build can take a long time, so we don't want it to depend on the connection staying up
+	cmd.Detach = true
+	return cmd.Run()
+}
+
+// CollectArtifacts copies the bootstrap-vz logs to localDir
+func (b *BootstrapVZBackend) CollectArtifacts(target *executor.Target, localDir string) error {
+	if b.tmpdir == "" {
+		return nil
+	}
+	// bootstrap-vz runs as root, so its logs are not readable by the ssh user
+	err := target.Command("chmod", "-R", "a+rX", b.logDir()).WithSudo().Run()
 	if err != nil {
 		return err
 	}
+	return target.GetDir(b.logDir(), localDir)
+}
+
+// Cleanup removes the build directory
+func (b *BootstrapVZBackend) Cleanup(target *executor.Target) error {
+	if b.tmpdir == "" {
+		return nil
+	}
+	return target.Exec("rm", "-rf", b.tmpdir)
+}
+
+func (b *BootstrapVZBackend) logDir() string {
+	return path.Join(b.tmpdir, "logs")
+}
+
+func (b *BootstrapVZBackend) filesDir() string {
+	return path.Join(b.tmpdir, "files")
+}
+
+// validateFilesKey checks that the Files key k is a relative path that stays inside the files directory
+func validateFilesKey(k string) error {
+	if k == "" || path.IsAbs(k) {
+		return fmt.Errorf("Files key %q must be a relative path", k)
+	}
+	clean := path.Clean(k)
+	if clean == "." || clean == ".." || strings.HasPrefix(clean, "../") {
+		return fmt.Errorf("Files key %q must be a path inside the files directory", k)
+	}
+	return nil
+}
+
+// uploadFiles copies the files & directories in files (see Config.Files) to filesDir on the target
+func uploadFiles(target *executor.Target, files map[string]string, filesDir string) error {
+	err := target.Mkdir(filesDir, 0755)
+	if err != nil {
+		return err
+	}
+
+	var keys []string
+	for k := range files {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	for _, k := range keys {
+		src := files[k]
+		if err := validateFilesKey(k); err != nil {
+			return err
+		}
+		dest := path.Join(filesDir, path.Clean(k))
+
+		stat, err := os.Stat(src)
+		if err != nil {
+			return fmt.Errorf("error reading file %q: %v", src, err)
+		}
+
+		if path.Dir(dest) != filesDir {
+			err = target.Exec("mkdir", "-p", path.Dir(dest))
+			if err != nil {
+				return err
+			}
+		}
+
+		glog.Infof("Uploading %q to %q", src, dest)
+		if stat.IsDir() {
+			err = target.PutDir(src, dest)
+		} else {
+			var f *os.File
+			f, err = os.Open(src)
+			if err != nil {
+				return fmt.Errorf("error opening file %q: %v", src, err)
+			}
+			err = target.Put(dest, int(stat.Size()), f, stat.Mode().Perm())
+			f.Close()
+		}
+		if err != nil {
+			return fmt.Errorf("error uploading %q: %v", src, err)
+		}
+	}
 
-	// TODO: Capture debug output file?
 	return nil
 }
@@ -0,0 +1,46 @@
+/*
+Copyright 2016 The Kubernetes Authors All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package imagebuilder
+
+import "testing"
+
+func TestValidateFilesKey(t *testing.T) {
+	grid := []struct {
+		Key   string
+		Valid bool
+	}{
+		{Key: "config", Valid: true},
+		{Key: "certs/ca.crt", Valid: true},
+		{Key: "certs/../config", Valid: true},
+		{Key: "./config", Valid: true},
+		{Key: "", Valid: false},
+		{Key: ".", Valid: false},
+		{Key: "/etc/passwd", Valid: false},
+		{Key: "..", Valid: false},
+		{Key: "../etc/passwd", Valid: false},
+		{Key: "certs/../../etc/passwd", Valid: false},
+	}
+	for _, g := range grid {
+		err := validateFilesKey(g.Key)
+		if g.Valid && err != nil {
+			t.Errorf("expected %q to be valid, was %v", g.Key, err)
+		}
+		if !g.Valid && err == nil {
+			t.Errorf("expected %q to be rejected", g.Key)
+		}
+	}
+}
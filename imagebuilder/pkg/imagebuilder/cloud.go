@@ -10,11 +10,22 @@ type Cloud interface {
 	CreateInstance() (Instance, error)
 
 	FindImage(imageName string) (Image, error)
+	// FindImageByHash finds an image tagged with the content hash (see ImageIdentity)
+	FindImageByHash(hash string) (Image, error)
 
 	GetExtraEnv() (map[string]string, error)
+
+	// ListImages lists the images we own that match the filter, in all regions
+	ListImages(filter ImageFilter) ([]*ImageInfo, error)
+	// DescribeImage describes the image in all regions, including its launch permissions, or returns nil if not found
+	DescribeImage(imageName string) (*ImageInfo, error)
+	// DeleteImage deletes the image (and its copies in other regions, and its snapshots)
+	DeleteImage(imageName string) error
 }
 
 type Instance interface {
+	// ID identifies the instance on the cloud
+	ID() string
 	DialSSH(config *ssh.ClientConfig) (executor.Executor, error)
 	Shutdown() error
 }
@@ -25,5 +36,9 @@ type Image interface {
 	// Adds the specified tags to the image
 	AddTags(tags map[string]string) error
 
-	ReplicateImage(makePublic bool) (map[string]Image, error)
+	// ReplicateImage copies the image to all regions, calling progress (if not nil) as each copy is made or made public
+	ReplicateImage(makePublic bool, progress ReplicationProgress) (map[string]Image, error)
 }
+
+// ReplicationProgress is called by ReplicateImage for each region's copy of the image
+type ReplicationProgress func(region string, image Image, public bool)
@@ -0,0 +1,328 @@
+/*
+Copyright 2016 The Kubernetes Authors All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package imagebuilder
+
+import (
+	"fmt"
+	"path"
+	"reflect"
+	"strconv"
+	"strings"
+
+	"gopkg.in/yaml.v2"
+)
+
+// compositionKey is the top-level key in a template that declares its base and overlays.
+// It is removed from the merged manifest.
+const compositionKey = "imagebuilder"
+
+// maxCompositionDepth guards against cycles in base / overlay references
+const maxCompositionDepth = 10
+
+// Directives that can be used in overlays
+const (
+	// directiveAdd appends items to a list
+	directiveAdd = "$add"
+	// directiveRemove removes items from a list, or keys from a map
+	directiveRemove = "$remove"
+	// directiveReplace replaces a list, before $add and $remove are applied
+	directiveReplace = "$replace"
+)
+
+// TemplateSource is one file that contributes to a template
+type TemplateSource struct {
+	// Path is the path of the file
+	Path string
+	// Source is the unexpanded contents of the file
+	Source string
+	// Expanded is the contents after go-template expansion
+	Expanded string
+}
+
+// ComposedTemplate is a template built by merging a base template and overlays
+type ComposedTemplate struct {
+	// Sources are the files that were merged, in merge order
+	Sources []*TemplateSource
+	// Manifest is the merged bootstrap-vz manifest
+	Manifest string
+}
+
+// TemplateParseError is returned when a template file is not valid YAML after expansion
+type TemplateParseError struct {
+	Path string
+	// Line is the line in the unexpanded file, or 0 if not known
+	Line int
+	Err  error
+}
+
+func (e *TemplateParseError) Error() string {
+	return fmt.Sprintf("error parsing template %q: %v", e.Path, e.Err)
+}
+
+// composition is the value of the compositionKey
+type composition struct {
+	// Base is the template this template is layered on
+	Base string `yaml:"base"`
+	// Overlays are applied in order on top of the base, before the rest of this file
+	Overlays []string `yaml:"overlays"`
+}
+
+// LoadTemplate expands the template at p, and merges it with its base and overlays if it declares them.
+// A template without an imagebuilder section is returned unchanged.
+func LoadTemplate(p string, context interface{}, strict bool) (*ComposedTemplate, error) {
+	c := &ComposedTemplate{}
+
+	manifest, err := c.load(p, context, strict, 0)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(c.Sources) == 1 {
+		// Not composed; keep the file as written, so comments are preserved for bootstrap-vz logs
+		c.Manifest = c.Sources[0].Expanded
+		return c, nil
+	}
+
+	data, err := yaml.Marshal(manifest)
+	if err != nil {
+		return nil, fmt.Errorf("error serializing merged template: %v", err)
+	}
+	c.Manifest = "---\n" + string(data)
+	return c, nil
+}
+
+// load expands the file at p and its base & overlays, returning the merged manifest
+func (c *ComposedTemplate) load(p string, context interface{}, strict bool, depth int) (map[interface{}]interface{}, error) {
+	if depth > maxCompositionDepth {
+		return nil, fmt.Errorf("template %q: base and overlays are nested too deeply (is there a cycle?)", p)
+	}
+
+	raw, err := ReadFile(p)
+	if err != nil {
+		return nil, err
+	}
+
+	expanded, err := ExpandTemplate(p, string(raw), context, strict)
+	if err != nil {
+		return nil, err
+	}
+
+	data := make(map[interface{}]interface{})
+	err = yaml.Unmarshal([]byte(expanded), &data)
+	if err != nil {
+		parseError := &TemplateParseError{Path: p, Err: err}
+		if match := yamlErrorLine.FindStringSubmatch(err.Error()); match != nil {
+			line, _ := strconv.Atoi(match[1])
+			lineMap := mapExpandedLines(strings.Split(string(raw), "\n"), strings.Split(expanded, "\n"))
+			if line >= 1 && line <= len(lineMap) {
+				parseError.Line = lineMap[line-1] + 1
+			}
+		}
+		return nil, parseError
+	}
+
+	source := &TemplateSource{
+		Path:     p,
+		Source:   string(raw),
+		Expanded: expanded,
+	}
+
+	compositionData, found := data[compositionKey]
+	if !found {
+		c.Sources = append(c.Sources, source)
+		return data, nil
+	}
+	delete(data, compositionKey)
+
+	comp := &composition{}
+	{
+		b, err := yaml.Marshal(compositionData)
+		if err != nil {
+			return nil, fmt.Errorf("error reading %s section of %q: %v", compositionKey, p, err)
+		}
+		if err := yaml.Unmarshal(b, comp); err != nil {
+			return nil, fmt.Errorf("error reading %s section of %q: %v", compositionKey, p, err)
+		}
+	}
+
+	resolve := func(ref string) string {
+		if path.IsAbs(ref) {
+			return ref
+		}
+		return path.Join(path.Dir(p), ref)
+	}
+
+	var merged interface{}
+	if comp.Base != "" {
+		base, err := c.load(resolve(comp.Base), context, strict, depth+1)
+		if err != nil {
+			return nil, err
+		}
+		merged, err = mergeManifest(nil, nil, base)
+		if err != nil {
+			return nil, fmt.Errorf("error merging base %q: %v", resolve(comp.Base), err)
+		}
+	}
+
+	for _, overlay := range comp.Overlays {
+		o, err := c.load(resolve(overlay), context, strict, depth+1)
+		if err != nil {
+			return nil, err
+		}
+		merged, err = mergeManifest(nil, merged, o)
+		if err != nil {
+			return nil, fmt.Errorf("error merging overlay %q: %v", resolve(overlay), err)
+		}
+	}
+
+	c.Sources = append(c.Sources, source)
+	merged, err = mergeManifest(nil, merged, data)
+	if err != nil {
+		return nil, fmt.Errorf("error merging %q: %v", p, err)
+	}
+
+	m, ok := merged.(map[interface{}]interface{})
+	if !ok {
+		return nil, fmt.Errorf("merged template %q is not a map", p)
+	}
+	return m, nil
+}
+
+// mergeManifest merges overlay on top of base:
+// maps are merged recursively, and lists & scalars in the overlay replace the base value.
+// A map of directives ($add, $remove, $replace) in the overlay modifies a list in the base,
+// and $remove in a map removes the listed keys from the base map.
+func mergeManifest(p []string, base interface{}, overlay interface{}) (interface{}, error) {
+	overlayMap, ok := overlay.(map[interface{}]interface{})
+	if !ok {
+		return overlay, nil
+	}
+
+	switch base := base.(type) {
+	case []interface{}:
+		return mergeList(p, base, overlayMap)
+
+	case nil:
+		if _, isList := overlayMap[directiveAdd]; isList {
+			return mergeList(p, nil, overlayMap)
+		}
+		if _, isList := overlayMap[directiveReplace]; isList {
+			return mergeList(p, nil, overlayMap)
+		}
+		return mergeMap(p, nil, overlayMap)
+
+	case map[interface{}]interface{}:
+		return mergeMap(p, base, overlayMap)
+
+	default:
+		// A map replaces a scalar
+		return mergeMap(p, nil, overlayMap)
+	}
+}
+
+func mergeMap(p []string, base map[interface{}]interface{}, overlay map[interface{}]interface{}) (interface{}, error) {
+	merged := make(map[interface{}]interface{})
+	for k, v := range base {
+		merged[k] = v
+	}
+
+	for k, v := range overlay {
+		key := fmt.Sprintf("%v", k)
+		if key == directiveRemove {
+			keys, ok := v.([]interface{})
+			if !ok {
+				return nil, fmt.Errorf("%s: %s must be a list of keys", formatPath(p), directiveRemove)
+			}
+			for _, removeKey := range keys {
+				if _, found := merged[removeKey]; !found {
+					return nil, fmt.Errorf("%s: cannot remove %q, which is not set", formatPath(p), removeKey)
+				}
+				delete(merged, removeKey)
+			}
+			continue
+		}
+		if strings.HasPrefix(key, "$") {
+			return nil, fmt.Errorf("%s: %s can only be used on a list", formatPath(append(p, key)), key)
+		}
+
+		child, err := mergeManifest(append(p, key), merged[k], v)
+		if err != nil {
+			return nil, err
+		}
+		merged[k] = child
+	}
+
+	return merged, nil
+}
+
+func mergeList(p []string, base []interface{}, directives map[interface{}]interface{}) (interface{}, error) {
+	getList := func(directive string) ([]interface{}, error) {
+		v, found := directives[directive]
+		if !found {
+			return nil, nil
+		}
+		l, ok := v.([]interface{})
+		if !ok {
+			return nil, fmt.Errorf("%s: %s must be a list", formatPath(p), directive)
+		}
+		return l, nil
+	}
+
+	for k := range directives {
+		switch k {
+		case directiveAdd, directiveRemove, directiveReplace:
+		default:
+			return nil, fmt.Errorf("%s: unknown list directive %q (expected %s, %s or %s)", formatPath(p), k, directiveAdd, directiveRemove, directiveReplace)
+		}
+	}
+
+	merged := append([]interface{}(nil), base...)
+
+	if replace, err := getList(directiveReplace); err != nil {
+		return nil, err
+	} else if replace != nil {
+		merged = append([]interface{}(nil), replace...)
+	}
+
+	remove, err := getList(directiveRemove)
+	if err != nil {
+		return nil, err
+	}
+	for _, r := range remove {
+		var kept []interface{}
+		found := false
+		for _, item := range merged {
+			if reflect.DeepEqual(item, r) {
+				found = true
+				continue
+			}
+			kept = append(kept, item)
+		}
+		if !found {
+			return nil, fmt.Errorf("%s: cannot remove %v, which is not in the list", formatPath(p), r)
+		}
+		merged = kept
+	}
+
+	add, err := getList(directiveAdd)
+	if err != nil {
+		return nil, err
+	}
+	merged = append(merged, add...)
+
+	return merged, nil
+}
@@ -1,24 +1,82 @@
 package imagebuilder
 
 import (
+	"encoding/json"
+	"fmt"
 	"github.com/golang/glog"
+	"sort"
+	"strconv"
 	"strings"
+	"time"
 )
 
 type Config struct {
 	Cloud         string
 	TemplatePath  string
-	SetupCommands [][]string
+	SetupCommands []SetupCommand
 
 	BootstrapVZRepo   string
 	BootstrapVZBranch string
+	// BootstrapVZCommit pins the build to a commit of BootstrapVZRepo, instead of the tip of BootstrapVZBranch
+	BootstrapVZCommit string
+	// BootstrapVZTarball is the path or http(s) URL of a bootstrap-vz release tarball, used instead of git
+	BootstrapVZTarball string
+	// BootstrapVZTarballSHA256 is the expected sha256 of BootstrapVZTarball
+	BootstrapVZTarballSHA256 string
+	// BootstrapVZPath is a local bootstrap-vz tree (relative to the config file) that is uploaded to the builder
+	BootstrapVZPath string
 
 	SSHUsername   string
 	SSHPublicKey  string
 	SSHPrivateKey string
 
+	// SSHAgent enables authentication using the SSH agent at SSH_AUTH_SOCK
+	SSHAgent bool
+	// SSHProxy is a socks5:// or http:// (CONNECT) proxy URL, used to reach the instance or first jump host
+	SSHProxy string
+	// SSHJumpHosts are bastions through which we reach the instance, in order (like ssh ProxyJump)
+	SSHJumpHosts []SSHJumpHost
+
+	// DockerImage is the image used for the build container, when building with --docker
+	DockerImage string
+	// DockerSocket is the path to the docker daemon's unix socket
+	DockerSocket string
+
+	// PrivateIP launches the instance without a public IP, and connects to its private IP
+	PrivateIP bool
+
 	// Tags to add to the image
 	Tags map[string]string
+
+	// StrictTemplates makes template expansion fail on references to undefined keys, instead of expanding them to empty
+	StrictTemplates bool
+	// TemplateVars declares the variables available to the template as .Vars
+	TemplateVars map[string]TemplateVar
+	// Vars holds the resolved values of TemplateVars; it is set by ResolveTemplateVars
+	Vars map[string]interface{} `json:"-"`
+
+	// Backend selects how images are built: bootstrap-vz (the default), provision, or ebs (on AWS).
+	// Images for the container cloud are always built with the container backend.
+	Backend string
+	// ImageName is the name of images built by the provision backend, which can use the same {...}
+	// references as a template name (except for manifest values)
+	ImageName string
+	// ProvisionSteps are run on the builder instance by the provision backend, before it is saved as the image
+	ProvisionSteps []ProvisionStep
+
+	// ExtraPackages are added to the packages installed by the template
+	ExtraPackages []string
+	// ExtraCommands are run (by the commands plugin) after the template's commands
+	ExtraCommands [][]string
+
+	// Files are local files or directories to upload to the builder before building.
+	// The key is the path under the files directory (exported to the build as IMAGEBUILDER_FILES),
+	// the value is the local path (relative to the config file).
+	Files map[string]string
+
+	// BaseImagePinFile records the image each base image query resolved to (relative to the config file),
+	// so that builds use the same base image until the pins are updated with --update-pins
+	BaseImagePinFile string
 }
 
 func (c *Config) InitDefaults() {
@@ -29,31 +87,248 @@ func (c *Config) InitDefaults() {
 	c.SSHPublicKey = "~/.ssh/id_rsa.pub"
 	c.SSHPrivateKey = "~/.ssh/id_rsa"
 
+	c.DockerImage = "debian:jessie"
+	c.DockerSocket = "/var/run/docker.sock"
+
+	// These all hit the network, so we retry them
 	setupCommands := []string{
 		"sudo apt-get update",
 		"sudo apt-get install --yes git python debootstrap python-pip kpartx parted",
 		"sudo pip install termcolor jsonschema fysom docopt pyyaml boto",
 	}
 	for _, cmd := range setupCommands {
-		c.SetupCommands = append(c.SetupCommands, strings.Split(cmd, " "))
+		c.SetupCommands = append(c.SetupCommands, SetupCommand{
+			Command:    strings.Split(cmd, " "),
+			Retries:    3,
+			RetryDelay: "10s",
+		})
+	}
+}
+
+// Validate checks the config for problems that would stop a build, without contacting the cloud
+func (c *Config) Validate() []error {
+	var errors []error
+
+	switch c.Cloud {
+	case "aws", "gce", "container":
+	case "":
+		errors = append(errors, fmt.Errorf("Cloud not set"))
+	default:
+		errors = append(errors, fmt.Errorf("unknown Cloud %q", c.Cloud))
+	}
+
+	switch c.Backend {
+	case "", BackendBootstrapVZ, BackendContainer, BackendEBS:
+		if c.TemplatePath == "" {
+			errors = append(errors, fmt.Errorf("TemplatePath must be provided"))
+		}
+	case BackendProvision:
+		if c.ImageName == "" {
+			errors = append(errors, fmt.Errorf("ImageName must be provided for the %s backend", BackendProvision))
+		}
+		if len(c.ProvisionSteps) == 0 {
+			errors = append(errors, fmt.Errorf("ProvisionSteps must be provided for the %s backend", BackendProvision))
+		}
+		for i := range c.ProvisionSteps {
+			if err := c.ProvisionSteps[i].validate(); err != nil {
+				errors = append(errors, err)
+			}
+		}
+	default:
+		errors = append(errors, fmt.Errorf("unknown Backend %q", c.Backend))
+	}
+	if c.Backend == BackendEBS && c.Cloud != "aws" {
+		errors = append(errors, fmt.Errorf("the %s backend can only be used with the aws cloud", BackendEBS))
+	}
+	if c.Cloud == "container" && c.Backend != "" && c.Backend != BackendContainer {
+		errors = append(errors, fmt.Errorf("Backend %q is not supported for containers", c.Backend))
+	}
+	if c.Backend == BackendContainer && c.Cloud != "container" {
+		errors = append(errors, fmt.Errorf("the %s backend can only be used with the container cloud", BackendContainer))
+	}
+
+	for _, sc := range c.SetupCommands {
+		if len(sc.Command) == 0 {
+			errors = append(errors, fmt.Errorf("SetupCommands entry has no Command"))
+		}
+		if sc.Retries < 0 {
+			errors = append(errors, fmt.Errorf("Retries for command %q must not be negative, was %d", sc.Command, sc.Retries))
+		}
+		if sc.RetryDelay != "" {
+			if d, err := time.ParseDuration(sc.RetryDelay); err != nil {
+				errors = append(errors, fmt.Errorf("invalid RetryDelay %q for command %q", sc.RetryDelay, sc.Command))
+			} else if d < 0 {
+				errors = append(errors, fmt.Errorf("RetryDelay for command %q must not be negative, was %q", sc.Command, sc.RetryDelay))
+			}
+		}
+	}
+
+	var fileKeys []string
+	for k := range c.Files {
+		fileKeys = append(fileKeys, k)
+	}
+	sort.Strings(fileKeys)
+	for _, k := range fileKeys {
+		if err := validateFilesKey(k); err != nil {
+			errors = append(errors, err)
+		}
+	}
+
+	if c.BootstrapVZPath != "" && c.BootstrapVZTarball != "" {
+		errors = append(errors, fmt.Errorf("only one of BootstrapVZPath and BootstrapVZTarball can be set"))
+	}
+	if c.BootstrapVZTarball != "" && c.BootstrapVZTarballSHA256 == "" {
+		errors = append(errors, fmt.Errorf("BootstrapVZTarballSHA256 must be set when using BootstrapVZTarball"))
+	}
+	if c.BootstrapVZCommit != "" && !gitSHARegex.MatchString(c.BootstrapVZCommit) {
+		errors = append(errors, fmt.Errorf("BootstrapVZCommit must be a full (40 character) commit SHA, was %q", c.BootstrapVZCommit))
+	}
+
+	return errors
+}
+
+// TemplateVar declares a variable for use in templates
+type TemplateVar struct {
+	// Type is one of string (the default), int or bool
+	Type string
+	// Default is the value used if the variable is not set with --set; if there is no default, the variable is unset
+	Default interface{}
+	// Description documents the variable
+	Description string
+}
+
+// ResolveTemplateVars sets Vars from the declared TemplateVars, applying overrides (from --set).
+// Overrides must be for declared variables, and all values must be valid for the declared type.
+func (c *Config) ResolveTemplateVars(overrides map[string]string) error {
+	c.Vars = make(map[string]interface{})
+
+	for k := range overrides {
+		if _, found := c.TemplateVars[k]; !found {
+			return fmt.Errorf("template variable %q is not declared in TemplateVars", k)
+		}
+	}
+
+	for k, v := range c.TemplateVars {
+		var s string
+		if override, found := overrides[k]; found {
+			s = override
+		} else if v.Default != nil {
+			s = fmt.Sprintf("%v", v.Default)
+		} else {
+			// Declared but without a value; templates can use default or required
+			c.Vars[k] = nil
+			continue
+		}
+
+		switch v.Type {
+		case "", "string":
+			c.Vars[k] = s
+		case "int":
+			n, err := strconv.Atoi(s)
+			if err != nil {
+				return fmt.Errorf("template variable %q must be an int, was %q", k, s)
+			}
+			c.Vars[k] = n
+		case "bool":
+			b, err := strconv.ParseBool(s)
+			if err != nil {
+				return fmt.Errorf("template variable %q must be a bool, was %q", k, s)
+			}
+			c.Vars[k] = b
+		default:
+			return fmt.Errorf("template variable %q has unknown type %q", k, v.Type)
+		}
 	}
+
+	return nil
+}
+
+// SetupCommand is a command that is run on the builder before the build.
+// In the config it can be written either as a list of arguments, or as an object with a retry policy.
+type SetupCommand struct {
+	Command []string
+
+	// Retries is the number of times the command is retried if it fails
+	Retries int
+	// RetryDelay is the time to wait between attempts (e.g. "10s")
+	RetryDelay string
+}
+
+// UnmarshalJSON accepts either a list of arguments, or a full SetupCommand object
+func (c *SetupCommand) UnmarshalJSON(data []byte) error {
+	var argv []string
+	if err := json.Unmarshal(data, &argv); err == nil {
+		*c = SetupCommand{Command: argv}
+		return nil
+	}
+
+	// Use a different type to avoid recursing into this method
+	type setupCommand SetupCommand
+	var o setupCommand
+	if err := json.Unmarshal(data, &o); err != nil {
+		return fmt.Errorf("SetupCommands entries must be a list of arguments, or an object with Command: %v", err)
+	}
+	*c = SetupCommand(o)
+	return nil
 }
 
 type AWSConfig struct {
 	Config
 
-	Region          string
-	ImageID         string
+	Region  string
+	ImageID string
+	// ImageQuery selects the newest matching image as the base image; it takes precedence over ImageID
+	ImageQuery      *AWSImageQuery
 	InstanceType    string
 	SSHKeyName      string
 	SubnetID        string
 	SecurityGroupID string
+	// MachineName is the Name tag of the builder instance; if it is set, only an instance with the name is reused
+	MachineName string
+
+	// Volume configures the image's root volume, for the ebs backend
+	Volume AWSVolumeConfig
+}
+
+// AWSImageQuery selects an AMI by owner, name and architecture
+type AWSImageQuery struct {
+	// Owner is the account ID (or alias, e.g. amazon) that owns the image
+	Owner string
+	// Name is the image name, which can contain * and ? wildcards (e.g. debian-stretch-hvm-x86_64-gp2-*)
+	Name string
+	// Architecture is the image architecture, x86_64 by default
+	Architecture string
+}
+
+// AWSVolumeConfig configures the EBS volume that the ebs backend builds on, and the AMI registered from it
+type AWSVolumeConfig struct {
+	// Size is the size of the volume in GB
+	Size int64
+	// Type is the EBS volume type (e.g. gp2, io1)
+	Type string
+	// IOPS is the provisioned IOPS, for io1 volumes
+	IOPS int64
+	// Encrypted encrypts the volume, and so the snapshot, with KMSKeyID (or the default EBS key)
+	Encrypted bool
+	KMSKeyID  string
+	// ENASupport marks the image as supporting the Elastic Network Adapter
+	ENASupport bool
+	// SriovNetSupport is the enhanced networking mode of the image ("simple", or empty for none)
+	SriovNetSupport string
+	// BootMode is how the image boots; only legacy-bios (with grub) is supported
+	BootMode string
 }
 
 func (c *AWSConfig) InitDefaults(region string) {
 	c.Config.InitDefaults()
 	c.InstanceType = "m3.medium"
 
+	c.Volume.Size = 8
+	c.Volume.Type = "gp2"
+	c.Volume.ENASupport = true
+	c.Volume.SriovNetSupport = "simple"
+	c.Volume.BootMode = AWSBootModeLegacyBIOS
+
 	if region == "" {
 		region = "us-east-1"
 	}
@@ -88,7 +363,7 @@ func (c *AWSConfig) InitDefaults(region string) {
 		c.ImageID = "ami-98e114f8"
 
 	default:
-		glog.Warningf("Building in unknown region %q - will require specifying an image, may not work correctly")
+		glog.Warningf("Building in unknown region %q - will require specifying an image (ImageID or ImageQuery), may not work correctly", c.Region)
 	}
 }
 
@@ -104,6 +379,10 @@ type GCEConfig struct {
 
 	MachineType string
 	Image       string
+	// ImageFamily selects the newest image in the family as the base image; it takes precedence over Image
+	ImageFamily string
+	// ImageProject is the project of ImageFamily (e.g. debian-cloud), Project by default
+	ImageProject string
 }
 
 func (c *GCEConfig) InitDefaults() {
@@ -113,3 +392,16 @@ func (c *GCEConfig) InitDefaults() {
 	c.MachineType = "n1-standard-2"
 	c.Image = "https://www.googleapis.com/compute/v1/projects/debian-cloud/global/images/debian-8-jessie-v20160329"
 }
+
+// ContainerConfig is the configuration for building a container (OCI) image instead of a cloud image
+type ContainerConfig struct {
+	Config
+
+	// OutputDir is the local directory where the OCI image tarball is written
+	OutputDir string
+}
+
+func (c *ContainerConfig) InitDefaults() {
+	c.Config.InitDefaults()
+	c.OutputDir = "."
+}
@@ -0,0 +1,117 @@
+/*
+Copyright 2016 The Kubernetes Authors All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package imagebuilder
+
+import (
+	"encoding/json"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestSetupCommandUnmarshalJSON(t *testing.T) {
+	grid := []struct {
+		JSON        string
+		Expected    SetupCommand
+		ExpectError string
+	}{
+		{
+			JSON:     `["apt-get", "update"]`,
+			Expected: SetupCommand{Command: []string{"apt-get", "update"}},
+		},
+		{
+			JSON:     `{"Command": ["apt-get", "update"], "Retries": 3, "RetryDelay": "10s"}`,
+			Expected: SetupCommand{Command: []string{"apt-get", "update"}, Retries: 3, RetryDelay: "10s"},
+		},
+		{
+			JSON:     `{"Command": ["true"]}`,
+			Expected: SetupCommand{Command: []string{"true"}},
+		},
+		{
+			JSON:        `"apt-get update"`,
+			ExpectError: "must be a list of arguments, or an object with Command",
+		},
+		{
+			JSON:        `{"Command": ["true"], "Retries": "three"}`,
+			ExpectError: "must be a list of arguments, or an object with Command",
+		},
+	}
+	for _, g := range grid {
+		var actual SetupCommand
+		err := json.Unmarshal([]byte(g.JSON), &actual)
+		if g.ExpectError != "" {
+			if err == nil || !strings.Contains(err.Error(), g.ExpectError) {
+				t.Errorf("%s: expected error containing %q, got %v", g.JSON, g.ExpectError, err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: unexpected error: %v", g.JSON, err)
+			continue
+		}
+		if !reflect.DeepEqual(actual, g.Expected) {
+			t.Errorf("%s: expected %+v, got %+v", g.JSON, g.Expected, actual)
+		}
+	}
+}
+
+func TestValidateSetupCommands(t *testing.T) {
+	grid := []struct {
+		Command     SetupCommand
+		ExpectError string
+	}{
+		{
+			Command: SetupCommand{Command: []string{"true"}},
+		},
+		{
+			Command: SetupCommand{Command: []string{"true"}, Retries: 3, RetryDelay: "10s"},
+		},
+		{
+			Command:     SetupCommand{},
+			ExpectError: "SetupCommands entry has no Command",
+		},
+		{
+			Command:     SetupCommand{Command: []string{"true"}, Retries: -1},
+			ExpectError: "Retries for command",
+		},
+		{
+			Command:     SetupCommand{Command: []string{"true"}, RetryDelay: "soon"},
+			ExpectError: "invalid RetryDelay",
+		},
+		{
+			Command:     SetupCommand{Command: []string{"true"}, RetryDelay: "-10s"},
+			ExpectError: "RetryDelay for command",
+		},
+	}
+	for _, g := range grid {
+		c := &Config{
+			Cloud:         "container",
+			TemplatePath:  "template.yml",
+			SetupCommands: []SetupCommand{g.Command},
+		}
+		errors := c.Validate()
+		if g.ExpectError == "" {
+			if len(errors) != 0 {
+				t.Errorf("%+v: unexpected errors: %v", g.Command, errors)
+			}
+			continue
+		}
+		if len(errors) != 1 || !strings.Contains(errors[0].Error(), g.ExpectError) {
+			t.Errorf("%+v: expected an error containing %q, got %v", g.Command, g.ExpectError, errors)
+		}
+	}
+}
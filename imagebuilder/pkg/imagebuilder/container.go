@@ -0,0 +1,289 @@
+/*
+Copyright 2016 The Kubernetes Authors All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package imagebuilder
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/golang/glog"
+	"k8s.io/kube-deploy/imagebuilder/pkg/imagebuilder/executor"
+)
+
+// ContainerCloud builds images as OCI image tarballs on the local machine
+type ContainerCloud struct {
+	config *ContainerConfig
+}
+
+var _ Cloud = &ContainerCloud{}
+var _ Doctor = &ContainerCloud{}
+
+// Doctor checks that image tarballs can be written to the OutputDir
+func (c *ContainerCloud) Doctor() []*Check {
+	return []*Check{CheckWriteAccess("output dir", strings.TrimSuffix(c.config.OutputDir, "/")+"/")}
+}
+
+func NewContainerCloud(config *ContainerConfig) *ContainerCloud {
+	return &ContainerCloud{config: config}
+}
+
+// ImagePath returns the path of the OCI image tarball for the named image
+func (c *ContainerCloud) ImagePath(imageName string) string {
+	return filepath.Join(c.config.OutputDir, imageName+".tar")
+}
+
+// GetInstance returns the local machine; there is no builder instance for containers
+func (c *ContainerCloud) GetInstance() (Instance, error) {
+	return &LocalhostInstance{cloud: c}, nil
+}
+
+// CreateInstance returns the local machine; there is no builder instance for containers
+func (c *ContainerCloud) CreateInstance() (Instance, error) {
+	return &LocalhostInstance{cloud: c}, nil
+}
+
+// FindImage checks for an existing image tarball in the output directory
+func (c *ContainerCloud) FindImage(imageName string) (Image, error) {
+	p := c.ImagePath(imageName)
+	_, err := os.Stat(p)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("error checking for image %q: %v", p, err)
+	}
+	return &ContainerImage{path: p}, nil
+}
+
+// FindImageByHash checks the image tarballs in the output directory for one with the content hash label
+func (c *ContainerCloud) FindImageByHash(hash string) (Image, error) {
+	paths, err := filepath.Glob(filepath.Join(c.config.OutputDir, "*.tar"))
+	if err != nil {
+		return nil, fmt.Errorf("error listing images in %q: %v", c.config.OutputDir, err)
+	}
+
+	for _, p := range paths {
+		labels, err := readOCIImageLabels(p)
+		if err != nil {
+			glog.Warningf("ignoring %q: %v", p, err)
+			continue
+		}
+		if labels[ContentHashTag] == hash {
+			return &ContainerImage{path: p}, nil
+		}
+	}
+	return nil, nil
+}
+
+// ListImages lists the image tarballs in the output directory, with their labels as tags
+func (c *ContainerCloud) ListImages(filter ImageFilter) ([]*ImageInfo, error) {
+	paths, err := filepath.Glob(filepath.Join(c.config.OutputDir, "*.tar"))
+	if err != nil {
+		return nil, fmt.Errorf("error listing images in %q: %v", c.config.OutputDir, err)
+	}
+
+	infos := make(imageInfoMap)
+	for _, p := range paths {
+		name := strings.TrimSuffix(filepath.Base(p), ".tar")
+		if (filter.Name != "" && name != filter.Name) || !strings.HasPrefix(name, filter.Family) {
+			continue
+		}
+
+		stat, err := os.Stat(p)
+		if err != nil {
+			return nil, fmt.Errorf("error reading %q: %v", p, err)
+		}
+		labels, err := readOCIImageLabels(p)
+		if err != nil {
+			glog.Warningf("ignoring %q: %v", p, err)
+			continue
+		}
+		infos.add(name, stat.ModTime().UTC().Format(time.RFC3339), labels, &ImageRegionInfo{ID: p}, true)
+	}
+	return infos.list(&filter), nil
+}
+
+// DescribeImage describes the image tarball
+func (c *ContainerCloud) DescribeImage(imageName string) (*ImageInfo, error) {
+	images, err := c.ListImages(ImageFilter{Name: imageName})
+	if err != nil {
+		return nil, err
+	}
+	if len(images) == 0 {
+		return nil, nil
+	}
+	return images[0], nil
+}
+
+// DeleteImage removes the image tarball
+func (c *ContainerCloud) DeleteImage(imageName string) error {
+	p := c.ImagePath(imageName)
+	glog.Infof("Deleting %q", p)
+	if err := os.Remove(p); err != nil {
+		return fmt.Errorf("error deleting image %q: %v", p, err)
+	}
+	return nil
+}
+
+func (c *ContainerCloud) GetExtraEnv() (map[string]string, error) {
+	return make(map[string]string), nil
+}
+
+// ContainerImage is an OCI image tarball on the local machine
+type ContainerImage struct {
+	path string
+}
+
+var _ Image = &ContainerImage{}
+
+// String returns a string representation of the image
+func (i *ContainerImage) String() string {
+	return "ContainerImage[path=" + i.path + "]"
+}
+
+// EnsurePublic is not supported; the tarball should be pushed to a registry
+func (i *ContainerImage) EnsurePublic() error {
+	return fmt.Errorf("publishing is not supported for container images")
+}
+
+// AddTags is a no-op: Tags are set as image labels when the image is built
+func (i *ContainerImage) AddTags(tags map[string]string) error {
+	glog.Infof("Labels are set when container images are built; not adding tags to %q", i.path)
+	return nil
+}
+
+// ReplicateImage is a no-op: container images are not regional
+func (i *ContainerImage) ReplicateImage(makePublic bool, progress ReplicationProgress) (map[string]Image, error) {
+	return map[string]Image{}, nil
+}
+
+// ContainerBackend builds a rootfs from the template with debootstrap and the commands plugin,
+// and writes it as an OCI image tarball.
+// Kernel, bootloader & volume steps are skipped.
+type ContainerBackend struct {
+	config    *Config
+	template  *BootstrapVzTemplate
+	imageName string
+	labels    map[string]string
+	output    string
+
+	tmpdir string
+}
+
+var _ BuildBackend = &ContainerBackend{}
+
+// NewContainerBackend builds a backend that builds the template as a container image, written to output
+func NewContainerBackend(config *Config, template *BootstrapVzTemplate, imageName string, labels map[string]string, output string) *ContainerBackend {
+	return &ContainerBackend{
+		config:    config,
+		template:  template,
+		imageName: imageName,
+		labels:    labels,
+		output:    output,
+	}
+}
+
+// Name returns the name of the backend
+func (b *ContainerBackend) Name() string {
+	return BackendContainer
+}
+
+// ImageName returns the name of the image
+func (b *ContainerBackend) ImageName() string {
+	return b.imageName
+}
+
+// Prepare runs the setup commands (to install debootstrap), and creates the build directory
+func (b *ContainerBackend) Prepare(target *executor.Target) error {
+	err := runSetupCommands(target, b.config.SetupCommands)
+	if err != nil {
+		return err
+	}
+
+	b.tmpdir = fmt.Sprintf("/tmp/imagebuilder-%d", rand.Int63())
+	return target.Mkdir(b.tmpdir, 0755)
+}
+
+// CollectArtifacts does nothing; the image is the only output
+func (b *ContainerBackend) CollectArtifacts(target *executor.Target, localDir string) error {
+	return nil
+}
+
+// Cleanup removes the build directory, including the rootfs
+func (b *ContainerBackend) Cleanup(target *executor.Target) error {
+	if b.tmpdir == "" {
+		return nil
+	}
+	return target.Command("rm", "-rf", b.tmpdir).WithSudo().Run()
+}
+
+// Build builds the rootfs and writes the image
+func (b *ContainerBackend) Build(target *executor.Target) error {
+	template := b.template
+	tmpdir := b.tmpdir
+
+	spec, err := loadRootfsSpec(template)
+	if err != nil {
+		return err
+	}
+
+	rootfs := path.Join(tmpdir, "rootfs")
+	err = buildRootfs(target, spec, rootfs, tmpdir, false, nil)
+	if err != nil {
+		return err
+	}
+
+	layerPath := path.Join(tmpdir, "layer.tar")
+	err = target.Command("tar", "--numeric-owner", "-C", rootfs, "-cf", layerPath, ".").WithSudo().Run()
+	if err != nil {
+		return err
+	}
+	err = target.Command("chmod", "0644", layerPath).WithSudo().Run()
+	if err != nil {
+		return err
+	}
+
+	layer, err := ioutil.TempFile("", "imagebuilder-rootfs")
+	if err != nil {
+		return fmt.Errorf("error creating temp file: %v", err)
+	}
+	defer os.Remove(layer.Name())
+	defer layer.Close()
+
+	glog.Infof("Downloading rootfs from %q", layerPath)
+	err = target.Get(layerPath, layer)
+	if err != nil {
+		return fmt.Errorf("error downloading rootfs: %v", err)
+	}
+	if _, err := layer.Seek(0, io.SeekStart); err != nil {
+		return fmt.Errorf("error reading rootfs: %v", err)
+	}
+
+	image := &OCIImage{
+		Name:         b.imageName,
+		Architecture: spec.arch,
+		Labels:       b.labels,
+	}
+	return WriteOCIImage(image, layer, b.output)
+}
@@ -0,0 +1,99 @@
+/*
+Copyright 2016 The Kubernetes Authors All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package imagebuilder
+
+import (
+	"fmt"
+	"strings"
+)
+
+// CheckStatus is the outcome of a preflight Check
+type CheckStatus string
+
+const (
+	CheckPass CheckStatus = "pass"
+	// CheckWarn is a problem that may not stop the build
+	CheckWarn CheckStatus = "warn"
+	CheckFail CheckStatus = "fail"
+)
+
+// Check is the result of a preflight check of the account or config
+type Check struct {
+	Name    string      `json:"name"`
+	Status  CheckStatus `json:"status"`
+	Message string      `json:"message"`
+	// Fix is a hint for fixing a warning or failure
+	Fix string `json:"fix,omitempty"`
+}
+
+// Doctor is implemented by clouds that can check that they are able to build images, before anything is launched
+type Doctor interface {
+	// Doctor runs the preflight checks; it does not create anything (other than probe objects, which it deletes)
+	Doctor() []*Check
+}
+
+func passCheck(name string, format string, args ...interface{}) *Check {
+	return &Check{Name: name, Status: CheckPass, Message: fmt.Sprintf(format, args...)}
+}
+
+func warnCheck(name string, message string, fix string) *Check {
+	return &Check{Name: name, Status: CheckWarn, Message: message, Fix: fix}
+}
+
+func failCheck(name string, message string, fix string) *Check {
+	return &Check{Name: name, Status: CheckFail, Message: message, Fix: fix}
+}
+
+// CheckWriteAccess checks that we can write, read and delete a probe object next to the location
+// (a local path, s3://<bucket>/<key> or gs://<bucket>/<object>)
+func CheckWriteAccess(name string, location string) *Check {
+	probe := location + ".imagebuilder-doctor"
+	if strings.HasSuffix(location, "/") {
+		probe = location + "imagebuilder-doctor"
+	}
+	fix := fmt.Sprintf("Check that the bucket (or directory) of %s exists, and that we can write and delete objects in it", location)
+
+	store, err := NewStateStore(probe)
+	if err != nil {
+		return failCheck(name, err.Error(), fix)
+	}
+	err = store.Write(&BuildState{BuildID: "doctor"})
+	if err == nil {
+		_, err = store.Read()
+	}
+	if err != nil {
+		return failCheck(name, err.Error(), fix)
+	}
+	if err := store.Delete(); err != nil {
+		return warnCheck(name, fmt.Sprintf("wrote %s, but could not delete it: %v", probe, err), fix)
+	}
+	return passCheck(name, "can write to %s", location)
+}
+
+// checkSSHPublicKey checks that the SSHPublicKey can be read, if it is set
+func checkSSHPublicKey(config *Config) *Check {
+	if config.SSHPublicKey == "" {
+		return warnCheck("ssh key", "SSHPublicKey is not set", "Set SSHPublicKey to the public key of the key used to SSH to the builder")
+	}
+	if _, err := ReadFile(config.SSHPublicKey); err != nil {
+		return failCheck("ssh key", err.Error(), "Set SSHPublicKey to the public key of the key used to SSH to the builder (e.g. ~/.ssh/id_rsa.pub)")
+	}
+	return passCheck("ssh key", "will use %s", config.SSHPublicKey)
+}
+
+// sshIngressFix is the hint for opening port 22
+const sshIngressFix = "Allow tcp:22 from the address imagebuilder runs from (or set PrivateIP and run it inside the network)"
@@ -0,0 +1,573 @@
+/*
+Copyright 2016 The Kubernetes Authors All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package imagebuilder
+
+import (
+	"bytes"
+	"fmt"
+	"math/rand"
+	"os"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/ec2"
+	"github.com/golang/glog"
+	"k8s.io/kube-deploy/imagebuilder/pkg/imagebuilder/executor"
+)
+
+// AWSBootModeLegacyBIOS boots the image with grub from the MBR
+const AWSBootModeLegacyBIOS = "legacy-bios"
+
+const (
+	// ebsAttachDevice is the device name we attach the build volume as
+	ebsAttachDevice = "/dev/sdf"
+	// ebsRootDevice is the root device name of the registered image
+	ebsRootDevice = "/dev/xvda"
+	// ebsRootLabel is the filesystem label of the root filesystem, which we use in fstab
+	ebsRootLabel = "root"
+)
+
+// ebsFstab mounts the root filesystem by label, because the device name differs between instance types
+const ebsFstab = "LABEL=" + ebsRootLabel + " / ext4 defaults,noatime 0 1\n"
+
+// ebsInterfaces configures the primary network interface with DHCP
+const ebsInterfaces = "auto lo\niface lo inet loopback\n\nauto eth0\niface eth0 inet dhcp\n"
+
+// ebsGrubDefaults sends the console to the serial port, so it shows in the EC2 console output
+const ebsGrubDefaults = "GRUB_CMDLINE_LINUX=\"console=tty0 console=ttyS0,115200n8\"\nGRUB_TIMEOUT=0\n"
+
+// EBSBackend builds AMIs without bootstrap-vz's EC2 provider: it attaches a new EBS volume to the builder,
+// builds the template's rootfs onto it over the executor (with debootstrap), and then snapshots the volume
+// and registers the snapshot as an AMI.
+// Because imagebuilder makes the EC2 calls, no AWS credentials are passed to the builder.
+type EBSBackend struct {
+	cloud     *AWSCloud
+	instance  *AWSInstance
+	template  *BootstrapVzTemplate
+	imageName string
+
+	tmpdir string
+	// volumeID is the build volume, once it is created
+	volumeID string
+	// attached is true while the volume is attached to the builder
+	attached bool
+	// device is the path of the volume on the builder
+	device string
+	// mounts are the mount points under the rootfs, in the order they were mounted
+	mounts []string
+	// snapshotID is the snapshot of the volume, once it is created
+	snapshotID string
+	// registered is true once the snapshot is registered as an image
+	registered bool
+}
+
+var _ BuildBackend = &EBSBackend{}
+
+// NewEBSBackend builds a backend that builds the template onto a volume attached to the instance,
+// and registers it as imageName
+func NewEBSBackend(cloud *AWSCloud, instance Instance, template *BootstrapVzTemplate, imageName string) (*EBSBackend, error) {
+	awsInstance, ok := instance.(*AWSInstance)
+	if !ok {
+		return nil, fmt.Errorf("the %s backend requires an EC2 instance (not localhost or docker)", BackendEBS)
+	}
+
+	volume := &cloud.config.Volume
+	if volume.BootMode != AWSBootModeLegacyBIOS {
+		return nil, fmt.Errorf("Volume.BootMode %q is not supported; only %q is supported", volume.BootMode, AWSBootModeLegacyBIOS)
+	}
+	if volume.Size <= 0 {
+		return nil, fmt.Errorf("Volume.Size must be set")
+	}
+
+	return &EBSBackend{
+		cloud:     cloud,
+		instance:  awsInstance,
+		template:  template,
+		imageName: imageName,
+	}, nil
+}
+
+// Name returns the name of the backend
+func (b *EBSBackend) Name() string {
+	return BackendEBS
+}
+
+// ImageName returns the name of the AMI
+func (b *EBSBackend) ImageName() string {
+	return b.imageName
+}
+
+// Prepare runs the setup commands (to install debootstrap, parted and grub), and creates and attaches the volume
+func (b *EBSBackend) Prepare(target *executor.Target) error {
+	err := runSetupCommands(target, b.cloud.config.SetupCommands)
+	if err != nil {
+		return err
+	}
+
+	b.tmpdir = fmt.Sprintf("/tmp/imagebuilder-%d", rand.Int63())
+	err = target.Mkdir(b.tmpdir, 0755)
+	if err != nil {
+		return err
+	}
+
+	err = b.createVolume()
+	if err != nil {
+		return err
+	}
+
+	err = b.attachVolume()
+	if err != nil {
+		return err
+	}
+
+	b.device, err = findEBSDevice(target, b.volumeID)
+	return err
+}
+
+// Build builds the rootfs onto the volume, then snapshots it and registers the image
+func (b *EBSBackend) Build(target *executor.Target) error {
+	spec, err := loadRootfsSpec(b.template)
+	if err != nil {
+		return err
+	}
+	if spec.arch != "" && spec.arch != "amd64" {
+		return fmt.Errorf("the %s backend only supports amd64 images, not %q", BackendEBS, spec.arch)
+	}
+
+	err = target.Command("parted", "-s", b.device, "mklabel", "msdos", "mkpart", "primary", "ext4", "1MiB", "100%", "set", "1", "boot", "on").WithSudo().Run()
+	if err != nil {
+		return err
+	}
+	err = target.Command("udevadm", "settle").WithSudo().Run()
+	if err != nil {
+		return err
+	}
+	partition := ebsPartition(b.device)
+	if err := waitForFile(target, partition); err != nil {
+		return err
+	}
+
+	err = target.Command("mkfs.ext4", "-q", "-L", ebsRootLabel, partition).WithSudo().Run()
+	if err != nil {
+		return err
+	}
+
+	rootfs := path.Join(b.tmpdir, "root")
+	err = target.Mkdir(rootfs, 0755)
+	if err != nil {
+		return err
+	}
+	err = b.mount(target, rootfs, "mount", partition, rootfs)
+	if err != nil {
+		return err
+	}
+
+	var extraPackages []string
+	if !hasPackage(spec.packages, "linux-image") {
+		extraPackages = append(extraPackages, "linux-image-amd64")
+	}
+	if !hasPackage(spec.packages, "grub") {
+		extraPackages = append(extraPackages, "grub-pc")
+	}
+	err = buildRootfs(target, spec, rootfs, b.tmpdir, true, extraPackages)
+	if err != nil {
+		return err
+	}
+
+	files := []struct {
+		path     string
+		contents string
+	}{
+		{"etc/fstab", ebsFstab},
+		{"etc/network/interfaces", ebsInterfaces},
+		{"etc/default/grub.d/50-imagebuilder.cfg", ebsGrubDefaults},
+	}
+	for _, f := range files {
+		err = b.putRootFile(target, rootfs, f.path, f.contents)
+		if err != nil {
+			return err
+		}
+	}
+
+	err = b.installGrub(target, rootfs)
+	if err != nil {
+		return err
+	}
+
+	err = b.unmountAll(target)
+	if err != nil {
+		return err
+	}
+
+	err = b.detachVolume()
+	if err != nil {
+		return err
+	}
+
+	err = b.createSnapshot()
+	if err != nil {
+		return err
+	}
+
+	return b.registerImage()
+}
+
+// CollectArtifacts does nothing; command output is logged as it runs
+func (b *EBSBackend) CollectArtifacts(target *executor.Target, localDir string) error {
+	return nil
+}
+
+// Cleanup unmounts, detaches and deletes the volume, and deletes the snapshot if it was not registered
+func (b *EBSBackend) Cleanup(target *executor.Target) error {
+	var errors []string
+
+	if err := b.unmountAll(target); err != nil {
+		errors = append(errors, err.Error())
+	}
+	if b.attached {
+		if err := b.detachVolume(); err != nil {
+			errors = append(errors, err.Error())
+		}
+	}
+	if b.volumeID != "" && !b.attached {
+		glog.Infof("Deleting volume %q", b.volumeID)
+		_, err := b.cloud.ec2.DeleteVolume(&ec2.DeleteVolumeInput{VolumeId: aws.String(b.volumeID)})
+		if err != nil {
+			errors = append(errors, fmt.Sprintf("error deleting volume %q: %v", b.volumeID, err))
+		} else {
+			b.volumeID = ""
+		}
+	}
+	if b.snapshotID != "" && !b.registered {
+		glog.Infof("Deleting snapshot %q", b.snapshotID)
+		_, err := b.cloud.ec2.DeleteSnapshot(&ec2.DeleteSnapshotInput{SnapshotId: aws.String(b.snapshotID)})
+		if err != nil {
+			errors = append(errors, fmt.Sprintf("error deleting snapshot %q: %v", b.snapshotID, err))
+		}
+	}
+	if b.tmpdir != "" {
+		if err := target.Command("rm", "-rf", b.tmpdir).WithSudo().Run(); err != nil {
+			errors = append(errors, err.Error())
+		}
+	}
+
+	if len(errors) != 0 {
+		return fmt.Errorf("%s", strings.Join(errors, "; "))
+	}
+	return nil
+}
+
+// tags returns the tags for the volume and snapshot: the config Tags, the role tag and a Name
+func (b *EBSBackend) tags() []*ec2.Tag {
+	tags := []*ec2.Tag{
+		{Key: aws.String(tagRoleKey), Value: aws.String(tagRoleValue)},
+		{Key: aws.String("Name"), Value: aws.String(b.imageName)},
+	}
+	for k, v := range b.cloud.config.Tags {
+		tags = append(tags, &ec2.Tag{Key: aws.String(k), Value: aws.String(v)})
+	}
+	return tags
+}
+
+func (b *EBSBackend) createVolume() error {
+	instance, err := b.cloud.describeInstance(b.instance.instanceID)
+	if err != nil {
+		return err
+	}
+	if instance == nil || instance.Placement == nil {
+		return fmt.Errorf("could not find availability zone of instance %q", b.instance.instanceID)
+	}
+
+	volume := &b.cloud.config.Volume
+	request := &ec2.CreateVolumeInput{
+		AvailabilityZone: instance.Placement.AvailabilityZone,
+		Size:             aws.Int64(volume.Size),
+		VolumeType:       aws.String(volume.Type),
+	}
+	if volume.IOPS != 0 {
+		request.Iops = aws.Int64(volume.IOPS)
+	}
+	if volume.Encrypted {
+		request.Encrypted = aws.Bool(true)
+		if volume.KMSKeyID != "" {
+			request.KmsKeyId = aws.String(volume.KMSKeyID)
+		}
+	}
+
+	glog.V(2).Infof("AWS CreateVolume AvailabilityZone=%q Size=%d VolumeType=%q", aws.StringValue(request.AvailabilityZone), volume.Size, volume.Type)
+	response, err := b.cloud.ec2.CreateVolume(request)
+	if err != nil {
+		return fmt.Errorf("error creating volume: %v", err)
+	}
+	b.volumeID = aws.StringValue(response.VolumeId)
+	glog.Infof("Created volume %q", b.volumeID)
+
+	err = b.cloud.TagResource(b.volumeID, b.tags()...)
+	if err != nil {
+		return err
+	}
+
+	err = b.cloud.ec2.WaitUntilVolumeAvailable(&ec2.DescribeVolumesInput{VolumeIds: aws.StringSlice([]string{b.volumeID})})
+	if err != nil {
+		return fmt.Errorf("error waiting for volume %q to be available: %v", b.volumeID, err)
+	}
+	return nil
+}
+
+func (b *EBSBackend) attachVolume() error {
+	request := &ec2.AttachVolumeInput{
+		VolumeId:   aws.String(b.volumeID),
+		InstanceId: aws.String(b.instance.instanceID),
+		Device:     aws.String(ebsAttachDevice),
+	}
+
+	glog.V(2).Infof("AWS AttachVolume VolumeId=%q InstanceId=%q Device=%q", b.volumeID, b.instance.instanceID, ebsAttachDevice)
+	_, err := b.cloud.ec2.AttachVolume(request)
+	if err != nil {
+		return fmt.Errorf("error attaching volume %q: %v", b.volumeID, err)
+	}
+	b.attached = true
+
+	err = b.cloud.ec2.WaitUntilVolumeInUse(&ec2.DescribeVolumesInput{VolumeIds: aws.StringSlice([]string{b.volumeID})})
+	if err != nil {
+		return fmt.Errorf("error waiting for volume %q to attach: %v", b.volumeID, err)
+	}
+	return nil
+}
+
+func (b *EBSBackend) detachVolume() error {
+	glog.V(2).Infof("AWS DetachVolume VolumeId=%q", b.volumeID)
+	_, err := b.cloud.ec2.DetachVolume(&ec2.DetachVolumeInput{VolumeId: aws.String(b.volumeID)})
+	if err != nil {
+		return fmt.Errorf("error detaching volume %q: %v", b.volumeID, err)
+	}
+
+	err = b.cloud.ec2.WaitUntilVolumeAvailable(&ec2.DescribeVolumesInput{VolumeIds: aws.StringSlice([]string{b.volumeID})})
+	if err != nil {
+		return fmt.Errorf("error waiting for volume %q to detach: %v", b.volumeID, err)
+	}
+	b.attached = false
+	return nil
+}
+
+func (b *EBSBackend) createSnapshot() error {
+	request := &ec2.CreateSnapshotInput{
+		VolumeId:    aws.String(b.volumeID),
+		Description: aws.String("imagebuilder: " + b.imageName),
+	}
+
+	glog.V(2).Infof("AWS CreateSnapshot VolumeId=%q", b.volumeID)
+	response, err := b.cloud.ec2.CreateSnapshot(request)
+	if err != nil {
+		return fmt.Errorf("error creating snapshot of volume %q: %v", b.volumeID, err)
+	}
+	b.snapshotID = aws.StringValue(response.SnapshotId)
+	glog.Infof("Created snapshot %q", b.snapshotID)
+
+	err = b.cloud.TagResource(b.snapshotID, b.tags()...)
+	if err != nil {
+		return err
+	}
+
+	for {
+		// TODO: Timeout
+		glog.V(2).Infof("AWS DescribeSnapshots SnapshotId=%q", b.snapshotID)
+		response, err := b.cloud.ec2.DescribeSnapshots(&ec2.DescribeSnapshotsInput{SnapshotIds: aws.StringSlice([]string{b.snapshotID})})
+		if err != nil {
+			return fmt.Errorf("error making AWS DescribeSnapshots call: %v", err)
+		}
+		if len(response.Snapshots) != 1 {
+			return fmt.Errorf("snapshot not found %q", b.snapshotID)
+		}
+
+		snapshot := response.Snapshots[0]
+		state := aws.StringValue(snapshot.State)
+		switch state {
+		case ec2.SnapshotStateCompleted:
+			return nil
+		case ec2.SnapshotStateError:
+			return fmt.Errorf("snapshot %q failed: %s", b.snapshotID, aws.StringValue(snapshot.StateMessage))
+		}
+		glog.Infof("Snapshot not yet complete (%s, %s); waiting", b.snapshotID, aws.StringValue(snapshot.Progress))
+		time.Sleep(10 * time.Second)
+	}
+}
+
+func (b *EBSBackend) registerImage() error {
+	volume := &b.cloud.config.Volume
+
+	ebs := &ec2.EbsBlockDevice{
+		SnapshotId:          aws.String(b.snapshotID),
+		VolumeSize:          aws.Int64(volume.Size),
+		VolumeType:          aws.String(volume.Type),
+		DeleteOnTermination: aws.Bool(true),
+	}
+	if volume.IOPS != 0 {
+		ebs.Iops = aws.Int64(volume.IOPS)
+	}
+
+	request := &ec2.RegisterImageInput{
+		Name:               aws.String(b.imageName),
+		Architecture:       aws.String(ec2.ArchitectureValuesX8664),
+		VirtualizationType: aws.String("hvm"),
+		RootDeviceName:     aws.String(ebsRootDevice),
+		BlockDeviceMappings: []*ec2.BlockDeviceMapping{
+			{DeviceName: aws.String(ebsRootDevice), Ebs: ebs},
+		},
+	}
+	if volume.ENASupport {
+		request.EnaSupport = aws.Bool(true)
+	}
+	if volume.SriovNetSupport != "" {
+		request.SriovNetSupport = aws.String(volume.SriovNetSupport)
+	}
+
+	glog.V(2).Infof("AWS RegisterImage Name=%q SnapshotId=%q", b.imageName, b.snapshotID)
+	response, err := b.cloud.ec2.RegisterImage(request)
+	if err != nil {
+		return fmt.Errorf("error registering image %q: %v", b.imageName, err)
+	}
+	b.registered = true
+
+	image := &AWSImage{
+		ec2:     b.cloud.ec2,
+		region:  b.cloud.config.Region,
+		imageID: aws.StringValue(response.ImageId),
+		events:  b.cloud.events,
+	}
+	glog.Infof("Registered image %q", image.imageID)
+	return image.waitStatusAvailable()
+}
+
+// installGrub installs grub to the MBR of the volume, and generates its config
+func (b *EBSBackend) installGrub(target *executor.Target, rootfs string) error {
+	mounts := [][]string{
+		{"mount", "--bind", "/dev", path.Join(rootfs, "dev")},
+		{"mount", "-t", "proc", "proc", path.Join(rootfs, "proc")},
+		{"mount", "-t", "sysfs", "sysfs", path.Join(rootfs, "sys")},
+	}
+	for _, m := range mounts {
+		if err := b.mount(target, m[len(m)-1], m...); err != nil {
+			return err
+		}
+	}
+
+	err := target.Command("chroot", rootfs, "grub-install", "--target=i386-pc", b.device).WithSudo().Run()
+	if err != nil {
+		return err
+	}
+	return target.Command("chroot", rootfs, "update-grub").WithSudo().Run()
+}
+
+// putRootFile writes a file owned by root into the rootfs
+func (b *EBSBackend) putRootFile(target *executor.Target, rootfs string, p string, contents string) error {
+	tmp := path.Join(b.tmpdir, path.Base(p))
+	err := target.Put(tmp, len(contents), bytes.NewReader([]byte(contents)), 0644)
+	if err != nil {
+		return err
+	}
+	return target.Command("install", "-D", "-m", "0644", tmp, path.Join(rootfs, p)).WithSudo().Run()
+}
+
+// mount runs the mount command, recording the mount point so it is unmounted
+func (b *EBSBackend) mount(target *executor.Target, mountPoint string, command ...string) error {
+	err := target.Command(command...).WithSudo().Run()
+	if err != nil {
+		return err
+	}
+	b.mounts = append(b.mounts, mountPoint)
+	return nil
+}
+
+// unmountAll unmounts everything we mounted, in reverse order
+func (b *EBSBackend) unmountAll(target *executor.Target) error {
+	if len(b.mounts) != 0 {
+		if err := target.Command("sync").Run(); err != nil {
+			return err
+		}
+	}
+	for len(b.mounts) != 0 {
+		mountPoint := b.mounts[len(b.mounts)-1]
+		err := target.Command("umount", mountPoint).WithSudo().Run()
+		if err != nil {
+			return err
+		}
+		b.mounts = b.mounts[:len(b.mounts)-1]
+	}
+	return nil
+}
+
+// findEBSDevice returns the path of the attached volume on the builder.
+// Xen instances name it after the attach device (e.g. /dev/xvdf); nitro instances expose it as NVMe,
+// with the volume ID as the serial number.
+func findEBSDevice(target *executor.Target, volumeID string) (string, error) {
+	candidates := []string{
+		"/dev/xvd" + strings.TrimPrefix(ebsAttachDevice, "/dev/sd"),
+		ebsAttachDevice,
+		"/dev/disk/by-id/nvme-Amazon_Elastic_Block_Store_" + strings.Replace(volumeID, "-", "", 1),
+	}
+
+	for attempt := 0; attempt < 60; attempt++ {
+		for _, p := range candidates {
+			_, err := target.Stat(p)
+			if err == nil {
+				glog.Infof("Volume %q is attached as %q", volumeID, p)
+				return p, nil
+			}
+			if !os.IsNotExist(err) {
+				return "", fmt.Errorf("error checking for device %q: %v", p, err)
+			}
+		}
+		time.Sleep(2 * time.Second)
+	}
+	return "", fmt.Errorf("volume %q did not appear on the builder (tried %s)", volumeID, strings.Join(candidates, ", "))
+}
+
+// ebsPartition returns the path of the first partition of the device
+func ebsPartition(device string) string {
+	if strings.HasPrefix(device, "/dev/disk/by-id/") {
+		return device + "-part1"
+	}
+	return device + "1"
+}
+
+// waitForFile waits for the file to exist on the target (e.g. for udev to create a device)
+func waitForFile(target *executor.Target, p string) error {
+	for attempt := 0; attempt < 30; attempt++ {
+		_, err := target.Stat(p)
+		if err == nil {
+			return nil
+		}
+		if !os.IsNotExist(err) {
+			return fmt.Errorf("error checking for %q: %v", p, err)
+		}
+		time.Sleep(time.Second)
+	}
+	return fmt.Errorf("%q did not appear on the builder", p)
+}
+
+// hasPackage returns true if one of the packages contains s (e.g. linux-image)
+func hasPackage(packages []string, s string) bool {
+	for _, p := range packages {
+		if strings.Contains(p, s) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,197 @@
+/*
+Copyright 2016 The Kubernetes Authors All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package imagebuilder
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/golang/glog"
+	"k8s.io/kube-deploy/imagebuilder/pkg/imagebuilder/executor"
+)
+
+// EventType identifies what an Event reports
+type EventType string
+
+const (
+	EventPhaseStarted  EventType = "phase-started"
+	EventPhaseFinished EventType = "phase-finished"
+	// EventInstanceCreated is emitted when a builder instance is launched (not when an existing one is found)
+	EventInstanceCreated EventType = "instance-created"
+	EventSSHConnected    EventType = "ssh-connected"
+	EventCommandStarted  EventType = "command-started"
+	EventCommandFinished EventType = "command-finished"
+	// EventImageState is emitted when we see an image change state (e.g. pending to available)
+	EventImageState EventType = "image-state"
+	// EventRegionCopy is emitted as the image is copied to a region (State copying, then copied), and made public there
+	EventRegionCopy EventType = "region-copy"
+)
+
+// Event is a structured progress event; only the fields that apply to the Type are set
+type Event struct {
+	Type EventType `json:"type"`
+	Time time.Time `json:"time"`
+	// Build labels the build the event is for, if the Events has a Build label
+	Build string `json:"build,omitempty"`
+
+	Phase    Phase  `json:"phase,omitempty"`
+	Instance string `json:"instance,omitempty"`
+	Command  string `json:"command,omitempty"`
+	Image    string `json:"image,omitempty"`
+	Region   string `json:"region,omitempty"`
+	// State is the image state, or the progress of a region copy
+	State string `json:"state,omitempty"`
+
+	// Duration is how long the phase or command took, in seconds
+	Duration float64 `json:"duration,omitempty"`
+	Error    string  `json:"error,omitempty"`
+}
+
+// Subscriber receives events as they are emitted
+type Subscriber interface {
+	OnEvent(event *Event)
+}
+
+// Events sends events to its subscribers.  A nil *Events discards events, so it can always be used.
+type Events struct {
+	// Build labels the events, e.g. with the name of the build in a matrix
+	Build string
+
+	mutex       sync.Mutex
+	subscribers []Subscriber
+}
+
+// Subscribe adds a subscriber, which receives all events emitted from now on
+func (e *Events) Subscribe(s Subscriber) {
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+	e.subscribers = append(e.subscribers, s)
+}
+
+// Emit sends the event to the subscribers, setting its Time (if not set) and Build
+func (e *Events) Emit(event *Event) {
+	if e == nil {
+		return
+	}
+	if event.Time.IsZero() {
+		event.Time = time.Now().UTC()
+	}
+	if event.Build == "" {
+		event.Build = e.Build
+	}
+
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+	for _, s := range e.subscribers {
+		s.OnEvent(event)
+	}
+}
+
+// EventEmitter is implemented by clouds that emit events themselves, e.g. as they wait for an image
+type EventEmitter interface {
+	SetEvents(events *Events)
+}
+
+// jsonlSubscriber writes each event as a line of JSON
+type jsonlSubscriber struct {
+	w io.Writer
+}
+
+// NewJSONLSubscriber returns a Subscriber that writes each event to w as a line of JSON
+func NewJSONLSubscriber(w io.Writer) Subscriber {
+	return &jsonlSubscriber{w: w}
+}
+
+func (s *jsonlSubscriber) OnEvent(event *Event) {
+	data, err := json.Marshal(event)
+	if err != nil {
+		glog.Warningf("error serializing event: %v", err)
+		return
+	}
+	// A single write, so lines from processes appending to the same file are not interleaved
+	if _, err := s.w.Write(append(data, '\n')); err != nil {
+		glog.Warningf("error writing event: %v", err)
+	}
+}
+
+// consoleSubscriber renders events as lines of text for people to read
+type consoleSubscriber struct {
+	w io.Writer
+}
+
+// NewConsoleSubscriber returns a Subscriber that writes a line of text to w for each event.
+// The Build label is not shown, because matrix builds already prefix their output with it.
+func NewConsoleSubscriber(w io.Writer) Subscriber {
+	return &consoleSubscriber{w: w}
+}
+
+func (s *consoleSubscriber) OnEvent(event *Event) {
+	var line string
+	switch event.Type {
+	case EventPhaseStarted:
+		line = fmt.Sprintf("==> %s", event.Phase)
+	case EventPhaseFinished:
+		line = fmt.Sprintf("<== %s finished in %s", event.Phase, formatSeconds(event.Duration))
+	case EventInstanceCreated:
+		line = fmt.Sprintf("    created instance %s", event.Instance)
+	case EventSSHConnected:
+		line = fmt.Sprintf("    connected to instance %s", event.Instance)
+	case EventCommandStarted:
+		line = fmt.Sprintf("    $ %s", event.Command)
+	case EventCommandFinished:
+		line = fmt.Sprintf("      done in %s", formatSeconds(event.Duration))
+	case EventImageState:
+		line = fmt.Sprintf("    image %s is %s", event.Image, event.State)
+	case EventRegionCopy:
+		line = fmt.Sprintf("    %s: image %s %s", event.Region, event.Image, event.State)
+	default:
+		line = fmt.Sprintf("    %s", event.Type)
+	}
+	if event.Error != "" {
+		line += " (failed: " + strings.Join(strings.Fields(event.Error), " ") + ")"
+	}
+	fmt.Fprintf(s.w, "%s %s\n", event.Time.Local().Format("15:04:05"), line)
+}
+
+func formatSeconds(seconds float64) string {
+	return (time.Duration(seconds * float64(time.Second))).Round(100 * time.Millisecond).String()
+}
+
+// eventExecutor emits events for the commands run by an Executor
+type eventExecutor struct {
+	executor.Executor
+	events *Events
+}
+
+func (x *eventExecutor) Run(c *executor.CommandExecution) error {
+	command := strings.Join(c.Command, " ")
+	x.events.Emit(&Event{Type: EventCommandStarted, Command: command})
+
+	start := time.Now()
+	err := x.Executor.Run(c)
+
+	finished := &Event{Type: EventCommandFinished, Command: command, Duration: time.Since(start).Seconds()}
+	if err != nil {
+		finished.Error = err.Error()
+	}
+	x.events.Emit(finished)
+	return err
+}
@@ -0,0 +1,521 @@
+/*
+Copyright 2016 The Kubernetes Authors All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package executor
+
+import (
+	"archive/tar"
+	"bytes"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/golang/glog"
+)
+
+// dockerAPIVersion is the Docker Engine API version we speak; 1.24 is supported by docker 1.12 onwards
+const dockerAPIVersion = "v1.24"
+
+// DockerExecutor runs commands inside a privileged docker container, using the Docker Engine API.
+// The container is created by NewDocker, and removed on Close.
+type DockerExecutor struct {
+	client      *http.Client
+	containerID string
+}
+
+var _ Executor = &DockerExecutor{}
+
+// NewDocker pulls image, and starts a privileged container from it, talking to the docker daemon at socket
+func NewDocker(socket string, image string) (*DockerExecutor, error) {
+	client := &http.Client{
+		Transport: &http.Transport{
+			Dial: func(network, addr string) (net.Conn, error) {
+				return net.Dial("unix", socket)
+			},
+		},
+	}
+	e := &DockerExecutor{client: client}
+
+	if err := e.pullImage(image); err != nil {
+		return nil, err
+	}
+
+	// bootstrap-vz needs loop / block devices, so we share /dev with the host
+	request := map[string]interface{}{
+		"Image": image,
+		"Cmd":   []string{"sleep", "infinity"},
+		"HostConfig": map[string]interface{}{
+			"Privileged": true,
+			"Binds":      []string{"/dev:/dev"},
+		},
+	}
+	var response struct {
+		Id string
+	}
+	glog.Infof("Creating docker container from image %q", image)
+	if err := e.doJSON("POST", "/containers/create", nil, request, &response); err != nil {
+		return nil, fmt.Errorf("error creating docker container: %v", err)
+	}
+	e.containerID = response.Id
+
+	if err := e.doJSON("POST", "/containers/"+e.containerID+"/start", nil, nil, nil); err != nil {
+		e.Close()
+		return nil, fmt.Errorf("error starting docker container: %v", err)
+	}
+	glog.Infof("Started docker container %q", e.containerID)
+
+	return e, nil
+}
+
+// Close removes the container
+func (e *DockerExecutor) Close() error {
+	if e.containerID == "" {
+		return nil
+	}
+
+	glog.Infof("Removing docker container %q", e.containerID)
+	query := url.Values{}
+	query.Set("force", "1")
+	query.Set("v", "1")
+	err := e.doJSON("DELETE", "/containers/"+e.containerID, query, nil, nil)
+	if err != nil {
+		return fmt.Errorf("error removing docker container %q: %v", e.containerID, err)
+	}
+	e.containerID = ""
+	return nil
+}
+
+// pullImage pulls the image, if it is not already present
+func (e *DockerExecutor) pullImage(image string) error {
+	if err := e.doJSON("GET", "/images/"+image+"/json", nil, nil, nil); err == nil {
+		return nil
+	}
+
+	glog.Infof("Pulling docker image %q", image)
+	query := url.Values{}
+	query.Set("fromImage", image)
+	if !strings.Contains(path.Base(image), ":") {
+		query.Set("tag", "latest")
+	}
+	response, err := e.do("POST", "/images/create", query, nil, "")
+	if err != nil {
+		return fmt.Errorf("error pulling docker image %q: %v", image, err)
+	}
+	defer response.Body.Close()
+
+	// The pull is reported as a stream of JSON progress messages; errors are reported inline
+	decoder := json.NewDecoder(response.Body)
+	for {
+		var message struct {
+			Status string
+			Error  string
+		}
+		err := decoder.Decode(&message)
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("error reading progress pulling docker image %q: %v", image, err)
+		}
+		if message.Error != "" {
+			return fmt.Errorf("error pulling docker image %q: %s", image, message.Error)
+		}
+		glog.V(4).Infof("docker pull: %s", message.Status)
+	}
+}
+
+// do performs a request against the docker API
+func (e *DockerExecutor) do(method string, p string, query url.Values, body io.Reader, contentType string) (*http.Response, error) {
+	u := "http://docker/" + dockerAPIVersion + p
+	if len(query) != 0 {
+		u += "?" + query.Encode()
+	}
+
+	request, err := http.NewRequest(method, u, body)
+	if err != nil {
+		return nil, err
+	}
+	if contentType != "" {
+		request.Header.Set("Content-Type", contentType)
+	}
+
+	glog.V(4).Infof("docker %s %s", method, p)
+	response, err := e.client.Do(request)
+	if err != nil {
+		return nil, err
+	}
+
+	if response.StatusCode >= 300 {
+		defer response.Body.Close()
+		message, _ := ioutil.ReadAll(response.Body)
+		return nil, &dockerAPIError{StatusCode: response.StatusCode, Message: strings.TrimSpace(string(message))}
+	}
+	return response, nil
+}
+
+// doJSON performs a request with a JSON body (if request is not nil), decoding the JSON response into result (if not nil)
+func (e *DockerExecutor) doJSON(method string, p string, query url.Values, request interface{}, result interface{}) error {
+	var body io.Reader
+	contentType := ""
+	if request != nil {
+		data, err := json.Marshal(request)
+		if err != nil {
+			return fmt.Errorf("error serializing docker request: %v", err)
+		}
+		body = bytes.NewReader(data)
+		contentType = "application/json"
+	}
+
+	response, err := e.do(method, p, query, body, contentType)
+	if err != nil {
+		return err
+	}
+	defer response.Body.Close()
+
+	if result == nil {
+		return nil
+	}
+	if err := json.NewDecoder(response.Body).Decode(result); err != nil {
+		return fmt.Errorf("error parsing docker response: %v", err)
+	}
+	return nil
+}
+
+// dockerAPIError is returned when the docker daemon returns a non-success status code
+type dockerAPIError struct {
+	StatusCode int
+	Message    string
+}
+
+func (e *dockerAPIError) Error() string {
+	return fmt.Sprintf("docker API returned %d: %s", e.StatusCode, e.Message)
+}
+
+func isDockerNotFound(err error) bool {
+	apiErr, ok := err.(*dockerAPIError)
+	return ok && apiErr.StatusCode == http.StatusNotFound
+}
+
+// Run executes the command inside the container.
+// Commands run as root, so sudo is not used (and a leading "sudo" is removed).
+func (e *DockerExecutor) Run(cmd *CommandExecution) error {
+	c := *cmd
+	c.Sudo = false
+	if len(c.Command) > 1 && c.Command[0] == "sudo" {
+		c.Command = c.Command[1:]
+	}
+
+	return runCommand(&c, e, e.exec)
+}
+
+// exec runs the command using docker exec, returning stdout and stderr
+func (e *DockerExecutor) exec(command []string) ([]byte, []byte, error) {
+	request := map[string]interface{}{
+		"AttachStdout": true,
+		"AttachStderr": true,
+		"Cmd":          command,
+	}
+	var created struct {
+		Id string
+	}
+	if err := e.doJSON("POST", "/containers/"+e.containerID+"/exec", nil, request, &created); err != nil {
+		return nil, nil, fmt.Errorf("error creating docker exec: %v", err)
+	}
+
+	start := map[string]interface{}{
+		"Detach": false,
+		"Tty":    false,
+	}
+	data, _ := json.Marshal(start)
+	response, err := e.do("POST", "/exec/"+created.Id+"/start", nil, bytes.NewReader(data), "application/json")
+	if err != nil {
+		return nil, nil, fmt.Errorf("error starting docker exec: %v", err)
+	}
+	defer response.Body.Close()
+
+	var stdout, stderr bytes.Buffer
+	if err := demultiplexDockerStream(response.Body, &stdout, &stderr); err != nil {
+		return stdout.Bytes(), stderr.Bytes(), err
+	}
+
+	exitCode, err := e.waitExec(created.Id)
+	if err != nil {
+		return stdout.Bytes(), stderr.Bytes(), err
+	}
+	if exitCode != 0 {
+		return stdout.Bytes(), stderr.Bytes(), &dockerExitError{ExitCode: exitCode}
+	}
+	return stdout.Bytes(), stderr.Bytes(), nil
+}
+
+// dockerExecExitTimeout is how long we wait for docker to report an exec as finished, after its output has ended
+var dockerExecExitTimeout = 30 * time.Second
+
+// dockerExecPollInterval is how often we inspect an exec while waiting for it to finish
+var dockerExecPollInterval = 100 * time.Millisecond
+
+// waitExec returns the exit code of the exec.  Docker can still report the exec as running
+// (with an exit code of 0) just after the attach stream ends, so we wait until it is not.
+func (e *DockerExecutor) waitExec(id string) (int, error) {
+	deadline := time.Now().Add(dockerExecExitTimeout)
+	for {
+		var inspect struct {
+			Running  bool
+			ExitCode int
+		}
+		if err := e.doJSON("GET", "/exec/"+id+"/json", nil, nil, &inspect); err != nil {
+			return 0, fmt.Errorf("error inspecting docker exec: %v", err)
+		}
+		if !inspect.Running {
+			return inspect.ExitCode, nil
+		}
+		if time.Now().After(deadline) {
+			return 0, fmt.Errorf("docker exec %q was still running %v after its output ended", id, dockerExecExitTimeout)
+		}
+		time.Sleep(dockerExecPollInterval)
+	}
+}
+
+// dockerExitError is returned when a docker exec exits with a non-zero code
+type dockerExitError struct {
+	ExitCode int
+}
+
+func (e *dockerExitError) Error() string {
+	return fmt.Sprintf("exit status %d", e.ExitCode)
+}
+
+// demultiplexDockerStream splits the docker attach stream into stdout and stderr.
+// Each frame has an 8 byte header: the stream (1 = stdout, 2 = stderr), 3 padding bytes, and the big-endian frame length.
+func demultiplexDockerStream(r io.Reader, stdout io.Writer, stderr io.Writer) error {
+	header := make([]byte, 8)
+	for {
+		_, err := io.ReadFull(r, header)
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("error reading docker stream: %v", err)
+		}
+
+		w := stdout
+		if header[0] == 2 {
+			w = stderr
+		}
+		length := int64(binary.BigEndian.Uint32(header[4:]))
+		if _, err := io.CopyN(w, r, length); err != nil {
+			return fmt.Errorf("error reading docker stream: %v", err)
+		}
+	}
+}
+
+// putArchive extracts the tar stream into the directory dir in the container
+func (e *DockerExecutor) putArchive(dir string, archive io.Reader) error {
+	query := url.Values{}
+	query.Set("path", dir)
+	response, err := e.do("PUT", "/containers/"+e.containerID+"/archive", query, archive, "application/x-tar")
+	if err != nil {
+		return err
+	}
+	response.Body.Close()
+	return nil
+}
+
+// getArchive returns a tar stream of p in the container; entries are prefixed by the base name of p
+func (e *DockerExecutor) getArchive(p string) (io.ReadCloser, error) {
+	query := url.Values{}
+	query.Set("path", p)
+	response, err := e.do("GET", "/containers/"+e.containerID+"/archive", query, nil, "")
+	if err != nil {
+		if isDockerNotFound(err) {
+			return nil, &os.PathError{Op: "get", Path: p, Err: os.ErrNotExist}
+		}
+		return nil, err
+	}
+	return response.Body, nil
+}
+
+func (e *DockerExecutor) Mkdir(dest string, mode os.FileMode) error {
+	var archive bytes.Buffer
+	tw := tar.NewWriter(&archive)
+	err := tw.WriteHeader(&tar.Header{
+		Name:     path.Base(dest) + "/",
+		Mode:     int64(mode.Perm()),
+		Typeflag: tar.TypeDir,
+		ModTime:  time.Now(),
+	})
+	if err != nil {
+		return fmt.Errorf("error building tar: %v", err)
+	}
+	if err := tw.Close(); err != nil {
+		return fmt.Errorf("error building tar: %v", err)
+	}
+
+	glog.Infof("Doing docker mkdir: %q", dest)
+	if err := e.putArchive(path.Dir(dest), &archive); err != nil {
+		return fmt.Errorf("error creating directory %q: %v", dest, err)
+	}
+	return nil
+}
+
+func (e *DockerExecutor) Put(dest string, length int, content io.Reader, mode os.FileMode) error {
+	// The tar header needs the length
+	if length < 0 {
+		data, err := ioutil.ReadAll(content)
+		if err != nil {
+			return fmt.Errorf("error reading content for %q: %v", dest, err)
+		}
+		length = len(data)
+		content = bytes.NewReader(data)
+	}
+
+	r, w := io.Pipe()
+	go func() {
+		tw := tar.NewWriter(w)
+		err := tw.WriteHeader(&tar.Header{
+			Name:     path.Base(dest),
+			Mode:     int64(mode.Perm()),
+			Size:     int64(length),
+			Typeflag: tar.TypeReg,
+			ModTime:  time.Now(),
+		})
+		if err == nil {
+			_, err = io.Copy(tw, content)
+		}
+		if err == nil {
+			err = tw.Close()
+		}
+		w.CloseWithError(err)
+	}()
+
+	glog.Infof("Doing docker upload: %q", dest)
+	if err := e.putArchive(path.Dir(dest), r); err != nil {
+		r.Close()
+		return fmt.Errorf("error uploading %q: %v", dest, err)
+	}
+	return nil
+}
+
+func (e *DockerExecutor) Get(src string, dest io.Writer) error {
+	archive, err := e.getArchive(src)
+	if err != nil {
+		return err
+	}
+	defer archive.Close()
+
+	tr := tar.NewReader(archive)
+	for {
+		header, err := tr.Next()
+		if err == io.EOF {
+			return fmt.Errorf("file %q not found in docker archive", src)
+		}
+		if err != nil {
+			return fmt.Errorf("error reading docker archive: %v", err)
+		}
+		if header.Typeflag != tar.TypeReg && header.Typeflag != tar.TypeRegA {
+			return fmt.Errorf("%q is not a regular file", src)
+		}
+		_, err = io.Copy(dest, tr)
+		if err != nil {
+			return fmt.Errorf("error reading %q: %v", src, err)
+		}
+		return nil
+	}
+}
+
+func (e *DockerExecutor) PutDir(localDir string, dest string) error {
+	_, _, err := e.exec([]string{"mkdir", "-p", dest})
+	if err != nil {
+		return fmt.Errorf("error creating directory %q: %v", dest, err)
+	}
+
+	r, w := io.Pipe()
+	go func() {
+		w.CloseWithError(writeTar(localDir, w))
+	}()
+
+	glog.Infof("Doing docker directory upload: %q -> %q", localDir, dest)
+	if err := e.putArchive(dest, r); err != nil {
+		r.Close()
+		return fmt.Errorf("error uploading directory %q: %v", localDir, err)
+	}
+	return nil
+}
+
+func (e *DockerExecutor) GetDir(src string, localDir string) error {
+	archive, err := e.getArchive(src)
+	if err != nil {
+		return err
+	}
+	defer archive.Close()
+
+	glog.Infof("Doing docker directory download: %q -> %q", src, localDir)
+	return extractTar(archive, localDir, path.Base(src))
+}
+
+func (e *DockerExecutor) Stat(p string) (os.FileInfo, error) {
+	query := url.Values{}
+	query.Set("path", p)
+	response, err := e.do("HEAD", "/containers/"+e.containerID+"/archive", query, nil, "")
+	if err != nil {
+		if isDockerNotFound(err) {
+			return nil, &os.PathError{Op: "stat", Path: p, Err: os.ErrNotExist}
+		}
+		return nil, err
+	}
+	response.Body.Close()
+
+	// The stat is returned as base64-encoded JSON in a header
+	var stat struct {
+		Name  string
+		Size  int64
+		Mode  uint32
+		Mtime time.Time
+	}
+	header := response.Header.Get("X-Docker-Container-Path-Stat")
+	data, err := base64.StdEncoding.DecodeString(header)
+	if err != nil {
+		return nil, fmt.Errorf("error decoding docker path stat %q: %v", header, err)
+	}
+	if err := json.Unmarshal(data, &stat); err != nil {
+		return nil, fmt.Errorf("error parsing docker path stat %q: %v", string(data), err)
+	}
+
+	return &remoteFileInfo{
+		name:    stat.Name,
+		size:    stat.Size,
+		mode:    os.FileMode(stat.Mode),
+		modTime: stat.Mtime,
+	}, nil
+}
+
+func (e *DockerExecutor) Remove(p string) error {
+	stdout, stderr, err := e.exec([]string{"rm", "-rf", p})
+	if err != nil {
+		return fmt.Errorf("error removing %q: %v: %s%s", p, err, stdout, stderr)
+	}
+	return nil
+}
@@ -0,0 +1,122 @@
+/*
+Copyright 2016 The Kubernetes Authors All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package executor
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+// dockerFrame builds a frame of the docker attach stream
+func dockerFrame(stream byte, payload string) []byte {
+	header := make([]byte, 8)
+	header[0] = stream
+	binary.BigEndian.PutUint32(header[4:], uint32(len(payload)))
+	return append(header, payload...)
+}
+
+func TestDemultiplexDockerStream(t *testing.T) {
+	grid := []struct {
+		Frames [][]byte
+		Stdout string
+		Stderr string
+		Error  bool
+	}{
+		{
+			Frames: nil,
+		},
+		{
+			Frames: [][]byte{dockerFrame(1, "hello\n"), dockerFrame(2, "warning\n"), dockerFrame(1, "world\n")},
+			Stdout: "hello\nworld\n",
+			Stderr: "warning\n",
+		},
+		{
+			Frames: [][]byte{dockerFrame(1, ""), dockerFrame(2, "only stderr")},
+			Stderr: "only stderr",
+		},
+		{
+			// Truncated header
+			Frames: [][]byte{dockerFrame(1, "ok"), {1, 0, 0}},
+			Stdout: "ok",
+			Error:  true,
+		},
+		{
+			// Truncated payload
+			Frames: [][]byte{dockerFrame(2, "partial")[:10]},
+			Stderr: "pa",
+			Error:  true,
+		},
+	}
+	for i, g := range grid {
+		var stdout, stderr bytes.Buffer
+		err := demultiplexDockerStream(bytes.NewReader(bytes.Join(g.Frames, nil)), &stdout, &stderr)
+		if (err != nil) != g.Error {
+			t.Errorf("case %d: expected error=%v, was %v", i, g.Error, err)
+		}
+		if stdout.String() != g.Stdout {
+			t.Errorf("case %d: expected stdout %q, was %q", i, g.Stdout, stdout.String())
+		}
+		if stderr.String() != g.Stderr {
+			t.Errorf("case %d: expected stderr %q, was %q", i, g.Stderr, stderr.String())
+		}
+	}
+}
+
+func TestWaitExecWaitsUntilNotRunning(t *testing.T) {
+	defer func(interval time.Duration) { dockerExecPollInterval = interval }(dockerExecPollInterval)
+	dockerExecPollInterval = time.Millisecond
+
+	inspections := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/"+dockerAPIVersion+"/exec/abc/json" {
+			http.NotFound(w, r)
+			return
+		}
+		inspections++
+		if inspections < 3 {
+			fmt.Fprint(w, `{"Running": true, "ExitCode": 0}`)
+			return
+		}
+		fmt.Fprint(w, `{"Running": false, "ExitCode": 2}`)
+	}))
+	defer server.Close()
+
+	e := &DockerExecutor{client: &http.Client{
+		Transport: &http.Transport{
+			Dial: func(network, addr string) (net.Conn, error) {
+				return net.Dial("tcp", server.Listener.Addr().String())
+			},
+		},
+	}}
+
+	exitCode, err := e.waitExec("abc")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if exitCode != 2 {
+		t.Errorf("expected exit code 2, was %d", exitCode)
+	}
+	if inspections != 3 {
+		t.Errorf("expected 3 inspections, was %d", inspections)
+	}
+}
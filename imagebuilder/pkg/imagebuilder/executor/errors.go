@@ -0,0 +1,119 @@
+/*
+Copyright 2016 The Kubernetes Authors All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package executor
+
+import (
+	"fmt"
+	"os/exec"
+	"syscall"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// outputTailLength is the amount of stdout / stderr we keep in a CommandError
+const outputTailLength = 4096
+
+// CommandError is returned when a command does not complete successfully
+type CommandError struct {
+	// Command is the argv of the command
+	Command []string
+
+	// ExitStatus is the exit code of the command, or -1 if it did not exit normally
+	ExitStatus int
+	// Signal is the name of the signal that killed the command, if any
+	Signal string
+
+	// Stdout and Stderr are the last few KB of output
+	Stdout string
+	Stderr string
+
+	// Duration is how long the command ran
+	Duration time.Duration
+
+	// Err is the underlying error
+	Err error
+}
+
+var _ error = &CommandError{}
+
+func (e *CommandError) Error() string {
+	switch {
+	case e.Signal != "":
+		return fmt.Sprintf("command %q killed by signal %s after %v", e.Command, e.Signal, e.Duration)
+	case e.ExitStatus >= 0:
+		return fmt.Sprintf("command %q failed with exit status %d after %v", e.Command, e.ExitStatus, e.Duration)
+	default:
+		return fmt.Sprintf("error executing command %q: %v", e.Command, e.Err)
+	}
+}
+
+// Exited returns true if the command ran to completion (or was killed by a signal),
+// false if we don't know the result, for example because the connection was lost
+func (e *CommandError) Exited() bool {
+	return e.ExitStatus >= 0 || e.Signal != ""
+}
+
+// IsCommandFailure returns true if err is a CommandError for a command that ran and failed,
+// as opposed to (for example) a network error
+func IsCommandFailure(err error) bool {
+	cmdErr, ok := err.(*CommandError)
+	return ok && cmdErr.Exited()
+}
+
+// newCommandError builds a CommandError from the error returned by running the command
+func newCommandError(command []string, stdout []byte, stderr []byte, duration time.Duration, err error) *CommandError {
+	e := &CommandError{
+		Command:    command,
+		ExitStatus: -1,
+		Stdout:     tail(stdout),
+		Stderr:     tail(stderr),
+		Duration:   duration,
+		Err:        err,
+	}
+
+	switch err := err.(type) {
+	case *ssh.ExitError:
+		if err.Signal() != "" {
+			e.Signal = err.Signal()
+		} else {
+			e.ExitStatus = err.ExitStatus()
+		}
+
+	case *dockerExitError:
+		e.ExitStatus = err.ExitCode
+
+	case *exec.ExitError:
+		if status, ok := err.Sys().(syscall.WaitStatus); ok {
+			if status.Signaled() {
+				e.Signal = status.Signal().String()
+			} else {
+				e.ExitStatus = status.ExitStatus()
+			}
+		}
+	}
+
+	return e
+}
+
+// tail returns the last outputTailLength bytes of b
+func tail(b []byte) string {
+	if len(b) > outputTailLength {
+		b = b[len(b)-outputTailLength:]
+	}
+	return string(b)
+}
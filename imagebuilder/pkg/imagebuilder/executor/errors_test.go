@@ -0,0 +1,127 @@
+/*
+Copyright 2016 The Kubernetes Authors All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package executor
+
+import (
+	"fmt"
+	"os/exec"
+	"strings"
+	"testing"
+	"time"
+)
+
+// runError runs a shell script locally, returning the error from exec
+func runError(t *testing.T, script string) error {
+	err := exec.Command("/bin/sh", "-c", script).Run()
+	if err == nil {
+		t.Fatalf("expected %q to fail", script)
+	}
+	return err
+}
+
+func TestNewCommandError(t *testing.T) {
+	long := strings.Repeat("x", outputTailLength) + "the end"
+
+	grid := []struct {
+		Name         string
+		Err          error
+		Stdout       string
+		Stderr       string
+		ExitStatus   int
+		Signal       string
+		Exited       bool
+		ExpectStdout string
+		ExpectStderr string
+		ExpectError  string
+	}{
+		{
+			Name:        "exit status",
+			Err:         runError(t, "exit 3"),
+			ExitStatus:  3,
+			Exited:      true,
+			ExpectError: "failed with exit status 3",
+		},
+		{
+			Name:        "signal",
+			Err:         runError(t, "kill -KILL $$"),
+			ExitStatus:  -1,
+			Signal:      "killed",
+			Exited:      true,
+			ExpectError: "killed by signal killed",
+		},
+		{
+			Name:        "docker exit code",
+			Err:         &dockerExitError{ExitCode: 2},
+			ExitStatus:  2,
+			Exited:      true,
+			ExpectError: "failed with exit status 2",
+		},
+		{
+			Name:        "connection error",
+			Err:         fmt.Errorf("connection reset"),
+			ExitStatus:  -1,
+			Exited:      false,
+			ExpectError: "error executing command",
+		},
+		{
+			Name:         "short output is kept",
+			Err:          &dockerExitError{ExitCode: 1},
+			Stdout:       "out",
+			Stderr:       "err",
+			ExitStatus:   1,
+			Exited:       true,
+			ExpectStdout: "out",
+			ExpectStderr: "err",
+			ExpectError:  "failed with exit status 1",
+		},
+		{
+			Name:         "long output is truncated to the tail",
+			Err:          &dockerExitError{ExitCode: 1},
+			Stdout:       long,
+			Stderr:       "err" + long,
+			ExitStatus:   1,
+			Exited:       true,
+			ExpectStdout: long[len(long)-outputTailLength:],
+			ExpectStderr: long[len(long)-outputTailLength:],
+			ExpectError:  "failed with exit status 1",
+		},
+	}
+	for _, g := range grid {
+		e := newCommandError([]string{"test"}, []byte(g.Stdout), []byte(g.Stderr), time.Second, g.Err)
+		if e.ExitStatus != g.ExitStatus {
+			t.Errorf("%s: expected exit status %d, got %d", g.Name, g.ExitStatus, e.ExitStatus)
+		}
+		if e.Signal != g.Signal {
+			t.Errorf("%s: expected signal %q, got %q", g.Name, g.Signal, e.Signal)
+		}
+		if e.Exited() != g.Exited || IsCommandFailure(e) != g.Exited {
+			t.Errorf("%s: expected Exited %v, got %v", g.Name, g.Exited, e.Exited())
+		}
+		if e.Stdout != g.ExpectStdout {
+			t.Errorf("%s: expected stdout of %d bytes, got %d bytes", g.Name, len(g.ExpectStdout), len(e.Stdout))
+		}
+		if e.Stderr != g.ExpectStderr {
+			t.Errorf("%s: expected stderr of %d bytes, got %d bytes", g.Name, len(g.ExpectStderr), len(e.Stderr))
+		}
+		if !strings.Contains(e.Error(), g.ExpectError) {
+			t.Errorf("%s: expected error containing %q, got %q", g.Name, g.ExpectError, e.Error())
+		}
+		if e.Err != g.Err {
+			t.Errorf("%s: expected the underlying error to be kept", g.Name)
+		}
+	}
+}
@@ -0,0 +1,379 @@
+/*
+Copyright 2016 The Kubernetes Authors All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package executor
+
+import (
+	"archive/tar"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/golang/glog"
+)
+
+// fileSystem is the set of file operations we need to copy directory trees
+type fileSystem interface {
+	Put(dest string, content io.Reader, mode os.FileMode) error
+	Get(src string, dest io.Writer) error
+	Mkdir(dest string, mode os.FileMode) error
+	Stat(p string) (os.FileInfo, error)
+	ReadDir(p string) ([]os.FileInfo, error)
+}
+
+// POSIX file type bits, as found in a raw file mode
+const (
+	posixTypeMask = 0170000
+	posixDir      = 0040000
+	posixSymlink  = 0120000
+)
+
+// statAttrs holds the attributes of a remote file, with permissions as the raw POSIX mode
+type statAttrs struct {
+	size        uint64
+	permissions uint32
+	mtime       uint32
+}
+
+func (a *statAttrs) fileInfo(name string) os.FileInfo {
+	mode := os.FileMode(a.permissions & 0777)
+	switch a.permissions & posixTypeMask {
+	case posixDir:
+		mode |= os.ModeDir
+	case posixSymlink:
+		mode |= os.ModeSymlink
+	}
+	return &remoteFileInfo{
+		name:    name,
+		size:    int64(a.size),
+		mode:    mode,
+		modTime: time.Unix(int64(a.mtime), 0),
+	}
+}
+
+// remoteFileInfo implements os.FileInfo for a file on a remote system
+type remoteFileInfo struct {
+	name    string
+	size    int64
+	mode    os.FileMode
+	modTime time.Time
+}
+
+var _ os.FileInfo = &remoteFileInfo{}
+
+func (i *remoteFileInfo) Name() string       { return i.name }
+func (i *remoteFileInfo) Size() int64        { return i.size }
+func (i *remoteFileInfo) Mode() os.FileMode  { return i.mode }
+func (i *remoteFileInfo) ModTime() time.Time { return i.modTime }
+func (i *remoteFileInfo) IsDir() bool        { return i.mode.IsDir() }
+func (i *remoteFileInfo) Sys() interface{}   { return nil }
+
+// putDir recursively copies the local directory localDir to dest on fs
+func putDir(fs fileSystem, localDir string, dest string) error {
+	return filepath.Walk(localDir, func(p string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+
+		relativePath, err := filepath.Rel(localDir, p)
+		if err != nil {
+			return err
+		}
+		target := path.Join(dest, filepath.ToSlash(relativePath))
+
+		switch {
+		case info.IsDir():
+			if _, err := fs.Stat(target); err == nil {
+				return nil
+			} else if !os.IsNotExist(err) {
+				return err
+			}
+			glog.V(2).Infof("Creating directory %q", target)
+			return fs.Mkdir(target, info.Mode().Perm())
+
+		case info.Mode().IsRegular():
+			f, err := os.Open(p)
+			if err != nil {
+				return fmt.Errorf("error opening file %q: %v", p, err)
+			}
+			defer f.Close()
+
+			glog.V(2).Infof("Uploading %q to %q", p, target)
+			return fs.Put(target, f, info.Mode().Perm())
+
+		default:
+			glog.Warningf("Skipping %q, which is not a regular file or directory", p)
+			return nil
+		}
+	})
+}
+
+// getDir recursively copies the directory src on fs to the local directory localDir
+func getDir(fs fileSystem, src string, localDir string) error {
+	info, err := fs.Stat(src)
+	if err != nil {
+		return err
+	}
+	if !info.IsDir() {
+		return fmt.Errorf("%q is not a directory", src)
+	}
+
+	if err := os.MkdirAll(localDir, info.Mode().Perm()); err != nil {
+		return fmt.Errorf("error creating directory %q: %v", localDir, err)
+	}
+
+	children, err := fs.ReadDir(src)
+	if err != nil {
+		return err
+	}
+
+	for _, child := range children {
+		childSrc := path.Join(src, child.Name())
+		childDest := filepath.Join(localDir, child.Name())
+
+		switch {
+		case child.IsDir():
+			if err := getDir(fs, childSrc, childDest); err != nil {
+				return err
+			}
+
+		case child.Mode().IsRegular():
+			glog.V(2).Infof("Downloading %q to %q", childSrc, childDest)
+			if err := getFile(fs, childSrc, childDest, child.Mode().Perm()); err != nil {
+				return err
+			}
+
+		default:
+			glog.Warningf("Skipping %q, which is not a regular file or directory", childSrc)
+		}
+	}
+
+	return nil
+}
+
+func getFile(fs fileSystem, src string, localPath string, mode os.FileMode) error {
+	f, err := os.OpenFile(localPath, os.O_RDWR|os.O_CREATE|os.O_TRUNC, mode)
+	if err != nil {
+		return fmt.Errorf("error creating file %q: %v", localPath, err)
+	}
+	err = fs.Get(src, f)
+	if err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return fmt.Errorf("error closing file %q: %v", localPath, err)
+	}
+	return nil
+}
+
+// writeTar writes the local directory localDir as a tar stream to w
+func writeTar(localDir string, w io.Writer) error {
+	tw := tar.NewWriter(w)
+
+	err := filepath.Walk(localDir, func(p string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+
+		relativePath, err := filepath.Rel(localDir, p)
+		if err != nil {
+			return err
+		}
+		if relativePath == "." {
+			return nil
+		}
+
+		if !info.IsDir() && !info.Mode().IsRegular() {
+			glog.Warningf("Skipping %q, which is not a regular file or directory", p)
+			return nil
+		}
+
+		header, err := tar.FileInfoHeader(info, "")
+		if err != nil {
+			return fmt.Errorf("error building tar header for %q: %v", p, err)
+		}
+		header.Name = filepath.ToSlash(relativePath)
+		if info.IsDir() {
+			header.Name += "/"
+		}
+		if err := tw.WriteHeader(header); err != nil {
+			return fmt.Errorf("error writing tar header for %q: %v", p, err)
+		}
+
+		if info.IsDir() {
+			return nil
+		}
+
+		f, err := os.Open(p)
+		if err != nil {
+			return fmt.Errorf("error opening file %q: %v", p, err)
+		}
+		defer f.Close()
+		if _, err := io.Copy(tw, f); err != nil {
+			return fmt.Errorf("error writing %q to tar: %v", p, err)
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	return tw.Close()
+}
+
+// extractTar extracts the tar stream from r into the local directory localDir.
+// If stripPrefix is not empty, entries must be under that directory, which is removed from their names.
+func extractTar(r io.Reader, localDir string, stripPrefix string) error {
+	tr := tar.NewReader(r)
+	for {
+		header, err := tr.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("error reading tar: %v", err)
+		}
+
+		name := path.Clean(header.Name)
+		if stripPrefix != "" {
+			if name == stripPrefix {
+				name = "."
+			} else if strings.HasPrefix(name, stripPrefix+"/") {
+				name = strings.TrimPrefix(name, stripPrefix+"/")
+			} else {
+				return fmt.Errorf("unexpected tar entry %q outside of %q", header.Name, stripPrefix)
+			}
+		}
+		if name == "." {
+			if header.Typeflag == tar.TypeDir {
+				if err := os.MkdirAll(localDir, os.FileMode(header.Mode).Perm()); err != nil {
+					return fmt.Errorf("error creating directory %q: %v", localDir, err)
+				}
+			}
+			continue
+		}
+		if path.IsAbs(name) || name == ".." || strings.HasPrefix(name, "../") {
+			return fmt.Errorf("refusing to extract tar entry outside destination: %q", header.Name)
+		}
+		target := filepath.Join(localDir, filepath.FromSlash(name))
+		mode := os.FileMode(header.Mode).Perm()
+
+		switch header.Typeflag {
+		case tar.TypeDir:
+			if err := os.MkdirAll(target, mode); err != nil {
+				return fmt.Errorf("error creating directory %q: %v", target, err)
+			}
+
+		case tar.TypeReg, tar.TypeRegA:
+			if err := os.MkdirAll(filepath.Dir(target), 0755); err != nil {
+				return fmt.Errorf("error creating directory %q: %v", filepath.Dir(target), err)
+			}
+			f, err := os.OpenFile(target, os.O_RDWR|os.O_CREATE|os.O_TRUNC, mode)
+			if err != nil {
+				return fmt.Errorf("error creating file %q: %v", target, err)
+			}
+			_, err = io.Copy(f, tr)
+			closeErr := f.Close()
+			if err != nil {
+				return fmt.Errorf("error writing file %q: %v", target, err)
+			}
+			if closeErr != nil {
+				return fmt.Errorf("error closing file %q: %v", target, closeErr)
+			}
+
+		default:
+			glog.Warningf("Skipping tar entry %q of type %c", header.Name, header.Typeflag)
+		}
+	}
+}
+
+// localFileSystem implements fileSystem against the local machine
+type localFileSystem struct{}
+
+var _ fileSystem = &localFileSystem{}
+
+func (l *localFileSystem) Put(dest string, content io.Reader, mode os.FileMode) error {
+	f, err := os.OpenFile(dest, os.O_RDWR|os.O_CREATE|os.O_TRUNC, mode)
+	if err != nil {
+		return fmt.Errorf("error opening file %q: %v", dest, err)
+	}
+
+	defer func() {
+		if f != nil {
+			err := f.Close()
+			if err != nil {
+				glog.Warningf("error closing file %q: %v", dest, err)
+			}
+		}
+	}()
+
+	_, err = io.Copy(f, content)
+	if err != nil {
+		return fmt.Errorf("error writing file %q: %v", dest, err)
+	}
+
+	err = f.Close()
+	f = nil // Don't close in defer block
+	if err != nil {
+		return fmt.Errorf("error closing file %q: %v", dest, err)
+	}
+
+	return os.Chmod(dest, mode)
+}
+
+func (l *localFileSystem) Get(src string, dest io.Writer) error {
+	f, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	_, err = io.Copy(dest, f)
+	if err != nil {
+		return fmt.Errorf("error reading file %q: %v", src, err)
+	}
+	return nil
+}
+
+func (l *localFileSystem) Mkdir(dest string, mode os.FileMode) error {
+	return mkdirLocal(dest, mode)
+}
+
+// mkdirLocal creates the local directory dest.  Like the remote executors, it is not an error if dest is
+// already a directory; its mode is left unchanged.
+func mkdirLocal(dest string, mode os.FileMode) error {
+	err := os.Mkdir(dest, mode)
+	if err != nil && os.IsExist(err) {
+		if info, statErr := os.Stat(dest); statErr == nil && info.IsDir() {
+			return nil
+		}
+	}
+	return err
+}
+
+func (l *localFileSystem) Stat(p string) (os.FileInfo, error) {
+	return os.Stat(p)
+}
+
+func (l *localFileSystem) ReadDir(p string) ([]os.FileInfo, error) {
+	return ioutil.ReadDir(p)
+}
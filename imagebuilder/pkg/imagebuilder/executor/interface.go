@@ -8,6 +8,7 @@ import (
 	"math/rand"
 	"os"
 	"strings"
+	"time"
 )
 
 type Executor interface {
@@ -15,11 +16,27 @@ type Executor interface {
 
 	Run(c *CommandExecution) error
 
+	// Put uploads content to the file dest.  length may be -1 if it is not known.
 	Put(dest string, length int, content io.Reader, mode os.FileMode) error
+	// Mkdir creates the directory dest.  It is not an error if dest is already a directory.
 	Mkdir(dest string, mode os.FileMode) error
+
+	// Get downloads the file src, writing the contents to dest
+	Get(src string, dest io.Writer) error
+
+	// PutDir recursively uploads the local directory localDir to dest
+	PutDir(localDir string, dest string) error
+	// GetDir recursively downloads the directory src to the local directory localDir
+	GetDir(src string, localDir string) error
+
+	// Stat returns information about the file p; the error satisfies os.IsNotExist if it does not exist
+	Stat(p string) (os.FileInfo, error)
+	// Remove removes the file or directory p (recursively); it is not an error if p does not exist
+	Remove(p string) error
 }
 
-type runFunction func(cmd []string) ([]byte, error)
+// runFunction runs a command, returning stdout and stderr
+type runFunction func(cmd []string) ([]byte, []byte, error)
 
 // runCommand is a helper function for executing a command
 func runCommand(cmd *CommandExecution, x Executor, runner runFunction) error {
@@ -28,34 +45,12 @@ func runCommand(cmd *CommandExecution, x Executor, runner runFunction) error {
 		glog.Warningf("sudo used with command that includes sudo (%q)", cmd.Command)
 	}
 
-	var script bytes.Buffer
-
-	needScript := false
-
-	script.WriteString("#!/bin/bash -e\n")
-	if cmd.Cwd != "" {
-		script.WriteString("cd " + cmd.Cwd + "\n")
-		needScript = true
-	}
-	if cmd.Env != nil && len(cmd.Env) != 0 {
-		// Most SSH servers are configured not to accept arbitrary env vars
-		for k, v := range cmd.Env {
-			/*			err := session.Setenv(k, v)
-						if err != nil {
-							return fmt.Errorf("error setting env var in SSH session: %v", err)
-						}
-			*/
-			script.WriteString("export " + k + "='" + v + "'\n")
-			needScript = true
-		}
-	}
-	script.WriteString(joinCommand(cmd.Command) + "\n")
+	script, needScript := buildScript(cmd)
 
 	cmdToRun := cmd.Command
 	if needScript {
 		tmpScript := fmt.Sprintf("/tmp/ssh-exec-%d", rand.Int63())
-		scriptBytes := script.Bytes()
-		err := x.Put(tmpScript, len(scriptBytes), bytes.NewReader(scriptBytes), 0755)
+		err := x.Put(tmpScript, len(script), bytes.NewReader(script), 0755)
 		if err != nil {
 			return fmt.Errorf("error uploading temporary script: %v", err)
 		}
@@ -73,17 +68,49 @@ func runCommand(cmd *CommandExecution, x Executor, runner runFunction) error {
 
 	// We "lie" about the command we're running when we're using a script
 	glog.Infof("Executing command: %q", cmd.Command)
-	output, err := runner(cmdToRun)
+	start := time.Now()
+	stdout, stderr, err := runner(cmdToRun)
+	duration := time.Since(start)
 	if err != nil {
-		glog.Infof("Error from SSH command %q: %v", cmd.Command, err)
-		glog.Infof("Output was: %s", output)
-		return fmt.Errorf("error executing SSH command %q: %v", cmd.Command, err)
+		glog.Infof("Error from command %q: %v", cmd.Command, err)
+		glog.Infof("Output was: %s%s", stdout, stderr)
+		return newCommandError(cmd.Command, stdout, stderr, duration, err)
 	}
 
-	glog.V(2).Infof("Output was: %s", output)
+	glog.V(2).Infof("Output was: %s%s", stdout, stderr)
+	glog.V(2).Infof("Command %q completed in %v", cmd.Command, duration)
 	return nil
 }
 
+// buildScript builds a shell script that runs the command in the requested directory & environment.
+// needScript is false if the command can be executed directly.
+func buildScript(cmd *CommandExecution) ([]byte, bool) {
+	var script bytes.Buffer
+
+	needScript := false
+
+	script.WriteString("#!/bin/bash -e\n")
+	if cmd.Cwd != "" {
+		script.WriteString("cd " + cmd.Cwd + "\n")
+		needScript = true
+	}
+	if cmd.Env != nil && len(cmd.Env) != 0 {
+		// Most SSH servers are configured not to accept arbitrary env vars
+		for k, v := range cmd.Env {
+			/*			err := session.Setenv(k, v)
+						if err != nil {
+							return fmt.Errorf("error setting env var in SSH session: %v", err)
+						}
+			*/
+			script.WriteString("export " + k + "='" + v + "'\n")
+			needScript = true
+		}
+	}
+	script.WriteString(joinCommand(cmd.Command) + "\n")
+
+	return script.Bytes(), needScript
+}
+
 func joinCommand(argv []string) string {
 	// TODO: escaping
 	return strings.Join(argv, " ")
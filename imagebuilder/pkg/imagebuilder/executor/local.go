@@ -1,8 +1,7 @@
 package executor
 
 import (
-	"fmt"
-	"github.com/golang/glog"
+	"bytes"
 	"io"
 	"os"
 	"os/exec"
@@ -18,47 +17,48 @@ func (e *LocalhostExecutor) Close() error {
 }
 
 func (s *LocalhostExecutor) Mkdir(dest string, mode os.FileMode) error {
-	return os.Mkdir(dest, mode)
+	return mkdirLocal(dest, mode)
 }
 
 func (s *LocalhostExecutor) Put(dest string, length int, content io.Reader, mode os.FileMode) error {
-	f, err := os.OpenFile(dest, os.O_RDWR|os.O_CREATE|os.O_TRUNC, mode)
-	if err != nil {
-		return fmt.Errorf("error opening file %q: %v", err)
-	}
+	fs := &localFileSystem{}
+	return fs.Put(dest, content, mode)
+}
 
-	defer func() {
-		if f != nil {
-			err := f.Close()
-			if err != nil {
-				glog.Warningf("error closing file %q: %v", dest, err)
-			}
-		}
-	}()
+func (s *LocalhostExecutor) Get(src string, dest io.Writer) error {
+	fs := &localFileSystem{}
+	return fs.Get(src, dest)
+}
+
+func (s *LocalhostExecutor) PutDir(localDir string, dest string) error {
+	return putDir(&localFileSystem{}, localDir, dest)
+}
 
-	_, err = io.Copy(f, content)
-	if err != nil {
-		return fmt.Errorf("error writing file %q: %v", dest, err)
-	}
+func (s *LocalhostExecutor) GetDir(src string, localDir string) error {
+	return getDir(&localFileSystem{}, src, localDir)
+}
 
-	err = f.Close()
-	f = nil // Don't close in defer block
-	if err != nil {
-		return fmt.Errorf("error closing file %q: %v", dest, err)
-	}
+func (s *LocalhostExecutor) Stat(p string) (os.FileInfo, error) {
+	return os.Stat(p)
+}
 
-	return nil
+func (s *LocalhostExecutor) Remove(p string) error {
+	return os.RemoveAll(p)
 }
 
 func (s *LocalhostExecutor) Run(cmd *CommandExecution) error {
-	return runCommand(cmd, s, func(command []string) ([]byte, error) {
+	return runCommand(cmd, s, func(command []string) ([]byte, []byte, error) {
 		name := command[0]
 		args := []string{}
 		if len(command) > 1 {
 			args = command[1:]
 		}
 
-		output, err := exec.Command(name, args...).CombinedOutput()
-		return output, err
+		var stdout, stderr bytes.Buffer
+		c := exec.Command(name, args...)
+		c.Stdout = &stdout
+		c.Stderr = &stderr
+		err := c.Run()
+		return stdout.Bytes(), stderr.Bytes(), err
 	})
 }
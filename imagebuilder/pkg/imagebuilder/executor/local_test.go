@@ -0,0 +1,48 @@
+/*
+Copyright 2016 The Kubernetes Authors All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package executor
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestLocalhostMkdirExisting(t *testing.T) {
+	dir, err := ioutil.TempDir("", "mkdir")
+	if err != nil {
+		t.Fatalf("error creating temp dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	e := &LocalhostExecutor{}
+	p := filepath.Join(dir, "files")
+	for i := 0; i < 2; i++ {
+		if err := e.Mkdir(p, 0755); err != nil {
+			t.Fatalf("Mkdir %d: unexpected error: %v", i+1, err)
+		}
+	}
+
+	f := filepath.Join(dir, "file")
+	if err := ioutil.WriteFile(f, nil, 0644); err != nil {
+		t.Fatalf("error writing file: %v", err)
+	}
+	if err := e.Mkdir(f, 0755); err == nil {
+		t.Errorf("expected an error from Mkdir over a file")
+	}
+}
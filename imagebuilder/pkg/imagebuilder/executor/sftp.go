@@ -0,0 +1,172 @@
+/*
+Copyright 2016 The Kubernetes Authors All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package executor
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path"
+
+	"github.com/golang/glog"
+	"github.com/pkg/sftp"
+	"golang.org/x/crypto/ssh"
+)
+
+// sftpClient adapts an sftp.Client on an SSH session to our fileSystem interface
+type sftpClient struct {
+	session *ssh.Session
+	client  *sftp.Client
+}
+
+var _ fileSystem = &sftpClient{}
+
+// errSFTPNotSupported is returned if the server does not support the sftp subsystem
+var errSFTPNotSupported = errors.New("sftp subsystem not supported")
+
+// newSFTPClient starts the sftp subsystem on a new session
+func newSFTPClient(session *ssh.Session) (*sftpClient, error) {
+	w, err := session.StdinPipe()
+	if err != nil {
+		return nil, fmt.Errorf("error opening stdin for sftp: %v", err)
+	}
+	r, err := session.StdoutPipe()
+	if err != nil {
+		return nil, fmt.Errorf("error opening stdout for sftp: %v", err)
+	}
+	err = session.RequestSubsystem("sftp")
+	if err != nil {
+		glog.V(2).Infof("error starting sftp subsystem: %v", err)
+		return nil, errSFTPNotSupported
+	}
+
+	client, err := sftp.NewClientPipe(r, w)
+	if err != nil {
+		return nil, fmt.Errorf("error starting sftp client: %v", err)
+	}
+	return &sftpClient{session: session, client: client}, nil
+}
+
+// Close closes the sftp client and the underlying session
+func (c *sftpClient) Close() error {
+	c.client.Close()
+	if c.session == nil {
+		return nil
+	}
+	return c.session.Close()
+}
+
+// Put writes the contents to the remote file p, creating or truncating it
+func (c *sftpClient) Put(p string, content io.Reader, mode os.FileMode) error {
+	f, err := c.client.OpenFile(p, os.O_WRONLY|os.O_CREATE|os.O_TRUNC)
+	if err != nil {
+		return &os.PathError{Op: "open", Path: p, Err: err}
+	}
+	if _, err := io.Copy(f, content); err != nil {
+		f.Close()
+		return fmt.Errorf("error writing %q: %v", p, err)
+	}
+	if err := f.Close(); err != nil {
+		return &os.PathError{Op: "close", Path: p, Err: err}
+	}
+
+	// The umask may have applied on create; and an existing file keeps its old mode
+	return c.Chmod(p, mode)
+}
+
+// Get copies the contents of the remote file p to dest
+func (c *sftpClient) Get(p string, dest io.Writer) error {
+	f, err := c.client.Open(p)
+	if err != nil {
+		return &os.PathError{Op: "open", Path: p, Err: err}
+	}
+	defer f.Close()
+
+	if _, err := io.Copy(dest, f); err != nil {
+		return fmt.Errorf("error reading %q: %v", p, err)
+	}
+	return nil
+}
+
+// Mkdir creates the remote directory p.  It is not an error if p is already a directory;
+// its mode is left unchanged.
+func (c *sftpClient) Mkdir(p string, mode os.FileMode) error {
+	err := c.client.Mkdir(p)
+	if err != nil {
+		// Servers report an existing directory as a generic failure, so check what is there
+		if info, statErr := c.client.Stat(p); statErr == nil && info.IsDir() {
+			return nil
+		}
+		return &os.PathError{Op: "mkdir", Path: p, Err: err}
+	}
+	return c.Chmod(p, mode)
+}
+
+// Chmod sets the permissions of the remote file p
+func (c *sftpClient) Chmod(p string, mode os.FileMode) error {
+	if err := c.client.Chmod(p, mode.Perm()); err != nil {
+		return &os.PathError{Op: "chmod", Path: p, Err: err}
+	}
+	return nil
+}
+
+// Stat returns information about the remote file p, following symlinks
+func (c *sftpClient) Stat(p string) (os.FileInfo, error) {
+	info, err := c.client.Stat(p)
+	if err != nil {
+		return nil, &os.PathError{Op: "stat", Path: p, Err: err}
+	}
+	return info, nil
+}
+
+// ReadDir lists the remote directory p
+func (c *sftpClient) ReadDir(p string) ([]os.FileInfo, error) {
+	infos, err := c.client.ReadDir(p)
+	if err != nil {
+		return nil, &os.PathError{Op: "readdir", Path: p, Err: err}
+	}
+	return infos, nil
+}
+
+// RemoveAll removes the remote path p, recursively if it is a directory.  It is not an error if p does not exist.
+func (c *sftpClient) RemoveAll(p string) error {
+	info, err := c.client.Lstat(p)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return &os.PathError{Op: "lstat", Path: p, Err: err}
+	}
+
+	if info.IsDir() {
+		children, err := c.ReadDir(p)
+		if err != nil {
+			return err
+		}
+		for _, child := range children {
+			if err := c.RemoveAll(path.Join(p, child.Name())); err != nil {
+				return err
+			}
+		}
+	}
+
+	if err := c.client.Remove(p); err != nil {
+		return &os.PathError{Op: "remove", Path: p, Err: err}
+	}
+	return nil
+}
@@ -0,0 +1,125 @@
+/*
+Copyright 2016 The Kubernetes Authors All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package executor
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/pkg/sftp"
+)
+
+// pipeConn joins the ends of two pipes into a connection
+type pipeConn struct {
+	io.Reader
+	io.WriteCloser
+}
+
+// newTestSFTPClient returns a client connected to an in-process sftp server on the local filesystem
+func newTestSFTPClient(t *testing.T) *sftpClient {
+	serverReader, clientWriter := io.Pipe()
+	clientReader, serverWriter := io.Pipe()
+
+	server, err := sftp.NewServer(&pipeConn{serverReader, serverWriter})
+	if err != nil {
+		t.Fatalf("error creating sftp server: %v", err)
+	}
+	go func() {
+		// Like sftp-server, exit when the client closes its end
+		server.Serve()
+		serverWriter.Close()
+	}()
+
+	client, err := sftp.NewClientPipe(clientReader, clientWriter)
+	if err != nil {
+		t.Fatalf("error creating sftp client: %v", err)
+	}
+	return &sftpClient{client: client}
+}
+
+func TestSFTPClient(t *testing.T) {
+	dir, err := ioutil.TempDir("", "sftp")
+	if err != nil {
+		t.Fatalf("error creating temp dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	c := newTestSFTPClient(t)
+	defer c.Close()
+
+	sub := filepath.Join(dir, "sub")
+	if err := c.Mkdir(sub, 0750); err != nil {
+		t.Fatalf("error from Mkdir: %v", err)
+	}
+	if err := c.Mkdir(sub, 0755); err != nil {
+		t.Fatalf("Mkdir of an existing directory should succeed, was %v", err)
+	}
+	info, err := c.Stat(sub)
+	if err != nil {
+		t.Fatalf("error from Stat: %v", err)
+	}
+	if !info.IsDir() || info.Mode().Perm() != 0750 {
+		t.Fatalf("unexpected directory info: %v %v", info.IsDir(), info.Mode())
+	}
+
+	file := filepath.Join(sub, "file")
+	if err := c.Mkdir(file, 0755); err != nil {
+		t.Fatalf("error from Mkdir: %v", err)
+	}
+	if err := c.RemoveAll(file); err != nil {
+		t.Fatalf("error from RemoveAll: %v", err)
+	}
+	if err := ioutil.WriteFile(file, nil, 0644); err != nil {
+		t.Fatalf("error writing file: %v", err)
+	}
+	if err := c.Mkdir(file, 0755); err == nil {
+		t.Fatalf("Mkdir over a file should fail")
+	}
+
+	contents := bytes.Repeat([]byte("0123456789"), 10000)
+	if err := c.Put(file, bytes.NewReader(contents), 0600); err != nil {
+		t.Fatalf("error from Put: %v", err)
+	}
+	var got bytes.Buffer
+	if err := c.Get(file, &got); err != nil {
+		t.Fatalf("error from Get: %v", err)
+	}
+	if !bytes.Equal(got.Bytes(), contents) {
+		t.Fatalf("Get returned %d bytes, expected %d", got.Len(), len(contents))
+	}
+	if info, err := os.Stat(file); err != nil || info.Mode().Perm() != 0600 {
+		t.Fatalf("unexpected mode after Put: %v %v", info, err)
+	}
+
+	if _, err := c.Stat(filepath.Join(dir, "missing")); !os.IsNotExist(err) {
+		t.Fatalf("expected not-exist error from Stat, was %v", err)
+	}
+
+	if err := c.RemoveAll(sub); err != nil {
+		t.Fatalf("error from RemoveAll: %v", err)
+	}
+	if _, err := os.Stat(sub); !os.IsNotExist(err) {
+		t.Fatalf("expected %q to be removed, was %v", sub, err)
+	}
+	if err := c.RemoveAll(sub); err != nil {
+		t.Fatalf("RemoveAll of a missing path should succeed, was %v", err)
+	}
+}
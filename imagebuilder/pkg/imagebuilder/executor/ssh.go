@@ -1,35 +1,440 @@
 package executor
 
 import (
+	"bytes"
 	"fmt"
 	"github.com/golang/glog"
 	"golang.org/x/crypto/ssh"
 	"io"
+	"io/ioutil"
+	"math/rand"
+	"net"
 	"os"
 	"path/filepath"
 	"strconv"
+	"strings"
+	"sync"
+	"time"
 )
 
+const (
+	// KeepaliveInterval is how often we check that the SSH connection is still alive
+	KeepaliveInterval = 30 * time.Second
+	// KeepaliveMaxMissed is the number of missed keepalives after which we consider the connection lost
+	KeepaliveMaxMissed = 3
+	// ReconnectTimeout is how long we keep trying to reestablish a lost connection
+	ReconnectTimeout = 10 * time.Minute
+	// DetachedTimeout is how long we wait for a detached command to finish
+	DetachedTimeout = 4 * time.Hour
+
+	// detachedPollInterval is how often we check on a detached command
+	detachedPollInterval = 10 * time.Second
+)
+
+// SSHDialFunction establishes a new SSH connection to the same target
+type SSHDialFunction func() (*ssh.Client, error)
+
 type SSHExecutor struct {
+	mutex     sync.Mutex
 	sshClient *ssh.Client
+	redial    SSHDialFunction
+	closed    bool
+
+	// reconnecting is closed when the reconnection in progress (if any) finishes
+	reconnecting chan struct{}
+	// reconnectErr is the error from the last failed reconnection
+	reconnectErr error
 }
 
+// NewSSH builds an Executor for the SSH connection.  It cannot reconnect if the connection is lost.
 func NewSSH(client *ssh.Client) Executor {
-	return &SSHExecutor{sshClient: client}
+	return NewReconnectingSSH(client, nil)
+}
+
+// NewReconnectingSSH builds an Executor for the SSH connection, which uses redial to reconnect if the connection is lost
+func NewReconnectingSSH(client *ssh.Client, redial SSHDialFunction) Executor {
+	s := &SSHExecutor{sshClient: client, redial: redial}
+	go s.keepalive(client)
+	return s
 }
 
 var _ Executor = &SSHExecutor{}
 
 func (e *SSHExecutor) Close() error {
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+
+	e.closed = true
 	return e.sshClient.Close()
 }
 
-// SCPMkdir executes a mkdir against the SSH target, using SCP
+// keepalive sends keepalive requests, and closes the connection if they are not answered.
+// Closing the connection unblocks any sessions; the next operation will then reconnect.
+func (s *SSHExecutor) keepalive(client *ssh.Client) {
+	missed := 0
+	for {
+		time.Sleep(KeepaliveInterval)
+
+		s.mutex.Lock()
+		done := s.closed || s.sshClient != client
+		s.mutex.Unlock()
+		if done {
+			return
+		}
+
+		replied := make(chan error, 1)
+		go func() {
+			_, _, err := client.SendRequest("keepalive@openssh.com", true, nil)
+			replied <- err
+		}()
+
+		var err error
+		select {
+		case err = <-replied:
+		case <-time.After(KeepaliveInterval):
+			err = fmt.Errorf("timeout waiting for keepalive response")
+		}
+
+		if err == nil {
+			missed = 0
+			continue
+		}
+
+		missed++
+		glog.Warningf("SSH keepalive failed (%d/%d): %v", missed, KeepaliveMaxMissed, err)
+		if missed >= KeepaliveMaxMissed {
+			glog.Warningf("SSH connection lost; closing")
+			client.Close()
+			return
+		}
+	}
+}
+
+// client returns the current ssh client
+func (s *SSHExecutor) client() *ssh.Client {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.sshClient
+}
+
+// isConnectionError returns true if err means the SSH connection has been lost, rather than the request failing
+func isConnectionError(err error) bool {
+	if err == nil {
+		return false
+	}
+	if err == io.EOF || err == io.ErrUnexpectedEOF {
+		return true
+	}
+	if _, ok := err.(net.Error); ok {
+		return true
+	}
+	// x/crypto/ssh does not return typed errors for these
+	msg := err.Error()
+	for _, s := range []string{
+		"use of closed network connection",
+		"connection reset by peer",
+		"broken pipe",
+		"remote command exited without exit status or exit signal",
+	} {
+		if strings.Contains(msg, s) {
+			return true
+		}
+	}
+	return false
+}
+
+// reconnect replaces the broken client with a new connection, unless that was already done.
+// The lock is not held while dialing; concurrent callers wait for the same reconnection.
+func (s *SSHExecutor) reconnect(broken *ssh.Client) error {
+	s.mutex.Lock()
+	if s.closed {
+		s.mutex.Unlock()
+		return fmt.Errorf("SSH connection is closed")
+	}
+	if s.sshClient != broken {
+		s.mutex.Unlock()
+		return nil
+	}
+	if s.redial == nil {
+		s.mutex.Unlock()
+		return fmt.Errorf("SSH connection lost, and reconnection is not configured")
+	}
+	if s.reconnecting != nil {
+		done := s.reconnecting
+		s.mutex.Unlock()
+		<-done
+
+		s.mutex.Lock()
+		defer s.mutex.Unlock()
+		if s.sshClient != broken {
+			return nil
+		}
+		return s.reconnectErr
+	}
+	done := make(chan struct{})
+	s.reconnecting = done
+	s.mutex.Unlock()
+
+	broken.Close()
+	client, err := s.redialUntil(time.Now().Add(ReconnectTimeout))
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.reconnecting = nil
+	close(done)
+
+	if err != nil {
+		s.reconnectErr = err
+		return err
+	}
+	if s.closed {
+		client.Close()
+		return fmt.Errorf("SSH connection is closed")
+	}
+	s.sshClient = client
+	go s.keepalive(client)
+	return nil
+}
+
+// redialUntil calls redial until it succeeds, the deadline passes, or the executor is closed
+func (s *SSHExecutor) redialUntil(deadline time.Time) (*ssh.Client, error) {
+	for {
+		glog.Infof("Reconnecting SSH connection")
+		client, err := s.redial()
+		if err == nil {
+			return client, nil
+		}
+
+		if time.Now().After(deadline) {
+			return nil, fmt.Errorf("unable to reconnect SSH connection within %v: %v", ReconnectTimeout, err)
+		}
+		glog.Warningf("error reconnecting SSH: %v", err)
+		time.Sleep(10 * time.Second)
+
+		s.mutex.Lock()
+		closed := s.closed
+		s.mutex.Unlock()
+		if closed {
+			return nil, fmt.Errorf("SSH connection is closed")
+		}
+	}
+}
+
+// newSession opens a new SSH session, reconnecting if the connection has been lost
+func (s *SSHExecutor) newSession() (*ssh.Session, error) {
+	client := s.client()
+	session, err := client.NewSession()
+	if err == nil {
+		return session, nil
+	}
+
+	if s.redial == nil || !isConnectionError(err) {
+		return nil, fmt.Errorf("error establishing SSH session: %v", err)
+	}
+
+	glog.Warningf("error establishing SSH session, will reconnect: %v", err)
+	if err := s.reconnect(client); err != nil {
+		return nil, err
+	}
+
+	session, err = s.client().NewSession()
+	if err != nil {
+		return nil, fmt.Errorf("error establishing SSH session: %v", err)
+	}
+	return session, nil
+}
+
+// withSFTP runs fn with a new SFTP client.  fn is called with nil if the server does not support SFTP.
+func (s *SSHExecutor) withSFTP(fn func(c *sftpClient) error) error {
+	session, err := s.newSession()
+	if err != nil {
+		return err
+	}
+
+	c, err := newSFTPClient(session)
+	if err != nil {
+		session.Close()
+		if err == errSFTPNotSupported {
+			glog.V(2).Infof("SFTP not supported by server; falling back to scp / shell commands")
+			return fn(nil)
+		}
+		return err
+	}
+	defer c.Close()
+
+	return fn(c)
+}
+
+// Mkdir creates a directory on the SSH target, using SFTP (or SCP if SFTP is not available)
 func (s *SSHExecutor) Mkdir(dest string, mode os.FileMode) error {
+	return s.withSFTP(func(c *sftpClient) error {
+		if c == nil {
+			return s.scpMkdir(dest, mode)
+		}
+		glog.Infof("Doing SFTP mkdir: %q", dest)
+		return c.Mkdir(dest, mode)
+	})
+}
+
+// Put copies a file to the SSH target, using SFTP (or SCP if SFTP is not available)
+func (s *SSHExecutor) Put(dest string, length int, content io.Reader, mode os.FileMode) error {
+	return s.withSFTP(func(c *sftpClient) error {
+		if c == nil {
+			return s.scpPut(dest, length, content, mode)
+		}
+		glog.Infof("Doing SFTP upload: %q", dest)
+		return c.Put(dest, content, mode)
+	})
+}
+
+// Get copies a file from the SSH target, using SFTP (or cat if SFTP is not available)
+func (s *SSHExecutor) Get(src string, dest io.Writer) error {
+	return s.withSFTP(func(c *sftpClient) error {
+		if c != nil {
+			glog.Infof("Doing SFTP download: %q", src)
+			return c.Get(src, dest)
+		}
+
+		return s.runWithStdout([]string{"cat", src}, dest)
+	})
+}
+
+// PutDir recursively copies a local directory to the SSH target, using SFTP (or tar if SFTP is not available)
+func (s *SSHExecutor) PutDir(localDir string, dest string) error {
+	return s.withSFTP(func(c *sftpClient) error {
+		if c != nil {
+			glog.Infof("Doing SFTP directory upload: %q -> %q", localDir, dest)
+			return putDir(c, localDir, dest)
+		}
+
+		session, err := s.newSession()
+		if err != nil {
+			return err
+		}
+		defer session.Close()
+
+		var stdinErr error
+		w, err := session.StdinPipe()
+		if err != nil {
+			return fmt.Errorf("error opening stdin: %v", err)
+		}
+		go func() {
+			defer w.Close()
+			stdinErr = writeTar(localDir, w)
+		}()
+		output, err := session.CombinedOutput(joinCommand([]string{"mkdir", "-p", dest, "&&", "tar", "-C", dest, "-xf", "-"}))
+		if err != nil {
+			glog.Warningf("Error output from tar: %s", output)
+			return fmt.Errorf("error uploading directory %q: %v", localDir, err)
+		}
+		if stdinErr != nil {
+			return fmt.Errorf("error uploading directory %q: %v", localDir, stdinErr)
+		}
+		return nil
+	})
+}
+
+// GetDir recursively copies a directory from the SSH target, using SFTP (or tar if SFTP is not available)
+func (s *SSHExecutor) GetDir(src string, localDir string) error {
+	return s.withSFTP(func(c *sftpClient) error {
+		if c != nil {
+			glog.Infof("Doing SFTP directory download: %q -> %q", src, localDir)
+			return getDir(c, src, localDir)
+		}
+
+		session, err := s.newSession()
+		if err != nil {
+			return err
+		}
+		defer session.Close()
+
+		r, err := session.StdoutPipe()
+		if err != nil {
+			return fmt.Errorf("error opening stdout: %v", err)
+		}
+		err = session.Start(joinCommand([]string{"tar", "-C", src, "-cf", "-", "."}))
+		if err != nil {
+			return fmt.Errorf("error starting tar: %v", err)
+		}
+		if err := extractTar(r, localDir, ""); err != nil {
+			return err
+		}
+		if err := session.Wait(); err != nil {
+			return fmt.Errorf("error downloading directory %q: %v", src, err)
+		}
+		return nil
+	})
+}
+
+// Stat returns information about a file on the SSH target
+func (s *SSHExecutor) Stat(p string) (os.FileInfo, error) {
+	var info os.FileInfo
+	err := s.withSFTP(func(c *sftpClient) error {
+		var err error
+		if c != nil {
+			info, err = c.Stat(p)
+			return err
+		}
+
+		// Prints size, raw mode (hex) and mtime
+		output, err := s.runSession([]string{"stat", "-L", "-c", "'%s %f %Y'", p})
+		if err != nil {
+			if strings.Contains(string(output), "No such file") {
+				return &os.PathError{Op: "stat", Path: p, Err: os.ErrNotExist}
+			}
+			return fmt.Errorf("error running stat on %q: %v: %s", p, err, output)
+		}
+		var size uint64
+		var mode, mtime uint32
+		if _, err := fmt.Sscanf(string(output), "%d %x %d", &size, &mode, &mtime); err != nil {
+			return fmt.Errorf("unexpected output from stat %q: %q", p, output)
+		}
+		attrs := &statAttrs{size: size, permissions: mode, mtime: mtime}
+		info = attrs.fileInfo(filepath.Base(p))
+		return nil
+	})
+	return info, err
+}
+
+// Remove removes a file or directory (recursively) from the SSH target
+func (s *SSHExecutor) Remove(p string) error {
+	return s.withSFTP(func(c *sftpClient) error {
+		if c != nil {
+			return c.RemoveAll(p)
+		}
+
+		output, err := s.runSession([]string{"rm", "-rf", p})
+		if err != nil {
+			return fmt.Errorf("error removing %q: %v: %s", p, err, output)
+		}
+		return nil
+	})
+}
+
+// runWithStdout runs the command, copying stdout to dest
+func (s *SSHExecutor) runWithStdout(command []string, dest io.Writer) error {
+	session, err := s.newSession()
+	if err != nil {
+		return err
+	}
+	defer session.Close()
+
+	var stderr bytes.Buffer
+	session.Stdout = dest
+	session.Stderr = &stderr
+	err = session.Run(joinCommand(command))
+	if err != nil {
+		return fmt.Errorf("error running %q: %v: %s", command, err, stderr.String())
+	}
+	return nil
+}
+
+// scpMkdir executes a mkdir against the SSH target, using SCP
+func (s *SSHExecutor) scpMkdir(dest string, mode os.FileMode) error {
 	glog.Infof("Doing SSH SCP mkdir: %q", dest)
-	session, err := s.sshClient.NewSession()
+	session, err := s.newSession()
 	if err != nil {
-		return fmt.Errorf("error establishing SSH session: %v", err)
+		return err
 	}
 	defer session.Close()
 
@@ -63,12 +468,22 @@ func toOctal(mode os.FileMode) string {
 	return strconv.FormatUint(uint64(mode), 8)
 }
 
-// SCPPut copies a file to the SSH target, using SCP
-func (s *SSHExecutor) Put(dest string, length int, content io.Reader, mode os.FileMode) error {
+// scpPut copies a file to the SSH target, using SCP
+func (s *SSHExecutor) scpPut(dest string, length int, content io.Reader, mode os.FileMode) error {
+	// SCP needs to know the length up front
+	if length < 0 {
+		data, err := ioutil.ReadAll(content)
+		if err != nil {
+			return fmt.Errorf("error reading content for %q: %v", dest, err)
+		}
+		length = len(data)
+		content = bytes.NewReader(data)
+	}
+
 	glog.Infof("Doing SSH SCP upload: %q", dest)
-	session, err := s.sshClient.NewSession()
+	session, err := s.newSession()
 	if err != nil {
-		return fmt.Errorf("error establishing SSH session: %v", err)
+		return err
 	}
 	defer session.Close()
 
@@ -107,14 +522,124 @@ func (s *SSHExecutor) Put(dest string, length int, content io.Reader, mode os.Fi
 }
 
 func (s *SSHExecutor) Run(cmd *CommandExecution) error {
-	session, err := s.sshClient.NewSession()
+	if cmd.Detach {
+		return s.runDetached(cmd)
+	}
+
+	return runCommand(cmd, s, func(command []string) ([]byte, []byte, error) {
+		session, err := s.newSession()
+		if err != nil {
+			return nil, nil, err
+		}
+		defer session.Close()
+
+		var stdout, stderr bytes.Buffer
+		session.Stdout = &stdout
+		session.Stderr = &stderr
+		err = session.Run(joinCommand(command))
+		return stdout.Bytes(), stderr.Bytes(), err
+	})
+}
+
+// runSession runs the command in a new session, returning the combined output
+func (s *SSHExecutor) runSession(command []string) ([]byte, error) {
+	session, err := s.newSession()
 	if err != nil {
-		return fmt.Errorf("error establishing SSH session: %v", err)
+		return nil, err
 	}
 	defer session.Close()
 
-	return runCommand(cmd, s, func(command []string) ([]byte, error) {
-		output, err := session.CombinedOutput(joinCommand(command))
-		return output, err
-	})
+	output, err := session.CombinedOutput(joinCommand(command))
+	return output, err
+}
+
+// runDetached runs the command on the remote side with nohup, recording its output and exit code in files.
+// If the connection is lost while we wait, we reconnect and reattach by continuing to poll those files.
+// We give up if the command has not finished within DetachedTimeout.
+func (s *SSHExecutor) runDetached(cmd *CommandExecution) error {
+	dir := fmt.Sprintf("/tmp/ssh-detached-%d", rand.Int63())
+	if _, err := s.runSession([]string{"mkdir", "-p", dir}); err != nil {
+		return fmt.Errorf("error creating directory for detached command: %v", err)
+	}
+	defer s.runSession([]string{"rm", "-rf", dir})
+
+	script, _ := buildScript(cmd)
+	scriptPath := dir + "/script"
+	logPath := dir + "/output.log"
+	exitCodePath := dir + "/exitcode"
+
+	err := s.Put(scriptPath, len(script), bytes.NewReader(script), 0755)
+	if err != nil {
+		return fmt.Errorf("error uploading script for detached command: %v", err)
+	}
+
+	run := scriptPath
+	if cmd.Sudo {
+		run = "sudo " + scriptPath
+	}
+	// Write the exit code atomically, so we never read a partial file
+	wrapper := run + " > " + logPath + " 2>&1; echo $? > " + exitCodePath + ".tmp && mv " + exitCodePath + ".tmp " + exitCodePath
+	launch := "nohup setsid /bin/bash -c '" + wrapper + "' > /dev/null 2>&1 < /dev/null &"
+
+	glog.Infof("Executing detached command: %q", cmd.Command)
+	start := time.Now()
+	if output, err := s.runSession([]string{launch}); err != nil {
+		glog.Infof("Output was: %s", output)
+		return newCommandError(cmd.Command, output, nil, time.Since(start), err)
+	}
+
+	// We keep the tail of the output, for errors
+	var outputTail []byte
+	logOffset := 0
+	deadline := start.Add(DetachedTimeout)
+	for {
+		if time.Now().After(deadline) {
+			return newCommandError(cmd.Command, outputTail, nil, time.Since(start), fmt.Errorf("detached command did not finish within %v", DetachedTimeout))
+		}
+		time.Sleep(detachedPollInterval)
+
+		client := s.client()
+
+		// Stream any new output (the log may not exist yet if the command has only just launched)
+		output, err := s.runSession([]string{"tail -c +" + strconv.Itoa(logOffset+1) + " " + logPath + " 2>/dev/null || true"})
+		if err == nil {
+			if len(output) != 0 {
+				glog.V(2).Infof("Output: %s", output)
+				logOffset += len(output)
+				outputTail = []byte(tail(append(outputTail, output...)))
+			}
+
+			output, err = s.runSession([]string{"cat " + exitCodePath + " 2>/dev/null || true"})
+		}
+		if err != nil {
+			if !isConnectionError(err) {
+				return newCommandError(cmd.Command, outputTail, nil, time.Since(start), fmt.Errorf("error checking on detached command: %v", err))
+			}
+			glog.Warningf("error checking on detached command %q, will reconnect: %v", cmd.Command, err)
+			if err := s.reconnect(client); err != nil {
+				return newCommandError(cmd.Command, outputTail, nil, time.Since(start), fmt.Errorf("lost connection while running detached command: %v", err))
+			}
+			continue
+		}
+
+		exitCodeString := strings.TrimSpace(string(output))
+		if exitCodeString == "" {
+			// Still running
+			continue
+		}
+
+		exitCode, err := strconv.Atoi(exitCodeString)
+		if err != nil {
+			return fmt.Errorf("unexpected exit code %q from detached command %q", exitCodeString, cmd.Command)
+		}
+		duration := time.Since(start)
+		if exitCode != 0 {
+			glog.Infof("Detached command %q failed with exit status %d", cmd.Command, exitCode)
+			cmdErr := newCommandError(cmd.Command, outputTail, nil, duration, fmt.Errorf("exit status %d", exitCode))
+			cmdErr.ExitStatus = exitCode
+			return cmdErr
+		}
+		glog.V(2).Infof("Command %q completed in %v", cmd.Command, duration)
+		return nil
+	}
 }
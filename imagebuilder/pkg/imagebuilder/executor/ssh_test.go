@@ -0,0 +1,47 @@
+/*
+Copyright 2016 The Kubernetes Authors All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package executor
+
+import (
+	"errors"
+	"io"
+	"net"
+	"testing"
+
+	"golang.org/x/crypto/ssh"
+)
+
+func TestIsConnectionError(t *testing.T) {
+	grid := []struct {
+		Err        error
+		Connection bool
+	}{
+		{Err: io.EOF, Connection: true},
+		{Err: &net.OpError{Op: "read", Err: errors.New("connection reset by peer")}, Connection: true},
+		{Err: errors.New("read tcp 10.0.0.1:22: use of closed network connection"), Connection: true},
+		{Err: errors.New("wait: remote command exited without exit status or exit signal"), Connection: true},
+		{Err: nil, Connection: false},
+		{Err: &ssh.OpenChannelError{Reason: ssh.Prohibited, Message: "open failed"}, Connection: false},
+		{Err: &ssh.ExitError{}, Connection: false},
+		{Err: errors.New("permission denied"), Connection: false},
+	}
+	for _, g := range grid {
+		if actual := isConnectionError(g.Err); actual != g.Connection {
+			t.Errorf("isConnectionError(%v): expected %v, was %v", g.Err, g.Connection, actual)
+		}
+	}
+}
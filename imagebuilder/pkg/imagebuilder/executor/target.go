@@ -43,12 +43,37 @@ func (t *Target) Mkdir(dest string, mode os.FileMode) error {
 	return t.executor.Mkdir(dest, mode)
 }
 
+func (t *Target) Get(src string, dest io.Writer) error {
+	return t.executor.Get(src, dest)
+}
+
+func (t *Target) PutDir(localDir string, dest string) error {
+	return t.executor.PutDir(localDir, dest)
+}
+
+func (t *Target) GetDir(src string, localDir string) error {
+	return t.executor.GetDir(src, localDir)
+}
+
+func (t *Target) Stat(p string) (os.FileInfo, error) {
+	return t.executor.Stat(p)
+}
+
+func (t *Target) Remove(p string) error {
+	return t.executor.Remove(p)
+}
+
 // CommandExecution helps us build a command for running
 type CommandExecution struct {
-	Command  []string
-	Cwd      string
-	Env      map[string]string
-	Sudo     bool
+	Command []string
+	Cwd     string
+	Env     map[string]string
+	Sudo    bool
+
+	// Detach runs the command detached from the connection on the remote side,
+	// so that it survives (and can be reattached after) a dropped connection
+	Detach bool
+
 	executor Executor
 }
 
@@ -64,6 +89,12 @@ func (c *CommandExecution) WithCwd(cwd string) *CommandExecution {
 	return c
 }
 
+// WithDetach indicates that the command should be run detached from the connection
+func (c *CommandExecution) WithDetach() *CommandExecution {
+	c.Detach = true
+	return c
+}
+
 // Setenv sets an environment variable for the command execution
 func (c *CommandExecution) Setenv(k, v string) *CommandExecution {
 	c.Env[k] = v
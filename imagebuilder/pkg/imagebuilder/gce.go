@@ -17,12 +17,21 @@ limitations under the License.
 package imagebuilder
 
 import (
+	"encoding/json"
 	"fmt"
 	"github.com/golang/glog"
 	"golang.org/x/crypto/ssh"
+	"golang.org/x/net/context"
+	computebeta "google.golang.org/api/compute/v0.beta"
 	"google.golang.org/api/compute/v1"
 	"google.golang.org/api/googleapi"
+	"google.golang.org/api/storage/v1"
 	"k8s.io/kube-deploy/imagebuilder/pkg/imagebuilder/executor"
+	"net/http"
+	"net/url"
+	"path"
+	"regexp"
+	"strings"
 	"time"
 )
 
@@ -37,31 +46,81 @@ type GCEInstance struct {
 	instance *compute.Instance
 }
 
+// ID returns the instance name
+func (i *GCEInstance) ID() string {
+	return i.name
+}
+
 // Shutdown terminates the running instance
 func (i *GCEInstance) Shutdown() error {
 	glog.Infof("Terminating instance %q", i.name)
 	return i.cloud.deleteInstance(i.name)
 }
 
+var _ ImageCreator = &GCEInstance{}
+
+// CreateImage stops the instance and creates an image from its boot disk, waiting until it is ready
+func (i *GCEInstance) CreateImage(name string) error {
+	c := i.cloud
+
+	glog.Infof("Stopping instance %q", i.name)
+	op, err := c.computeClient.Instances.Stop(c.config.Project, c.config.Zone, i.name).Do()
+	if err != nil {
+		return fmt.Errorf("error stopping instance %q: %v", i.name, err)
+	}
+	if err := c.waitForOperation(op); err != nil {
+		return fmt.Errorf("error stopping instance %q: %v", i.name, err)
+	}
+
+	// The boot disk is named after the instance
+	image := &compute.Image{
+		Name:       name,
+		SourceDisk: "zones/" + c.config.Zone + "/disks/" + i.name,
+	}
+	glog.V(2).Infof("GCE Images Insert Name=%q, SourceDisk=%q", name, image.SourceDisk)
+	op, err = c.computeClient.Images.Insert(c.config.Project, image).Do()
+	if err != nil {
+		return fmt.Errorf("error creating image %q: %v", name, err)
+	}
+	c.events.Emit(&Event{Type: EventImageState, Image: name, State: "PENDING"})
+	if err := c.waitForOperation(op); err != nil {
+		return fmt.Errorf("error creating image %q: %v", name, err)
+	}
+	c.events.Emit(&Event{Type: EventImageState, Image: name, State: "READY"})
+	return nil
+}
+
 // DialSSH establishes an SSH client connection to the instance
+// The host key is verified against the fingerprints the instance reports in its guest attributes (set by the
+// guest agent), or prints on its serial port (from cloud-init)
 func (i *GCEInstance) DialSSH(config *ssh.ClientConfig) (executor.Executor, error) {
-	publicIP, err := i.WaitPublicIP()
+	var ip string
+	var err error
+	if i.cloud.config.PrivateIP {
+		ip, err = i.WaitPrivateIP()
+	} else {
+		ip, err = i.WaitPublicIP()
+	}
 	if err != nil {
 		return nil, err
 	}
 
-	for {
-		// TODO: Timeout, check error code
-		sshClient, err := ssh.Dial("tcp", publicIP+":22", config)
-		if err != nil {
-			glog.Warningf("error connecting to SSH on server %q: %v", publicIP, err)
-			time.Sleep(5 * time.Second)
-			continue
-			//	return nil, fmt.Errorf("error connecting to SSH on server %q", publicIP)
+	getConsoleOutput := func() (string, error) {
+		return i.cloud.getSerialPortOutput(i.name)
+	}
+	fromConsole := consoleHostKeyFingerprints(getConsoleOutput)
+	getFingerprints := func() ([]string, error) {
+		fingerprints, err := i.cloud.getGuestAttributeHostKeys(i.name)
+		if err == nil && len(fingerprints) != 0 {
+			return fingerprints, nil
 		}
-
-		return executor.NewSSH(sshClient), nil
+		consoleFingerprints, consoleErr := fromConsole()
+		if consoleErr != nil && err != nil {
+			return nil, fmt.Errorf("%v; %v", err, consoleErr)
+		}
+		return consoleFingerprints, nil
 	}
+	return dialSSH(i.name, ip+":22", &i.cloud.config.Config, config, getFingerprints)
 }
 
 // WaitPublicIP waits for the instance to get a public IP, returning it
@@ -86,20 +145,73 @@ func (i *GCEInstance) WaitPublicIP() (string, error) {
 	}
 }
 
+// WaitPrivateIP waits for the instance to get a private (network) IP, returning it
+func (i *GCEInstance) WaitPrivateIP() (string, error) {
+	// TODO: Timeout
+	for {
+		instance, err := i.cloud.describeInstance(i.name)
+		if err != nil {
+			return "", err
+		}
+
+		for _, ni := range instance.NetworkInterfaces {
+			if ni.NetworkIP != "" {
+				glog.Infof("Instance private IP is %q", ni.NetworkIP)
+				return ni.NetworkIP, nil
+			}
+		}
+		glog.V(2).Infof("Sleeping before requerying instance for private IP: %q", i.name)
+		time.Sleep(5 * time.Second)
+	}
+}
+
 // GCECloud is a helper type for talking to an GCE acccount
 type GCECloud struct {
 	config *GCEConfig
 
 	computeClient *compute.Service
+	// computeBetaClient is used for image labels, which are only in the beta API
+	computeBetaClient *computebeta.Service
+	storageClient     *storage.Service
+	// httpClient is the authenticated client, for the calls that the vendored API clients don't have
+	httpClient *http.Client
+
+	events *Events
 }
 
 var _ Cloud = &GCECloud{}
+var _ EventEmitter = &GCECloud{}
 
-func NewGCECloud(computeClient *compute.Service, config *GCEConfig) *GCECloud {
+func NewGCECloud(httpClient *http.Client, computeClient *compute.Service, computeBetaClient *computebeta.Service, storageClient *storage.Service, config *GCEConfig) *GCECloud {
 	return &GCECloud{
-		computeClient: computeClient,
-		config:        config,
+		httpClient:        httpClient,
+		computeClient:     computeClient,
+		computeBetaClient: computeBetaClient,
+		storageClient:     storageClient,
+		config:            config,
+	}
+}
+
+// SetEvents sets where the cloud sends events about its images
+func (c *GCECloud) SetEvents(events *Events) {
+	c.events = events
+}
+
+// CheckGCSDestination checks that the bucket in GCSDestination exists
+func (c *GCECloud) CheckGCSDestination() error {
+	u, err := url.Parse(c.config.GCSDestination)
+	if err != nil {
+		return fmt.Errorf("GCSDestination %q is not a well-formed URL: %v", c.config.GCSDestination, err)
+	}
+	glog.Infof("Checking for bucket %q", u.Host)
+	_, err = c.storageClient.Buckets.Get(u.Host).Do()
+	if err != nil {
+		if IsGCENotFound(err) {
+			return fmt.Errorf("GCS bucket does not exist: %v", c.config.GCSDestination)
+		}
+		return fmt.Errorf("Error checking that bucket exists: %v", err)
 	}
+	return nil
 }
 
 func (a *GCECloud) GetExtraEnv() (map[string]string, error) {
@@ -132,7 +244,71 @@ func (c *GCECloud) describeInstance(name string) (*compute.Instance, error) {
 	return instances.Items[0], nil
 }
 
+// getSerialPortOutput returns the output of the first serial port (the console) of the instance
+func (c *GCECloud) getSerialPortOutput(name string) (string, error) {
+	glog.V(2).Infof("GCE Instances GetSerialPortOutput Name=%q", name)
+	output, err := c.computeClient.Instances.GetSerialPortOutput(c.config.Project, c.config.Zone, name).Do()
+	if err != nil {
+		return "", fmt.Errorf("error making GCE Instances GetSerialPortOutput call: %v", err)
+	}
+	return output.Contents, nil
+}
+
+// getGuestAttributeHostKeys returns the fingerprints of the host keys that the guest agent has reported in the
+// instance's guest attributes, or none if it has not reported them (yet)
+func (c *GCECloud) getGuestAttributeHostKeys(name string) ([]string, error) {
+	// getGuestAttributes is not in the vendored compute API client, so we call it directly
+	u := c.computeClient.BasePath + url.PathEscape(c.config.Project) + "/zones/" + url.PathEscape(c.config.Zone) + "/instances/" + url.PathEscape(name) + "/getGuestAttributes?queryPath=" + url.QueryEscape("hostkeys/")
+	glog.V(2).Infof("GCE Instances GetGuestAttributes Name=%q", name)
+	response, err := c.httpClient.Get(u)
+	if err != nil {
+		return nil, fmt.Errorf("error making GCE Instances GetGuestAttributes call: %v", err)
+	}
+	defer response.Body.Close()
+
+	// Not found until the guest agent has set the attributes
+	if response.StatusCode == http.StatusNotFound {
+		return nil, nil
+	}
+	if err := googleapi.CheckResponse(response); err != nil {
+		return nil, fmt.Errorf("error making GCE Instances GetGuestAttributes call: %v", err)
+	}
+
+	var attributes struct {
+		QueryValue struct {
+			Items []guestAttribute `json:"items"`
+		} `json:"queryValue"`
+	}
+	if err := json.NewDecoder(response.Body).Decode(&attributes); err != nil {
+		return nil, fmt.Errorf("error parsing GCE Instances GetGuestAttributes response: %v", err)
+	}
+	return parseGuestAttributeHostKeys(attributes.QueryValue.Items), nil
+}
+
 // deleteInstance terminates the specified instance
+// waitForOperation waits for a zone or global operation to finish, returning its error (if any)
+func (c *GCECloud) waitForOperation(op *compute.Operation) error {
+	for op.Status != "DONE" {
+		time.Sleep(5 * time.Second)
+
+		var err error
+		if op.Zone != "" {
+			op, err = c.computeClient.ZoneOperations.Get(c.config.Project, path.Base(op.Zone), op.Name).Do()
+		} else {
+			op, err = c.computeClient.GlobalOperations.Get(c.config.Project, op.Name).Do()
+		}
+		if err != nil {
+			return fmt.Errorf("error getting status of operation: %v", err)
+		}
+		glog.V(2).Infof("GCE operation %q status %q", op.Name, op.Status)
+	}
+
+	if op.Error != nil && len(op.Error.Errors) != 0 {
+		return fmt.Errorf("%s", op.Error.Errors[0].Message)
+	}
+	return nil
+}
+
 func (c *GCECloud) deleteInstance(name string) error {
 	glog.V(2).Infof("GCE Delete Instances name=%q", name)
 	_, err := c.computeClient.Instances.Delete(c.config.Project, c.config.Zone, name).Do()
@@ -185,7 +361,13 @@ func (c *GCECloud) CreateInstance() (Instance, error) {
 		Type:       "PERSISTENT",
 	})
 
-	metadata := &compute.Metadata{}
+	// The guest agent reports the host keys in guest attributes, which must be enabled
+	enableGuestAttributes := "TRUE"
+	metadata := &compute.Metadata{
+		Items: []*compute.MetadataItems{
+			{Key: "enable-guest-attributes", Value: &enableGuestAttributes},
+		},
+	}
 
 	if c.config.SSHPublicKey != "" {
 		publicKey, err := ReadFile(c.config.SSHPublicKey)
@@ -205,21 +387,22 @@ func (c *GCECloud) CreateInstance() (Instance, error) {
 		"https://www.googleapis.com/auth/compute",
 	}
 
-	instance := &compute.Instance{
-		Name: name,
-		NetworkInterfaces: []*compute.NetworkInterface{
+	networkInterface := &compute.NetworkInterface{}
+	if !c.config.PrivateIP {
+		networkInterface.AccessConfigs = []*compute.AccessConfig{
 			{
-				AccessConfigs: []*compute.AccessConfig{
-					{
-						Name: "nat",
-						Type: "ONE_TO_ONE_NAT",
-					},
-				},
+				Name: "nat",
+				Type: "ONE_TO_ONE_NAT",
 			},
-		},
-		MachineType: machineType,
-		Disks:       disks,
-		Metadata:    metadata,
+		}
+	}
+
+	instance := &compute.Instance{
+		Name:              name,
+		NetworkInterfaces: []*compute.NetworkInterface{networkInterface},
+		MachineType:       machineType,
+		Disks:             disks,
+		Metadata:          metadata,
 		ServiceAccounts: []*compute.ServiceAccount{
 			{
 				Email:  "default",
@@ -237,6 +420,41 @@ func (c *GCECloud) CreateInstance() (Instance, error) {
 	}, nil
 }
 
+var _ BaseImageQuerier = &GCECloud{}
+
+// BaseImageQuery describes the ImageFamily; images are global on GCE, so there is one pin for the cloud
+func (c *GCECloud) BaseImageQuery() (string, string) {
+	if c.config.ImageFamily == "" {
+		return "", ""
+	}
+	return "gce", "projects/" + c.imageProject() + "/global/images/family/" + c.config.ImageFamily
+}
+
+func (c *GCECloud) imageProject() string {
+	if c.config.ImageProject == "" {
+		return c.config.Project
+	}
+	return c.config.ImageProject
+}
+
+// FindBaseImage finds the newest image in the ImageFamily that is not deprecated
+func (c *GCECloud) FindBaseImage() (string, error) {
+	if c.config.ImageFamily == "" {
+		return "", fmt.Errorf("ImageFamily is not set")
+	}
+	glog.V(2).Infof("GCE Images GetFromFamily %s/%s", c.imageProject(), c.config.ImageFamily)
+	image, err := c.computeClient.Images.GetFromFamily(c.imageProject(), c.config.ImageFamily).Do()
+	if err != nil {
+		return "", fmt.Errorf("error getting newest image in family %q of project %q: %v", c.config.ImageFamily, c.imageProject(), err)
+	}
+	return image.SelfLink, nil
+}
+
+// SetBaseImage sets the Image the builder is launched from
+func (c *GCECloud) SetBaseImage(image string) {
+	c.config.Image = image
+}
+
 // FindImage finds a registered image, matching by the name tag
 func (c *GCECloud) FindImage(imageName string) (Image, error) {
 	image, err := findGCEImage(c.computeClient, c.config.Project, imageName)
@@ -249,12 +467,103 @@ func (c *GCECloud) FindImage(imageName string) (Image, error) {
 	}
 
 	return &GCEImage{
-		computeClient: c.computeClient,
-		name:          imageName,
+		computeClient:     c.computeClient,
+		computeBetaClient: c.computeBetaClient,
+		project:           c.config.Project,
+		name:              imageName,
 		//image:   image,
 	}, nil
 }
 
+// FindImageByHash finds a registered image, matching by the content hash label
+func (c *GCECloud) FindImageByHash(hash string) (Image, error) {
+	key := gceLabel(ContentHashTag)
+	images, err := c.computeBetaClient.Images.List(c.config.Project).Filter("labels." + key + " eq " + hash).Do()
+	if err != nil {
+		return nil, fmt.Errorf("error listing images: %v", err)
+	}
+
+	glog.V(2).Infof("GCE Images List Filter:labels.%s=%q", key, hash)
+
+	if len(images.Items) == 0 {
+		return nil, nil
+	}
+
+	// If the same contents were built more than once (e.g. with --force), use the most recent
+	image := images.Items[0]
+	for _, i := range images.Items[1:] {
+		if i.CreationTimestamp > image.CreationTimestamp {
+			image = i
+		}
+	}
+
+	return &GCEImage{
+		computeClient:     c.computeClient,
+		computeBetaClient: c.computeBetaClient,
+		project:           c.config.Project,
+		name:              image.Name,
+	}, nil
+}
+
+// ListImages lists the images in the project.  GCE images are global, so each has a single (empty) region.
+// Tag filters are converted to labels, as AddTags does.
+func (c *GCECloud) ListImages(filter ImageFilter) ([]*ImageInfo, error) {
+	call := c.computeBetaClient.Images.List(c.config.Project)
+	if filter.Name != "" {
+		call = call.Filter("name eq " + filter.Name)
+	}
+
+	labelFilter := filter
+	labelFilter.Tags = make(map[string]string)
+	for k, v := range filter.Tags {
+		labelFilter.Tags[gceLabel(k)] = gceLabel(v)
+	}
+
+	glog.V(2).Infof("GCE Images List Project=%q", c.config.Project)
+	infos := make(imageInfoMap)
+	err := call.Pages(context.Background(), func(page *computebeta.ImageList) error {
+		for _, image := range page.Items {
+			if labelFilter.Family != "" && !strings.HasPrefix(image.Name, labelFilter.Family) {
+				continue
+			}
+			infos.add(image.Name, image.CreationTimestamp, image.Labels, &ImageRegionInfo{
+				ID:    image.SelfLink,
+				State: image.Status,
+			}, true)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("error listing images: %v", err)
+	}
+	return infos.list(&labelFilter), nil
+}
+
+// DescribeImage describes the image; GCE images are never public, so there are no launch permissions
+func (c *GCECloud) DescribeImage(imageName string) (*ImageInfo, error) {
+	images, err := c.ListImages(ImageFilter{Name: imageName})
+	if err != nil {
+		return nil, err
+	}
+	if len(images) == 0 {
+		return nil, nil
+	}
+	return images[0], nil
+}
+
+// DeleteImage deletes the image
+func (c *GCECloud) DeleteImage(imageName string) error {
+	glog.Infof("Deleting image %q", imageName)
+	op, err := c.computeClient.Images.Delete(c.config.Project, imageName).Do()
+	if err != nil {
+		return fmt.Errorf("error deleting image %q: %v", imageName, err)
+	}
+	if err := c.waitForOperation(op); err != nil {
+		return fmt.Errorf("error deleting image %q: %v", imageName, err)
+	}
+	return nil
+}
+
 func findGCEImage(computeClient *compute.Service, project string, imageName string) (*compute.Image, error) {
 	images, err := computeClient.Images.List(project).Filter("name eq " + imageName).Do()
 	if err != nil {
@@ -276,8 +585,10 @@ func findGCEImage(computeClient *compute.Service, project string, imageName stri
 
 // GCEImage represents an image on GCE
 type GCEImage struct {
-	computeClient *compute.Service
-	name          string
+	computeClient     *compute.Service
+	computeBetaClient *computebeta.Service
+	project           string
+	name              string
 }
 
 var _ Image = &GCEImage{}
@@ -292,13 +603,59 @@ func (i *GCEImage) EnsurePublic() error {
 	return fmt.Errorf("GCE does not currently support public images")
 }
 
-// AddTags adds the specified tags on the image
+// AddTags adds the specified tags on the image, as labels.
+// Keys and values are converted to valid GCE labels (lower case letters, numbers, _ and -).
 func (i *GCEImage) AddTags(tags map[string]string) error {
-	return fmt.Errorf("Tagging of GCE images not yet implemented")
+	image, err := i.computeBetaClient.Images.Get(i.project, i.name).Do()
+	if err != nil {
+		return fmt.Errorf("error getting image %q: %v", i.name, err)
+	}
+
+	request := &computebeta.GlobalSetLabelsRequest{
+		LabelFingerprint: image.LabelFingerprint,
+		Labels:           make(map[string]string),
+	}
+	for k, v := range image.Labels {
+		request.Labels[k] = v
+	}
+	for k, v := range tags {
+		request.Labels[gceLabel(k)] = gceLabel(v)
+	}
+
+	glog.V(2).Infof("GCE Images SetLabels on image %q", i.name)
+	op, err := i.computeBetaClient.Images.SetLabels(i.project, i.name, request).Do()
+	if err != nil {
+		return fmt.Errorf("error labelling image %q: %v", i.name, err)
+	}
+
+	for op.Status != "DONE" {
+		time.Sleep(2 * time.Second)
+		op, err = i.computeBetaClient.GlobalOperations.Get(i.project, op.Name).Do()
+		if err != nil {
+			return fmt.Errorf("error waiting for labels on image %q: %v", i.name, err)
+		}
+	}
+	if op.Error != nil && len(op.Error.Errors) != 0 {
+		return fmt.Errorf("error labelling image %q: %s", i.name, op.Error.Errors[0].Message)
+	}
+
+	return nil
+}
+
+// gceLabelInvalidChars matches characters that are not allowed in GCE label keys & values
+var gceLabelInvalidChars = regexp.MustCompile("[^a-z0-9_-]")
+
+// gceLabel converts s to a valid GCE label key or value, e.g. k8s.io/build => k8s-io-build
+func gceLabel(s string) string {
+	s = gceLabelInvalidChars.ReplaceAllString(strings.ToLower(s), "-")
+	if len(s) > 63 {
+		s = s[:63]
+	}
+	return s
 }
 
 // ReplicateImage copies the image to all accessible GCE regions
-func (i *GCEImage) ReplicateImage(makePublic bool) (map[string]Image, error) {
+func (i *GCEImage) ReplicateImage(makePublic bool, progress ReplicationProgress) (map[string]Image, error) {
 	if makePublic {
 		return nil, fmt.Errorf("GCE does not currently support public images")
 	}
@@ -0,0 +1,206 @@
+/*
+Copyright 2016 The Kubernetes Authors All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package imagebuilder
+
+import (
+	"fmt"
+	"path"
+	"regexp"
+	"strings"
+
+	"github.com/golang/glog"
+)
+
+var _ Doctor = &GCECloud{}
+
+// gceNetwork is the network the builder is launched in
+const gceNetwork = "default"
+
+// Doctor checks the project, zone, base image, machine type, firewall, SSH key, GCSDestination bucket and quota
+func (c *GCECloud) Doctor() []*Check {
+	var checks []*Check
+
+	check := c.doctorProject()
+	checks = append(checks, check)
+	if check.Status == CheckFail {
+		return checks
+	}
+
+	region, check := c.doctorZone()
+	checks = append(checks, check)
+	if check.Status == CheckFail {
+		return checks
+	}
+
+	checks = append(checks, c.doctorBaseImage())
+
+	cpus, check := c.doctorMachineType()
+	checks = append(checks, check)
+
+	checks = append(checks, c.doctorFirewall())
+	checks = append(checks, checkSSHPublicKey(&c.config.Config))
+	checks = append(checks, CheckWriteAccess("bucket", c.config.GCSDestination))
+	checks = append(checks, c.doctorQuota(region, cpus))
+
+	return checks
+}
+
+func (c *GCECloud) doctorProject() *Check {
+	glog.V(2).Infof("GCE Projects Get %q", c.config.Project)
+	project, err := c.computeClient.Projects.Get(c.config.Project).Do()
+	if err != nil {
+		return failCheck("credentials", fmt.Sprintf("error getting project %q: %v", c.config.Project, err),
+			"Run gcloud auth application-default login (or set GOOGLE_APPLICATION_CREDENTIALS), and check Project")
+	}
+	return passCheck("credentials", "project %s", project.Name)
+}
+
+// doctorZone checks the zone is up, returning its region
+func (c *GCECloud) doctorZone() (string, *Check) {
+	fix := "Set Zone to a zone in the project (e.g. us-central1-f)"
+
+	glog.V(2).Infof("GCE Zones Get %q", c.config.Zone)
+	zone, err := c.computeClient.Zones.Get(c.config.Project, c.config.Zone).Do()
+	if err != nil {
+		return "", failCheck("zone", fmt.Sprintf("error getting zone %q: %v", c.config.Zone, err), fix)
+	}
+	if zone.Status != "UP" {
+		return "", failCheck("zone", fmt.Sprintf("zone %q is %s", c.config.Zone, zone.Status), fix)
+	}
+	region := path.Base(zone.Region)
+	return region, passCheck("zone", "%s (%s)", zone.Name, region)
+}
+
+// gceImageURL matches the project and name in an image URL
+var gceImageURL = regexp.MustCompile("projects/([^/]+)/global/images/([^/]+)$")
+
+func (c *GCECloud) doctorBaseImage() *Check {
+	fix := "Set Image to the URL of a Debian image (e.g. from gcloud compute images list --uri), or select one with ImageFamily"
+
+	project, name := c.config.Project, c.config.Image
+	if m := gceImageURL.FindStringSubmatch(c.config.Image); m != nil {
+		project, name = m[1], m[2]
+	}
+
+	glog.V(2).Infof("GCE Images Get %s/%s", project, name)
+	image, err := c.computeClient.Images.Get(project, name).Do()
+	if err != nil {
+		return failCheck("base image", fmt.Sprintf("error getting image %q: %v", c.config.Image, err), fix)
+	}
+	if image.Status != "READY" {
+		return failCheck("base image", fmt.Sprintf("image %q is %s", name, image.Status), fix)
+	}
+	if image.Deprecated != nil && image.Deprecated.State != "" {
+		switch image.Deprecated.State {
+		case "OBSOLETE", "DELETED":
+			return failCheck("base image", fmt.Sprintf("image %q is %s", name, strings.ToLower(image.Deprecated.State)), fix)
+		default:
+			return warnCheck("base image", fmt.Sprintf("image %q is %s", name, strings.ToLower(image.Deprecated.State)), fix)
+		}
+	}
+	return passCheck("base image", "%s/%s", project, name)
+}
+
+// doctorMachineType checks that the machine type is available in the zone, returning its CPUs
+func (c *GCECloud) doctorMachineType() (int64, *Check) {
+	glog.V(2).Infof("GCE MachineTypes Get %q", c.config.MachineType)
+	machineType, err := c.computeClient.MachineTypes.Get(c.config.Project, c.config.Zone, c.config.MachineType).Do()
+	if err != nil {
+		return 0, failCheck("machine type", fmt.Sprintf("machine type %q is not available in %s: %v", c.config.MachineType, c.config.Zone, err),
+			"Set MachineType to a type available in the zone (gcloud compute machine-types list --zones "+c.config.Zone+")")
+	}
+	return machineType.GuestCpus, passCheck("machine type", "%s (%d CPUs)", machineType.Name, machineType.GuestCpus)
+}
+
+// doctorFirewall checks that a firewall rule allows SSH to the network
+func (c *GCECloud) doctorFirewall() *Check {
+	fix := sshIngressFix + ", e.g. gcloud compute firewall-rules create imagebuilder-ssh --network " + gceNetwork + " --allow tcp:22 --source-ranges <ip>/32"
+
+	glog.V(2).Infof("GCE Firewalls List")
+	firewalls, err := c.computeClient.Firewalls.List(c.config.Project).Do()
+	if err != nil {
+		return failCheck("ssh ingress", fmt.Sprintf("error listing firewall rules: %v", err), fix)
+	}
+
+	var sources []string
+	for _, f := range firewalls.Items {
+		if path.Base(f.Network) != gceNetwork {
+			continue
+		}
+		// Rules with target tags don't apply to the builder, which has no tags
+		if len(f.TargetTags) != 0 {
+			continue
+		}
+		for _, allowed := range f.Allowed {
+			if allowsGCEPort(allowed.IPProtocol, allowed.Ports, 22) {
+				sources = append(sources, f.Name+" ("+strings.Join(f.SourceRanges, ",")+")")
+				break
+			}
+		}
+	}
+	if len(sources) == 0 {
+		return failCheck("ssh ingress", fmt.Sprintf("no firewall rule allows tcp:22 to network %q", gceNetwork), fix)
+	}
+	return passCheck("ssh ingress", "tcp:22 allowed by %s", strings.Join(sources, ", "))
+}
+
+// allowsGCEPort returns true if a firewall rule's protocol and ports allow tcp on the port
+func allowsGCEPort(protocol string, ports []string, port int) bool {
+	if protocol != "tcp" && protocol != "all" {
+		return false
+	}
+	if len(ports) == 0 {
+		return true
+	}
+	for _, p := range ports {
+		var from, to int
+		if n, _ := fmt.Sscanf(p, "%d-%d", &from, &to); n == 2 {
+			if from <= port && port <= to {
+				return true
+			}
+		} else if n == 1 && from == port {
+			return true
+		}
+	}
+	return false
+}
+
+// doctorQuota checks that the region has quota for the builder's CPUs and disk
+func (c *GCECloud) doctorQuota(region string, cpus int64) *Check {
+	fix := "Delete unused instances and disks in " + region + ", or request a quota increase"
+
+	glog.V(2).Infof("GCE Regions Get %q", region)
+	r, err := c.computeClient.Regions.Get(c.config.Project, region).Do()
+	if err != nil {
+		return warnCheck("quota", fmt.Sprintf("error getting quotas for %s: %v", region, err), fix)
+	}
+
+	// The builder's boot disk is a 10GB SSD
+	need := map[string]float64{"CPUS": float64(cpus), "SSD_TOTAL_GB": 10, "IN_USE_ADDRESSES": 1}
+	var headroom []string
+	for _, q := range r.Quotas {
+		n, found := need[q.Metric]
+		if !found {
+			continue
+		}
+		if q.Limit-q.Usage < n {
+			return failCheck("quota", fmt.Sprintf("%s in %s: %.0f of %.0f used, %.0f needed", q.Metric, region, q.Usage, q.Limit, n), fix)
+		}
+		headroom = append(headroom, fmt.Sprintf("%s %.0f/%.0f", q.Metric, q.Usage, q.Limit))
+	}
+	return passCheck("quota", "%s", strings.Join(headroom, ", "))
+}
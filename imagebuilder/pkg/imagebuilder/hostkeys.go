@@ -0,0 +1,249 @@
+/*
+Copyright 2016 The Kubernetes Authors All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package imagebuilder
+
+import (
+	"bufio"
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/base64"
+	"fmt"
+	"net"
+	"strings"
+	"time"
+
+	"github.com/golang/glog"
+	"golang.org/x/crypto/ssh"
+)
+
+// HostKeyTimeout is how long we wait for an instance to report its SSH host keys on the console
+const HostKeyTimeout = 15 * time.Minute
+
+// Markers that cloud-init writes around the host key information on the console
+const (
+	beginHostKeyFingerprints = "-----BEGIN SSH HOST KEY FINGERPRINTS-----"
+	endHostKeyFingerprints   = "-----END SSH HOST KEY FINGERPRINTS-----"
+	beginHostKeys            = "-----BEGIN SSH HOST KEY KEYS-----"
+	endHostKeys              = "-----END SSH HOST KEY KEYS-----"
+)
+
+// hostKeyFingerprintsFunction returns the host key fingerprints that an instance has reported so far (if any)
+type hostKeyFingerprintsFunction func() ([]string, error)
+
+// consoleHostKeyFingerprints returns a hostKeyFingerprintsFunction that parses the console output from getConsoleOutput
+func consoleHostKeyFingerprints(getConsoleOutput func() (string, error)) hostKeyFingerprintsFunction {
+	return func() ([]string, error) {
+		console, err := getConsoleOutput()
+		if err != nil {
+			return nil, err
+		}
+		return ParseHostKeyFingerprints(console), nil
+	}
+}
+
+// HostKeyPinner is an ssh.HostKeyCallback that only accepts host keys
+// whose fingerprint was reported out-of-band (on the instance console, or in GCE guest attributes)
+type HostKeyPinner struct {
+	fingerprints map[string]bool
+
+	// rejected is set if we refused a host key; retrying will not help
+	rejected error
+}
+
+// NewHostKeyPinner builds a HostKeyPinner accepting the specified fingerprints.
+// Fingerprints are in the form MD5:aa:bb:... or SHA256:<base64>
+func NewHostKeyPinner(fingerprints []string) *HostKeyPinner {
+	p := &HostKeyPinner{
+		fingerprints: make(map[string]bool),
+	}
+	for _, f := range fingerprints {
+		p.fingerprints[f] = true
+	}
+	return p
+}
+
+// Check implements ssh.HostKeyCallback
+func (p *HostKeyPinner) Check(hostname string, remote net.Addr, key ssh.PublicKey) error {
+	for _, f := range hostKeyFingerprints(key) {
+		if p.fingerprints[f] {
+			glog.V(2).Infof("Accepted SSH host key %s for %s", f, hostname)
+			return nil
+		}
+	}
+
+	p.rejected = fmt.Errorf("SSH host key for %s (%s) did not match any fingerprint reported by the instance", hostname, fingerprintSHA256(key))
+	return p.rejected
+}
+
+// Rejected returns the error if a host key was rejected
+func (p *HostKeyPinner) Rejected() error {
+	return p.rejected
+}
+
+// hostKeyFingerprints returns the fingerprints of the key, in all the formats we understand
+func hostKeyFingerprints(key ssh.PublicKey) []string {
+	return []string{fingerprintMD5(key), fingerprintSHA256(key)}
+}
+
+func fingerprintMD5(key ssh.PublicKey) string {
+	hash := md5.Sum(key.Marshal())
+	var hexes []string
+	for _, b := range hash {
+		hexes = append(hexes, fmt.Sprintf("%02x", b))
+	}
+	return "MD5:" + strings.Join(hexes, ":")
+}
+
+func fingerprintSHA256(key ssh.PublicKey) string {
+	hash := sha256.Sum256(key.Marshal())
+	return "SHA256:" + base64.RawStdEncoding.EncodeToString(hash[:])
+}
+
+// ParseHostKeyFingerprints extracts the SSH host key fingerprints from console output.
+// cloud-init prints the fingerprints (and typically the keys themselves) between well-known markers.
+// Only sections that have been closed by their end marker are used, as the console may still be being written.
+func ParseHostKeyFingerprints(console string) []string {
+	var fingerprints []string
+
+	// section is the marker that began the current section, and pending are the fingerprints found in it so far
+	section := ""
+	var pending []string
+	scanner := bufio.NewScanner(strings.NewReader(console))
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+
+		// Some images prefix each console line (e.g. "ec2: ")
+		for _, marker := range []string{beginHostKeyFingerprints, endHostKeyFingerprints, beginHostKeys, endHostKeys} {
+			if strings.HasSuffix(line, marker) {
+				line = marker
+			}
+		}
+
+		switch line {
+		case beginHostKeyFingerprints, beginHostKeys:
+			section = line
+			pending = nil
+			continue
+		case endHostKeyFingerprints, endHostKeys:
+			if section != "" {
+				fingerprints = append(fingerprints, pending...)
+			}
+			section = ""
+			pending = nil
+			continue
+		}
+
+		switch section {
+		case beginHostKeyFingerprints:
+			fingerprint := parseFingerprintLine(line)
+			if fingerprint != "" {
+				pending = append(pending, fingerprint)
+			}
+
+		case beginHostKeys:
+			// Strip any prefix before the key type
+			for _, field := range strings.Fields(line) {
+				if strings.HasPrefix(field, "ssh-") || strings.HasPrefix(field, "ecdsa-") {
+					line = line[strings.Index(line, field):]
+					break
+				}
+			}
+			key, _, _, _, err := ssh.ParseAuthorizedKey([]byte(line))
+			if err != nil {
+				glog.V(2).Infof("Ignoring unparseable host key line %q: %v", line, err)
+				continue
+			}
+			pending = append(pending, fingerprintSHA256(key))
+		}
+	}
+
+	return fingerprints
+}
+
+// guestAttribute is a GCE guest attribute, which the guest agent sets on the instance.
+// The guest agent reports each host key as an attribute in the hostkeys namespace, named for the key type,
+// with the base64 key as its value.
+type guestAttribute struct {
+	Namespace string `json:"namespace"`
+	Key       string `json:"key"`
+	Value     string `json:"value"`
+}
+
+// parseGuestAttributeHostKeys returns the fingerprints of the host keys in the GCE guest attributes
+func parseGuestAttributeHostKeys(attributes []guestAttribute) []string {
+	var fingerprints []string
+	for _, a := range attributes {
+		if a.Namespace != "hostkeys" {
+			continue
+		}
+		key, _, _, _, err := ssh.ParseAuthorizedKey([]byte(a.Key + " " + a.Value))
+		if err != nil {
+			glog.V(2).Infof("Ignoring unparseable host key guest attribute %q: %v", a.Key, err)
+			continue
+		}
+		fingerprints = append(fingerprints, fingerprintSHA256(key))
+	}
+	return fingerprints
+}
+
+// parseFingerprintLine parses a line from ssh-keygen -l, e.g. "2048 aa:bb:...:ff /etc/ssh/ssh_host_rsa_key.pub (RSA)".
+// Newer versions print "256 SHA256:<base64> root@host (ECDSA)" instead.
+func parseFingerprintLine(line string) string {
+	for _, field := range strings.Fields(line) {
+		if strings.HasPrefix(field, "SHA256:") {
+			return field
+		}
+		if strings.HasPrefix(field, "MD5:") {
+			return "MD5:" + strings.ToLower(strings.TrimPrefix(field, "MD5:"))
+		}
+		if len(field) == 47 && strings.Count(field, ":") == 15 {
+			return "MD5:" + strings.ToLower(field)
+		}
+	}
+	return ""
+}
+
+// hostKeyPollInterval is how often we check for the host key fingerprints
+var hostKeyPollInterval = 10 * time.Second
+
+// waitHostKeyFingerprints polls the instance until it reports its host key fingerprints.
+// Errors fetching them are retried, as the cloud APIs can fail transiently.
+// We fail closed: if no fingerprints are found before the timeout, we return an error.
+func waitHostKeyFingerprints(id string, getFingerprints hostKeyFingerprintsFunction, timeout time.Duration) ([]string, error) {
+	deadline := time.Now().Add(timeout)
+	for {
+		fingerprints, err := getFingerprints()
+		if err != nil {
+			glog.Warningf("error fetching SSH host key fingerprints for %q (will retry): %v", id, err)
+		} else if len(fingerprints) != 0 {
+			glog.Infof("Instance %q reported SSH host key fingerprints: %v", id, fingerprints)
+			return fingerprints, nil
+		}
+
+		if time.Now().After(deadline) {
+			if err != nil {
+				return nil, fmt.Errorf("instance %q did not report SSH host key fingerprints within %v; refusing to connect (last error: %v)", id, timeout, err)
+			}
+			return nil, fmt.Errorf("instance %q did not report SSH host key fingerprints within %v; refusing to connect", id, timeout)
+		}
+
+		if err == nil {
+			glog.Infof("SSH host key fingerprints not yet available for %q; waiting", id)
+		}
+		time.Sleep(hostKeyPollInterval)
+	}
+}
@@ -0,0 +1,232 @@
+/*
+Copyright 2016 The Kubernetes Authors All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package imagebuilder
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+	"google.golang.org/api/compute/v1"
+)
+
+func TestWaitHostKeyFingerprintsRetriesErrors(t *testing.T) {
+	defer func(interval time.Duration) { hostKeyPollInterval = interval }(hostKeyPollInterval)
+	hostKeyPollInterval = time.Millisecond
+
+	console := "ec2: -----BEGIN SSH HOST KEY FINGERPRINTS-----\n" +
+		"ec2: 256 SHA256:abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQ root@host (ECDSA)\n" +
+		"ec2: -----END SSH HOST KEY FINGERPRINTS-----\n"
+
+	calls := 0
+	getConsoleOutput := func() (string, error) {
+		calls++
+		switch calls {
+		case 1, 2:
+			return "", fmt.Errorf("RequestLimitExceeded")
+		case 3:
+			return "booting", nil
+		default:
+			return console, nil
+		}
+	}
+
+	fingerprints, err := waitHostKeyFingerprints("i-1234", consoleHostKeyFingerprints(getConsoleOutput), time.Minute)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(fingerprints) != 1 || fingerprints[0] != "SHA256:abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQ" {
+		t.Fatalf("unexpected fingerprints %v", fingerprints)
+	}
+	if calls != 4 {
+		t.Fatalf("expected 4 calls, was %d", calls)
+	}
+}
+
+func TestWaitHostKeyFingerprintsTimeout(t *testing.T) {
+	defer func(interval time.Duration) { hostKeyPollInterval = interval }(hostKeyPollInterval)
+	hostKeyPollInterval = time.Millisecond
+
+	getConsoleOutput := func() (string, error) {
+		return "", fmt.Errorf("InternalError")
+	}
+
+	_, err := waitHostKeyFingerprints("i-1234", consoleHostKeyFingerprints(getConsoleOutput), 10*time.Millisecond)
+	if err == nil {
+		t.Fatalf("expected error after timeout")
+	}
+	if !strings.Contains(err.Error(), "InternalError") {
+		t.Fatalf("expected error to include the last API error, was %v", err)
+	}
+}
+
+// testHostKey generates a host key, returning it in authorized_keys format, and its SHA256 fingerprint
+func testHostKey(t *testing.T) (string, string) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("error generating key: %v", err)
+	}
+	publicKey, err := ssh.NewPublicKey(&key.PublicKey)
+	if err != nil {
+		t.Fatalf("error building public key: %v", err)
+	}
+	return strings.TrimSpace(string(ssh.MarshalAuthorizedKey(publicKey))), fingerprintSHA256(publicKey)
+}
+
+func TestParseHostKeyFingerprints(t *testing.T) {
+	hostKey, hostKeyFingerprint := testHostKey(t)
+	sha256 := "SHA256:abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQ"
+	md5 := "MD5:0a:1b:2c:3d:4e:5f:60:71:82:93:a4:b5:c6:d7:e8:f9"
+
+	grid := []struct {
+		name    string
+		console string
+		expect  []string
+	}{
+		{
+			name: "SHA256 fingerprints",
+			console: "-----BEGIN SSH HOST KEY FINGERPRINTS-----\n" +
+				"256 " + sha256 + " root@host (ECDSA)\n" +
+				"-----END SSH HOST KEY FINGERPRINTS-----\n",
+			expect: []string{sha256},
+		},
+		{
+			name: "MD5 fingerprints, from older ssh-keygen, in either case",
+			console: "-----BEGIN SSH HOST KEY FINGERPRINTS-----\n" +
+				"2048 0A:1B:2C:3D:4E:5F:60:71:82:93:A4:B5:C6:D7:E8:F9 /etc/ssh/ssh_host_rsa_key.pub (RSA)\n" +
+				"256 " + md5 + " root@host (ECDSA)\n" +
+				"-----END SSH HOST KEY FINGERPRINTS-----\n",
+			expect: []string{md5, md5},
+		},
+		{
+			name: "prefixed console lines",
+			console: "[   12.345] cloud-init[1]: boot\n" +
+				"ec2: #############################################################\n" +
+				"ec2: -----BEGIN SSH HOST KEY FINGERPRINTS-----\n" +
+				"ec2: 256 " + sha256 + " root@ip-10-0-0-1 (ECDSA)\n" +
+				"ec2: -----END SSH HOST KEY FINGERPRINTS-----\n" +
+				"ec2: #############################################################\n",
+			expect: []string{sha256},
+		},
+		{
+			name: "key blocks, with and without a prefix",
+			console: "-----BEGIN SSH HOST KEY KEYS-----\n" +
+				hostKey + " root@host\n" +
+				"ec2: " + hostKey + "\n" +
+				"not a key\n" +
+				"-----END SSH HOST KEY KEYS-----\n",
+			expect: []string{hostKeyFingerprint, hostKeyFingerprint},
+		},
+		{
+			name: "fingerprints and keys",
+			console: "-----BEGIN SSH HOST KEY FINGERPRINTS-----\n" +
+				"256 " + sha256 + " root@host (ECDSA)\n" +
+				"-----END SSH HOST KEY FINGERPRINTS-----\n" +
+				"-----BEGIN SSH HOST KEY KEYS-----\n" +
+				hostKey + " root@host\n" +
+				"-----END SSH HOST KEY KEYS-----\n",
+			expect: []string{sha256, hostKeyFingerprint},
+		},
+		{
+			name: "a missing end marker, because the console is still being written",
+			console: "-----BEGIN SSH HOST KEY FINGERPRINTS-----\n" +
+				"256 " + sha256 + " root@host (ECDSA)\n",
+			expect: nil,
+		},
+		{
+			name: "only the closed sections",
+			console: "-----BEGIN SSH HOST KEY FINGERPRINTS-----\n" +
+				"256 " + sha256 + " root@host (ECDSA)\n" +
+				"-----END SSH HOST KEY FINGERPRINTS-----\n" +
+				"-----BEGIN SSH HOST KEY KEYS-----\n" +
+				hostKey + " root@host\n",
+			expect: []string{sha256},
+		},
+		{
+			name:    "no markers",
+			console: "256 " + sha256 + " root@host (ECDSA)\n",
+			expect:  nil,
+		},
+	}
+	for _, g := range grid {
+		actual := ParseHostKeyFingerprints(g.console)
+		if !reflect.DeepEqual(actual, g.expect) {
+			t.Errorf("%s: expected %v, got %v", g.name, g.expect, actual)
+		}
+	}
+}
+
+func TestParseGuestAttributeHostKeys(t *testing.T) {
+	hostKey, hostKeyFingerprint := testHostKey(t)
+	fields := strings.Fields(hostKey)
+
+	attributes := []guestAttribute{
+		{Namespace: "hostkeys", Key: fields[0], Value: fields[1]},
+		{Namespace: "hostkeys", Key: "ssh-rsa", Value: "not-base64"},
+		{Namespace: "other", Key: fields[0], Value: fields[1]},
+	}
+	actual := parseGuestAttributeHostKeys(attributes)
+	if !reflect.DeepEqual(actual, []string{hostKeyFingerprint}) {
+		t.Errorf("expected %v, got %v", []string{hostKeyFingerprint}, actual)
+	}
+}
+
+func TestGetGuestAttributeHostKeys(t *testing.T) {
+	hostKey, hostKeyFingerprint := testHostKey(t)
+	fields := strings.Fields(hostKey)
+
+	ready := false
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/projects/p/zones/z/instances/builder/getGuestAttributes" || r.URL.Query().Get("queryPath") != "hostkeys/" {
+			t.Errorf("unexpected request %s", r.URL)
+		}
+		if !ready {
+			http.Error(w, `{"error": {"code": 404, "message": "not found"}}`, http.StatusNotFound)
+			return
+		}
+		fmt.Fprintf(w, `{"queryPath": "hostkeys/", "queryValue": {"items": [{"namespace": "hostkeys", "key": %q, "value": %q}]}}`, fields[0], fields[1])
+	}))
+	defer server.Close()
+
+	c := &GCECloud{
+		config:        &GCEConfig{Project: "p", Zone: "z"},
+		computeClient: &compute.Service{BasePath: server.URL + "/projects/"},
+		httpClient:    http.DefaultClient,
+	}
+
+	fingerprints, err := c.getGuestAttributeHostKeys("builder")
+	if err != nil || len(fingerprints) != 0 {
+		t.Errorf("expected no fingerprints before the guest agent reports them, got %v (%v)", fingerprints, err)
+	}
+
+	ready = true
+	fingerprints, err = c.getGuestAttributeHostKeys("builder")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if !reflect.DeepEqual(fingerprints, []string{hostKeyFingerprint}) {
+		t.Errorf("expected %v, got %v", []string{hostKeyFingerprint}, fingerprints)
+	}
+}
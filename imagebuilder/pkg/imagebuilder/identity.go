@@ -0,0 +1,143 @@
+/*
+Copyright 2016 The Kubernetes Authors All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package imagebuilder
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+)
+
+// ContentHashTag is the tag (or label) on an image that holds its ImageIdentity hash
+const ContentHashTag = "k8s.io/imagebuilder/content-hash"
+
+// contentHashLength is the number of hex characters in a content hash; it must fit in a GCE label value
+const contentHashLength = 40
+
+// ImageIdentity is everything that determines the contents of a built image.
+// Two builds with the same identity produce the same image, so we only build an identity once.
+type ImageIdentity struct {
+	// Version is incremented if the way we compute the hash changes
+	Version int
+	// Manifest is the expanded (and merged) bootstrap-vz manifest, before the image name is resolved
+	Manifest string
+	// BootstrapVZVersion identifies the bootstrap-vz code that runs the build (see BootstrapVZSource)
+	BootstrapVZVersion string
+	// SetupCommands are the commands run on the builder before the build
+	SetupCommands [][]string
+	// BaseImage is the image of the builder instance
+	BaseImage string
+	// Backend is the build backend, if it is not bootstrap-vz
+	Backend string `json:",omitempty"`
+	// BackendConfig is the configuration of the backend that affects the image, if any
+	BackendConfig interface{} `json:",omitempty"`
+	// Files maps each of the Config.Files uploaded to the builder to the hash of its contents (see AddFiles)
+	Files map[string]string `json:",omitempty"`
+}
+
+// Hash returns the hex content hash of the identity
+func (i *ImageIdentity) Hash() (string, error) {
+	// Struct fields are serialized in a fixed order, so this is canonical
+	data, err := json.Marshal(i)
+	if err != nil {
+		return "", fmt.Errorf("error serializing image identity: %v", err)
+	}
+	hash := sha256.Sum256(data)
+	return hex.EncodeToString(hash[:])[:contentHashLength], nil
+}
+
+// NewImageIdentity builds the identity of the image built from the manifest with the config
+func NewImageIdentity(manifest string, config *Config, bootstrapVZVersion string, baseImage string) *ImageIdentity {
+	i := &ImageIdentity{
+		Version:            1,
+		Manifest:           manifest,
+		BootstrapVZVersion: bootstrapVZVersion,
+		BaseImage:          baseImage,
+	}
+	for _, c := range config.SetupCommands {
+		i.SetupCommands = append(i.SetupCommands, c.Command)
+	}
+	return i
+}
+
+// AddFiles adds the contents of the files & directories (see Config.Files) to the identity,
+// so that changing an uploaded file changes the hash
+func (i *ImageIdentity) AddFiles(files map[string]string) error {
+	if len(files) == 0 {
+		return nil
+	}
+	i.Files = make(map[string]string)
+	for k, p := range files {
+		hash, err := hashFiles(p)
+		if err != nil {
+			return err
+		}
+		i.Files[k] = hash
+	}
+	return nil
+}
+
+// hashFiles returns the hex sha256 hash of the file or directory tree at p:
+// the path (relative to p), mode and contents of each entry, in sorted order
+func hashFiles(p string) (string, error) {
+	// Files are uploaded from the target of a symlink
+	root, err := filepath.EvalSymlinks(p)
+	if err != nil {
+		return "", fmt.Errorf("error reading file %q: %v", p, err)
+	}
+
+	hasher := sha256.New()
+	// Walk visits the entries in lexical order
+	err = filepath.Walk(root, func(f string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(root, f)
+		if err != nil {
+			return err
+		}
+		fmt.Fprintf(hasher, "%s\x00%o\x00", filepath.ToSlash(rel), info.Mode())
+
+		switch {
+		case info.Mode()&os.ModeSymlink != 0:
+			target, err := os.Readlink(f)
+			if err != nil {
+				return err
+			}
+			fmt.Fprintf(hasher, "%s\x00", target)
+		case info.Mode().IsRegular():
+			r, err := os.Open(f)
+			if err != nil {
+				return err
+			}
+			defer r.Close()
+			fmt.Fprintf(hasher, "%d\x00", info.Size())
+			if _, err := io.Copy(hasher, r); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return "", fmt.Errorf("error hashing %q: %v", p, err)
+	}
+	return hex.EncodeToString(hasher.Sum(nil)), nil
+}
@@ -0,0 +1,98 @@
+/*
+Copyright 2016 The Kubernetes Authors All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package imagebuilder
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestImageIdentityFiles(t *testing.T) {
+	dir, err := ioutil.TempDir("", "identity")
+	if err != nil {
+		t.Fatalf("error creating temp dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	certs := filepath.Join(dir, "certs")
+	write := func(p string, contents string, mode os.FileMode) {
+		if err := os.MkdirAll(filepath.Dir(p), 0755); err != nil {
+			t.Fatalf("error creating directory: %v", err)
+		}
+		if err := ioutil.WriteFile(p, []byte(contents), mode); err != nil {
+			t.Fatalf("error writing file: %v", err)
+		}
+		if err := os.Chmod(p, mode); err != nil {
+			t.Fatalf("error changing mode: %v", err)
+		}
+	}
+	write(filepath.Join(certs, "ca.crt"), "ca", 0644)
+	write(filepath.Join(certs, "sub", "server.crt"), "server", 0644)
+	write(filepath.Join(dir, "config"), "config", 0644)
+
+	files := map[string]string{"certs": certs, "etc/config": filepath.Join(dir, "config")}
+	hash := func() string {
+		i := NewImageIdentity("manifest", &Config{}, "bvz", "base")
+		if err := i.AddFiles(files); err != nil {
+			t.Fatalf("error adding files: %v", err)
+		}
+		h, err := i.Hash()
+		if err != nil {
+			t.Fatalf("error hashing identity: %v", err)
+		}
+		return h
+	}
+
+	noFiles, err := NewImageIdentity("manifest", &Config{}, "bvz", "base").Hash()
+	if err != nil {
+		t.Fatalf("error hashing identity: %v", err)
+	}
+
+	original := hash()
+	if original == noFiles {
+		t.Errorf("files did not change the hash")
+	}
+	if hash() != original {
+		t.Errorf("hash is not deterministic")
+	}
+
+	changes := []struct {
+		name   string
+		change func()
+	}{
+		{"file in a tree changed", func() { write(filepath.Join(certs, "sub", "server.crt"), "new server", 0644) }},
+		{"file mode changed", func() { write(filepath.Join(dir, "config"), "config", 0600) }},
+		{"file added to a tree", func() { write(filepath.Join(certs, "new.crt"), "new", 0644) }},
+		{"file renamed in a tree", func() {
+			if err := os.Rename(filepath.Join(certs, "new.crt"), filepath.Join(certs, "renamed.crt")); err != nil {
+				t.Fatalf("error renaming file: %v", err)
+			}
+		}},
+		{"destination changed", func() { files["etc/other"] = files["etc/config"]; delete(files, "etc/config") }},
+	}
+	seen := map[string]string{original: "original"}
+	for _, c := range changes {
+		c.change()
+		h := hash()
+		if previous, found := seen[h]; found {
+			t.Errorf("%s: hash is the same as %s", c.name, previous)
+		}
+		seen[h] = c.name
+	}
+}
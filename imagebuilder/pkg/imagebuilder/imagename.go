@@ -0,0 +1,252 @@
+/*
+Copyright 2016 The Kubernetes Authors All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package imagebuilder
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"os/exec"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/golang/glog"
+)
+
+// Tokens that can be used in the image name, in addition to strftime specifiers and manifest values
+const (
+	// TokenBuildID is a random identifier for the build
+	TokenBuildID = "build.id"
+	// TokenBuildSeq is the lowest number (from 1) that gives a name that is not already used
+	TokenBuildSeq = "build.seq"
+	// TokenTemplateSHA is a short hash of the expanded template
+	TokenTemplateSHA = "template.sha"
+	// TokenGitSHA is the git commit of the template directory
+	TokenGitSHA = "git.sha"
+)
+
+// BuildInfo holds the build-derived values that can be used in the image name
+type BuildInfo struct {
+	// Time is the time of the build, used for strftime specifiers
+	Time time.Time
+	// ID is a random identifier for the build
+	ID string
+	// Seq is the value of {build.seq}
+	Seq int
+	// TemplateSHA is a short hash of the expanded template
+	TemplateSHA string
+	// GitSHA is the git commit of the template directory, or empty if it is not in a git repository
+	GitSHA string
+}
+
+// NewBuildInfo builds the BuildInfo for building the manifest, from the template in templateDir
+func NewBuildInfo(manifest string, templateDir string) (*BuildInfo, error) {
+	info := &BuildInfo{
+		Time: time.Now().UTC(),
+		Seq:  1,
+	}
+
+	id := make([]byte, 4)
+	if _, err := rand.Read(id); err != nil {
+		return nil, fmt.Errorf("error generating build id: %v", err)
+	}
+	info.ID = hex.EncodeToString(id)
+
+	hash := sha256.Sum256([]byte(manifest))
+	info.TemplateSHA = hex.EncodeToString(hash[:])[:12]
+
+	out, err := exec.Command("git", "-C", templateDir, "rev-parse", "--short=12", "HEAD").Output()
+	if err != nil {
+		glog.V(2).Infof("unable to determine git commit of %q: %v", templateDir, err)
+	} else {
+		info.GitSHA = strings.TrimSpace(string(out))
+	}
+
+	return info, nil
+}
+
+// token returns the value of a build token, or false if it is not a build token
+func (i *BuildInfo) token(name string) (string, bool, error) {
+	switch name {
+	case TokenBuildID:
+		return i.ID, true, nil
+	case TokenBuildSeq:
+		return strconv.Itoa(i.Seq), true, nil
+	case TokenTemplateSHA:
+		return i.TemplateSHA, true, nil
+	case TokenGitSHA:
+		if i.GitSHA == "" {
+			return "", true, fmt.Errorf("{%s} is used in the name, but the template is not in a git repository", TokenGitSHA)
+		}
+		return i.GitSHA, true, nil
+	default:
+		return "", false, nil
+	}
+}
+
+// ExpandImageName replaces the {...} references in name.
+// References are strftime-formatted build times (e.g. {%Y%m%d-%H%M}), build tokens
+// ({build.id}, {build.seq}, {template.sha}, {git.sha}), or values looked up with lookup (e.g. from the manifest).
+func ExpandImageName(name string, info *BuildInfo, lookup func(path string) (string, error)) (string, error) {
+	var replaceErr error
+
+	replacer := func(path string) string {
+		// Remove { and }
+		path = path[1 : len(path)-1]
+
+		if path == "" {
+			return ""
+		}
+
+		if path[0] == '%' {
+			v, err := strftime(path, info.Time)
+			if err != nil {
+				replaceErr = err
+				return ""
+			}
+			return v
+		}
+
+		if v, isToken, err := info.token(path); isToken {
+			if err != nil {
+				replaceErr = err
+			}
+			return v
+		}
+
+		v, err := lookup(path)
+		if err != nil {
+			replaceErr = fmt.Errorf("error replacing template spec %q: %v", path, err)
+			return ""
+		}
+		return v
+	}
+
+	name = placeholderRegex.ReplaceAllStringFunc(name, replacer)
+	if replaceErr != nil {
+		return "", replaceErr
+	}
+	return name, nil
+}
+
+// ImageNameUses returns true if the name references {token}
+func ImageNameUses(name string, token string) bool {
+	return strings.Contains(name, "{"+token+"}")
+}
+
+// strftime formats t according to the strftime specifiers in format
+func strftime(format string, t time.Time) (string, error) {
+	var b strings.Builder
+	for i := 0; i < len(format); i++ {
+		if format[i] != '%' {
+			b.WriteByte(format[i])
+			continue
+		}
+		i++
+		if i >= len(format) {
+			return "", fmt.Errorf("incomplete strftime specifier at end of %q", format)
+		}
+		switch format[i] {
+		case 'Y':
+			b.WriteString(strconv.Itoa(t.Year()))
+		case 'y':
+			fmt.Fprintf(&b, "%02d", t.Year()%100)
+		case 'm':
+			fmt.Fprintf(&b, "%02d", t.Month())
+		case 'd':
+			fmt.Fprintf(&b, "%02d", t.Day())
+		case 'e':
+			fmt.Fprintf(&b, "%2d", t.Day())
+		case 'H':
+			fmt.Fprintf(&b, "%02d", t.Hour())
+		case 'I':
+			fmt.Fprintf(&b, "%02d", (t.Hour()+11)%12+1)
+		case 'M':
+			fmt.Fprintf(&b, "%02d", t.Minute())
+		case 'S':
+			fmt.Fprintf(&b, "%02d", t.Second())
+		case 'p':
+			b.WriteString(t.Format("PM"))
+		case 's':
+			b.WriteString(strconv.FormatInt(t.Unix(), 10))
+		case 'j':
+			fmt.Fprintf(&b, "%03d", t.YearDay())
+		case 'a':
+			b.WriteString(t.Format("Mon"))
+		case 'A':
+			b.WriteString(t.Format("Monday"))
+		case 'b':
+			b.WriteString(t.Format("Jan"))
+		case 'B':
+			b.WriteString(t.Format("January"))
+		case 'u':
+			fmt.Fprintf(&b, "%d", (int(t.Weekday())+6)%7+1)
+		case 'w':
+			fmt.Fprintf(&b, "%d", t.Weekday())
+		case 'Z':
+			b.WriteString(t.Format("MST"))
+		case '%':
+			b.WriteByte('%')
+		default:
+			return "", fmt.Errorf("unknown strftime specifier %%%c in %q", format[i], format)
+		}
+	}
+	return b.String(), nil
+}
+
+var (
+	// awsImageNameRegex is the set of characters allowed in an AMI name
+	awsImageNameRegex = regexp.MustCompile(`^[a-zA-Z0-9()\[\] ./\-'@_]+$`)
+	// gceImageNameRegex is the format of a GCE image name (RFC1035, lower case)
+	gceImageNameRegex = regexp.MustCompile(`^[a-z]([-a-z0-9]*[a-z0-9])?$`)
+	// containerImageNameRegex is the set of characters we allow in a container image name, which is also a file name
+	containerImageNameRegex = regexp.MustCompile(`^[a-zA-Z0-9][a-zA-Z0-9._-]*$`)
+)
+
+// ValidateImageName checks that name is a valid image name on the cloud
+func ValidateImageName(cloud string, name string) error {
+	switch cloud {
+	case "aws":
+		if len(name) < 3 || len(name) > 128 {
+			return fmt.Errorf("AWS image name %q must be between 3 and 128 characters (was %d)", name, len(name))
+		}
+		if !awsImageNameRegex.MatchString(name) {
+			return fmt.Errorf("AWS image name %q can only contain letters, numbers, spaces and ()[]./-'@_", name)
+		}
+
+	case "gce":
+		if len(name) > 63 {
+			return fmt.Errorf("GCE image name %q must be at most 63 characters (was %d)", name, len(name))
+		}
+		if !gceImageNameRegex.MatchString(name) {
+			return fmt.Errorf("GCE image name %q must start with a lower case letter, and can only contain lower case letters, numbers and -", name)
+		}
+
+	case "container":
+		if len(name) > 128 {
+			return fmt.Errorf("container image name %q must be at most 128 characters (was %d)", name, len(name))
+		}
+		if !containerImageNameRegex.MatchString(name) {
+			return fmt.Errorf("container image name %q can only contain letters, numbers and ._-", name)
+		}
+	}
+
+	return nil
+}
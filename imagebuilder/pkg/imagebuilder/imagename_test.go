@@ -0,0 +1,107 @@
+/*
+Copyright 2016 The Kubernetes Authors All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package imagebuilder
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestStrftime(t *testing.T) {
+	// A Wednesday afternoon
+	when := time.Date(2016, time.March, 2, 15, 4, 5, 0, time.UTC)
+
+	grid := []struct {
+		Format   string
+		Expected string
+	}{
+		{Format: "%Y%m%d", Expected: "20160302"},
+		{Format: "%y-%m-%d", Expected: "16-03-02"},
+		{Format: "%e", Expected: " 2"},
+		{Format: "%H%M%S", Expected: "150405"},
+		{Format: "%I%p", Expected: "03PM"},
+		{Format: "%s", Expected: "1456931045"},
+		{Format: "%j", Expected: "062"},
+		{Format: "%a %A", Expected: "Wed Wednesday"},
+		{Format: "%b %B", Expected: "Mar March"},
+		{Format: "%u %w", Expected: "3 3"},
+		{Format: "%Z", Expected: "UTC"},
+		{Format: "100%%", Expected: "100%"},
+		{Format: "k8s-%Y", Expected: "k8s-2016"},
+	}
+	for _, g := range grid {
+		actual, err := strftime(g.Format, when)
+		if err != nil {
+			t.Errorf("strftime(%q): unexpected error: %v", g.Format, err)
+			continue
+		}
+		if actual != g.Expected {
+			t.Errorf("strftime(%q): expected %q, was %q", g.Format, g.Expected, actual)
+		}
+	}
+
+	// Sunday is 7 for %u, but 0 for %w; midnight is 12 for %I
+	sunday := time.Date(2016, time.March, 6, 0, 30, 0, 0, time.UTC)
+	if actual, _ := strftime("%u %w %I%p", sunday); actual != "7 0 12AM" {
+		t.Errorf("unexpected %%u %%w %%I%%p for a Sunday at midnight: %q", actual)
+	}
+
+	for _, format := range []string{"%", "%Y%", "%Q"} {
+		if _, err := strftime(format, when); err == nil {
+			t.Errorf("strftime(%q): expected error", format)
+		}
+	}
+}
+
+func TestValidateImageName(t *testing.T) {
+	grid := []struct {
+		Cloud string
+		Name  string
+		Valid bool
+	}{
+		{Cloud: "aws", Name: "k8s-1.4-debian-jessie-amd64-hvm-ebs-2016-10-19", Valid: true},
+		{Cloud: "aws", Name: "k8s (1.4) [test]/o'brien@home_1", Valid: true},
+		{Cloud: "aws", Name: "ab", Valid: false},
+		{Cloud: "aws", Name: strings.Repeat("a", 128), Valid: true},
+		{Cloud: "aws", Name: strings.Repeat("a", 129), Valid: false},
+		{Cloud: "aws", Name: "k8s:1.4", Valid: false},
+
+		{Cloud: "gce", Name: "k8s-1-4-debian-jessie-amd64-2016-10-19", Valid: true},
+		{Cloud: "gce", Name: "a", Valid: true},
+		{Cloud: "gce", Name: "k8s-1.4", Valid: false},
+		{Cloud: "gce", Name: "K8s", Valid: false},
+		{Cloud: "gce", Name: "1k8s", Valid: false},
+		{Cloud: "gce", Name: "k8s-", Valid: false},
+		{Cloud: "gce", Name: "a" + strings.Repeat("b", 62), Valid: true},
+		{Cloud: "gce", Name: "a" + strings.Repeat("b", 63), Valid: false},
+
+		{Cloud: "container", Name: "k8s-1.4_debian", Valid: true},
+		{Cloud: "container", Name: ".hidden", Valid: false},
+		{Cloud: "container", Name: "k8s/1.4", Valid: false},
+		{Cloud: "container", Name: strings.Repeat("a", 129), Valid: false},
+	}
+	for _, g := range grid {
+		err := ValidateImageName(g.Cloud, g.Name)
+		if g.Valid && err != nil {
+			t.Errorf("%s: expected %q to be valid, was %v", g.Cloud, g.Name, err)
+		}
+		if !g.Valid && err == nil {
+			t.Errorf("%s: expected %q to be invalid", g.Cloud, g.Name)
+		}
+	}
+}
@@ -0,0 +1,118 @@
+/*
+Copyright 2016 The Kubernetes Authors All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package imagebuilder
+
+import (
+	"sort"
+	"strings"
+)
+
+// ImageFilter selects images for ListImages
+type ImageFilter struct {
+	// Name matches the image with exactly this name
+	Name string
+	// Family matches images whose name starts with Family
+	Family string
+	// Tags matches images with all of these tags
+	Tags map[string]string
+}
+
+// ImageInfo describes an image, and its copies in other regions
+type ImageInfo struct {
+	Name string `json:"name"`
+	// Created is the creation time of the image (RFC3339), in the region where it was built
+	Created string            `json:"created,omitempty"`
+	Tags    map[string]string `json:"tags,omitempty"`
+	// Regions are the copies of the image, sorted by region
+	Regions []*ImageRegionInfo `json:"regions"`
+}
+
+// ImageRegionInfo describes the copy of an image in one region
+type ImageRegionInfo struct {
+	// Region is empty for images that are not regional
+	Region string `json:"region,omitempty"`
+	ID     string `json:"id"`
+	State  string `json:"state,omitempty"`
+	Public bool   `json:"public"`
+	// LaunchPermissions are the accounts (or groups, e.g. "all") that can use the image; only set by DescribeImage
+	LaunchPermissions []string `json:"launchPermissions,omitempty"`
+}
+
+// Public returns true if the image is public in any region
+func (i *ImageInfo) Public() bool {
+	for _, r := range i.Regions {
+		if r.Public {
+			return true
+		}
+	}
+	return false
+}
+
+// matches returns true if the image (with the tags) is selected by the filter
+func (f *ImageFilter) matches(name string, tags map[string]string) bool {
+	if f.Name != "" && name != f.Name {
+		return false
+	}
+	if f.Family != "" && !strings.HasPrefix(name, f.Family) {
+		return false
+	}
+	for k, v := range f.Tags {
+		if actual, found := tags[k]; !found || actual != v {
+			return false
+		}
+	}
+	return true
+}
+
+// imageInfoMap collects ImageInfos by name, merging the copies in different regions
+type imageInfoMap map[string]*ImageInfo
+
+// add adds a copy of the image; created and tags are taken from the copy in homeRegion, if there is one
+func (m imageInfoMap) add(name string, created string, tags map[string]string, region *ImageRegionInfo, home bool) {
+	info := m[name]
+	if info == nil {
+		info = &ImageInfo{Name: name, Tags: make(map[string]string)}
+		m[name] = info
+	}
+	if home || info.Created == "" {
+		info.Created = created
+	}
+	for k, v := range tags {
+		// Tags aren't copied with the image, so merge them
+		if _, found := info.Tags[k]; !found || home {
+			info.Tags[k] = v
+		}
+	}
+	info.Regions = append(info.Regions, region)
+}
+
+// list returns the images, with the tag filters applied, sorted by name
+func (m imageInfoMap) list(filter *ImageFilter) []*ImageInfo {
+	var images []*ImageInfo
+	for _, info := range m {
+		if !filter.matches(info.Name, info.Tags) {
+			continue
+		}
+		if len(info.Tags) == 0 {
+			info.Tags = nil
+		}
+		sort.Slice(info.Regions, func(i, j int) bool { return info.Regions[i].Region < info.Regions[j].Region })
+		images = append(images, info)
+	}
+	sort.Slice(images, func(i, j int) bool { return images[i].Name < images[j].Name })
+	return images
+}
@@ -0,0 +1,544 @@
+/*
+Copyright 2016 The Kubernetes Authors All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package imagebuilder
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/ghodss/yaml"
+	"github.com/golang/glog"
+)
+
+// ConfigSourceDefault is the source of values that no layer sets
+const ConfigSourceDefault = "default"
+
+// ConfigEnvPrefix is the prefix of environment variables that set config keys
+const ConfigEnvPrefix = "IMAGEBUILDER_"
+
+// configLayer is one source of config values
+type configLayer struct {
+	// source describes the layer: the config file, the environment variable, or --set
+	source string
+	// file is true if source is a config file, which local paths in it are relative to
+	file bool
+
+	// values is the parsed config file, for file layers
+	values map[string]interface{}
+
+	// key is the key (split by sep) that a single value sets, for other layers
+	key   string
+	sep   string
+	value string
+	// env is true if key is from an environment variable name, where case and single underscores are ignored
+	env bool
+}
+
+// LayeredConfig merges the config from layers: config files in order, then IMAGEBUILDER_* environment variables,
+// then --set overrides.  Later layers override earlier ones; objects are merged key by key, other values (including
+// lists) are replaced.  It records the layer that set each value, and rejects keys that are not in the config.
+type LayeredConfig struct {
+	layers []*configLayer
+	// defaults are layers that are applied before the files
+	defaults []*configLayer
+
+	// merged and sources are computed from the layers when needed
+	merged  map[string]interface{}
+	sources map[string]string
+}
+
+// ConfigValue is a value in the effective config, and the layer that set it
+type ConfigValue struct {
+	Key    string      `json:"key"`
+	Value  interface{} `json:"value"`
+	Source string      `json:"source"`
+}
+
+// NewLayeredConfig returns a LayeredConfig with no layers
+func NewLayeredConfig() *LayeredConfig {
+	return &LayeredConfig{}
+}
+
+// AddFile adds the YAML (or JSON) config file p as a layer
+func (c *LayeredConfig) AddFile(p string) error {
+	data, err := ioutil.ReadFile(p)
+	if err != nil {
+		return fmt.Errorf("error reading file %q: %v", p, err)
+	}
+
+	values := make(map[string]interface{})
+	err = yaml.Unmarshal(data, &values)
+	if err != nil {
+		return fmt.Errorf("error parsing file %q: %v", p, err)
+	}
+
+	c.layers = append(c.layers, &configLayer{source: p, file: true, values: values})
+	c.merged = nil
+	return nil
+}
+
+// AddEnv adds a layer for each IMAGEBUILDER_<KEY> variable in environ (in the form k=v).  Nested keys are separated
+// by __ (e.g. IMAGEBUILDER_VOLUME__SIZE), and case and single underscores are ignored in key names.
+// Variables that are not config keys are ignored (with a warning) when the layers are merged.
+func (c *LayeredConfig) AddEnv(environ []string) {
+	var names []string
+	values := make(map[string]string)
+	for _, kv := range environ {
+		tokens := strings.SplitN(kv, "=", 2)
+		if len(tokens) != 2 || !strings.HasPrefix(tokens[0], ConfigEnvPrefix) || tokens[0] == ConfigEnvPrefix {
+			continue
+		}
+		names = append(names, tokens[0])
+		values[tokens[0]] = tokens[1]
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		c.layers = append(c.layers, &configLayer{
+			source: "$" + name,
+			key:    strings.TrimPrefix(name, ConfigEnvPrefix),
+			sep:    "__",
+			value:  values[name],
+			env:    true,
+		})
+	}
+	c.merged = nil
+}
+
+// Set adds a layer setting the key (with nested keys separated by ., e.g. Volume.Size) to value, which is parsed
+// as YAML unless the key is a string.
+func (c *LayeredConfig) Set(key string, value string, source string) {
+	c.layers = append(c.layers, &configLayer{source: source, key: key, sep: ".", value: value})
+	c.merged = nil
+}
+
+// AddDefault is like Set, but the layer is applied before the files, so it only sets the key if no other layer does
+func (c *LayeredConfig) AddDefault(key string, value string, source string) {
+	c.defaults = append(c.defaults, &configLayer{source: source, key: key, sep: ".", value: value})
+	c.merged = nil
+}
+
+// Cloud returns the Cloud that the layers set, which determines the keys that are allowed
+func (c *LayeredConfig) Cloud() string {
+	cloud := ""
+	for _, layer := range c.allLayers() {
+		if layer.file {
+			for k, v := range layer.values {
+				if s, ok := v.(string); ok && strings.EqualFold(k, "Cloud") {
+					cloud = s
+				}
+			}
+		} else if strings.EqualFold(layer.key, "Cloud") {
+			cloud = layer.value
+		}
+	}
+	return cloud
+}
+
+func (c *LayeredConfig) allLayers() []*configLayer {
+	return append(append([]*configLayer{}, c.defaults...), c.layers...)
+}
+
+// configTypes are the config types whose keys are allowed for the cloud; all of them if the cloud is not known
+func configTypes(cloud string) []reflect.Type {
+	switch cloud {
+	case "aws":
+		return []reflect.Type{reflect.TypeOf(AWSConfig{})}
+	case "gce":
+		return []reflect.Type{reflect.TypeOf(GCEConfig{})}
+	case "container":
+		return []reflect.Type{reflect.TypeOf(ContainerConfig{})}
+	default:
+		return []reflect.Type{reflect.TypeOf(AWSConfig{}), reflect.TypeOf(GCEConfig{}), reflect.TypeOf(ContainerConfig{})}
+	}
+}
+
+// CheckKey returns an error if key (as for Set) is not a config key for the cloud
+func (c *LayeredConfig) CheckKey(key string) error {
+	_, _, err := resolveConfigKey(configTypes(c.Cloud()), key, ".", false)
+	return err
+}
+
+// Merge merges the layers, returning an error for keys that are not in the config for the cloud
+func (c *LayeredConfig) Merge() error {
+	if c.merged != nil {
+		return nil
+	}
+
+	types := configTypes(c.Cloud())
+	merged := make(map[string]interface{})
+	sources := make(map[string]string)
+	for _, layer := range c.allLayers() {
+		if layer.file {
+			values, err := normalizeConfigTypes(layer.values, types)
+			if err != nil {
+				return fmt.Errorf("error in config file %q: %v", layer.source, err)
+			}
+			for k, v := range values.(map[string]interface{}) {
+				mergeConfigValue(merged, sources, []string{k}, v, layer.source)
+			}
+			continue
+		}
+
+		key, t, err := resolveConfigKey(types, layer.key, layer.sep, layer.env)
+		if err != nil {
+			// Other tools use IMAGEBUILDER_* variables too (e.g. IMAGEBUILDER_VERSION in CI), so we only warn
+			if layer.env {
+				glog.Warningf("ignoring %s, which is not a config key: %v", layer.source, err)
+				continue
+			}
+			return fmt.Errorf("error in %s: %v", layer.source, err)
+		}
+		var value interface{} = layer.value
+		if derefType(t).Kind() != reflect.String {
+			if err := yaml.Unmarshal([]byte(layer.value), &value); err != nil {
+				return fmt.Errorf("error parsing %s value %q: %v", layer.source, layer.value, err)
+			}
+			if value, err = normalizeConfigValue(value, t, key); err != nil {
+				return fmt.Errorf("error in %s: %v", layer.source, err)
+			}
+		}
+		mergeConfigValue(merged, sources, key, value, layer.source)
+	}
+
+	c.merged = merged
+	c.sources = sources
+	return nil
+}
+
+// Decode merges the layers, and decodes the result into dest, overriding the defaults already set in dest
+func (c *LayeredConfig) Decode(dest interface{}) error {
+	if err := c.Merge(); err != nil {
+		return err
+	}
+	data, err := json.Marshal(c.merged)
+	if err != nil {
+		return fmt.Errorf("error serializing config: %v", err)
+	}
+	if err := json.Unmarshal(data, dest); err != nil {
+		return fmt.Errorf("error parsing config: %v", err)
+	}
+	return nil
+}
+
+// Lookup returns the merged value of the key (with nested keys separated by .), if a layer sets it
+func (c *LayeredConfig) Lookup(key string) (interface{}, bool, error) {
+	if err := c.Merge(); err != nil {
+		return nil, false, err
+	}
+	var v interface{} = c.merged
+	for _, k := range strings.Split(key, ".") {
+		m, ok := v.(map[string]interface{})
+		if !ok {
+			return nil, false, nil
+		}
+		if v, ok = m[k]; !ok {
+			return nil, false, nil
+		}
+	}
+	return v, true, nil
+}
+
+// Source returns the layer that set the key (with nested keys separated by .), or ConfigSourceDefault
+func (c *LayeredConfig) Source(key string) string {
+	if c.Merge() != nil {
+		return ConfigSourceDefault
+	}
+	for k := key; ; {
+		if source, found := c.sources[k]; found {
+			return source
+		}
+		i := strings.LastIndex(k, ".")
+		if i == -1 {
+			return ConfigSourceDefault
+		}
+		k = k[:i]
+	}
+}
+
+// Dir returns the directory that a local path in the key is relative to: the directory of the config file that set
+// it, the working directory for the environment and --set, and the directory of the last config file for defaults
+func (c *LayeredConfig) Dir(key string) string {
+	source := c.Source(key)
+	var lastFile string
+	for _, layer := range c.layers {
+		if layer.file {
+			if layer.source == source {
+				return filepath.Dir(source)
+			}
+			lastFile = layer.source
+		}
+	}
+	if source == ConfigSourceDefault && lastFile != "" {
+		return filepath.Dir(lastFile)
+	}
+	return "."
+}
+
+// Describe lists the values in the effective config (e.g. an *AWSConfig, decoded with Decode), with their sources
+func (c *LayeredConfig) Describe(effective interface{}) ([]*ConfigValue, error) {
+	data, err := json.Marshal(effective)
+	if err != nil {
+		return nil, fmt.Errorf("error serializing config: %v", err)
+	}
+	var v interface{}
+	if err := json.Unmarshal(data, &v); err != nil {
+		return nil, fmt.Errorf("error parsing config: %v", err)
+	}
+
+	var values []*ConfigValue
+	var describe func(key string, v interface{})
+	describe = func(key string, v interface{}) {
+		if m, ok := v.(map[string]interface{}); ok && len(m) != 0 {
+			var keys []string
+			for k := range m {
+				keys = append(keys, k)
+			}
+			sort.Strings(keys)
+			for _, k := range keys {
+				if key != "" {
+					describe(key+"."+k, m[k])
+				} else {
+					describe(k, m[k])
+				}
+			}
+			return
+		}
+		values = append(values, &ConfigValue{Key: key, Value: v, Source: c.Source(key)})
+	}
+	describe("", v)
+	return values, nil
+}
+
+// mergeConfigValue sets the key in merged to v, merging objects key by key, and records the source of the values
+func mergeConfigValue(merged map[string]interface{}, sources map[string]string, key []string, v interface{}, source string) {
+	m := merged
+	for _, k := range key[:len(key)-1] {
+		child, ok := m[k].(map[string]interface{})
+		if !ok {
+			child = make(map[string]interface{})
+			m[k] = child
+		}
+		m = child
+	}
+
+	k := key[len(key)-1]
+	if values, ok := v.(map[string]interface{}); ok {
+		if _, ok := m[k].(map[string]interface{}); ok {
+			for ck, cv := range values {
+				mergeConfigValue(merged, sources, append(append([]string{}, key...), ck), cv, source)
+			}
+			return
+		}
+	}
+
+	m[k] = v
+	p := strings.Join(key, ".")
+	for s := range sources {
+		if strings.HasPrefix(s, p+".") {
+			delete(sources, s)
+		}
+	}
+	sources[p] = source
+}
+
+// configField is a field of a config type
+type configField struct {
+	Name string
+	Type reflect.Type
+}
+
+// findConfigField finds the field of the struct type t (including embedded structs) for the key, ignoring case
+// (and single underscores, if env is set)
+func findConfigField(t reflect.Type, key string, env bool) (*configField, bool) {
+	if env {
+		key = strings.Replace(key, "_", "", -1)
+	}
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		if f.Anonymous && f.Type.Kind() == reflect.Struct {
+			if field, ok := findConfigField(f.Type, key, env); ok {
+				return field, true
+			}
+			continue
+		}
+		if f.PkgPath != "" {
+			continue
+		}
+		name := f.Name
+		if tag := strings.Split(f.Tag.Get("json"), ",")[0]; tag == "-" {
+			continue
+		} else if tag != "" {
+			name = tag
+		}
+		if strings.EqualFold(name, key) {
+			return &configField{Name: name, Type: f.Type}, true
+		}
+	}
+	return nil, false
+}
+
+func derefType(t reflect.Type) reflect.Type {
+	for t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+	return t
+}
+
+var jsonUnmarshalerType = reflect.TypeOf((*json.Unmarshaler)(nil)).Elem()
+
+// resolveConfigKey splits key by sep into the canonical key, and returns the type of its value.
+// The rest of the key after a map of non-objects is the map key, so map keys can contain sep (e.g. Tags.k8s.io/role).
+func resolveConfigKey(types []reflect.Type, key string, sep string, env bool) ([]string, reflect.Type, error) {
+	var firstErr error
+	for _, t := range types {
+		resolved, rt, err := resolveConfigKeyInType(t, key, sep, env)
+		if err == nil {
+			return resolved, rt, nil
+		}
+		if firstErr == nil {
+			firstErr = err
+		}
+	}
+	return nil, nil, firstErr
+}
+
+func resolveConfigKeyInType(t reflect.Type, key string, sep string, env bool) ([]string, reflect.Type, error) {
+	var resolved []string
+	rest := key
+	for rest != "" {
+		var name string
+		t = derefType(t)
+		switch t.Kind() {
+		case reflect.Struct:
+			if i := strings.Index(rest, sep); i != -1 {
+				name, rest = rest[:i], rest[i+len(sep):]
+			} else {
+				name, rest = rest, ""
+			}
+			field, ok := findConfigField(t, name, env)
+			if !ok {
+				return nil, nil, fmt.Errorf("unknown config key %q", strings.Join(append(resolved, name), "."))
+			}
+			resolved = append(resolved, field.Name)
+			t = field.Type
+
+		case reflect.Map:
+			if i := strings.Index(rest, sep); i != -1 && derefType(t.Elem()).Kind() == reflect.Struct {
+				name, rest = rest[:i], rest[i+len(sep):]
+			} else {
+				name, rest = rest, ""
+			}
+			resolved = append(resolved, name)
+			t = t.Elem()
+
+		default:
+			return nil, nil, fmt.Errorf("config key %q does not have keys (setting %q)", strings.Join(resolved, "."), key)
+		}
+	}
+	if len(resolved) == 0 {
+		return nil, nil, fmt.Errorf("config key must not be empty")
+	}
+	return resolved, t, nil
+}
+
+// normalizeConfigTypes normalizes v for the first of the types that has all its keys
+func normalizeConfigTypes(v interface{}, types []reflect.Type) (interface{}, error) {
+	var firstErr error
+	for _, t := range types {
+		normalized, err := normalizeConfigValue(v, t, nil)
+		if err == nil {
+			return normalized, nil
+		}
+		if firstErr == nil {
+			firstErr = err
+		}
+	}
+	return nil, firstErr
+}
+
+// normalizeConfigValue replaces the keys of objects in v with the names of the fields of t they set (which json
+// matches ignoring case), so that layers merge whatever case they use, and returns an error for unknown keys.
+// Mismatched types are left for Decode to report.
+func normalizeConfigValue(v interface{}, t reflect.Type, key []string) (interface{}, error) {
+	t = derefType(t)
+	if reflect.PtrTo(t).Implements(jsonUnmarshalerType) {
+		return v, nil
+	}
+
+	child := func(k string) []string {
+		return append(append([]string{}, key...), k)
+	}
+
+	switch t.Kind() {
+	case reflect.Struct:
+		m, ok := v.(map[string]interface{})
+		if !ok {
+			return v, nil
+		}
+		normalized := make(map[string]interface{})
+		for k, fv := range m {
+			field, ok := findConfigField(t, k, false)
+			if !ok {
+				return nil, fmt.Errorf("unknown config key %q", strings.Join(child(k), "."))
+			}
+			n, err := normalizeConfigValue(fv, field.Type, child(field.Name))
+			if err != nil {
+				return nil, err
+			}
+			normalized[field.Name] = n
+		}
+		return normalized, nil
+
+	case reflect.Map:
+		m, ok := v.(map[string]interface{})
+		if !ok {
+			return v, nil
+		}
+		normalized := make(map[string]interface{})
+		for k, ev := range m {
+			n, err := normalizeConfigValue(ev, t.Elem(), child(k))
+			if err != nil {
+				return nil, err
+			}
+			normalized[k] = n
+		}
+		return normalized, nil
+
+	case reflect.Slice:
+		l, ok := v.([]interface{})
+		if !ok {
+			return v, nil
+		}
+		normalized := make([]interface{}, len(l))
+		for i, ev := range l {
+			n, err := normalizeConfigValue(ev, t.Elem(), child(strconv.Itoa(i)))
+			if err != nil {
+				return nil, err
+			}
+			normalized[i] = n
+		}
+		return normalized, nil
+	}
+	return v, nil
+}
@@ -0,0 +1,180 @@
+/*
+Copyright 2016 The Kubernetes Authors All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package imagebuilder
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// writeConfigFile writes a config file in dir, returning its path
+func writeConfigFile(t *testing.T, dir string, name string, contents string) string {
+	p := filepath.Join(dir, name)
+	if err := ioutil.WriteFile(p, []byte(contents), 0644); err != nil {
+		t.Fatalf("error writing %q: %v", p, err)
+	}
+	return p
+}
+
+func TestLayeredConfigPrecedence(t *testing.T) {
+	dir, err := ioutil.TempDir("", "layered")
+	if err != nil {
+		t.Fatalf("error creating temp dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	org := writeConfigFile(t, dir, "org.yaml", "Cloud: aws\nInstanceType: m4.large\nSSHKeyName: org\nSubnetID: subnet-org\nVolume:\n  Size: 10\n  Type: io1\n")
+	team := writeConfigFile(t, dir, "team.yaml", "SSHKeyName: team\nSubnetID: subnet-team\nVolume:\n  Size: 12\n")
+
+	l := NewLayeredConfig()
+	l.AddDefault("MachineName", "default-name", "default")
+	l.AddDefault("InstanceType", "t2.micro", "default")
+	if err := l.AddFile(org); err != nil {
+		t.Fatalf("error adding file: %v", err)
+	}
+	if err := l.AddFile(team); err != nil {
+		t.Fatalf("error adding file: %v", err)
+	}
+	l.AddEnv([]string{"IMAGEBUILDER_SUBNET_ID=subnet-env", "IMAGEBUILDER_SSH_KEY_NAME=env", "HOME=/root"})
+	l.Set("SSHKeyName", "set", "--set")
+
+	config := &AWSConfig{}
+	config.InitDefaults("us-east-1")
+	if err := l.Decode(config); err != nil {
+		t.Fatalf("error decoding config: %v", err)
+	}
+
+	grid := []struct {
+		Key    string
+		Value  interface{}
+		Actual interface{}
+		Source string
+	}{
+		{Key: "MachineName", Value: "default-name", Actual: config.MachineName, Source: "default"},
+		{Key: "InstanceType", Value: "m4.large", Actual: config.InstanceType, Source: org},
+		{Key: "Volume.Type", Value: "io1", Actual: config.Volume.Type, Source: org},
+		{Key: "Volume.Size", Value: int64(12), Actual: config.Volume.Size, Source: team},
+		{Key: "SubnetID", Value: "subnet-env", Actual: config.SubnetID, Source: "$IMAGEBUILDER_SUBNET_ID"},
+		{Key: "SSHKeyName", Value: "set", Actual: config.SSHKeyName, Source: "--set"},
+		// Not set by any layer
+		{Key: "Region", Value: "us-east-1", Actual: config.Region, Source: ConfigSourceDefault},
+	}
+	for _, g := range grid {
+		if g.Actual != g.Value {
+			t.Errorf("%s: expected %v, was %v", g.Key, g.Value, g.Actual)
+		}
+		if source := l.Source(g.Key); source != g.Source {
+			t.Errorf("%s: expected source %q, was %q", g.Key, g.Source, source)
+		}
+	}
+}
+
+func TestLayeredConfigKeyNormalization(t *testing.T) {
+	dir, err := ioutil.TempDir("", "layered")
+	if err != nil {
+		t.Fatalf("error creating temp dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	p := writeConfigFile(t, dir, "config.yaml", "cloud: aws\nsshkeyname: file\nvolume:\n  SIZE: 10\n")
+
+	l := NewLayeredConfig()
+	if err := l.AddFile(p); err != nil {
+		t.Fatalf("error adding file: %v", err)
+	}
+	l.AddEnv([]string{
+		"IMAGEBUILDER_VOLUME__KMS_KEY_ID=key",
+		"IMAGEBUILDER_Instance_Type=m4.large",
+		"IMAGEBUILDER_TAGS__cost_center=infra",
+	})
+	l.Set("volume.iops", "100", "--set")
+	l.Set("SecurityGroupId", "sg-1", "--set")
+
+	config := &AWSConfig{}
+	if err := l.Decode(config); err != nil {
+		t.Fatalf("error decoding config: %v", err)
+	}
+
+	if config.Cloud != "aws" || config.SSHKeyName != "file" || config.Volume.Size != 10 {
+		t.Errorf("keys in the file were not matched ignoring case: %+v", config)
+	}
+	if config.Volume.KMSKeyID != "key" || config.InstanceType != "m4.large" {
+		t.Errorf("environment keys were not matched ignoring case and single underscores: %q %q", config.Volume.KMSKeyID, config.InstanceType)
+	}
+	// Map keys are kept as written
+	if config.Tags["cost_center"] != "infra" {
+		t.Errorf("expected Tags.cost_center to be set, tags were %v", config.Tags)
+	}
+	if config.Volume.IOPS != 100 || config.SecurityGroupID != "sg-1" {
+		t.Errorf("--set keys were not matched ignoring case: %d %q", config.Volume.IOPS, config.SecurityGroupID)
+	}
+}
+
+func TestLayeredConfigUnknownKeys(t *testing.T) {
+	dir, err := ioutil.TempDir("", "layered")
+	if err != nil {
+		t.Fatalf("error creating temp dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	p := writeConfigFile(t, dir, "config.yaml", "Cloud: aws\nSSHKeyName: file\n")
+
+	// Environment variables that are not config keys are ignored
+	l := NewLayeredConfig()
+	if err := l.AddFile(p); err != nil {
+		t.Fatalf("error adding file: %v", err)
+	}
+	l.AddEnv([]string{"IMAGEBUILDER_VERSION=1.2.3", "IMAGEBUILDER_SSH_KEY_NAME=env"})
+	config := &AWSConfig{}
+	if err := l.Decode(config); err != nil {
+		t.Fatalf("unexpected error for an unknown environment variable: %v", err)
+	}
+	if config.SSHKeyName != "env" {
+		t.Errorf("expected SSHKeyName from the environment, was %q", config.SSHKeyName)
+	}
+
+	// ... but unknown keys in --set and in files are errors
+	l = NewLayeredConfig()
+	if err := l.AddFile(p); err != nil {
+		t.Fatalf("error adding file: %v", err)
+	}
+	l.Set("Version", "1.2.3", "--set")
+	if err := l.Merge(); err == nil {
+		t.Errorf("expected error for an unknown --set key")
+	}
+
+	bad := writeConfigFile(t, dir, "bad.yaml", "Cloud: aws\nSSHKeyNmae: typo\n")
+	l = NewLayeredConfig()
+	if err := l.AddFile(bad); err != nil {
+		t.Fatalf("error adding file: %v", err)
+	}
+	if err := l.Merge(); err == nil {
+		t.Errorf("expected error for an unknown key in a file")
+	}
+
+	// Keys for another cloud are unknown
+	l = NewLayeredConfig()
+	if err := l.AddFile(p); err != nil {
+		t.Fatalf("error adding file: %v", err)
+	}
+	l.Set("Project", "my-project", "--set")
+	if err := l.Merge(); err == nil {
+		t.Errorf("expected error for a gce key with Cloud: aws")
+	}
+}
@@ -0,0 +1,351 @@
+/*
+Copyright 2016 The Kubernetes Authors All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package imagebuilder
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Severities of LintMessages
+const (
+	LintError   = "error"
+	LintWarning = "warning"
+)
+
+// LintMessage is a problem found in a template
+type LintMessage struct {
+	File     string
+	Line     int
+	Severity string
+	Message  string
+}
+
+func (m *LintMessage) String() string {
+	return fmt.Sprintf("%s:%d: %s: %s", m.File, m.Line, m.Severity, m.Message)
+}
+
+// yamlErrorLine matches the line number in errors from the yaml parser
+var yamlErrorLine = regexp.MustCompile(`line (\d+)`)
+
+// placeholderRegex matches {...} references, as used in name and commands
+var placeholderRegex = regexp.MustCompile("{([^}]*)}")
+
+// LintTemplate checks a template against the bootstrap-vz manifest schema, and for common mistakes.
+// The image name is checked against the naming rules of cloud.
+// Messages are reported against the unexpanded source file (and line) that set the value.
+func LintTemplate(template *ComposedTemplate, cloud string) ([]*LintMessage, error) {
+	l := &linter{}
+	for _, source := range template.Sources {
+		expanded := strings.Split(source.Expanded, "\n")
+		l.sources = append(l.sources, &lintSource{
+			path:    source.Path,
+			lines:   expanded,
+			lineMap: mapExpandedLines(strings.Split(source.Source, "\n"), expanded),
+		})
+	}
+
+	t, err := NewBootstrapVzTemplate(template.Manifest)
+	if err != nil {
+		// We parse each source when loading, so this should only happen with a bad merge
+		return nil, err
+	}
+
+	schemaErrors, err := ValidateManifestSchema(t.data)
+	if err != nil {
+		return nil, err
+	}
+	for _, e := range schemaErrors {
+		l.addAt(e.Path, LintError, "%s", e.Error())
+	}
+
+	l.lintName(t, cloud)
+	l.lintCommands(t)
+
+	return l.messages, nil
+}
+
+type linter struct {
+	sources  []*lintSource
+	messages []*LintMessage
+}
+
+// lintSource is a file that contributed to the template
+type lintSource struct {
+	path    string
+	lines   []string
+	lineMap []int
+}
+
+// addAt adds a message for the manifest value at path p.
+// The position is in the last source that sets the most specific part of the path.
+func (l *linter) addAt(p []string, severity string, format string, args ...interface{}) {
+	var best *lintSource
+	bestLine, bestDepth := 0, -1
+	for _, source := range l.sources {
+		line, depth := findLine(source.lines, p)
+		if depth >= bestDepth {
+			best, bestLine, bestDepth = source, line, depth
+		}
+	}
+
+	l.add(best, bestLine, severity, format, args...)
+}
+
+// addAtCommand adds a message for a command in the manifest at path p.
+// Indexes in a merged list don't match the lists in the sources, so we look for the line containing the command.
+func (l *linter) addAtCommand(p []string, command []string, severity string, format string, args ...interface{}) {
+	for i := len(l.sources) - 1; i >= 0; i-- {
+		source := l.sources[i]
+		for line, s := range source.lines {
+			if containsAll(s, command) {
+				l.add(source, line, severity, format, args...)
+				return
+			}
+		}
+	}
+	l.addAt(p, severity, format, args...)
+}
+
+func containsAll(s string, substrings []string) bool {
+	for _, substring := range substrings {
+		if !strings.Contains(s, substring) {
+			return false
+		}
+	}
+	return true
+}
+
+func (l *linter) add(source *lintSource, line int, severity string, format string, args ...interface{}) {
+	m := &LintMessage{
+		Severity: severity,
+		Message:  fmt.Sprintf(format, args...),
+		Line:     1,
+	}
+	if source != nil {
+		m.File = source.path
+		if line < len(source.lineMap) {
+			m.Line = source.lineMap[line] + 1
+		}
+	}
+	l.messages = append(l.messages, m)
+}
+
+// lintName checks that the {...} references in name can be resolved,
+// and that the resulting name is valid on the cloud
+func (l *linter) lintName(t *BootstrapVzTemplate, cloud string) {
+	name, err := t.getString("name")
+	if err != nil || name == "" {
+		// Reported by schema validation
+		return
+	}
+
+	// An example build, for checking the expanded name
+	info := &BuildInfo{
+		Time:        time.Now().UTC(),
+		ID:          "0123abcd",
+		Seq:         1,
+		TemplateSHA: "0123456789ab",
+		GitSHA:      "0123456789ab",
+	}
+
+	valid := true
+	for _, match := range placeholderRegex.FindAllStringSubmatch(name, -1) {
+		ref := match[1]
+		if ref == "" {
+			l.addAt([]string{"name"}, LintError, "name contains an empty {} reference")
+			valid = false
+			continue
+		}
+		if ref[0] == '%' {
+			if _, err := strftime(ref, info.Time); err != nil {
+				l.addAt([]string{"name"}, LintError, "name contains an invalid date: %v", err)
+				valid = false
+			}
+			continue
+		}
+		if _, isToken, _ := info.token(ref); isToken {
+			continue
+		}
+		v, err := t.getString(ref)
+		if err != nil {
+			l.addAt([]string{"name"}, LintError, "name references {%s}: %v", ref, err)
+			valid = false
+		} else if v == "" {
+			l.addAt([]string{"name"}, LintError, "name references {%s}, which is not set in the manifest", ref)
+			valid = false
+		}
+	}
+	if !valid {
+		return
+	}
+
+	expanded, err := t.BuildImageName(info)
+	if err != nil {
+		l.addAt([]string{"name"}, LintError, "error expanding name: %v", err)
+		return
+	}
+	if err := ValidateImageName(cloud, expanded); err != nil {
+		l.addAt([]string{"name"}, LintError, "%v", err)
+	}
+}
+
+// lintCommands checks the commands plugin for misuse of {root}.
+// bootstrap-vz replaces {root} with the path of the image on the build host, so it
+// is wrong inside a chroot, and absolute paths outside a chroot refer to the build host.
+func (l *linter) lintCommands(t *BootstrapVzTemplate) {
+	commands, err := t.Commands()
+	if err != nil {
+		// Reported by schema validation
+		return
+	}
+
+	for i, command := range commands {
+		p := []string{"plugins", "commands", "commands", strconv.Itoa(i)}
+		if len(command) == 0 {
+			l.addAt(p, LintError, "command is empty")
+			continue
+		}
+
+		chrooted := command[0] == "chroot"
+		if chrooted && (len(command) < 2 || command[1] != "{root}") {
+			l.addAtCommand(p, command, LintWarning, "chroot should use {root}, not a hard-coded path: %q", command)
+		}
+
+		for j, arg := range command {
+			for _, match := range placeholderRegex.FindAllStringSubmatchIndex(arg, -1) {
+				ref := arg[match[2]:match[3]]
+				if ref != "root" {
+					l.addAtCommand(p, command, LintError, "{%s} in %q is not a valid placeholder (only {root} is replaced; escape literal braces as {{ and }})", ref, arg)
+					continue
+				}
+				end := match[1]
+				if end < len(arg) && arg[end] != '/' && arg[end] != ' ' && arg[end] != ';' && arg[end] != '\'' && arg[end] != '"' {
+					l.addAtCommand(p, command, LintWarning, "{root} should be followed by / in %q", arg)
+				}
+				if chrooted && j >= 2 {
+					l.addAtCommand(p, command, LintError, "{root} is used inside the chroot, where it is not a valid path: %q", arg)
+				}
+			}
+
+			if !chrooted && j >= 1 && strings.HasPrefix(arg, "/") {
+				l.addAtCommand(p, command, LintWarning, "%q refers to the build host, not the image (did you mean {root}%s?)", arg, arg)
+			}
+		}
+	}
+}
+
+// findLine finds the (0-based) line in the manifest text for the value at path p.
+// It understands the block-style YAML we use in templates; if the path is not found,
+// it returns the line of the deepest parent that was found, along with the number of path elements found.
+func findLine(lines []string, p []string) (int, int) {
+	found := 0
+	start := 0
+	parentIndent := -1
+
+	for depth, token := range p {
+		index, err := strconv.Atoi(token)
+		isIndex := err == nil
+
+		itemIndent := -1
+		item := 0
+		match := -1
+		for i := start; i < len(lines); i++ {
+			trimmed := strings.TrimLeft(lines[i], " ")
+			if trimmed == "" || strings.HasPrefix(trimmed, "#") {
+				continue
+			}
+			indent := len(lines[i]) - len(trimmed)
+			if indent <= parentIndent {
+				break
+			}
+
+			if isIndex {
+				if !strings.HasPrefix(trimmed, "-") {
+					continue
+				}
+				if itemIndent == -1 {
+					itemIndent = indent
+				}
+				if indent != itemIndent {
+					continue
+				}
+				if item == index {
+					match = i
+					parentIndent = indent
+					break
+				}
+				item++
+			} else {
+				key := strings.TrimLeft(strings.TrimPrefix(trimmed, "-"), " ")
+				if strings.HasPrefix(key, token+":") {
+					match = i
+					parentIndent = indent
+					break
+				}
+			}
+		}
+
+		if match == -1 {
+			return found, depth
+		}
+		found = match
+		start = match + 1
+	}
+
+	return found, len(p)
+}
+
+// findSourceLine finds the first source line from start that could have produced line:
+// either an identical line, or a line with an action whose literal prefix matches
+func findSourceLine(source []string, start int, line string) int {
+	for j := start; j < len(source); j++ {
+		if source[j] == line {
+			return j
+		}
+	}
+	for j := start; j < len(source); j++ {
+		action := strings.Index(source[j], "{{")
+		if action > 0 && strings.TrimSpace(source[j][:action]) != "" && strings.HasPrefix(line, source[j][:action]) {
+			return j
+		}
+	}
+	return -1
+}
+
+// mapExpandedLines maps each line of an expanded template to the line of the source template it came from.
+// Lines are matched in order; lines that were produced by template actions map to the preceding source line.
+func mapExpandedLines(source []string, expanded []string) []int {
+	lineMap := make([]int, len(expanded))
+
+	next := 0
+	last := 0
+	for i, line := range expanded {
+		if strings.TrimSpace(line) != "" {
+			if j := findSourceLine(source, next, line); j != -1 {
+				last = j
+				next = j + 1
+			}
+		}
+		lineMap[i] = last
+	}
+
+	return lineMap
+}
@@ -0,0 +1,134 @@
+/*
+Copyright 2016 The Kubernetes Authors All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package imagebuilder
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+const lintTestBase = `name: k8s-{system.release}-{%Y}{%m}{%d}
+provider:
+  name: ec2
+bootstrapper:
+  workspace: /target
+system:
+  release: jessie
+  architecture: amd64
+  bootloader: grub
+  charmap: UTF-8
+  locale: en_US
+  timezone: UTC
+volume:
+  backing: ebs
+  partitions:
+    type: none
+    root:
+      size: 8GiB
+      filesystem: ext4
+plugins:
+  commands:
+    commands:
+      - [chroot, '{root}', apt-get, update]
+`
+
+// The overlay has template actions before the mistakes, so the expanded lines don't match the source lines
+const lintTestOverlay = `{{ if true }}
+# a comment that is only in the expanded template
+{{ end }}
+system:
+  timzone: UTC
+plugins:
+  commands:
+    commands:
+      $add:
+{{ range $i := .Items }}
+        - [echo, '{{ $i }}']
+{{ end }}
+        - [chroot, '{root}', ls, '{root}/etc']
+`
+
+const lintTestTemplate = `imagebuilder:
+  base: base.yml
+  overlays: [overlay.yml]
+`
+
+func TestLintTemplateReportsSourceLines(t *testing.T) {
+	dir, err := ioutil.TempDir("", "lint")
+	if err != nil {
+		t.Fatalf("error creating temp dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	files := map[string]string{
+		"base.yml":     lintTestBase,
+		"overlay.yml":  lintTestOverlay,
+		"template.yml": lintTestTemplate,
+	}
+	for name, contents := range files {
+		if err := ioutil.WriteFile(filepath.Join(dir, name), []byte(contents), 0644); err != nil {
+			t.Fatalf("error writing %s: %v", name, err)
+		}
+	}
+
+	context := map[string]interface{}{"Items": []string{"a", "b", "c"}}
+	template, err := LoadTemplate(filepath.Join(dir, "template.yml"), context, true)
+	if err != nil {
+		t.Fatalf("error loading template: %v", err)
+	}
+	messages, err := LintTemplate(template, "aws")
+	if err != nil {
+		t.Fatalf("error linting template: %v", err)
+	}
+
+	overlay := filepath.Join(dir, "overlay.yml")
+	grid := []struct {
+		Message string
+		File    string
+		Line    int
+	}{
+		{
+			Message: `unknown key "timzone"`,
+			File:    overlay,
+			Line:    5,
+		},
+		{
+			Message: "{root} is used inside the chroot",
+			File:    overlay,
+			Line:    13,
+		},
+	}
+	for _, g := range grid {
+		var found *LintMessage
+		for _, m := range messages {
+			if strings.Contains(m.Message, g.Message) {
+				found = m
+				break
+			}
+		}
+		if found == nil {
+			t.Errorf("expected a message containing %q, got %v", g.Message, messages)
+			continue
+		}
+		if found.File != g.File || found.Line != g.Line {
+			t.Errorf("expected %q at %s:%d, was %s:%d", found.Message, g.File, g.Line, found.File, found.Line)
+		}
+	}
+}
@@ -0,0 +1,156 @@
+/*
+Copyright 2016 The Kubernetes Authors All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package imagebuilder
+
+import (
+	"fmt"
+
+	"gopkg.in/yaml.v2"
+)
+
+// Manifest is a typed bootstrap-vz manifest.
+// Keys we don't model are kept in the Extra maps, so a manifest round-trips through ParseManifest and Marshal.
+type Manifest struct {
+	Name         string                 `yaml:"name,omitempty"`
+	Provider     *ManifestProvider      `yaml:"provider,omitempty"`
+	Bootstrapper *ManifestBootstrapper  `yaml:"bootstrapper,omitempty"`
+	System       *ManifestSystem        `yaml:"system,omitempty"`
+	Volume       *ManifestVolume        `yaml:"volume,omitempty"`
+	Packages     *ManifestPackages      `yaml:"packages,omitempty"`
+	Plugins      *ManifestPlugins       `yaml:"plugins,omitempty"`
+	Extra        map[string]interface{} `yaml:",inline"`
+}
+
+// ManifestProvider is the provider section, which selects the cloud or image format
+type ManifestProvider struct {
+	Name           string                 `yaml:"name,omitempty"`
+	Description    string                 `yaml:"description,omitempty"`
+	Virtualization string                 `yaml:"virtualization,omitempty"`
+	Extra          map[string]interface{} `yaml:",inline"`
+}
+
+// ManifestBootstrapper is the bootstrapper section, which configures debootstrap
+type ManifestBootstrapper struct {
+	Workspace       string                 `yaml:"workspace,omitempty"`
+	Mirror          string                 `yaml:"mirror,omitempty"`
+	Tarball         *bool                  `yaml:"tarball,omitempty"`
+	Variant         string                 `yaml:"variant,omitempty"`
+	IncludePackages []string               `yaml:"include_packages,omitempty"`
+	ExcludePackages []string               `yaml:"exclude_packages,omitempty"`
+	Extra           map[string]interface{} `yaml:",inline"`
+}
+
+// ManifestSystem is the system section, which configures the OS
+type ManifestSystem struct {
+	Release      string                 `yaml:"release,omitempty"`
+	Architecture string                 `yaml:"architecture,omitempty"`
+	Bootloader   string                 `yaml:"bootloader,omitempty"`
+	Charmap      string                 `yaml:"charmap,omitempty"`
+	Locale       string                 `yaml:"locale,omitempty"`
+	Timezone     string                 `yaml:"timezone,omitempty"`
+	Hostname     string                 `yaml:"hostname,omitempty"`
+	Extra        map[string]interface{} `yaml:",inline"`
+}
+
+// ManifestVolume is the volume section, which configures the disk image
+type ManifestVolume struct {
+	Backing    string                    `yaml:"backing,omitempty"`
+	Partitions *ManifestVolumePartitions `yaml:"partitions,omitempty"`
+	Extra      map[string]interface{}    `yaml:",inline"`
+}
+
+// ManifestVolumePartitions is the partitions section of the volume; the partitions themselves are in Extra
+type ManifestVolumePartitions struct {
+	Type  string                 `yaml:"type,omitempty"`
+	Extra map[string]interface{} `yaml:",inline"`
+}
+
+// ManifestPackages is the packages section, which configures apt and the packages to install
+type ManifestPackages struct {
+	Mirror          string                 `yaml:"mirror,omitempty"`
+	Install         []string               `yaml:"install,omitempty"`
+	InstallStandard *bool                  `yaml:"install_standard,omitempty"`
+	Extra           map[string]interface{} `yaml:",inline"`
+}
+
+// ManifestPlugins is the plugins section; plugins other than commands are kept in Extra
+type ManifestPlugins struct {
+	Commands *ManifestCommandsPlugin `yaml:"commands,omitempty"`
+	Extra    map[string]interface{}  `yaml:",inline"`
+}
+
+// ManifestCommandsPlugin is the commands plugin, which runs commands after the system is installed
+type ManifestCommandsPlugin struct {
+	Commands [][]string             `yaml:"commands,omitempty"`
+	Extra    map[string]interface{} `yaml:",inline"`
+}
+
+// ParseManifest parses a bootstrap-vz manifest
+func ParseManifest(data []byte) (*Manifest, error) {
+	m := &Manifest{}
+	err := yaml.Unmarshal(data, m)
+	if err != nil {
+		return nil, fmt.Errorf("error parsing manifest: %v", err)
+	}
+	return m, nil
+}
+
+// Marshal serializes the manifest as YAML
+func (m *Manifest) Marshal() ([]byte, error) {
+	data, err := yaml.Marshal(m)
+	if err != nil {
+		return nil, fmt.Errorf("error serializing manifest: %v", err)
+	}
+	return append([]byte("---\n"), data...), nil
+}
+
+// AddPackage adds a package to packages.install, if it is not already there
+func (m *Manifest) AddPackage(name string) {
+	if m.Packages == nil {
+		m.Packages = &ManifestPackages{}
+	}
+	for _, p := range m.Packages.Install {
+		if p == name {
+			return
+		}
+	}
+	m.Packages.Install = append(m.Packages.Install, name)
+}
+
+// AppendCommand adds a command to the end of the commands plugin, enabling the plugin if needed
+func (m *Manifest) AppendCommand(command []string) {
+	if m.Plugins == nil {
+		m.Plugins = &ManifestPlugins{}
+	}
+	if m.Plugins.Commands == nil {
+		m.Plugins.Commands = &ManifestCommandsPlugin{}
+	}
+	m.Plugins.Commands.Commands = append(m.Plugins.Commands.Commands, command)
+}
+
+// SetMirror sets the debian mirror used by both debootstrap and apt
+func (m *Manifest) SetMirror(mirror string) {
+	if m.Bootstrapper == nil {
+		m.Bootstrapper = &ManifestBootstrapper{}
+	}
+	m.Bootstrapper.Mirror = mirror
+
+	if m.Packages == nil {
+		m.Packages = &ManifestPackages{}
+	}
+	m.Packages.Mirror = mirror
+}
@@ -0,0 +1,269 @@
+/*
+Copyright 2016 The Kubernetes Authors All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package imagebuilder
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/ghodss/yaml"
+)
+
+// Matrix lists the builds to run together, e.g. every template on every cloud for a release
+type Matrix struct {
+	// Configs are config files (relative to the matrix file) for every build, before the build's own Configs
+	Configs []string
+	// Parallelism is the number of builds that run at once on each cloud (1 by default)
+	Parallelism map[string]int
+	Builds      []MatrixBuild
+}
+
+// MatrixBuild is an entry in a Matrix, which is a build of each of its Templates (in each of its Regions)
+type MatrixBuild struct {
+	// Name prefixes the names of the builds; it defaults to the template file name
+	Name string
+	// Configs are config files (relative to the matrix file), layered after the matrix's Configs
+	Configs []string
+	// Cloud overrides the Cloud in the config files
+	Cloud string
+	// Templates are the TemplatePaths (relative to the matrix file) to build; if empty, the config's TemplatePath is built
+	Templates []string
+	// Regions are the AWS regions to build in; if empty, the config's Region is used
+	Regions []string
+	// Set overrides config keys, like --set
+	Set map[string]string
+}
+
+// MatrixCell is a single build in a Matrix
+type MatrixCell struct {
+	// Name identifies the build in the matrix
+	Name string `json:"name"`
+	// Cloud is the cloud the build is on
+	Cloud string `json:"cloud"`
+	// Configs are the config files, in order (absolute paths)
+	Configs []string `json:"configs"`
+	// Template is the TemplatePath (an absolute path), if it is overridden
+	Template string `json:"template,omitempty"`
+	Region   string `json:"region,omitempty"`
+	// Set are the config overrides, including Cloud, TemplatePath and Region
+	Set map[string]string `json:"set,omitempty"`
+}
+
+// LoadMatrix reads the matrix file p
+func LoadMatrix(p string) (*Matrix, error) {
+	data, err := ioutil.ReadFile(p)
+	if err != nil {
+		return nil, fmt.Errorf("error reading matrix %q: %v", p, err)
+	}
+	m := &Matrix{}
+	if err := yaml.Unmarshal(data, m); err != nil {
+		return nil, fmt.Errorf("error parsing matrix %q: %v", p, err)
+	}
+
+	// Paths are relative to the matrix file, but the builds can run from anywhere
+	dir, err := filepath.Abs(filepath.Dir(p))
+	if err != nil {
+		return nil, fmt.Errorf("error resolving path %q: %v", p, err)
+	}
+	resolve := func(paths []string) {
+		for i, p := range paths {
+			if !filepath.IsAbs(p) {
+				paths[i] = filepath.Join(dir, p)
+			}
+		}
+	}
+	resolve(m.Configs)
+	for i := range m.Builds {
+		resolve(m.Builds[i].Configs)
+		resolve(m.Builds[i].Templates)
+	}
+	return m, nil
+}
+
+// ParallelismFor returns the number of builds that run at once on the cloud
+func (m *Matrix) ParallelismFor(cloud string) int {
+	if n := m.Parallelism[cloud]; n > 0 {
+		return n
+	}
+	return 1
+}
+
+// invalidMachineNameChars are the characters that can't be used in a GCE instance name
+var invalidMachineNameChars = regexp.MustCompile("[^a-z0-9-]+")
+
+// Cells expands the builds into the individual builds, with baseConfigs (e.g. from --config) before the matrix's Configs
+func (m *Matrix) Cells(baseConfigs []string) ([]*MatrixCell, error) {
+	var cells []*MatrixCell
+	names := make(map[string]bool)
+	// machineNames maps cloud/MachineName to the build using it
+	machineNames := make(map[string]string)
+	for i := range m.Builds {
+		b := &m.Builds[i]
+
+		configs := append(append(append([]string{}, baseConfigs...), m.Configs...), b.Configs...)
+		if len(configs) == 0 {
+			return nil, fmt.Errorf("matrix build %d has no Configs", i+1)
+		}
+
+		cloud := b.Cloud
+		if cloud == "" {
+			l := NewLayeredConfig()
+			for _, p := range configs {
+				if err := l.AddFile(p); err != nil {
+					return nil, err
+				}
+			}
+			cloud = l.Cloud()
+		}
+		switch cloud {
+		case "aws", "gce", "container":
+		case "":
+			return nil, fmt.Errorf("matrix build %d does not set Cloud, and neither do its Configs", i+1)
+		default:
+			return nil, fmt.Errorf("matrix build %d has unknown cloud %q", i+1, cloud)
+		}
+		if len(b.Regions) != 0 && cloud != "aws" {
+			return nil, fmt.Errorf("matrix build %d sets Regions, which are only supported on aws", i+1)
+		}
+
+		templates := b.Templates
+		if len(templates) == 0 {
+			templates = []string{""}
+		}
+		regions := b.Regions
+		if len(regions) == 0 {
+			regions = []string{""}
+		}
+
+		for _, template := range templates {
+			for _, region := range regions {
+				cell := &MatrixCell{
+					Cloud:    cloud,
+					Configs:  configs,
+					Template: template,
+					Region:   region,
+					Set:      make(map[string]string),
+				}
+
+				nameParts := []string{b.Name}
+				if b.Name == "" {
+					if template != "" {
+						nameParts = []string{strings.TrimSuffix(filepath.Base(template), filepath.Ext(template))}
+					} else {
+						nameParts = []string{fmt.Sprintf("build%d", i+1)}
+					}
+				}
+				if len(templates) > 1 && b.Name != "" {
+					nameParts = append(nameParts, strings.TrimSuffix(filepath.Base(template), filepath.Ext(template)))
+				}
+				nameParts = append(nameParts, cloud)
+				if region != "" {
+					nameParts = append(nameParts, region)
+				}
+				cell.Name = strings.Join(nameParts, "-")
+				if names[cell.Name] {
+					return nil, fmt.Errorf("matrix has more than one build named %q; set Name to tell them apart", cell.Name)
+				}
+				names[cell.Name] = true
+
+				for k, v := range b.Set {
+					cell.Set[k] = v
+				}
+				if b.Cloud != "" {
+					cell.Set["Cloud"] = cloud
+				}
+				if template != "" {
+					cell.Set["TemplatePath"] = template
+				}
+				if region != "" {
+					cell.Set["Region"] = region
+				}
+				// Each build has its own builder instance, so builds on the same cloud don't share one
+				if cloud != "container" {
+					if !hasKey(cell.Set, "MachineName") {
+						cell.Set["MachineName"] = matrixMachineName(cell.Name)
+					}
+					machineName := cloud + "/" + getKey(cell.Set, "MachineName")
+					if machineNames[machineName] != "" {
+						return nil, fmt.Errorf("matrix builds %q and %q have the same MachineName %q", machineNames[machineName], cell.Name, getKey(cell.Set, "MachineName"))
+					}
+					machineNames[machineName] = cell.Name
+				}
+
+				cells = append(cells, cell)
+			}
+		}
+	}
+	return cells, nil
+}
+
+// maxMachineNameLength is the longest GCE instance name
+const maxMachineNameLength = 63
+
+// matrixMachineName returns the MachineName for a matrix build: a valid GCE instance name, which is unique for the
+// build name.  Long names are shortened, ending with a hash of the whole name, so that names differing only at the
+// end (e.g. in the region) are still different.
+func matrixMachineName(buildName string) string {
+	name := strings.Trim(invalidMachineNameChars.ReplaceAllString(strings.ToLower("k8s-imagebuilder-"+buildName), "-"), "-")
+	if len(name) <= maxMachineNameLength {
+		return name
+	}
+	hash := sha256.Sum256([]byte(buildName))
+	suffix := "-" + hex.EncodeToString(hash[:])[:8]
+	return strings.TrimRight(name[:maxMachineNameLength-len(suffix)], "-") + suffix
+}
+
+// getKey returns the value of key in m, ignoring case (as config keys do)
+func getKey(m map[string]string, key string) string {
+	for k, v := range m {
+		if strings.EqualFold(k, key) {
+			return v
+		}
+	}
+	return ""
+}
+
+// hasKey returns true if m has the key, ignoring case (as config keys do)
+func hasKey(m map[string]string, key string) bool {
+	for k := range m {
+		if strings.EqualFold(k, key) {
+			return true
+		}
+	}
+	return false
+}
+
+// SetArgs returns the --set flags for the cell's overrides, in a stable order
+func (c *MatrixCell) SetArgs() []string {
+	var keys []string
+	for k := range c.Set {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	var args []string
+	for _, k := range keys {
+		args = append(args, "--set", k+"="+c.Set[k])
+	}
+	return args
+}
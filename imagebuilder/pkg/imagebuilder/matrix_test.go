@@ -0,0 +1,199 @@
+/*
+Copyright 2016 The Kubernetes Authors All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package imagebuilder
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestMatrixCells(t *testing.T) {
+	long := "kubernetes-release-candidate-jessie-amd64-hvm-ebs"
+
+	grid := []struct {
+		name   string
+		matrix *Matrix
+		// expect maps each build name to its MachineName ("" if it has none)
+		expect map[string]string
+		order  []string
+		error  string
+	}{
+		{
+			name: "names builds from the template, cloud and region",
+			matrix: &Matrix{
+				Configs: []string{"/c/org.yaml"},
+				Builds: []MatrixBuild{
+					{Cloud: "aws", Templates: []string{"/t/1.3.yml", "/t/1.4.yml"}, Regions: []string{"us-east-1", "eu-west-1"}},
+					{Cloud: "gce", Name: "k8s", Templates: []string{"/t/1.4.yml"}},
+					{Cloud: "container"},
+				},
+			},
+			order: []string{"1.3-aws-us-east-1", "1.3-aws-eu-west-1", "1.4-aws-us-east-1", "1.4-aws-eu-west-1", "k8s-gce", "build3-container"},
+			expect: map[string]string{
+				"1.3-aws-us-east-1": "k8s-imagebuilder-1-3-aws-us-east-1",
+				"1.3-aws-eu-west-1": "k8s-imagebuilder-1-3-aws-eu-west-1",
+				"1.4-aws-us-east-1": "k8s-imagebuilder-1-4-aws-us-east-1",
+				"1.4-aws-eu-west-1": "k8s-imagebuilder-1-4-aws-eu-west-1",
+				"k8s-gce":           "k8s-imagebuilder-k8s-gce",
+				"build3-container":  "",
+			},
+		},
+		{
+			name: "adds the template to a named build with several templates",
+			matrix: &Matrix{
+				Builds: []MatrixBuild{
+					{Cloud: "gce", Name: "k8s", Configs: []string{"/c/gce.yaml"}, Templates: []string{"/t/1.3.yml", "/t/1.4.yml"}},
+				},
+			},
+			order: []string{"k8s-1.3-gce", "k8s-1.4-gce"},
+			expect: map[string]string{
+				"k8s-1.3-gce": "k8s-imagebuilder-k8s-1-3-gce",
+				"k8s-1.4-gce": "k8s-imagebuilder-k8s-1-4-gce",
+			},
+		},
+		{
+			name: "keeps long machine names unique",
+			matrix: &Matrix{
+				Builds: []MatrixBuild{
+					{Cloud: "aws", Name: long, Configs: []string{"/c/aws.yaml"}, Regions: []string{"ap-southeast-1", "ap-southeast-2"}},
+				},
+			},
+			order: []string{long + "-aws-ap-southeast-1", long + "-aws-ap-southeast-2"},
+			expect: map[string]string{
+				long + "-aws-ap-southeast-1": "k8s-imagebuilder-kubernetes-release-candidate-jessie-a-38442396",
+				long + "-aws-ap-southeast-2": "k8s-imagebuilder-kubernetes-release-candidate-jessie-a-a5c892d1",
+			},
+		},
+		{
+			name: "keeps a MachineName set by the build",
+			matrix: &Matrix{
+				Builds: []MatrixBuild{
+					{Cloud: "gce", Configs: []string{"/c/gce.yaml"}, Set: map[string]string{"machinename": "my-builder"}},
+				},
+			},
+			order:  []string{"build1-gce"},
+			expect: map[string]string{"build1-gce": "my-builder"},
+		},
+		{
+			name: "rejects builds sharing a MachineName",
+			matrix: &Matrix{
+				Builds: []MatrixBuild{
+					{Cloud: "gce", Name: "a", Configs: []string{"/c/gce.yaml"}, Set: map[string]string{"MachineName": "builder"}},
+					{Cloud: "gce", Name: "b", Configs: []string{"/c/gce.yaml"}, Set: map[string]string{"MachineName": "builder"}},
+				},
+			},
+			error: `matrix builds "a-gce" and "b-gce" have the same MachineName "builder"`,
+		},
+		{
+			name: "rejects builds with the same name",
+			matrix: &Matrix{
+				Builds: []MatrixBuild{
+					{Cloud: "gce", Name: "k8s", Configs: []string{"/c/gce.yaml"}},
+					{Cloud: "gce", Name: "k8s", Configs: []string{"/c/other.yaml"}},
+				},
+			},
+			error: `matrix has more than one build named "k8s-gce"`,
+		},
+		{
+			name: "rejects Regions on clouds other than aws",
+			matrix: &Matrix{
+				Builds: []MatrixBuild{
+					{Cloud: "gce", Configs: []string{"/c/gce.yaml"}, Regions: []string{"us-central1"}},
+				},
+			},
+			error: "matrix build 1 sets Regions, which are only supported on aws",
+		},
+		{
+			name: "rejects unknown clouds",
+			matrix: &Matrix{
+				Builds: []MatrixBuild{
+					{Cloud: "azure", Configs: []string{"/c/azure.yaml"}},
+				},
+			},
+			error: `matrix build 1 has unknown cloud "azure"`,
+		},
+		{
+			name: "rejects builds without configs",
+			matrix: &Matrix{
+				Builds: []MatrixBuild{
+					{Cloud: "gce"},
+				},
+			},
+			error: "matrix build 1 has no Configs",
+		},
+	}
+
+	for _, g := range grid {
+		cells, err := g.matrix.Cells(nil)
+		if g.error != "" {
+			if err == nil || !strings.Contains(err.Error(), g.error) {
+				t.Errorf("%s: expected error containing %q, got %v", g.name, g.error, err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: unexpected error: %v", g.name, err)
+			continue
+		}
+
+		var order []string
+		actual := make(map[string]string)
+		for _, cell := range cells {
+			order = append(order, cell.Name)
+			actual[cell.Name] = getKey(cell.Set, "MachineName")
+			if len(actual[cell.Name]) > maxMachineNameLength {
+				t.Errorf("%s: MachineName %q is longer than %d characters", g.name, actual[cell.Name], maxMachineNameLength)
+			}
+		}
+		if !reflect.DeepEqual(order, g.order) {
+			t.Errorf("%s: expected builds %v, got %v", g.name, g.order, order)
+		}
+		if !reflect.DeepEqual(actual, g.expect) {
+			t.Errorf("%s: expected machine names %v, got %v", g.name, g.expect, actual)
+		}
+	}
+}
+
+func TestMatrixCellsSetOverrides(t *testing.T) {
+	m := &Matrix{
+		Builds: []MatrixBuild{
+			{Cloud: "aws", Configs: []string{"/c/aws.yaml"}, Templates: []string{"/t/1.4.yml"}, Regions: []string{"us-east-1"}, Set: map[string]string{"InstanceType": "m4.large"}},
+		},
+	}
+	cells, err := m.Cells([]string{"/base.yaml"})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(cells) != 1 {
+		t.Fatalf("expected 1 build, got %d", len(cells))
+	}
+	cell := cells[0]
+	if !reflect.DeepEqual(cell.Configs, []string{"/base.yaml", "/c/aws.yaml"}) {
+		t.Errorf("unexpected configs %v", cell.Configs)
+	}
+	expect := map[string]string{
+		"Cloud":        "aws",
+		"TemplatePath": "/t/1.4.yml",
+		"Region":       "us-east-1",
+		"InstanceType": "m4.large",
+		"MachineName":  "k8s-imagebuilder-1-4-aws-us-east-1",
+	}
+	if !reflect.DeepEqual(cell.Set, expect) {
+		t.Errorf("expected overrides %v, got %v", expect, cell.Set)
+	}
+}
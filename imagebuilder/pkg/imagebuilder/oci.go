@@ -0,0 +1,315 @@
+/*
+Copyright 2016 The Kubernetes Authors All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package imagebuilder
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/golang/glog"
+)
+
+// Media types from the OCI image spec
+const (
+	ociMediaTypeManifest = "application/vnd.oci.image.manifest.v1+json"
+	ociMediaTypeConfig   = "application/vnd.oci.image.config.v1+json"
+	ociMediaTypeLayer    = "application/vnd.oci.image.layer.v1.tar+gzip"
+
+	// ociAnnotationRefName is the annotation holding the name of the image in the index
+	ociAnnotationRefName = "org.opencontainers.image.ref.name"
+)
+
+type ociDescriptor struct {
+	MediaType   string            `json:"mediaType"`
+	Digest      string            `json:"digest"`
+	Size        int64             `json:"size"`
+	Annotations map[string]string `json:"annotations,omitempty"`
+}
+
+type ociManifest struct {
+	SchemaVersion int             `json:"schemaVersion"`
+	MediaType     string          `json:"mediaType"`
+	Config        ociDescriptor   `json:"config"`
+	Layers        []ociDescriptor `json:"layers"`
+}
+
+type ociIndex struct {
+	SchemaVersion int             `json:"schemaVersion"`
+	Manifests     []ociDescriptor `json:"manifests"`
+}
+
+type ociImageConfig struct {
+	Created      string `json:"created"`
+	Architecture string `json:"architecture"`
+	OS           string `json:"os"`
+	Config       struct {
+		Cmd    []string          `json:"Cmd,omitempty"`
+		Labels map[string]string `json:"Labels,omitempty"`
+	} `json:"config"`
+	RootFS struct {
+		Type    string   `json:"type"`
+		DiffIDs []string `json:"diff_ids"`
+	} `json:"rootfs"`
+}
+
+// OCIImage describes a single-layer OCI image
+type OCIImage struct {
+	// Name is recorded as the ref name in the image index
+	Name string
+	// Architecture is the debian architecture of the image (e.g. amd64)
+	Architecture string
+	// Labels are set on the image config
+	Labels map[string]string
+}
+
+// WriteOCIImage writes an OCI image-layout tarball to output, with the uncompressed layer tar read from layer
+func WriteOCIImage(image *OCIImage, layer io.Reader, output string) error {
+	// We need the digests before we can write the manifest, so we compress the layer to a temp file first
+	layerFile, err := ioutil.TempFile("", "imagebuilder-layer")
+	if err != nil {
+		return fmt.Errorf("error creating temp file: %v", err)
+	}
+	defer os.Remove(layerFile.Name())
+	defer layerFile.Close()
+
+	diffIDHash := sha256.New()
+	digestHash := sha256.New()
+	gzipWriter := gzip.NewWriter(io.MultiWriter(layerFile, digestHash))
+	if _, err := io.Copy(io.MultiWriter(gzipWriter, diffIDHash), layer); err != nil {
+		return fmt.Errorf("error compressing layer: %v", err)
+	}
+	if err := gzipWriter.Close(); err != nil {
+		return fmt.Errorf("error compressing layer: %v", err)
+	}
+	layerSize, err := layerFile.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return fmt.Errorf("error compressing layer: %v", err)
+	}
+	if _, err := layerFile.Seek(0, io.SeekStart); err != nil {
+		return fmt.Errorf("error compressing layer: %v", err)
+	}
+
+	layerDescriptor := ociDescriptor{
+		MediaType: ociMediaTypeLayer,
+		Digest:    "sha256:" + hex.EncodeToString(digestHash.Sum(nil)),
+		Size:      layerSize,
+	}
+
+	config := &ociImageConfig{
+		Created:      time.Now().UTC().Format(time.RFC3339),
+		Architecture: ociArchitecture(image.Architecture),
+		OS:           "linux",
+	}
+	config.Config.Cmd = []string{"/bin/bash"}
+	config.Config.Labels = image.Labels
+	config.RootFS.Type = "layers"
+	config.RootFS.DiffIDs = []string{"sha256:" + hex.EncodeToString(diffIDHash.Sum(nil))}
+
+	configJSON, err := json.Marshal(config)
+	if err != nil {
+		return fmt.Errorf("error serializing image config: %v", err)
+	}
+	configDescriptor := ociDescriptor{
+		MediaType: ociMediaTypeConfig,
+		Digest:    sha256Digest(configJSON),
+		Size:      int64(len(configJSON)),
+	}
+
+	manifest := &ociManifest{
+		SchemaVersion: 2,
+		MediaType:     ociMediaTypeManifest,
+		Config:        configDescriptor,
+		Layers:        []ociDescriptor{layerDescriptor},
+	}
+	manifestJSON, err := json.Marshal(manifest)
+	if err != nil {
+		return fmt.Errorf("error serializing image manifest: %v", err)
+	}
+
+	index := &ociIndex{
+		SchemaVersion: 2,
+		Manifests: []ociDescriptor{
+			{
+				MediaType:   ociMediaTypeManifest,
+				Digest:      sha256Digest(manifestJSON),
+				Size:        int64(len(manifestJSON)),
+				Annotations: map[string]string{ociAnnotationRefName: image.Name},
+			},
+		},
+	}
+	indexJSON, err := json.Marshal(index)
+	if err != nil {
+		return fmt.Errorf("error serializing image index: %v", err)
+	}
+
+	// Write to a temp file and rename, so we never leave a partial image that FindImage would find
+	tmpOutput := output + ".tmp"
+	f, err := os.Create(tmpOutput)
+	if err != nil {
+		return fmt.Errorf("error creating %q: %v", tmpOutput, err)
+	}
+	defer os.Remove(tmpOutput)
+	defer f.Close()
+
+	tw := tar.NewWriter(f)
+	writeEntry := func(name string, size int64, r io.Reader) error {
+		header := &tar.Header{
+			Name:     name,
+			Mode:     0644,
+			Size:     size,
+			Typeflag: tar.TypeReg,
+			ModTime:  time.Now(),
+		}
+		if err := tw.WriteHeader(header); err != nil {
+			return fmt.Errorf("error writing %q: %v", name, err)
+		}
+		if _, err := io.Copy(tw, r); err != nil {
+			return fmt.Errorf("error writing %q: %v", name, err)
+		}
+		return nil
+	}
+	writeBytes := func(name string, data []byte) error {
+		return writeEntry(name, int64(len(data)), bytes.NewReader(data))
+	}
+
+	if err := writeBytes("oci-layout", []byte(`{"imageLayoutVersion":"1.0.0"}`)); err != nil {
+		return err
+	}
+	if err := writeEntry(blobPath(layerDescriptor.Digest), layerSize, layerFile); err != nil {
+		return err
+	}
+	if err := writeBytes(blobPath(configDescriptor.Digest), configJSON); err != nil {
+		return err
+	}
+	if err := writeBytes(blobPath(index.Manifests[0].Digest), manifestJSON); err != nil {
+		return err
+	}
+	if err := writeBytes("index.json", indexJSON); err != nil {
+		return err
+	}
+	if err := tw.Close(); err != nil {
+		return fmt.Errorf("error writing %q: %v", tmpOutput, err)
+	}
+	if err := f.Close(); err != nil {
+		return fmt.Errorf("error writing %q: %v", tmpOutput, err)
+	}
+
+	if err := os.Rename(tmpOutput, output); err != nil {
+		return fmt.Errorf("error renaming %q to %q: %v", tmpOutput, output, err)
+	}
+
+	glog.Infof("Wrote OCI image %q to %q", image.Name, output)
+	return nil
+}
+
+// maxOCIMetadataSize is the largest index, manifest or config that we will read from an image tarball
+const maxOCIMetadataSize = 1024 * 1024
+
+// readOCIImageLabels reads the labels from the config of the (first) image in an OCI image-layout tarball
+func readOCIImageLabels(p string) (map[string]string, error) {
+	f, err := os.Open(p)
+	if err != nil {
+		return nil, fmt.Errorf("error opening %q: %v", p, err)
+	}
+	defer f.Close()
+
+	// The index is written last, so we read all the small files; the layer is skipped
+	files := make(map[string][]byte)
+	tr := tar.NewReader(f)
+	for {
+		header, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("error reading %q: %v", p, err)
+		}
+		if header.Size > maxOCIMetadataSize {
+			continue
+		}
+		data, err := ioutil.ReadAll(tr)
+		if err != nil {
+			return nil, fmt.Errorf("error reading %q from %q: %v", header.Name, p, err)
+		}
+		files[header.Name] = data
+	}
+
+	readJSON := func(name string, into interface{}) error {
+		data, found := files[name]
+		if !found {
+			return fmt.Errorf("%q not found in %q", name, p)
+		}
+		if err := json.Unmarshal(data, into); err != nil {
+			return fmt.Errorf("error parsing %q in %q: %v", name, p, err)
+		}
+		return nil
+	}
+
+	index := &ociIndex{}
+	if err := readJSON("index.json", index); err != nil {
+		return nil, err
+	}
+	if len(index.Manifests) == 0 {
+		return nil, fmt.Errorf("no images in %q", p)
+	}
+
+	manifest := &ociManifest{}
+	if err := readJSON(blobPath(index.Manifests[0].Digest), manifest); err != nil {
+		return nil, err
+	}
+
+	config := &ociImageConfig{}
+	if err := readJSON(blobPath(manifest.Config.Digest), config); err != nil {
+		return nil, err
+	}
+
+	return config.Config.Labels, nil
+}
+
+// ociArchitecture maps a debian architecture name to the GOARCH-style name used by OCI
+func ociArchitecture(debianArch string) string {
+	switch debianArch {
+	case "i386":
+		return "386"
+	case "armhf", "armel":
+		return "arm"
+	case "":
+		return "amd64"
+	default:
+		return debianArch
+	}
+}
+
+func sha256Digest(data []byte) string {
+	hash := sha256.Sum256(data)
+	return "sha256:" + hex.EncodeToString(hash[:])
+}
+
+// blobPath returns the path in the image layout for the blob with the given digest
+func blobPath(digest string) string {
+	return "blobs/sha256/" + strings.TrimPrefix(digest, "sha256:")
+}
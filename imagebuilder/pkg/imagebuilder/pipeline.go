@@ -0,0 +1,793 @@
+/*
+Copyright 2016 The Kubernetes Authors All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package imagebuilder
+
+import (
+	"fmt"
+	"path"
+	"time"
+
+	"github.com/golang/glog"
+	"golang.org/x/crypto/ssh"
+	"k8s.io/kube-deploy/imagebuilder/pkg/imagebuilder/executor"
+)
+
+// Phase is a step of the Pipeline
+type Phase string
+
+// The phases of the Pipeline, in the order they run
+const (
+	// PhasePlan loads the template, and computes the image name and content hash
+	PhasePlan Phase = "plan"
+	// PhaseUp finds (or creates) the builder instance
+	PhaseUp Phase = "up"
+	// PhaseBuild finds an existing image with the same contents, or builds the image
+	PhaseBuild Phase = "build"
+	// PhaseTag adds the config Tags to the image
+	PhaseTag Phase = "tag"
+	// PhasePublish makes the image public
+	PhasePublish Phase = "publish"
+	// PhaseReplicate copies the image to all regions
+	PhaseReplicate Phase = "replicate"
+	// PhaseDown shuts down the builder instance
+	PhaseDown Phase = "down"
+)
+
+// PipelineOptions control which phases of the Pipeline run, and how
+type PipelineOptions struct {
+	// Up creates the builder instance, if it is not found
+	Up bool
+	// Build builds the image, if an image with the same content hash is not found
+	Build bool
+	// Tag adds the config Tags to the image
+	Tag bool
+	// Publish makes the image (and its copies) public
+	Publish bool
+	// Replicate copies the image to all regions
+	Replicate bool
+	// Down shuts down the builder instance
+	Down bool
+
+	// Force builds the image even if an image with the same content hash exists; it cannot replace an image with the same name
+	Force bool
+	// StrictTemplates fails on references to undefined keys in the template (as does Config.StrictTemplates)
+	StrictTemplates bool
+	// ArtifactsDir is the local directory that build logs are copied to, if set
+	ArtifactsDir string
+}
+
+// PipelineHooks are called around each phase that runs
+type PipelineHooks struct {
+	// BeforePhase is called before the phase runs; if it returns an error, the pipeline stops with that error
+	BeforePhase func(phase Phase, result *BuildResult) error
+	// AfterPhase is called after the phase runs, with its error (if any)
+	AfterPhase func(phase Phase, result *BuildResult, err error)
+}
+
+// Pipeline builds (or finds) an image, and then tags, publishes and replicates it, as controlled by Options
+type Pipeline struct {
+	Config *Config
+	// TemplateContext is the cloud-specific config (e.g. *AWSConfig), with template vars resolved, for expanding the template
+	TemplateContext interface{}
+	// ConfigDir is the directory that TemplatePath is relative to
+	ConfigDir string
+	// BaseImage is the image of the builder, which is part of the content hash
+	BaseImage string
+
+	Cloud   Cloud
+	Options PipelineOptions
+	Hooks   PipelineHooks
+
+	// Dial connects to the builder instance; the default dials SSH, authenticating as configured
+	Dial func(instance Instance) (executor.Executor, error)
+	// Now returns the current time, for image names, the build tag and phase durations; the default is time.Now
+	Now func() time.Time
+
+	// State records the progress of the build, if set; phases that it records as completed are skipped (except plan)
+	State *BuildState
+	// StateStore saves the State as the build progresses, if set
+	StateStore StateStore
+	// Events receives progress events, if set
+	Events *Events
+
+	backendName string
+	template    *BootstrapVzTemplate
+	bvzSource   *BootstrapVZSource
+	instance    Instance
+	image       Image
+	result      *BuildResult
+}
+
+// Run runs the phases in order, returning the result.
+// The result is returned even if a phase fails, describing what was done.
+func (p *Pipeline) Run() (*BuildResult, error) {
+	if p.Now == nil {
+		p.Now = time.Now
+	}
+	if p.Dial == nil {
+		p.Dial = p.dialSSH
+	}
+	p.result = &BuildResult{Cloud: p.Config.Cloud, BaseImage: p.BaseImage}
+	if emitter, ok := p.Cloud.(EventEmitter); ok {
+		emitter.SetEvents(p.Events)
+	}
+	if p.State != nil {
+		p.restoreState()
+	}
+
+	defer func() {
+		if p.bvzSource != nil {
+			p.bvzSource.Close()
+		}
+	}()
+
+	phases := []struct {
+		phase   Phase
+		enabled bool
+		run     func() error
+	}{
+		{PhasePlan, true, p.plan},
+		{PhaseUp, true, p.up},
+		{PhaseBuild, true, p.build},
+		{PhaseTag, p.Options.Tag, p.tag},
+		{PhasePublish, p.Options.Publish, p.publish},
+		{PhaseReplicate, p.Options.Replicate, p.replicate},
+		{PhaseDown, p.Options.Down, p.down},
+	}
+	for _, phase := range phases {
+		if !phase.enabled {
+			continue
+		}
+		// We always plan, because the later phases need the template
+		if phase.phase != PhasePlan && p.State != nil && p.State.Completed(phase.phase) {
+			glog.Infof("Skipping phase %s, which completed in build %s", phase.phase, p.State.BuildID)
+			continue
+		}
+		if err := p.runPhase(phase.phase, phase.run); err != nil {
+			return p.result, err
+		}
+		if p.State != nil && !p.State.Completed(phase.phase) {
+			p.State.Phases = append(p.State.Phases, phase.phase)
+		}
+		if err := p.saveState(); err != nil {
+			return p.result, err
+		}
+	}
+	return p.result, nil
+}
+
+// restoreState fills in the result from the State, for the phases that will be skipped
+func (p *Pipeline) restoreState() {
+	p.result.Name = p.State.ImageName
+	p.result.ContentHash = p.State.ContentHash
+	p.result.Image = p.State.Image
+	p.result.Built = p.State.Built
+	if len(p.State.Regions) != 0 {
+		p.result.Regions = make(map[string]string)
+		for region, r := range p.State.Regions {
+			p.result.Regions[region] = r.Image
+		}
+	}
+}
+
+// saveState writes the State (updated from the result) to the StateStore, if they are set
+func (p *Pipeline) saveState() error {
+	if p.State == nil {
+		return nil
+	}
+	p.State.BaseImage = p.BaseImage
+	p.State.ImageName = p.result.Name
+	p.State.ContentHash = p.result.ContentHash
+	p.State.Image = p.result.Image
+	p.State.Built = p.result.Built
+	p.State.Updated = p.Now().UTC().Format(time.RFC3339)
+
+	if p.StateStore == nil {
+		return nil
+	}
+	return p.StateStore.Write(p.State)
+}
+
+func (p *Pipeline) runPhase(phase Phase, run func() error) error {
+	if p.Hooks.BeforePhase != nil {
+		if err := p.Hooks.BeforePhase(phase, p.result); err != nil {
+			return err
+		}
+	}
+	glog.V(2).Infof("Starting phase %s", phase)
+	p.Events.Emit(&Event{Type: EventPhaseStarted, Phase: phase})
+	start := p.Now()
+	err := run()
+
+	finished := &Event{Type: EventPhaseFinished, Phase: phase, Duration: p.Now().Sub(start).Seconds()}
+	if err != nil {
+		finished.Error = err.Error()
+	}
+	p.Events.Emit(finished)
+	if p.Hooks.AfterPhase != nil {
+		p.Hooks.AfterPhase(phase, p.result, err)
+	}
+	return err
+}
+
+// plan chooses the backend, and computes the image name and content hash
+func (p *Pipeline) plan() error {
+	config := p.Config
+
+	_, isContainer := p.Cloud.(*ContainerCloud)
+	_, isAWS := p.Cloud.(*AWSCloud)
+
+	p.backendName = config.Backend
+	if isContainer {
+		if p.backendName != "" && p.backendName != BackendContainer {
+			return fmt.Errorf("Backend %q is not supported for containers", p.backendName)
+		}
+		p.backendName = BackendContainer
+	}
+	switch p.backendName {
+	case "", BackendBootstrapVZ:
+		p.backendName = BackendBootstrapVZ
+	case BackendProvision:
+	case BackendEBS:
+		if !isAWS {
+			return fmt.Errorf("The %s backend can only be used with the aws cloud", p.backendName)
+		}
+	case BackendContainer:
+		if !isContainer {
+			return fmt.Errorf("The %s backend can only be used with the container cloud", p.backendName)
+		}
+	default:
+		return fmt.Errorf("Unknown Backend: %q", p.backendName)
+	}
+
+	if p.backendName == BackendProvision {
+		if config.ImageName == "" {
+			if p.Options.Build {
+				return fmt.Errorf("ImageName must be provided for the %s backend", p.backendName)
+			}
+			return nil
+		}
+		return p.planProvision()
+	}
+
+	if config.TemplatePath == "" {
+		if p.Options.Build {
+			return fmt.Errorf("TemplatePath must be provided")
+		}
+		return nil
+	}
+	return p.planTemplate()
+}
+
+// resolveImageName expands the image name, finding the first {build.seq} that has not been built
+func (p *Pipeline) resolveImageName(info *BuildInfo, usesSeq bool, expand func(*BuildInfo) (string, error)) (string, error) {
+	// When resuming, the name (which may include the time or {build.seq}) was already chosen
+	if p.State != nil && p.State.ImageName != "" {
+		return p.State.ImageName, nil
+	}
+
+	for {
+		imageName, err := expand(info)
+		if err != nil {
+			return "", fmt.Errorf("error inferring image name: %v", err)
+		}
+		if !usesSeq {
+			return imageName, nil
+		}
+
+		// Use the first sequence number that has not yet been built
+		existing, err := p.Cloud.FindImage(imageName)
+		if err != nil {
+			return "", fmt.Errorf("error finding image %q: %v", imageName, err)
+		}
+		if existing == nil {
+			return imageName, nil
+		}
+		info.Seq++
+	}
+}
+
+// setPlan records the image name and content hash, checking that the contents have not changed if we are resuming
+func (p *Pipeline) setPlan(imageName string, contentHash string) error {
+	if p.State != nil && p.State.ContentHash != "" && p.State.ContentHash != contentHash {
+		return fmt.Errorf("the image contents have changed since build %s started (content hash %s, was %s)", p.State.BuildID, contentHash, p.State.ContentHash)
+	}
+	p.result.Name = imageName
+	p.result.ContentHash = contentHash
+	return nil
+}
+
+func (p *Pipeline) planProvision() error {
+	config := p.Config
+
+	manifest, err := ProvisionManifest(config)
+	if err != nil {
+		return err
+	}
+
+	noManifest := func(path string) (string, error) {
+		return "", fmt.Errorf("only build tokens and times can be used in ImageName with the %s backend", BackendProvision)
+	}
+	buildInfo, err := NewBuildInfo(manifest, p.ConfigDir)
+	if err != nil {
+		return err
+	}
+	buildInfo.Time = p.Now().UTC()
+	imageName, err := p.resolveImageName(buildInfo, ImageNameUses(config.ImageName, TokenBuildSeq), func(info *BuildInfo) (string, error) {
+		return ExpandImageName(config.ImageName, info, noManifest)
+	})
+	if err != nil {
+		return err
+	}
+
+	err = ValidateImageName(config.Cloud, imageName)
+	if err != nil {
+		return fmt.Errorf("invalid image name: %v", err)
+	}
+
+	identity := NewImageIdentity(manifest, config, "", p.BaseImage)
+	identity.Backend = p.backendName
+	contentHash, err := identity.Hash()
+	if err != nil {
+		return err
+	}
+
+	if err := p.setPlan(imageName, contentHash); err != nil {
+		return err
+	}
+	glog.Infof("Will build image with name %s from %d provision steps (content hash %s)", imageName, len(config.ProvisionSteps), contentHash)
+	return nil
+}
+
+func (p *Pipeline) planTemplate() error {
+	config := p.Config
+
+	templateResolved := config.TemplatePath
+	if !path.IsAbs(templateResolved) {
+		templateResolved = path.Join(p.ConfigDir, templateResolved)
+	}
+
+	strict := p.Options.StrictTemplates || config.StrictTemplates
+	template, err := LoadTemplate(templateResolved, p.TemplateContext, strict)
+	if err != nil {
+		return fmt.Errorf("error loading template: %v", err)
+	}
+
+	bvzTemplate, err := NewBootstrapVzTemplate(template.Manifest)
+	if err != nil {
+		return fmt.Errorf("error parsing template: %v", err)
+	}
+
+	bvzTemplate, err = bvzTemplate.WithExtras(config.ExtraPackages, config.ExtraCommands)
+	if err != nil {
+		return fmt.Errorf("error adding ExtraPackages and ExtraCommands to template: %v", err)
+	}
+	manifest := string(bvzTemplate.Bytes())
+
+	buildInfo, err := NewBuildInfo(manifest, path.Dir(templateResolved))
+	if err != nil {
+		return err
+	}
+	buildInfo.Time = p.Now().UTC()
+	imageName, err := p.resolveImageName(buildInfo, bvzTemplate.NameUses(TokenBuildSeq), bvzTemplate.BuildImageName)
+	if err != nil {
+		return err
+	}
+
+	err = ValidateImageName(config.Cloud, imageName)
+	if err != nil {
+		return fmt.Errorf("invalid image name: %v", err)
+	}
+
+	// bootstrap-vz doesn't understand our build tokens, so give it the resolved name
+	p.template, err = bvzTemplate.WithName(imageName)
+	if err != nil {
+		return fmt.Errorf("error setting image name in template: %v", err)
+	}
+
+	// Container and EBS images are built without bootstrap-vz
+	bvzVersion := ""
+	if p.backendName == BackendBootstrapVZ {
+		p.bvzSource, err = ResolveBootstrapVZSource(config)
+		if err != nil {
+			return err
+		}
+		bvzVersion = p.bvzSource.Version
+		p.result.BootstrapVZ = NewBootstrapVZResult(p.bvzSource)
+	}
+
+	identity := NewImageIdentity(manifest, config, bvzVersion, p.BaseImage)
+	if p.backendName != BackendBootstrapVZ {
+		identity.Backend = p.backendName
+	}
+	if p.backendName == BackendEBS {
+		identity.BackendConfig = p.Cloud.(*AWSCloud).config.Volume
+	}
+	// Only bootstrap-vz builds upload the Files
+	if p.backendName == BackendBootstrapVZ {
+		if err := identity.AddFiles(config.Files); err != nil {
+			return err
+		}
+	}
+	contentHash, err := identity.Hash()
+	if err != nil {
+		return err
+	}
+
+	if err := p.setPlan(imageName, contentHash); err != nil {
+		return err
+	}
+	glog.Infof("Parsed template %q; will build image with name %s (content hash %s)", config.TemplatePath, imageName, contentHash)
+	return nil
+}
+
+// up finds the builder instance, creating it if Options.Up is set
+func (p *Pipeline) up() error {
+	instance, err := p.Cloud.GetInstance()
+	if err != nil {
+		return fmt.Errorf("error getting instance: %v", err)
+	}
+
+	if instance == nil && p.Options.Up {
+		instance, err = p.Cloud.CreateInstance()
+		if err != nil {
+			return fmt.Errorf("error creating instance: %v", err)
+		}
+		p.Events.Emit(&Event{Type: EventInstanceCreated, Instance: instance.ID()})
+	}
+	p.instance = instance
+	if instance != nil && p.State != nil {
+		p.State.InstanceID = instance.ID()
+	}
+	return nil
+}
+
+// build finds an existing image, or builds it if Options.Build is set
+func (p *Pipeline) build() error {
+	imageName := p.result.Name
+	contentHash := p.result.ContentHash
+
+	// We skip the build if an image was already built with the same content hash
+	if contentHash != "" && !p.Options.Force {
+		image, err := p.Cloud.FindImageByHash(contentHash)
+		if err != nil {
+			return fmt.Errorf("error finding image with content hash %s: %v", contentHash, err)
+		}
+		if image != nil {
+			glog.Infof("found existing image %q with content hash %s", image, contentHash)
+			p.setImage(image)
+			return nil
+		}
+	}
+
+	existing, err := p.Cloud.FindImage(imageName)
+	if err != nil {
+		return fmt.Errorf("error finding image %q: %v", imageName, err)
+	}
+	if existing != nil {
+		// We can't build an image with the name of an existing image, even with --force
+		if p.Options.Build && p.Options.Force {
+			return fmt.Errorf("image %q already exists, and --force cannot replace it; include a time or {build.seq} in the name to build it again", imageName)
+		}
+
+		hasHash, err := p.hasContentHash(imageName)
+		if err != nil {
+			return err
+		}
+		if !hasHash {
+			// Images built before we recorded content hashes were reused by name, so we keep doing that
+			glog.Warningf("found existing image %q, which has no content hash; assuming it has the same contents", existing)
+			p.setImage(existing)
+			return nil
+		}
+		if p.Options.Build {
+			return fmt.Errorf("image %q already exists with different contents; include a time or {build.seq} in the name to build it again", imageName)
+		}
+		glog.Infof("found existing image %q", existing)
+		p.setImage(existing)
+		return nil
+	}
+
+	if !p.Options.Build {
+		return nil
+	}
+
+	if p.instance == nil {
+		return fmt.Errorf("Instance was not found (specify --up?)")
+	}
+
+	x, err := p.Dial(p.instance)
+	if err != nil {
+		return err
+	}
+	defer x.Close()
+	p.Events.Emit(&Event{Type: EventSSHConnected, Instance: p.instance.ID()})
+	if p.Events != nil {
+		x = &eventExecutor{Executor: x, events: p.Events}
+	}
+
+	backend, err := p.newBackend()
+	if err != nil {
+		return err
+	}
+
+	builder := NewBuilder(p.Config, executor.NewTarget(x))
+	err = builder.Build(backend, p.Options.ArtifactsDir)
+	if err != nil {
+		return fmt.Errorf("error building image: %v", err)
+	}
+
+	image, err := p.Cloud.FindImage(backend.ImageName())
+	if err != nil {
+		return fmt.Errorf("error finding image %q: %v", backend.ImageName(), err)
+	}
+	if image == nil {
+		return fmt.Errorf("image not found after build: %q", backend.ImageName())
+	}
+	p.setImage(image)
+	p.result.Built = true
+
+	if _, isContainer := p.Cloud.(*ContainerCloud); !isContainer {
+		// Record the content hash, so we don't build the same contents again
+		tags := map[string]string{ContentHashTag: contentHash}
+		if p.bvzSource != nil {
+			bvzTag := p.bvzSource.Commit
+			if bvzTag == "" {
+				bvzTag = p.bvzSource.Version
+			}
+			tags[BootstrapVZTag] = bvzTag
+		}
+		err = image.AddTags(tags)
+		if err != nil {
+			return fmt.Errorf("error tagging image %q with content hash: %v", imageName, err)
+		}
+	}
+	return nil
+}
+
+// hasContentHash returns true if the image is tagged (or labelled) with a content hash
+func (p *Pipeline) hasContentHash(imageName string) (bool, error) {
+	info, err := p.Cloud.DescribeImage(imageName)
+	if err != nil {
+		return false, fmt.Errorf("error describing image %q: %v", imageName, err)
+	}
+	if info == nil {
+		return false, nil
+	}
+	// GCE labels have the tag converted to a valid label key
+	return info.Tags[ContentHashTag] != "" || info.Tags[gceLabel(ContentHashTag)] != "", nil
+}
+
+// newBackend builds the BuildBackend chosen by plan
+func (p *Pipeline) newBackend() (BuildBackend, error) {
+	config := p.Config
+	imageName := p.result.Name
+
+	switch p.backendName {
+	case BackendContainer:
+		// Tags become image labels, because we can't add them afterwards
+		labels := map[string]string{ContentHashTag: p.result.ContentHash}
+		for k, v := range config.Tags {
+			labels[k] = v
+		}
+		return NewContainerBackend(config, p.template, imageName, labels, p.Cloud.(*ContainerCloud).ImagePath(imageName)), nil
+
+	case BackendProvision:
+		return NewProvisionBackend(config, p.instance, imageName)
+
+	case BackendEBS:
+		return NewEBSBackend(p.Cloud.(*AWSCloud), p.instance, p.template, imageName)
+
+	default:
+		extraEnv, err := p.Cloud.GetExtraEnv()
+		if err != nil {
+			return nil, fmt.Errorf("error building environment: %v", err)
+		}
+		return NewBootstrapVZBackend(config, p.template, p.bvzSource, imageName, extraEnv), nil
+	}
+}
+
+// dialSSH connects to the instance with SSH, authenticating as configured (except for localhost)
+func (p *Pipeline) dialSSH(instance Instance) (executor.Executor, error) {
+	sshConfig := &ssh.ClientConfig{
+		User: p.Config.SSHUsername,
+	}
+	if _, isLocalhost := instance.(*LocalhostInstance); !isLocalhost {
+		auth, err := BuildSSHAuth(p.Config)
+		if err != nil {
+			return nil, fmt.Errorf("error building SSH authentication: %v", err)
+		}
+		sshConfig.Auth = auth
+	}
+
+	x, err := instance.DialSSH(sshConfig)
+	if err != nil {
+		return nil, fmt.Errorf("error SSHing to instance: %v", err)
+	}
+	return x, nil
+}
+
+func (p *Pipeline) setImage(image Image) {
+	p.image = image
+	p.result.Image = fmt.Sprintf("%v", image)
+}
+
+// requireImage returns an error if there is no image to act on.
+// If the build phase was skipped because we are resuming, we find the image that the build recorded.
+func (p *Pipeline) requireImage() error {
+	if p.image == nil && p.State != nil && p.State.Completed(PhaseBuild) {
+		image, err := p.findRecordedImage()
+		if err != nil {
+			return err
+		}
+		if image != nil {
+			p.setImage(image)
+		}
+	}
+	if p.image == nil {
+		return fmt.Errorf("image not found: %q", p.result.Name)
+	}
+	return nil
+}
+
+// findRecordedImage finds the image recorded in the State, or returns nil if it is not found.
+// The build phase may have reused an image with the same content hash but a different name,
+// so we look it up by content hash and then by name, and check it is the image recorded (if any).
+func (p *Pipeline) findRecordedImage() (Image, error) {
+	matches := func(image Image) bool {
+		return image != nil && (p.State.Image == "" || fmt.Sprintf("%v", image) == p.State.Image)
+	}
+
+	if p.State.ContentHash != "" {
+		image, err := p.Cloud.FindImageByHash(p.State.ContentHash)
+		if err != nil {
+			return nil, fmt.Errorf("error finding image with content hash %s: %v", p.State.ContentHash, err)
+		}
+		if matches(image) {
+			return image, nil
+		}
+	}
+
+	if p.result.Name != "" {
+		image, err := p.Cloud.FindImage(p.result.Name)
+		if err != nil {
+			return nil, fmt.Errorf("error finding image %q: %v", p.result.Name, err)
+		}
+		if matches(image) {
+			return image, nil
+		}
+	}
+
+	if p.State.Image != "" {
+		return nil, fmt.Errorf("image %s recorded by build %s was not found", p.State.Image, p.State.BuildID)
+	}
+	return nil, nil
+}
+
+// tag adds the config Tags, and a build timestamp, to the image
+func (p *Pipeline) tag() error {
+	if err := p.requireImage(); err != nil {
+		return err
+	}
+
+	glog.Infof("Tagging image %q", p.image)
+
+	tags := make(map[string]string)
+	for k, v := range p.Config.Tags {
+		tags[k] = v
+	}
+	tags["k8s.io/build"] = p.Now().UTC().Format("20060102150405")
+
+	err := p.image.AddTags(tags)
+	if err != nil {
+		return fmt.Errorf("error tagging image %q: %v", p.result.Name, err)
+	}
+
+	glog.Infof("Tagged image %q", p.image)
+	return nil
+}
+
+// publish makes the image public
+func (p *Pipeline) publish() error {
+	if err := p.requireImage(); err != nil {
+		return err
+	}
+
+	glog.Infof("Making image public: %v", p.image)
+
+	err := p.image.EnsurePublic()
+	if err != nil {
+		return fmt.Errorf("error making image public %q: %v", p.result.Name, err)
+	}
+
+	glog.Infof("Made image public: %v", p.image)
+	if p.State != nil {
+		p.State.Public = true
+	}
+	return nil
+}
+
+// replicate copies the image to all regions (making the copies public if Options.Publish is set)
+func (p *Pipeline) replicate() error {
+	if err := p.requireImage(); err != nil {
+		return err
+	}
+
+	glog.Infof("Copying image to all regions: %v", p.image)
+
+	images, err := p.image.ReplicateImage(p.Options.Publish, p.replicated)
+	if err != nil {
+		return fmt.Errorf("error replicating image %q: %v", p.result.Name, err)
+	}
+
+	p.result.Regions = make(map[string]string)
+	for region, imageID := range images {
+		glog.Infof("Image in region %q: %q", region, imageID)
+		p.result.Regions[region] = fmt.Sprintf("%v", imageID)
+	}
+	return nil
+}
+
+// replicated records the progress of replication in the State
+func (p *Pipeline) replicated(region string, image Image, public bool) {
+	state := "copied"
+	if public {
+		state = "public"
+	}
+	p.Events.Emit(&Event{Type: EventRegionCopy, Region: region, Image: fmt.Sprintf("%v", image), State: state})
+
+	if p.State == nil {
+		return
+	}
+	if p.State.Regions == nil {
+		p.State.Regions = make(map[string]*RegionState)
+	}
+	r := p.State.Regions[region]
+	if r == nil {
+		r = &RegionState{}
+		p.State.Regions[region] = r
+	}
+	r.Image = fmt.Sprintf("%v", image)
+	r.Public = r.Public || public
+
+	if err := p.saveState(); err != nil {
+		glog.Warningf("error saving build state: %v", err)
+	}
+}
+
+// down shuts down the builder instance
+func (p *Pipeline) down() error {
+	// If the up phase was skipped because we are resuming, we find the instance now
+	if p.instance == nil && p.State != nil && p.State.Completed(PhaseUp) {
+		instance, err := p.Cloud.GetInstance()
+		if err != nil {
+			return fmt.Errorf("error getting instance: %v", err)
+		}
+		p.instance = instance
+	}
+
+	if p.instance == nil {
+		glog.Infof("Instance not found / already shutdown")
+		return nil
+	}
+
+	err := p.instance.Shutdown()
+	if err != nil {
+		return fmt.Errorf("error terminating instance: %v", err)
+	}
+	return nil
+}
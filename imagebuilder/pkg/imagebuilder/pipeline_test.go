@@ -0,0 +1,581 @@
+/*
+Copyright 2016 The Kubernetes Authors All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package imagebuilder
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+	"k8s.io/kube-deploy/imagebuilder/pkg/imagebuilder/executor"
+)
+
+// fakeCloud is an in-memory Cloud, recording the calls that change it
+type fakeCloud struct {
+	images   map[string]*fakeImage
+	instance *fakeInstance
+	calls    []string
+}
+
+var _ Cloud = &fakeCloud{}
+
+func newFakeCloud() *fakeCloud {
+	return &fakeCloud{images: make(map[string]*fakeImage)}
+}
+
+func (c *fakeCloud) GetInstance() (Instance, error) {
+	if c.instance == nil {
+		return nil, nil
+	}
+	return c.instance, nil
+}
+
+func (c *fakeCloud) CreateInstance() (Instance, error) {
+	c.calls = append(c.calls, "CreateInstance")
+	c.instance = &fakeInstance{cloud: c}
+	return c.instance, nil
+}
+
+func (c *fakeCloud) FindImage(imageName string) (Image, error) {
+	if image := c.images[imageName]; image != nil {
+		return image, nil
+	}
+	return nil, nil
+}
+
+func (c *fakeCloud) FindImageByHash(hash string) (Image, error) {
+	for _, image := range c.images {
+		if image.tags[ContentHashTag] == hash {
+			return image, nil
+		}
+	}
+	return nil, nil
+}
+
+func (c *fakeCloud) GetExtraEnv() (map[string]string, error) {
+	return nil, nil
+}
+
+func (c *fakeCloud) ListImages(filter ImageFilter) ([]*ImageInfo, error) {
+	return nil, fmt.Errorf("not implemented")
+}
+
+func (c *fakeCloud) DescribeImage(imageName string) (*ImageInfo, error) {
+	image := c.images[imageName]
+	if image == nil {
+		return nil, nil
+	}
+	return &ImageInfo{Name: imageName, Tags: image.tags}, nil
+}
+
+func (c *fakeCloud) DeleteImage(imageName string) error {
+	return fmt.Errorf("not implemented")
+}
+
+// fakeInstance is a builder instance that can be saved as an image, for the provision backend
+type fakeInstance struct {
+	cloud    *fakeCloud
+	shutdown bool
+}
+
+var _ ImageCreator = &fakeInstance{}
+
+func (i *fakeInstance) ID() string {
+	return "i-fake"
+}
+
+func (i *fakeInstance) DialSSH(config *ssh.ClientConfig) (executor.Executor, error) {
+	return nil, fmt.Errorf("the tests replace Dial")
+}
+
+func (i *fakeInstance) Shutdown() error {
+	i.cloud.calls = append(i.cloud.calls, "Shutdown")
+	i.shutdown = true
+	return nil
+}
+
+func (i *fakeInstance) CreateImage(name string) error {
+	i.cloud.calls = append(i.cloud.calls, "CreateImage "+name)
+	i.cloud.images[name] = &fakeImage{name: name, tags: make(map[string]string)}
+	return nil
+}
+
+type fakeImage struct {
+	name   string
+	tags   map[string]string
+	public bool
+}
+
+func (i *fakeImage) String() string {
+	return "fake/" + i.name
+}
+
+func (i *fakeImage) EnsurePublic() error {
+	i.public = true
+	return nil
+}
+
+func (i *fakeImage) AddTags(tags map[string]string) error {
+	for k, v := range tags {
+		i.tags[k] = v
+	}
+	return nil
+}
+
+func (i *fakeImage) ReplicateImage(makePublic bool, progress ReplicationProgress) (map[string]Image, error) {
+	images := make(map[string]Image)
+	for _, region := range []string{"region-1", "region-2"} {
+		copy := &fakeImage{name: region + "/" + i.name, tags: i.tags, public: makePublic}
+		images[region] = copy
+		if progress != nil {
+			progress(region, copy, false)
+			if makePublic {
+				progress(region, copy, true)
+			}
+		}
+	}
+	return images, nil
+}
+
+// fakeExecutor records the commands it runs
+type fakeExecutor struct {
+	commands []string
+}
+
+var _ executor.Executor = &fakeExecutor{}
+
+func (x *fakeExecutor) Run(c *executor.CommandExecution) error {
+	x.commands = append(x.commands, strings.Join(c.Command, " "))
+	return nil
+}
+
+func (x *fakeExecutor) Put(dest string, length int, content io.Reader, mode os.FileMode) error {
+	return nil
+}
+
+func (x *fakeExecutor) Mkdir(dest string, mode os.FileMode) error {
+	return nil
+}
+
+func (x *fakeExecutor) Get(src string, dest io.Writer) error {
+	return nil
+}
+
+func (x *fakeExecutor) PutDir(localDir string, dest string) error {
+	return nil
+}
+
+func (x *fakeExecutor) GetDir(src string, localDir string) error {
+	return nil
+}
+
+func (x *fakeExecutor) Stat(p string) (os.FileInfo, error) {
+	return nil, os.ErrNotExist
+}
+
+func (x *fakeExecutor) Remove(p string) error {
+	return nil
+}
+
+func (x *fakeExecutor) Close() error {
+	return nil
+}
+
+var testBuildTime = time.Date(2016, 10, 19, 12, 30, 0, 0, time.UTC)
+
+// newTestPipeline builds a Pipeline that builds with the provision backend on the fake cloud
+func newTestPipeline(cloud *fakeCloud, x *fakeExecutor, options PipelineOptions, phases *[]Phase) *Pipeline {
+	config := &Config{
+		Cloud:     "aws",
+		Backend:   BackendProvision,
+		ImageName: "test-image-{%Y}{%m}{%d}",
+		ProvisionSteps: []ProvisionStep{
+			{Command: []string{"apt-get", "install", "--yes", "nginx"}, Sudo: true},
+		},
+	}
+	return &Pipeline{
+		Config:  config,
+		Cloud:   cloud,
+		Options: options,
+		Hooks: PipelineHooks{
+			BeforePhase: func(phase Phase, result *BuildResult) error {
+				*phases = append(*phases, phase)
+				return nil
+			},
+		},
+		Dial: func(instance Instance) (executor.Executor, error) {
+			return x, nil
+		},
+		Now: func() time.Time {
+			return testBuildTime
+		},
+	}
+}
+
+// testContentHash returns the content hash that the test pipeline computes, by running only its plan
+func testContentHash(t *testing.T) string {
+	var phases []Phase
+	p := newTestPipeline(newFakeCloud(), &fakeExecutor{}, PipelineOptions{}, &phases)
+	result, err := p.Run()
+	if err != nil {
+		t.Fatalf("error planning build: %v", err)
+	}
+	if result.ContentHash == "" {
+		t.Fatalf("plan did not compute a content hash")
+	}
+	return result.ContentHash
+}
+
+func TestPipelineRun(t *testing.T) {
+	allPhases := PipelineOptions{Up: true, Build: true, Tag: true, Publish: true, Replicate: true, Down: true}
+	contentHash := testContentHash(t)
+
+	grid := []struct {
+		name    string
+		options PipelineOptions
+		// setup prepares the cloud, and returns the build state to resume (if any)
+		setup func(cloud *fakeCloud) *BuildState
+
+		expectPhases   []Phase
+		expectCalls    []string
+		expectCommands []string
+		expectBuilt    bool
+		expectImage    string
+		expectRegions  map[string]string
+		expectError    string
+	}{
+		{
+			name:           "builds and runs every phase in order",
+			options:        allPhases,
+			expectPhases:   []Phase{PhasePlan, PhaseUp, PhaseBuild, PhaseTag, PhasePublish, PhaseReplicate, PhaseDown},
+			expectCalls:    []string{"CreateInstance", "CreateImage test-image-20161019", "Shutdown"},
+			expectCommands: []string{"apt-get install --yes nginx"},
+			expectBuilt:    true,
+			expectImage:    "fake/test-image-20161019",
+			expectRegions:  map[string]string{"region-1": "fake/region-1/test-image-20161019", "region-2": "fake/region-2/test-image-20161019"},
+		},
+		{
+			name:         "skips disabled phases",
+			options:      PipelineOptions{Up: true, Build: true},
+			expectPhases: []Phase{PhasePlan, PhaseUp, PhaseBuild},
+			// The instance is left running without --down
+			expectCalls:    []string{"CreateInstance", "CreateImage test-image-20161019"},
+			expectCommands: []string{"apt-get install --yes nginx"},
+			expectBuilt:    true,
+			expectImage:    "fake/test-image-20161019",
+		},
+		{
+			name:    "reuses an image with the same content hash",
+			options: allPhases,
+			setup: func(cloud *fakeCloud) *BuildState {
+				cloud.images["test-image-20161018"] = &fakeImage{name: "test-image-20161018", tags: map[string]string{ContentHashTag: contentHash}}
+				return nil
+			},
+			expectPhases: []Phase{PhasePlan, PhaseUp, PhaseBuild, PhaseTag, PhasePublish, PhaseReplicate, PhaseDown},
+			expectCalls:  []string{"CreateInstance", "Shutdown"},
+			expectBuilt:  false,
+			expectImage:  "fake/test-image-20161018",
+			expectRegions: map[string]string{
+				"region-1": "fake/region-1/test-image-20161018",
+				"region-2": "fake/region-2/test-image-20161018",
+			},
+		},
+		{
+			name:    "rebuilds an image with the same content hash with Force",
+			options: PipelineOptions{Up: true, Build: true, Down: true, Force: true},
+			setup: func(cloud *fakeCloud) *BuildState {
+				cloud.images["test-image-20161018"] = &fakeImage{name: "test-image-20161018", tags: map[string]string{ContentHashTag: contentHash}}
+				return nil
+			},
+			expectPhases:   []Phase{PhasePlan, PhaseUp, PhaseBuild, PhaseDown},
+			expectCalls:    []string{"CreateInstance", "CreateImage test-image-20161019", "Shutdown"},
+			expectCommands: []string{"apt-get install --yes nginx"},
+			expectBuilt:    true,
+			expectImage:    "fake/test-image-20161019",
+		},
+		{
+			name:    "does not build an image with a different content hash over an existing name",
+			options: allPhases,
+			setup: func(cloud *fakeCloud) *BuildState {
+				cloud.images["test-image-20161019"] = &fakeImage{name: "test-image-20161019", tags: map[string]string{ContentHashTag: "other"}}
+				return nil
+			},
+			expectPhases: []Phase{PhasePlan, PhaseUp, PhaseBuild},
+			expectCalls:  []string{"CreateInstance"},
+			expectError:  `image "test-image-20161019" already exists with different contents`,
+		},
+		{
+			name:    "reuses an existing image without a content hash",
+			options: allPhases,
+			setup: func(cloud *fakeCloud) *BuildState {
+				cloud.images["test-image-20161019"] = &fakeImage{name: "test-image-20161019", tags: map[string]string{}}
+				return nil
+			},
+			expectPhases: []Phase{PhasePlan, PhaseUp, PhaseBuild, PhaseTag, PhasePublish, PhaseReplicate, PhaseDown},
+			expectCalls:  []string{"CreateInstance", "Shutdown"},
+			expectBuilt:  false,
+			expectImage:  "fake/test-image-20161019",
+			expectRegions: map[string]string{
+				"region-1": "fake/region-1/test-image-20161019",
+				"region-2": "fake/region-2/test-image-20161019",
+			},
+		},
+		{
+			name:    "Force does not replace an image with the same name",
+			options: PipelineOptions{Up: true, Build: true, Down: true, Force: true},
+			setup: func(cloud *fakeCloud) *BuildState {
+				cloud.images["test-image-20161019"] = &fakeImage{name: "test-image-20161019", tags: map[string]string{ContentHashTag: contentHash}}
+				return nil
+			},
+			expectPhases: []Phase{PhasePlan, PhaseUp, PhaseBuild},
+			expectCalls:  []string{"CreateInstance"},
+			expectError:  `image "test-image-20161019" already exists, and --force cannot replace it`,
+		},
+		{
+			name:    "resuming skips the completed phases",
+			options: allPhases,
+			setup: func(cloud *fakeCloud) *BuildState {
+				cloud.instance = &fakeInstance{cloud: cloud}
+				cloud.images["test-image-20161019"] = &fakeImage{name: "test-image-20161019", tags: map[string]string{ContentHashTag: contentHash}}
+				return &BuildState{
+					BuildID:     "resumed",
+					Phases:      []Phase{PhasePlan, PhaseUp, PhaseBuild, PhaseTag},
+					ImageName:   "test-image-20161019",
+					ContentHash: contentHash,
+					Image:       "fake/test-image-20161019",
+					Built:       true,
+				}
+			},
+			// plan always runs, because the later phases need it
+			expectPhases: []Phase{PhasePlan, PhasePublish, PhaseReplicate, PhaseDown},
+			expectCalls:  []string{"Shutdown"},
+			expectBuilt:  true,
+			expectImage:  "fake/test-image-20161019",
+			expectRegions: map[string]string{
+				"region-1": "fake/region-1/test-image-20161019",
+				"region-2": "fake/region-2/test-image-20161019",
+			},
+		},
+		{
+			name:    "resuming finds a reused image with a different name by its content hash",
+			options: allPhases,
+			setup: func(cloud *fakeCloud) *BuildState {
+				cloud.instance = &fakeInstance{cloud: cloud}
+				cloud.images["test-image-20161018"] = &fakeImage{name: "test-image-20161018", tags: map[string]string{ContentHashTag: contentHash}}
+				return &BuildState{
+					BuildID:     "resumed",
+					Phases:      []Phase{PhasePlan, PhaseUp, PhaseBuild},
+					ImageName:   "test-image-20161019",
+					ContentHash: contentHash,
+					Image:       "fake/test-image-20161018",
+				}
+			},
+			expectPhases: []Phase{PhasePlan, PhaseTag, PhasePublish, PhaseReplicate, PhaseDown},
+			expectCalls:  []string{"Shutdown"},
+			expectBuilt:  false,
+			expectImage:  "fake/test-image-20161018",
+			expectRegions: map[string]string{
+				"region-1": "fake/region-1/test-image-20161018",
+				"region-2": "fake/region-2/test-image-20161018",
+			},
+		},
+		{
+			name:    "resuming fails if the recorded image is gone",
+			options: allPhases,
+			setup: func(cloud *fakeCloud) *BuildState {
+				cloud.instance = &fakeInstance{cloud: cloud}
+				return &BuildState{
+					BuildID:     "resumed",
+					Phases:      []Phase{PhasePlan, PhaseUp, PhaseBuild},
+					ImageName:   "test-image-20161019",
+					ContentHash: contentHash,
+					Image:       "fake/test-image-20161018",
+				}
+			},
+			expectPhases: []Phase{PhasePlan, PhaseTag},
+			expectError:  "image fake/test-image-20161018 recorded by build resumed was not found",
+		},
+		{
+			name:    "resuming fails if the contents have changed",
+			options: allPhases,
+			setup: func(cloud *fakeCloud) *BuildState {
+				return &BuildState{
+					BuildID:     "resumed",
+					Phases:      []Phase{PhasePlan, PhaseUp},
+					ImageName:   "test-image-20161019",
+					ContentHash: "changed",
+				}
+			},
+			expectPhases: []Phase{PhasePlan},
+			expectError:  "the image contents have changed since build resumed started",
+		},
+		{
+			name:         "fails to tag if no image was found or built",
+			options:      PipelineOptions{Tag: true},
+			expectPhases: []Phase{PhasePlan, PhaseUp, PhaseBuild, PhaseTag},
+			expectError:  `image not found: "test-image-20161019"`,
+		},
+	}
+
+	for _, g := range grid {
+		cloud := newFakeCloud()
+		var state *BuildState
+		if g.setup != nil {
+			state = g.setup(cloud)
+		}
+
+		x := &fakeExecutor{}
+		var phases []Phase
+		p := newTestPipeline(cloud, x, g.options, &phases)
+		p.State = state
+
+		result, err := p.Run()
+		if g.expectError != "" {
+			if err == nil || !strings.Contains(err.Error(), g.expectError) {
+				t.Errorf("%s: expected error containing %q, got %v", g.name, g.expectError, err)
+			}
+		} else if err != nil {
+			t.Errorf("%s: unexpected error: %v", g.name, err)
+			continue
+		}
+
+		if !reflect.DeepEqual(phases, g.expectPhases) {
+			t.Errorf("%s: expected phases %v, got %v", g.name, g.expectPhases, phases)
+		}
+		if !reflect.DeepEqual(cloud.calls, g.expectCalls) {
+			t.Errorf("%s: expected cloud calls %q, got %q", g.name, g.expectCalls, cloud.calls)
+		}
+		if !reflect.DeepEqual(x.commands, g.expectCommands) {
+			t.Errorf("%s: expected commands %q, got %q", g.name, g.expectCommands, x.commands)
+		}
+		if g.expectError != "" {
+			continue
+		}
+
+		if result.Built != g.expectBuilt {
+			t.Errorf("%s: expected Built=%v, got %v", g.name, g.expectBuilt, result.Built)
+		}
+		if result.Image != g.expectImage {
+			t.Errorf("%s: expected image %q, got %q", g.name, g.expectImage, result.Image)
+		}
+		if result.ContentHash != contentHash {
+			t.Errorf("%s: expected content hash %q, got %q", g.name, contentHash, result.ContentHash)
+		}
+		if !reflect.DeepEqual(result.Regions, g.expectRegions) {
+			t.Errorf("%s: expected regions %v, got %v", g.name, g.expectRegions, result.Regions)
+		}
+	}
+}
+
+func TestPipelineRunTagsAndPublishes(t *testing.T) {
+	cloud := newFakeCloud()
+	var phases []Phase
+	p := newTestPipeline(cloud, &fakeExecutor{}, PipelineOptions{Up: true, Build: true, Tag: true, Publish: true}, &phases)
+	p.Config.Tags = map[string]string{"k8s.io/version": "1.4"}
+
+	if _, err := p.Run(); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	image := cloud.images["test-image-20161019"]
+	if image == nil {
+		t.Fatalf("image was not built")
+	}
+	if !image.public {
+		t.Errorf("image was not made public")
+	}
+	expectTags := map[string]string{
+		ContentHashTag:   testContentHash(t),
+		"k8s.io/version": "1.4",
+		// The build tag comes from the pipeline's clock
+		"k8s.io/build": "20161019123000",
+	}
+	if !reflect.DeepEqual(image.tags, expectTags) {
+		t.Errorf("expected tags %v, got %v", expectTags, image.tags)
+	}
+}
+
+func TestPipelineRunRecordsState(t *testing.T) {
+	cloud := newFakeCloud()
+	var phases []Phase
+	p := newTestPipeline(cloud, &fakeExecutor{}, PipelineOptions{Up: true, Build: true, Replicate: true, Down: true}, &phases)
+	p.State = &BuildState{BuildID: "test", Phases: []Phase{}}
+
+	if _, err := p.Run(); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	expectPhases := []Phase{PhasePlan, PhaseUp, PhaseBuild, PhaseReplicate, PhaseDown}
+	if !reflect.DeepEqual(p.State.Phases, expectPhases) {
+		t.Errorf("expected completed phases %v, got %v", expectPhases, p.State.Phases)
+	}
+	if p.State.InstanceID != "i-fake" || p.State.ImageName != "test-image-20161019" || !p.State.Built {
+		t.Errorf("unexpected state: %+v", p.State)
+	}
+	if len(p.State.Regions) != 2 || p.State.Regions["region-1"].Image != "fake/region-1/test-image-20161019" {
+		t.Errorf("unexpected regions in state: %+v", p.State.Regions)
+	}
+	if p.State.Updated != "2016-10-19T12:30:00Z" {
+		t.Errorf("expected state to be updated at the pipeline's time, was %q", p.State.Updated)
+	}
+}
+
+// eventRecorder is a Subscriber that keeps the events it receives
+type eventRecorder struct {
+	events []*Event
+}
+
+func (r *eventRecorder) OnEvent(event *Event) {
+	r.events = append(r.events, event)
+}
+
+func TestPipelineRunTimesPhasesWithItsClock(t *testing.T) {
+	var phases []Phase
+	p := newTestPipeline(newFakeCloud(), &fakeExecutor{}, PipelineOptions{Up: true, Build: true, Down: true}, &phases)
+	// Each reading of the clock is a minute after the last
+	now := testBuildTime
+	p.Now = func() time.Time {
+		now = now.Add(time.Minute)
+		return now
+	}
+	recorder := &eventRecorder{}
+	p.Events = &Events{}
+	p.Events.Subscribe(recorder)
+
+	if _, err := p.Run(); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	finished := 0
+	for _, event := range recorder.events {
+		if event.Type != EventPhaseFinished {
+			continue
+		}
+		finished++
+		if event.Duration < 60 || event.Duration != float64(int(event.Duration/60)*60) {
+			t.Errorf("expected phase %s to take whole minutes of the pipeline's clock, was %vs", event.Phase, event.Duration)
+		}
+	}
+	if finished != 4 {
+		t.Errorf("expected 4 phases to finish, got %d", finished)
+	}
+}
@@ -0,0 +1,211 @@
+/*
+Copyright 2016 The Kubernetes Authors All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package imagebuilder
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+
+	"github.com/golang/glog"
+	"k8s.io/kube-deploy/imagebuilder/pkg/imagebuilder/executor"
+)
+
+// ProvisionStep is a step run on the builder instance by the provision backend.
+// Exactly one of Command, Shell or File should be set.
+type ProvisionStep struct {
+	// Command is a command to run
+	Command []string
+	// Shell is a script to run with sh -c
+	Shell string
+	// File is a local file or directory (relative to the config file) to upload to Destination
+	File        string
+	Destination string
+	// Sudo runs Command or Shell as root; files are uploaded as the SSH user
+	Sudo bool
+}
+
+func (s *ProvisionStep) validate() error {
+	n := 0
+	if len(s.Command) != 0 {
+		n++
+	}
+	if s.Shell != "" {
+		n++
+	}
+	if s.File != "" {
+		n++
+		if s.Destination == "" {
+			return fmt.Errorf("ProvisionSteps entry for File %q must set Destination", s.File)
+		}
+	}
+	if n != 1 {
+		return fmt.Errorf("ProvisionSteps entry must set exactly one of Command, Shell or File")
+	}
+	return nil
+}
+
+// ImageCreator is implemented by instances that can be saved as an image, for the provision backend
+type ImageCreator interface {
+	// CreateImage saves the instance's disk as an image with the name, waiting until it is ready
+	CreateImage(name string) error
+}
+
+// ProvisionBackend builds images Packer-style: it runs ProvisionSteps on a running builder instance,
+// and then saves the instance as the image.
+// Because it doesn't build the OS itself, it can build images of any distro the cloud has a base image for.
+type ProvisionBackend struct {
+	config    *Config
+	instance  ImageCreator
+	imageName string
+}
+
+var _ BuildBackend = &ProvisionBackend{}
+
+// NewProvisionBackend builds a backend that runs config.ProvisionSteps on the instance, and then saves it as imageName
+func NewProvisionBackend(config *Config, instance Instance, imageName string) (*ProvisionBackend, error) {
+	creator, ok := instance.(ImageCreator)
+	if !ok {
+		return nil, fmt.Errorf("the %s backend requires an instance that can be saved as an image (not localhost or docker)", BackendProvision)
+	}
+	for i := range config.ProvisionSteps {
+		if err := config.ProvisionSteps[i].validate(); err != nil {
+			return nil, err
+		}
+	}
+	return &ProvisionBackend{
+		config:    config,
+		instance:  creator,
+		imageName: imageName,
+	}, nil
+}
+
+// Name returns the name of the backend
+func (b *ProvisionBackend) Name() string {
+	return BackendProvision
+}
+
+// ImageName returns the name of the image
+func (b *ProvisionBackend) ImageName() string {
+	return b.imageName
+}
+
+// Prepare does nothing: the setup commands are for bootstrap-vz, and would end up in the image
+func (b *ProvisionBackend) Prepare(target *executor.Target) error {
+	return nil
+}
+
+// Build runs the steps, and then saves the instance as the image
+func (b *ProvisionBackend) Build(target *executor.Target) error {
+	for i := range b.config.ProvisionSteps {
+		step := &b.config.ProvisionSteps[i]
+		if err := b.runStep(target, step); err != nil {
+			return fmt.Errorf("error running step %d: %v", i+1, err)
+		}
+	}
+
+	glog.Infof("Creating image %q from instance", b.imageName)
+	return b.instance.CreateImage(b.imageName)
+}
+
+func (b *ProvisionBackend) runStep(target *executor.Target, step *ProvisionStep) error {
+	switch {
+	case step.File != "":
+		stat, err := os.Stat(step.File)
+		if err != nil {
+			return fmt.Errorf("error reading file %q: %v", step.File, err)
+		}
+		glog.Infof("Uploading %q to %q", step.File, step.Destination)
+		if stat.IsDir() {
+			return target.PutDir(step.File, step.Destination)
+		}
+		f, err := os.Open(step.File)
+		if err != nil {
+			return fmt.Errorf("error opening file %q: %v", step.File, err)
+		}
+		defer f.Close()
+		return target.Put(step.Destination, int(stat.Size()), f, stat.Mode().Perm())
+
+	case step.Shell != "":
+		cmd := target.Command("sh", "-c", step.Shell)
+		cmd.Sudo = step.Sudo
+		return cmd.Run()
+
+	default:
+		cmd := target.Command(step.Command...)
+		cmd.Sudo = step.Sudo
+		return cmd.Run()
+	}
+}
+
+// CollectArtifacts does nothing; command output is logged as it runs
+func (b *ProvisionBackend) CollectArtifacts(target *executor.Target, localDir string) error {
+	return nil
+}
+
+// Cleanup does nothing; the instance is the image
+func (b *ProvisionBackend) Cleanup(target *executor.Target) error {
+	return nil
+}
+
+// ProvisionManifest returns a canonical description of the provision build, for the content hash.
+// Uploaded files are included by hash.
+func ProvisionManifest(config *Config) (string, error) {
+	type step struct {
+		ProvisionStep
+		FileSHA256 string `json:",omitempty"`
+	}
+	manifest := struct {
+		ImageName string
+		Steps     []step
+	}{
+		ImageName: config.ImageName,
+	}
+
+	for _, s := range config.ProvisionSteps {
+		st := step{ProvisionStep: s}
+		if s.File != "" {
+			stat, err := os.Stat(s.File)
+			if err != nil {
+				return "", fmt.Errorf("error reading file %q: %v", s.File, err)
+			}
+			if stat.IsDir() {
+				st.FileSHA256, err = hashTree(s.File)
+				if err != nil {
+					return "", err
+				}
+			} else {
+				data, err := ioutil.ReadFile(s.File)
+				if err != nil {
+					return "", fmt.Errorf("error reading file %q: %v", s.File, err)
+				}
+				hash := sha256.Sum256(data)
+				st.FileSHA256 = hex.EncodeToString(hash[:])
+			}
+		}
+		manifest.Steps = append(manifest.Steps, st)
+	}
+
+	data, err := json.Marshal(manifest)
+	if err != nil {
+		return "", fmt.Errorf("error serializing provision steps: %v", err)
+	}
+	return string(data), nil
+}
@@ -0,0 +1,73 @@
+/*
+Copyright 2016 The Kubernetes Authors All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package imagebuilder
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+)
+
+// BootstrapVZTag is the tag (or label) on an image that records the bootstrap-vz commit (or version) that built it
+const BootstrapVZTag = "k8s.io/imagebuilder/bootstrap-vz"
+
+// BuildResult is the result manifest, describing the image that was built (or found)
+type BuildResult struct {
+	Cloud string `json:"cloud"`
+	// Name is the name of the image
+	Name string `json:"name"`
+	// Image identifies the image on the cloud
+	Image string `json:"image"`
+	// Built is true if we built the image, false if we found an existing image
+	Built       bool   `json:"built"`
+	ContentHash string `json:"contentHash,omitempty"`
+	// BaseImage is the image the builder was launched from (e.g. the AMI that an ImageQuery resolved to)
+	BaseImage string `json:"baseImage,omitempty"`
+	// BootstrapVZ is the bootstrap-vz source the image is built with
+	BootstrapVZ *BootstrapVZResult `json:"bootstrapVZ,omitempty"`
+	// Regions are the copies of the image in other regions, if it was replicated
+	Regions map[string]string `json:"regions,omitempty"`
+}
+
+// BootstrapVZResult records the bootstrap-vz source in a BuildResult
+type BootstrapVZResult struct {
+	Source  string `json:"source"`
+	Commit  string `json:"commit,omitempty"`
+	Version string `json:"version"`
+}
+
+// NewBootstrapVZResult builds the BootstrapVZResult for the source
+func NewBootstrapVZResult(s *BootstrapVZSource) *BootstrapVZResult {
+	return &BootstrapVZResult{
+		Source:  s.String(),
+		Commit:  s.Commit,
+		Version: s.Version,
+	}
+}
+
+// WriteFile writes the result as JSON to the file p
+func (r *BuildResult) WriteFile(p string) error {
+	data, err := json.MarshalIndent(r, "", "  ")
+	if err != nil {
+		return fmt.Errorf("error serializing build result: %v", err)
+	}
+	err = ioutil.WriteFile(p, append(data, '\n'), 0644)
+	if err != nil {
+		return fmt.Errorf("error writing build result to %q: %v", p, err)
+	}
+	return nil
+}
@@ -0,0 +1,258 @@
+/*
+Copyright 2016 The Kubernetes Authors All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package imagebuilder
+
+import (
+	"bytes"
+	"fmt"
+	"path"
+	"strings"
+
+	"github.com/golang/glog"
+	"k8s.io/kube-deploy/imagebuilder/pkg/imagebuilder/executor"
+)
+
+// defaultDebianMirror is used when the template does not set packages.mirror
+const defaultDebianMirror = "http://httpredir.debian.org/debian"
+
+// policyRCD stops packages from starting services in the rootfs while we install them
+const policyRCD = "#!/bin/sh\nexit 101\n"
+
+// rootfsSpec is the part of a template that we build ourselves with debootstrap, without bootstrap-vz
+type rootfsSpec struct {
+	release  string
+	arch     string
+	variant  string
+	mirror   string
+	packages []string
+	commands [][]string
+}
+
+// loadRootfsSpec reads the system, packages and commands sections of the template
+func loadRootfsSpec(template *BootstrapVzTemplate) (*rootfsSpec, error) {
+	s := &rootfsSpec{}
+
+	var err error
+	s.release, err = template.getString("system.release")
+	if err != nil {
+		return nil, err
+	}
+	if s.release == "" {
+		return nil, fmt.Errorf("system.release not found in template")
+	}
+	s.arch, err = template.getString("system.architecture")
+	if err != nil {
+		return nil, err
+	}
+	s.variant, err = template.getString("bootstrapper.variant")
+	if err != nil {
+		return nil, err
+	}
+	s.mirror, err = template.getString("packages.mirror")
+	if err != nil {
+		return nil, err
+	}
+	if s.mirror == "" {
+		s.mirror = defaultDebianMirror
+	}
+	s.packages, err = template.getStringList("packages.install")
+	if err != nil {
+		return nil, err
+	}
+	s.commands, err = template.Commands()
+	if err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// kernelPackages are patterns (for path.Match) for the kernel, bootloader and volume packages,
+// which we skip when building a container rootfs
+var kernelPackages = []string{
+	"linux-image-*",
+	"linux-headers-*",
+	"grub", "grub-*", "grub2", "grub2-*",
+	"extlinux",
+	"dkms",
+	"initramfs-tools",
+	"cloud-initramfs-*",
+}
+
+// kernelPrograms are the programs that only make sense for a bootable image
+var kernelPrograms = map[string]bool{
+	"update-grub":      true,
+	"update-grub2":     true,
+	"grub-install":     true,
+	"grub-mkconfig":    true,
+	"update-initramfs": true,
+	"extlinux":         true,
+	"dkms":             true,
+}
+
+// kernelPaths are the files and directories that only matter for a bootable image
+var kernelPaths = []string{"/etc/default/grub", "/boot/"}
+
+// isKernelPackage returns true if the package is for the kernel, bootloader or volume
+func isKernelPackage(name string) bool {
+	for _, pattern := range kernelPackages {
+		if match, _ := path.Match(pattern, name); match {
+			return true
+		}
+	}
+	return false
+}
+
+// isKernelCommand returns true if the command is for the kernel, bootloader or volume,
+// which we skip when building a container rootfs: it runs a kernel or bootloader program,
+// installs or removes a kernel package, or writes the bootloader config.
+func isKernelCommand(command []string) bool {
+	args := command
+	// Look at the command that runs in the chroot
+	if len(args) >= 2 && args[0] == "chroot" {
+		args = args[2:]
+	}
+	if len(args) == 0 {
+		return false
+	}
+
+	if kernelPrograms[path.Base(args[0])] {
+		return true
+	}
+
+	switch path.Base(args[0]) {
+	case "apt-get", "apt", "dpkg":
+		for _, arg := range args[1:] {
+			if !strings.HasPrefix(arg, "-") && isKernelPackage(arg) {
+				return true
+			}
+		}
+	}
+
+	for _, arg := range args[1:] {
+		for _, p := range kernelPaths {
+			if strings.Contains(arg, p) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// buildRootfs debootstraps the spec into rootfs (which must be empty), installs its packages (and extraPackages),
+// and runs its commands with {root} set to rootfs.
+// If kernel is false, kernel and bootloader packages and commands are skipped.
+// tmpdir is a scratch directory on the target.
+func buildRootfs(target *executor.Target, s *rootfsSpec, rootfs string, tmpdir string, kernel bool, extraPackages []string) error {
+	args := []string{"debootstrap"}
+	if s.arch != "" {
+		args = append(args, "--arch="+s.arch)
+	}
+	if s.variant != "" {
+		args = append(args, "--variant="+s.variant)
+	}
+	args = append(args, s.release, rootfs, s.mirror)
+	err := target.Command(args...).WithSudo().Run()
+	if err != nil {
+		return err
+	}
+
+	err = target.Put(path.Join(tmpdir, "policy-rc.d"), len(policyRCD), bytes.NewReader([]byte(policyRCD)), 0755)
+	if err != nil {
+		return err
+	}
+	err = target.Command("install", "-m", "0755", path.Join(tmpdir, "policy-rc.d"), path.Join(rootfs, "usr/sbin/policy-rc.d")).WithSudo().Run()
+	if err != nil {
+		return err
+	}
+	err = target.Command("cp", "/etc/resolv.conf", path.Join(rootfs, "etc/resolv.conf")).WithSudo().Run()
+	if err != nil {
+		return err
+	}
+
+	err = target.Command("mount", "-t", "proc", "proc", path.Join(rootfs, "proc")).WithSudo().Run()
+	if err != nil {
+		return err
+	}
+	mounted := true
+	defer func() {
+		if mounted {
+			target.Command("umount", path.Join(rootfs, "proc")).WithSudo().Run()
+		}
+	}()
+
+	err = chrootAptGet(target, rootfs, "update")
+	if err != nil {
+		return err
+	}
+
+	var install []string
+	for _, p := range s.packages {
+		if !kernel && isKernelPackage(p) {
+			glog.Infof("Skipping package %q for container image", p)
+			continue
+		}
+		install = append(install, p)
+	}
+	install = append(install, extraPackages...)
+	if len(install) != 0 {
+		err = chrootAptGet(target, rootfs, append([]string{"install", "--yes", "--no-install-recommends"}, install...)...)
+		if err != nil {
+			return err
+		}
+	}
+
+	for _, command := range s.commands {
+		if !kernel && isKernelCommand(command) {
+			glog.Infof("Skipping command %q for container image", command)
+			continue
+		}
+		var expanded []string
+		for _, arg := range command {
+			expanded = append(expanded, strings.Replace(arg, "{root}", rootfs, -1))
+		}
+		cmd := target.Command(expanded...).WithSudo()
+		cmd.Env["DEBIAN_FRONTEND"] = "noninteractive"
+		err = cmd.Run()
+		if err != nil {
+			return err
+		}
+	}
+
+	err = chrootAptGet(target, rootfs, "clean")
+	if err != nil {
+		return err
+	}
+	err = target.Command("rm", "-rf", path.Join(rootfs, "usr/sbin/policy-rc.d"), path.Join(rootfs, "var/lib/apt/lists")).WithSudo().Run()
+	if err != nil {
+		return err
+	}
+
+	err = target.Command("umount", path.Join(rootfs, "proc")).WithSudo().Run()
+	if err != nil {
+		return err
+	}
+	mounted = false
+
+	return nil
+}
+
+// chrootAptGet runs apt-get non-interactively in the rootfs
+func chrootAptGet(target *executor.Target, rootfs string, args ...string) error {
+	cmd := target.Command(append([]string{"chroot", rootfs, "apt-get"}, args...)...).WithSudo()
+	cmd.Env["DEBIAN_FRONTEND"] = "noninteractive"
+	return cmd.Run()
+}
@@ -0,0 +1,72 @@
+/*
+Copyright 2016 The Kubernetes Authors All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package imagebuilder
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestIsKernelCommand(t *testing.T) {
+	grid := []struct {
+		Command []string
+		Kernel  bool
+	}{
+		// From the templates
+		{Command: []string{"chroot", "{root}", "apt-get", "install", "--yes", "linux-image-k8s"}, Kernel: true},
+		{Command: []string{"chroot", "{root}", "dkms", "remove", "ixgbevf/2.16.1", "--all"}, Kernel: true},
+		{Command: []string{"chroot", "{root}", "apt-get", "remove", "--yes", "--purge", "dkms"}, Kernel: true},
+		{Command: []string{"chroot", "{root}", "apt-get", "remove", "--yes", "linux-headers-3.16.0-4-common"}, Kernel: true},
+		{Command: []string{"chroot", "{root}", "touch", "/etc/default/grub"}, Kernel: true},
+		{Command: []string{"chroot", "{root}", "sed", "-i", "s/^GRUB_TIMEOUT=/#GRUB_TIMEOUT=/g", "/etc/default/grub"}, Kernel: true},
+		{Command: []string{"chroot", "{root}", "/bin/sh", "-c", `echo "GRUB_TIMEOUT=0" >> /etc/default/grub`}, Kernel: true},
+		{Command: []string{"chroot", "{root}", "update-grub2"}, Kernel: true},
+		{Command: []string{"chroot", "{root}", "apt-get", "update"}, Kernel: false},
+		{Command: []string{"chroot", "{root}", "apt-get", "remove", "--yes", "libgcc-4.8-dev", "gcc-4.8", "cpp", "cpp-4.9"}, Kernel: false},
+		{Command: []string{"chroot", "{root}", "apt-get", "install", "--yes", "libapparmor1", "libltdl7"}, Kernel: false},
+		{Command: []string{"wget", "https://dist-kope-io.s3.amazonaws.com/apt/kopeio.gpg.key", "-O", "{root}/tmp/kopeio.gpg.key"}, Kernel: false},
+		{Command: []string{"chroot", "{root}", "/bin/sh", "-c", `echo "APT::Periodic::Unattended-Upgrade \"0\"; " >> /etc/apt/apt.conf.d/20auto-upgrades`}, Kernel: false},
+
+		// Mentioning a kernel word is not enough
+		{Command: []string{"chroot", "{root}", "/bin/sh", "-c", "echo 'no grub here' > /etc/motd"}, Kernel: false},
+		{Command: []string{"chroot", "{root}", "apt-get", "install", "--yes", "grubby-docs-linux-image-notes"}, Kernel: false},
+		{Command: []string{"cp", "/tmp/initramfs-notes.txt", "{root}/root/"}, Kernel: false},
+
+		{Command: []string{"update-initramfs", "-u"}, Kernel: true},
+		{Command: []string{"chroot", "{root}", "/usr/sbin/grub-install", "/dev/xvda"}, Kernel: true},
+		{Command: []string{"cp", "vmlinuz", "{root}/boot/"}, Kernel: true},
+		{Command: []string{"chroot", "{root}"}, Kernel: false},
+	}
+	for _, g := range grid {
+		if actual := isKernelCommand(g.Command); actual != g.Kernel {
+			t.Errorf("isKernelCommand(%s): expected %v, was %v", strings.Join(g.Command, " "), g.Kernel, actual)
+		}
+	}
+}
+
+func TestIsKernelPackage(t *testing.T) {
+	for _, p := range []string{"linux-image-amd64", "linux-headers-3.16.0-4-common", "grub-pc", "grub2", "extlinux", "dkms", "initramfs-tools", "cloud-initramfs-growroot"} {
+		if !isKernelPackage(p) {
+			t.Errorf("expected %q to be a kernel package", p)
+		}
+	}
+	for _, p := range []string{"rsync", "screen", "vim", "docker-engine", "python-pip", "grubby-docs", "linux-base"} {
+		if isKernelPackage(p) {
+			t.Errorf("expected %q not to be a kernel package", p)
+		}
+	}
+}
@@ -0,0 +1,353 @@
+/*
+Copyright 2016 The Kubernetes Authors All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package imagebuilder
+
+import (
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"sort"
+	"strconv"
+)
+
+// ManifestSchemaVersion identifies the bootstrap-vz release the embedded manifest schema was taken from.
+// It should be updated along with the schema when we move to a newer bootstrap-vz.
+const ManifestSchemaVersion = "bootstrap-vz 0.9.10"
+
+// manifestSchema is a hand-written subset of the bootstrap-vz manifest schema, derived from
+// bootstrapvz/base/manifest-schema.yml at the 0.9.10 tag of github.com/andsens/bootstrap-vz.
+// It is not a conversion of that file: it only has the sections and keys our templates use, it sets
+// additionalProperties: false on them (which upstream does not) so that typos are caught, and of the plugins it
+// only checks commands, ntp and cloud_init.  Providers and other plugins are left to bootstrap-vz to validate.
+const manifestSchema = `{
+  "type": "object",
+  "required": ["name", "provider", "bootstrapper", "system", "volume"],
+  "additionalProperties": false,
+  "properties": {
+    "name": {"type": "string"},
+    "provider": {
+      "type": "object",
+      "required": ["name"],
+      "properties": {
+        "name": {"type": "string", "enum": ["azure", "docker", "ec2", "gce", "kvm", "oracle", "virtualbox"]},
+        "description": {"type": "string"}
+      }
+    },
+    "bootstrapper": {
+      "type": "object",
+      "required": ["workspace"],
+      "additionalProperties": false,
+      "properties": {
+        "workspace": {"type": "string", "pattern": "^/"},
+        "mirror": {"type": "string"},
+        "tarball": {"type": "boolean"},
+        "variant": {"type": "string", "enum": ["minbase"]},
+        "include_packages": {"type": "array", "items": {"type": "string"}},
+        "exclude_packages": {"type": "array", "items": {"type": "string"}},
+        "guest_additions": {"type": "string"}
+      }
+    },
+    "system": {
+      "type": "object",
+      "required": ["release", "architecture", "bootloader", "charmap", "locale", "timezone"],
+      "additionalProperties": false,
+      "properties": {
+        "release": {"type": "string"},
+        "architecture": {"type": "string", "enum": ["i386", "amd64"]},
+        "bootloader": {"type": "string", "enum": ["pvgrub", "grub", "extlinux"]},
+        "charmap": {"type": "string"},
+        "locale": {"type": "string"},
+        "timezone": {"type": "string"},
+        "hostname": {"type": "string"}
+      }
+    },
+    "volume": {
+      "type": "object",
+      "required": ["backing", "partitions"],
+      "additionalProperties": false,
+      "properties": {
+        "backing": {"type": "string", "enum": ["raw", "s3", "ebs", "vdi", "vmdk", "qcow2", "folder"]},
+        "partitions": {
+          "type": "object",
+          "required": ["type"],
+          "additionalProperties": false,
+          "properties": {
+            "type": {"type": "string", "enum": ["none", "msdos", "gpt"]},
+            "boot": {"$ref": "#partition"},
+            "root": {"$ref": "#partition"},
+            "swap": {"$ref": "#partition"}
+          }
+        }
+      }
+    },
+    "packages": {
+      "type": "object",
+      "additionalProperties": false,
+      "properties": {
+        "mirror": {"type": "string"},
+        "security": {"type": "string"},
+        "sources": {"type": "object"},
+        "components": {"type": "array", "items": {"type": "string"}},
+        "preferences": {"type": "object"},
+        "trusted-keys": {"type": "array", "items": {"type": "string"}},
+        "include-source-type": {"type": "boolean"},
+        "install": {"type": "array", "items": {"type": "string"}},
+        "install_standard": {"type": "boolean"}
+      }
+    },
+    "plugins": {
+      "type": "object",
+      "properties": {
+        "commands": {
+          "type": "object",
+          "required": ["commands"],
+          "additionalProperties": false,
+          "properties": {
+            "commands": {"type": "array", "items": {"type": "array", "items": {"type": "string"}}}
+          }
+        },
+        "ntp": {
+          "type": "object",
+          "additionalProperties": false,
+          "properties": {
+            "servers": {"type": "array", "items": {"type": "string"}}
+          }
+        },
+        "cloud_init": {
+          "type": "object",
+          "required": ["username"],
+          "additionalProperties": false,
+          "properties": {
+            "username": {"type": "string"},
+            "groups": {"type": "array", "items": {"type": "string"}},
+            "metadata_sources": {"type": "string"},
+            "disable_modules": {"type": "array", "items": {"type": "string"}},
+            "enable_modules": {"type": "object"}
+          }
+        }
+      }
+    }
+  },
+  "definitions": {
+    "partition": {
+      "type": "object",
+      "required": ["size", "filesystem"],
+      "additionalProperties": false,
+      "properties": {
+        "size": {"type": "string", "pattern": "^\\d+([KMGT]i?B|B)$"},
+        "filesystem": {"type": "string", "enum": ["ext2", "ext3", "ext4", "xfs", "swap"]},
+        "format_command": {"type": "array", "items": {"type": "string"}},
+        "mountopts": {"type": "array", "items": {"type": "string"}}
+      }
+    }
+  }
+}`
+
+// jsonSchema is the subset of JSON schema that we support
+type jsonSchema struct {
+	Ref                  string                 `json:"$ref"`
+	Type                 string                 `json:"type"`
+	Required             []string               `json:"required"`
+	Properties           map[string]*jsonSchema `json:"properties"`
+	AdditionalProperties *bool                  `json:"additionalProperties"`
+	Items                *jsonSchema            `json:"items"`
+	Enum                 []string               `json:"enum"`
+	Pattern              string                 `json:"pattern"`
+	Definitions          map[string]*jsonSchema `json:"definitions"`
+
+	// pattern is Pattern, compiled when the schema is parsed
+	pattern *regexp.Regexp
+}
+
+// compilePatterns compiles the Pattern of the schema and all its subschemas
+func (s *jsonSchema) compilePatterns() error {
+	if s == nil {
+		return nil
+	}
+	if s.Pattern != "" {
+		pattern, err := regexp.Compile(s.Pattern)
+		if err != nil {
+			return fmt.Errorf("invalid pattern %q: %v", s.Pattern, err)
+		}
+		s.pattern = pattern
+	}
+	for _, child := range s.Properties {
+		if err := child.compilePatterns(); err != nil {
+			return err
+		}
+	}
+	for _, child := range s.Definitions {
+		if err := child.compilePatterns(); err != nil {
+			return err
+		}
+	}
+	return s.Items.compilePatterns()
+}
+
+// SchemaError is a schema violation at a path in the manifest
+type SchemaError struct {
+	// Path is the location of the error, as a list of map keys and list indexes
+	Path    []string
+	Message string
+}
+
+func (e *SchemaError) Error() string {
+	return fmt.Sprintf("%s: %s", formatPath(e.Path), e.Message)
+}
+
+func formatPath(p []string) string {
+	if len(p) == 0 {
+		return "."
+	}
+	s := ""
+	for _, token := range p {
+		if _, err := strconv.Atoi(token); err == nil {
+			s += "[" + token + "]"
+		} else if s == "" {
+			s = token
+		} else {
+			s += "." + token
+		}
+	}
+	return s
+}
+
+var parsedManifestSchema *jsonSchema
+
+// ValidateManifestSchema checks a parsed bootstrap-vz manifest against the embedded manifest schema
+func ValidateManifestSchema(manifest interface{}) ([]*SchemaError, error) {
+	if parsedManifestSchema == nil {
+		s := &jsonSchema{}
+		if err := json.Unmarshal([]byte(manifestSchema), s); err != nil {
+			return nil, fmt.Errorf("error parsing embedded manifest schema: %v", err)
+		}
+		if err := s.compilePatterns(); err != nil {
+			return nil, fmt.Errorf("error parsing embedded manifest schema: %v", err)
+		}
+		parsedManifestSchema = s
+	}
+
+	v := &schemaValidator{definitions: parsedManifestSchema.Definitions}
+	v.validate(nil, parsedManifestSchema, manifest)
+	return v.errors, nil
+}
+
+type schemaValidator struct {
+	definitions map[string]*jsonSchema
+	errors      []*SchemaError
+}
+
+func (v *schemaValidator) addError(p []string, format string, args ...interface{}) {
+	v.errors = append(v.errors, &SchemaError{
+		Path:    append([]string(nil), p...),
+		Message: fmt.Sprintf(format, args...),
+	})
+}
+
+func (v *schemaValidator) validate(p []string, schema *jsonSchema, value interface{}) {
+	if schema.Ref != "" {
+		ref := v.definitions[schema.Ref[1:]]
+		if ref == nil {
+			v.addError(p, "schema references unknown definition %q", schema.Ref)
+			return
+		}
+		schema = ref
+	}
+
+	switch schema.Type {
+	case "object":
+		m, ok := value.(map[interface{}]interface{})
+		if !ok {
+			v.addError(p, "expected a map, found %s", describeValue(value))
+			return
+		}
+		for _, k := range schema.Required {
+			if _, found := m[k]; !found {
+				v.addError(p, "required key %q is missing", k)
+			}
+		}
+		var keys []string
+		for k := range m {
+			keys = append(keys, fmt.Sprintf("%v", k))
+		}
+		sort.Strings(keys)
+		for _, k := range keys {
+			child := append(p, k)
+			childSchema := schema.Properties[k]
+			if childSchema == nil {
+				if schema.AdditionalProperties != nil && !*schema.AdditionalProperties {
+					v.addError(child, "unknown key %q", k)
+				}
+				continue
+			}
+			v.validate(child, childSchema, m[k])
+		}
+
+	case "array":
+		l, ok := value.([]interface{})
+		if !ok {
+			v.addError(p, "expected a list, found %s", describeValue(value))
+			return
+		}
+		if schema.Items != nil {
+			for i, item := range l {
+				v.validate(append(p, strconv.Itoa(i)), schema.Items, item)
+			}
+		}
+
+	case "string":
+		s, ok := value.(string)
+		if !ok {
+			v.addError(p, "expected a string, found %s", describeValue(value))
+			return
+		}
+		if len(schema.Enum) != 0 {
+			found := false
+			for _, e := range schema.Enum {
+				if e == s {
+					found = true
+				}
+			}
+			if !found {
+				v.addError(p, "value %q is not one of %q", s, schema.Enum)
+			}
+		}
+		if schema.pattern != nil && !schema.pattern.MatchString(s) {
+			v.addError(p, "value %q does not match %q", s, schema.Pattern)
+		}
+
+	case "boolean":
+		if _, ok := value.(bool); !ok {
+			v.addError(p, "expected a boolean, found %s", describeValue(value))
+		}
+	}
+}
+
+func describeValue(v interface{}) string {
+	switch v := v.(type) {
+	case nil:
+		return "an empty value"
+	case string:
+		return fmt.Sprintf("string %q", v)
+	case []interface{}:
+		return "a list"
+	case map[interface{}]interface{}:
+		return "a map"
+	default:
+		return fmt.Sprintf("%T %v", v, v)
+	}
+}
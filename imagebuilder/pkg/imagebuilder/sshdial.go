@@ -0,0 +1,369 @@
+/*
+Copyright 2016 The Kubernetes Authors All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package imagebuilder
+
+import (
+	"bufio"
+	"encoding/base64"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/golang/glog"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/agent"
+	"golang.org/x/net/proxy"
+	"k8s.io/kube-deploy/imagebuilder/pkg/imagebuilder/executor"
+)
+
+// dialTimeout is the timeout for establishing each TCP connection
+const dialTimeout = 30 * time.Second
+
+// SSHConnectTimeout is how long we keep trying to reach SSH on a new instance
+const SSHConnectTimeout = 10 * time.Minute
+
+// sshConnectRetryInterval is how long we wait between attempts to reach SSH on a new instance
+var sshConnectRetryInterval = 5 * time.Second
+
+// permanentDialError is a failure to connect that retrying will not fix,
+// e.g. credentials rejected by a proxy or jump host, or an unexpected jump host key
+type permanentDialError struct {
+	err error
+}
+
+func (e *permanentDialError) Error() string {
+	return e.err.Error()
+}
+
+// isPermanentDialError returns true if err is a failure that retrying will not fix
+func isPermanentDialError(err error) bool {
+	_, ok := err.(*permanentDialError)
+	return ok
+}
+
+// isSSHAuthError returns true if err is from the server rejecting all our credentials.
+// (x/crypto/ssh does not return typed errors, so we match the message.)
+// Other handshake errors, such as EOF from an sshd that is still starting, are treated as transient.
+func isSSHAuthError(err error) bool {
+	return err != nil && strings.Contains(err.Error(), "ssh: unable to authenticate")
+}
+
+// SSHJumpHost is a bastion through which we reach the builder instance
+type SSHJumpHost struct {
+	// Address is the jump host, in the form [user@]host[:port]
+	Address string
+
+	// HostKeyFingerprints are the accepted host key fingerprints (MD5:aa:bb:... or SHA256:<base64>)
+	HostKeyFingerprints []string
+}
+
+// BuildSSHAuth returns the SSH authentication methods configured in config
+func BuildSSHAuth(config *Config) ([]ssh.AuthMethod, error) {
+	var auth []ssh.AuthMethod
+
+	if config.SSHAgent {
+		socket := os.Getenv("SSH_AUTH_SOCK")
+		if socket == "" {
+			return nil, fmt.Errorf("SSHAgent is set, but SSH_AUTH_SOCK is not set")
+		}
+		// The connection stays open for the lifetime of the process
+		sshAgent, err := net.Dial("unix", socket)
+		if err != nil {
+			return nil, fmt.Errorf("error connecting to SSH agent: %v", err)
+		}
+		auth = append(auth, ssh.PublicKeysCallback(agent.NewClient(sshAgent).Signers))
+	}
+
+	if config.SSHPrivateKey != "" {
+		keyBytes, err := ReadFile(config.SSHPrivateKey)
+		if err != nil {
+			return nil, fmt.Errorf("error loading SSH private key: %v", err)
+		}
+		key, err := ssh.ParsePrivateKey(keyBytes)
+		if err != nil {
+			return nil, fmt.Errorf("error parsing SSH private key: %v", err)
+		}
+		auth = append(auth, ssh.PublicKeys(key))
+	}
+
+	if len(auth) == 0 {
+		return nil, fmt.Errorf("SSHPrivateKey or SSHAgent is required")
+	}
+
+	return auth, nil
+}
+
+// dialFunction matches the signature of net.Dial, ssh.Client.Dial and proxy.Dialer.Dial
+type dialFunction func(network, address string) (net.Conn, error)
+
+// sshRoute describes how we reach an instance: optionally through a proxy, then through a chain of jump hosts
+type sshRoute struct {
+	proxy     *url.URL
+	jumpHosts []SSHJumpHost
+	user      string
+}
+
+// newSSHRoute builds the sshRoute described by the config
+func newSSHRoute(config *Config) (*sshRoute, error) {
+	r := &sshRoute{
+		jumpHosts: config.SSHJumpHosts,
+		user:      config.SSHUsername,
+	}
+
+	if config.SSHProxy != "" {
+		u, err := url.Parse(config.SSHProxy)
+		if err != nil {
+			return nil, fmt.Errorf("SSHProxy %q is not a well-formed URL: %v", config.SSHProxy, err)
+		}
+		switch u.Scheme {
+		case "socks5", "http":
+		default:
+			return nil, fmt.Errorf("SSHProxy %q must be a socks5:// or http:// URL", config.SSHProxy)
+		}
+		r.proxy = u
+	}
+
+	for _, jumpHost := range r.jumpHosts {
+		if len(jumpHost.HostKeyFingerprints) == 0 {
+			return nil, fmt.Errorf("HostKeyFingerprints must be specified for SSH jump host %q", jumpHost.Address)
+		}
+	}
+
+	return r, nil
+}
+
+// dialFirstHop opens the TCP connection to the first hop, through the proxy if one is configured
+func (r *sshRoute) dialFirstHop(network, address string) (net.Conn, error) {
+	if r.proxy == nil {
+		return net.DialTimeout(network, address, dialTimeout)
+	}
+
+	switch r.proxy.Scheme {
+	case "socks5":
+		dialer, err := proxy.FromURL(r.proxy, proxy.Direct)
+		if err != nil {
+			return nil, &permanentDialError{fmt.Errorf("error building SOCKS5 dialer for %q: %v", r.proxy.Host, err)}
+		}
+		conn, err := dialer.Dial(network, address)
+		if err != nil && (strings.Contains(err.Error(), "requires authentication") || strings.Contains(err.Error(), "rejected username/password")) {
+			return nil, &permanentDialError{err}
+		}
+		return conn, err
+
+	case "http":
+		return dialHTTPConnect(r.proxy, address)
+
+	default:
+		return nil, &permanentDialError{fmt.Errorf("unhandled proxy scheme %q", r.proxy.Scheme)}
+	}
+}
+
+// Dial connects to address through the route, returning an SSH client for the final hop.
+// The jump host connections are closed when the returned client is closed.
+func (r *sshRoute) Dial(address string, config *ssh.ClientConfig) (*ssh.Client, error) {
+	var jumpClients []*ssh.Client
+	closeJumpClients := func() {
+		for i := len(jumpClients) - 1; i >= 0; i-- {
+			jumpClients[i].Close()
+		}
+	}
+
+	dial := dialFunction(r.dialFirstHop)
+	for _, jumpHost := range r.jumpHosts {
+		user, hostAddress := parseSSHAddress(jumpHost.Address, r.user)
+
+		pinner := NewHostKeyPinner(jumpHost.HostKeyFingerprints)
+		jumpConfig := &ssh.ClientConfig{
+			User:            user,
+			Auth:            config.Auth,
+			HostKeyCallback: pinner.Check,
+		}
+
+		glog.V(2).Infof("Connecting to SSH jump host %s@%s", user, hostAddress)
+		jumpClient, err := sshOverConn(dial, hostAddress, jumpConfig)
+		if err != nil {
+			closeJumpClients()
+			if isPermanentDialError(err) {
+				return nil, err
+			}
+			err = fmt.Errorf("error connecting to SSH jump host %q: %v", hostAddress, err)
+			if pinner.Rejected() != nil || isSSHAuthError(err) {
+				return nil, &permanentDialError{err}
+			}
+			return nil, err
+		}
+		jumpClients = append(jumpClients, jumpClient)
+		dial = jumpClient.Dial
+	}
+
+	// An auth failure on the instance itself is not permanent: sshd often starts
+	// before cloud-init or the guest agent has installed our key
+	client, err := sshOverConn(dial, address, config)
+	if err != nil {
+		closeJumpClients()
+		return nil, err
+	}
+
+	if len(jumpClients) != 0 {
+		go func() {
+			client.Wait()
+			closeJumpClients()
+		}()
+	}
+
+	return client, nil
+}
+
+// sshOverConn establishes an SSH client connection over a connection opened with dial
+func sshOverConn(dial dialFunction, address string, config *ssh.ClientConfig) (*ssh.Client, error) {
+	conn, err := dial("tcp", address)
+	if err != nil {
+		return nil, err
+	}
+
+	c, chans, reqs, err := ssh.NewClientConn(conn, address, config)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return ssh.NewClient(c, chans, reqs), nil
+}
+
+// parseSSHAddress parses an address of the form [user@]host[:port]
+func parseSSHAddress(s string, defaultUser string) (string, string) {
+	user := defaultUser
+	if i := strings.LastIndex(s, "@"); i != -1 {
+		user = s[:i]
+		s = s[i+1:]
+	}
+	if _, _, err := net.SplitHostPort(s); err != nil {
+		s = net.JoinHostPort(s, "22")
+	}
+	return user, s
+}
+
+// dialHTTPConnect opens a tunnel to address through an HTTP proxy, using the CONNECT method
+func dialHTTPConnect(proxyURL *url.URL, address string) (net.Conn, error) {
+	proxyAddress := proxyURL.Host
+	if _, _, err := net.SplitHostPort(proxyAddress); err != nil {
+		proxyAddress = net.JoinHostPort(proxyAddress, "80")
+	}
+
+	conn, err := net.DialTimeout("tcp", proxyAddress, dialTimeout)
+	if err != nil {
+		return nil, fmt.Errorf("error connecting to HTTP proxy %q: %v", proxyAddress, err)
+	}
+
+	request := &http.Request{
+		Method: "CONNECT",
+		URL:    &url.URL{Opaque: address},
+		Host:   address,
+		Header: make(http.Header),
+	}
+	if proxyURL.User != nil {
+		password, _ := proxyURL.User.Password()
+		credentials := base64.StdEncoding.EncodeToString([]byte(proxyURL.User.Username() + ":" + password))
+		request.Header.Set("Proxy-Authorization", "Basic "+credentials)
+	}
+
+	err = request.Write(conn)
+	if err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("error writing CONNECT request to HTTP proxy %q: %v", proxyAddress, err)
+	}
+
+	reader := bufio.NewReader(conn)
+	response, err := http.ReadResponse(reader, request)
+	if err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("error reading CONNECT response from HTTP proxy %q: %v", proxyAddress, err)
+	}
+	if response.StatusCode != http.StatusOK {
+		conn.Close()
+		err := fmt.Errorf("HTTP proxy %q refused CONNECT to %q: %s", proxyAddress, address, response.Status)
+		// Other statuses (e.g. 502 while the instance is starting) may succeed later
+		if response.StatusCode == http.StatusProxyAuthRequired || response.StatusCode == http.StatusForbidden {
+			return nil, &permanentDialError{err}
+		}
+		return nil, err
+	}
+
+	// The server may already have sent its SSH banner, which is now in our buffer
+	return &bufferedConn{Conn: conn, reader: reader}, nil
+}
+
+// bufferedConn is a net.Conn whose reads are served from a bufio.Reader
+type bufferedConn struct {
+	net.Conn
+	reader *bufio.Reader
+}
+
+func (c *bufferedConn) Read(p []byte) (int, error) {
+	return c.reader.Read(p)
+}
+
+// dialSSH connects to the address over the route configured in config, retrying until the server is reachable
+// or SSHConnectTimeout has passed.  Failures that retrying will not fix (rejected host keys, or credentials rejected by
+// a proxy or jump host) are returned immediately; the instance rejecting our key is retried, as the key may not be installed yet.
+// If clientConfig has no HostKeyCallback, the keys are pinned to the fingerprints returned by getFingerprints.
+// The returned executor reconnects over the same route (with the same pinned keys) if the connection is lost.
+func dialSSH(id string, address string, config *Config, clientConfig *ssh.ClientConfig, getFingerprints hostKeyFingerprintsFunction) (executor.Executor, error) {
+	route, err := newSSHRoute(config)
+	if err != nil {
+		return nil, err
+	}
+
+	sshConfig := *clientConfig
+
+	var pinner *HostKeyPinner
+	if sshConfig.HostKeyCallback == nil {
+		fingerprints, err := waitHostKeyFingerprints(id, getFingerprints, HostKeyTimeout)
+		if err != nil {
+			return nil, err
+		}
+		pinner = NewHostKeyPinner(fingerprints)
+		sshConfig.HostKeyCallback = pinner.Check
+	}
+
+	redial := func() (*ssh.Client, error) {
+		return route.Dial(address, &sshConfig)
+	}
+
+	deadline := time.Now().Add(SSHConnectTimeout)
+	for {
+		sshClient, err := redial()
+		if err == nil {
+			return executor.NewReconnectingSSH(sshClient, redial), nil
+		}
+
+		if pinner != nil && pinner.Rejected() != nil {
+			return nil, pinner.Rejected()
+		}
+		if isPermanentDialError(err) {
+			return nil, fmt.Errorf("error connecting to SSH on server %q: %v", address, err)
+		}
+		if time.Now().After(deadline) {
+			return nil, fmt.Errorf("unable to connect to SSH on server %q within %v: %v", address, SSHConnectTimeout, err)
+		}
+		glog.Warningf("error connecting to SSH on server %q: %v", address, err)
+		time.Sleep(sshConnectRetryInterval)
+	}
+}
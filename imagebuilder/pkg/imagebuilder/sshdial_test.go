@@ -0,0 +1,149 @@
+/*
+Copyright 2016 The Kubernetes Authors All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package imagebuilder
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+func TestDialHTTPConnectErrors(t *testing.T) {
+	grid := []struct {
+		Status    int
+		Permanent bool
+	}{
+		{Status: http.StatusProxyAuthRequired, Permanent: true},
+		{Status: http.StatusForbidden, Permanent: true},
+		{Status: http.StatusBadGateway, Permanent: false},
+		{Status: http.StatusServiceUnavailable, Permanent: false},
+	}
+	for _, g := range grid {
+		listener, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatalf("error listening: %v", err)
+		}
+		go func(status int) {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			defer conn.Close()
+			buf := make([]byte, 4096)
+			conn.Read(buf)
+			fmt.Fprintf(conn, "HTTP/1.1 %d %s\r\nContent-Length: 0\r\n\r\n", status, http.StatusText(status))
+		}(g.Status)
+
+		_, err = dialHTTPConnect(&url.URL{Scheme: "http", Host: listener.Addr().String()}, "10.0.0.1:22")
+		listener.Close()
+		if err == nil {
+			t.Errorf("expected error for status %d", g.Status)
+			continue
+		}
+		if isPermanentDialError(err) != g.Permanent {
+			t.Errorf("status %d: expected permanent=%v, was %v (%v)", g.Status, g.Permanent, isPermanentDialError(err), err)
+		}
+	}
+}
+
+func TestIsSSHAuthError(t *testing.T) {
+	auth := fmt.Errorf("ssh: handshake failed: ssh: unable to authenticate, attempted methods [none publickey], no supported methods remain")
+	if !isSSHAuthError(auth) {
+		t.Errorf("expected %v to be an auth error", auth)
+	}
+	eof := fmt.Errorf("ssh: handshake failed: EOF")
+	if isSSHAuthError(eof) {
+		t.Errorf("expected %v not to be an auth error", eof)
+	}
+}
+
+func TestDialSSHRetriesTargetAuthFailure(t *testing.T) {
+	defer func(interval time.Duration) { sshConnectRetryInterval = interval }(sshConnectRetryInterval)
+	sshConnectRetryInterval = 10 * time.Millisecond
+
+	hostKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("error generating host key: %v", err)
+	}
+	hostSigner, err := ssh.NewSignerFromKey(hostKey)
+	if err != nil {
+		t.Fatalf("error building host key signer: %v", err)
+	}
+
+	// The server rejects the first attempts, as an instance does before our key is installed
+	var attempts int32
+	serverConfig := &ssh.ServerConfig{
+		PasswordCallback: func(conn ssh.ConnMetadata, password []byte) (*ssh.Permissions, error) {
+			if atomic.AddInt32(&attempts, 1) <= 2 {
+				return nil, fmt.Errorf("key not yet installed")
+			}
+			return nil, nil
+		},
+	}
+	serverConfig.AddHostKey(hostSigner)
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("error listening: %v", err)
+	}
+	defer listener.Close()
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				_, chans, reqs, err := ssh.NewServerConn(conn, serverConfig)
+				if err != nil {
+					conn.Close()
+					return
+				}
+				go ssh.DiscardRequests(reqs)
+				for c := range chans {
+					c.Reject(ssh.Prohibited, "not supported")
+				}
+			}()
+		}
+	}()
+
+	clientConfig := &ssh.ClientConfig{
+		User: "admin",
+		Auth: []ssh.AuthMethod{ssh.Password("secret")},
+		HostKeyCallback: func(hostname string, remote net.Addr, key ssh.PublicKey) error {
+			return nil
+		},
+	}
+	e, err := dialSSH("i-test", listener.Addr().String(), &Config{}, clientConfig, nil)
+	if err != nil {
+		t.Fatalf("expected auth failures on the target to be retried, got %v", err)
+	}
+	e.Close()
+
+	if n := atomic.LoadInt32(&attempts); n < 3 {
+		t.Errorf("expected at least 3 authentication attempts, was %d", n)
+	}
+}
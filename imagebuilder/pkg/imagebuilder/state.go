@@ -0,0 +1,350 @@
+/*
+Copyright 2016 The Kubernetes Authors All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package imagebuilder
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/golang/glog"
+	"golang.org/x/net/context"
+	"golang.org/x/oauth2/google"
+	"google.golang.org/api/googleapi"
+	"google.golang.org/api/storage/v1"
+)
+
+// BuildState records the progress of a build, so that it can be resumed
+type BuildState struct {
+	// BuildID identifies the build
+	BuildID string `json:"buildID"`
+	Started string `json:"started"`
+	Updated string `json:"updated"`
+
+	// Dir and Args are the working directory and command-line arguments the build was started with
+	Dir  string   `json:"dir,omitempty"`
+	Args []string `json:"args,omitempty"`
+
+	// Phases are the phases that have completed, in order
+	Phases []Phase `json:"phases"`
+
+	// BaseImage is the image the builder is launched from, which a resumed build keeps using
+	BaseImage string `json:"baseImage,omitempty"`
+
+	// InstanceID identifies the builder instance, once it is found or created
+	InstanceID string `json:"instanceID,omitempty"`
+
+	ImageName   string `json:"imageName,omitempty"`
+	ContentHash string `json:"contentHash,omitempty"`
+	// Image identifies the image on the cloud, once it is found or built
+	Image string `json:"image,omitempty"`
+	// Built is true if this build built the image
+	Built bool `json:"built"`
+	// Public is true once the image is public
+	Public bool `json:"public"`
+
+	// Regions records the copy of the image in each region, as it is replicated
+	Regions map[string]*RegionState `json:"regions,omitempty"`
+}
+
+// RegionState records the copy of the image in a region
+type RegionState struct {
+	Image  string `json:"image"`
+	Public bool   `json:"public"`
+}
+
+// NewBuildState returns the state for a new build, with a new BuildID
+func NewBuildState(now time.Time) (*BuildState, error) {
+	b := make([]byte, 4)
+	if _, err := rand.Read(b); err != nil {
+		return nil, fmt.Errorf("error generating build id: %v", err)
+	}
+	t := now.UTC()
+	return &BuildState{
+		BuildID: t.Format("20060102-150405") + "-" + hex.EncodeToString(b),
+		Started: t.Format(time.RFC3339),
+		Updated: t.Format(time.RFC3339),
+		Phases:  []Phase{},
+	}, nil
+}
+
+// Completed returns true if the phase has completed
+func (s *BuildState) Completed(phase Phase) bool {
+	for _, p := range s.Phases {
+		if p == phase {
+			return true
+		}
+	}
+	return false
+}
+
+// StateStore reads and writes a BuildState; writes are atomic, so the state survives crashes
+type StateStore interface {
+	// Read reads the state, returning nil if it does not exist
+	Read() (*BuildState, error)
+	// Write replaces the state
+	Write(state *BuildState) error
+	// Delete deletes the state, if it exists
+	Delete() error
+}
+
+// NewStateStore returns the StateStore for the location: a local path, s3://<bucket>/<key> or gs://<bucket>/<object>
+func NewStateStore(location string) (StateStore, error) {
+	if !strings.Contains(location, "://") {
+		return &fileStateStore{path: location}, nil
+	}
+
+	u, err := url.Parse(location)
+	if err != nil {
+		return nil, fmt.Errorf("error parsing state location %q: %v", location, err)
+	}
+	key := strings.TrimPrefix(u.Path, "/")
+	if u.Host == "" || key == "" {
+		return nil, fmt.Errorf("state location %q must include a bucket and a key", location)
+	}
+
+	switch u.Scheme {
+	case "s3":
+		return newS3StateStore(u.Host, key)
+	case "gs":
+		return newGCSStateStore(u.Host, key)
+	default:
+		return nil, fmt.Errorf("unsupported state location %q (expected a local path, s3:// or gs://)", location)
+	}
+}
+
+func parseBuildState(data []byte, location string) (*BuildState, error) {
+	state := &BuildState{}
+	if err := json.Unmarshal(data, state); err != nil {
+		return nil, fmt.Errorf("error parsing build state %q: %v", location, err)
+	}
+	return state, nil
+}
+
+func serializeBuildState(state *BuildState) ([]byte, error) {
+	data, err := json.MarshalIndent(state, "", "  ")
+	if err != nil {
+		return nil, fmt.Errorf("error serializing build state: %v", err)
+	}
+	return append(data, '\n'), nil
+}
+
+// fileStateStore stores the state in a local file, replacing it with a rename
+type fileStateStore struct {
+	path string
+}
+
+func (s *fileStateStore) Read() (*BuildState, error) {
+	data, err := ioutil.ReadFile(s.path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("error reading build state %q: %v", s.path, err)
+	}
+	return parseBuildState(data, s.path)
+}
+
+func (s *fileStateStore) Write(state *BuildState) error {
+	data, err := serializeBuildState(state)
+	if err != nil {
+		return err
+	}
+
+	if err := writeFileAtomic(s.path, data, 0600); err != nil {
+		return fmt.Errorf("error writing build state %q: %v", s.path, err)
+	}
+	return nil
+}
+
+func (s *fileStateStore) Delete() error {
+	if err := os.Remove(s.path); err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("error deleting build state %q: %v", s.path, err)
+	}
+	return nil
+}
+
+// s3StateStore stores the state in an S3 object; a PutObject replaces the object atomically
+type s3StateStore struct {
+	s3     *s3.S3
+	bucket string
+	key    string
+}
+
+func newS3StateStore(bucket, key string) (*s3StateStore, error) {
+	// The bucket can be in any region
+	glog.V(2).Infof("AWS S3 GetBucketLocation Bucket=%q", bucket)
+	response, err := s3.New(session.New(), &aws.Config{Region: aws.String("us-east-1")}).GetBucketLocation(&s3.GetBucketLocationInput{
+		Bucket: aws.String(bucket),
+	})
+	if err != nil {
+		return nil, fmt.Errorf("error getting location of bucket %q: %v", bucket, err)
+	}
+	region := aws.StringValue(response.LocationConstraint)
+	switch region {
+	case "":
+		region = "us-east-1"
+	case "EU":
+		region = "eu-west-1"
+	}
+
+	return &s3StateStore{
+		s3:     s3.New(session.New(), &aws.Config{Region: aws.String(region)}),
+		bucket: bucket,
+		key:    key,
+	}, nil
+}
+
+func (s *s3StateStore) String() string {
+	return "s3://" + s.bucket + "/" + s.key
+}
+
+func (s *s3StateStore) Read() (*BuildState, error) {
+	glog.V(2).Infof("AWS S3 GetObject %s", s)
+	response, err := s.s3.GetObject(&s3.GetObjectInput{
+		Bucket: aws.String(s.bucket),
+		Key:    aws.String(s.key),
+	})
+	if err != nil {
+		if awsErr, ok := err.(awserr.Error); ok && awsErr.Code() == "NoSuchKey" {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("error reading build state %s: %v", s, err)
+	}
+	defer response.Body.Close()
+
+	data, err := ioutil.ReadAll(response.Body)
+	if err != nil {
+		return nil, fmt.Errorf("error reading build state %s: %v", s, err)
+	}
+	return parseBuildState(data, s.String())
+}
+
+func (s *s3StateStore) Write(state *BuildState) error {
+	data, err := serializeBuildState(state)
+	if err != nil {
+		return err
+	}
+
+	glog.V(2).Infof("AWS S3 PutObject %s", s)
+	_, err = s.s3.PutObject(&s3.PutObjectInput{
+		Bucket:      aws.String(s.bucket),
+		Key:         aws.String(s.key),
+		Body:        bytes.NewReader(data),
+		ContentType: aws.String("application/json"),
+	})
+	if err != nil {
+		return fmt.Errorf("error writing build state %s: %v", s, err)
+	}
+	return nil
+}
+
+func (s *s3StateStore) Delete() error {
+	glog.V(2).Infof("AWS S3 DeleteObject %s", s)
+	_, err := s.s3.DeleteObject(&s3.DeleteObjectInput{
+		Bucket: aws.String(s.bucket),
+		Key:    aws.String(s.key),
+	})
+	if err != nil {
+		return fmt.Errorf("error deleting build state %s: %v", s, err)
+	}
+	return nil
+}
+
+// gcsStateStore stores the state in a GCS object; an upload replaces the object atomically
+type gcsStateStore struct {
+	storage *storage.Service
+	bucket  string
+	object  string
+}
+
+func newGCSStateStore(bucket, object string) (*gcsStateStore, error) {
+	client, err := google.DefaultClient(context.Background(), storage.DevstorageReadWriteScope)
+	if err != nil {
+		return nil, fmt.Errorf("error building google API client: %v", err)
+	}
+	storageService, err := storage.New(client)
+	if err != nil {
+		return nil, fmt.Errorf("error building GCS client: %v", err)
+	}
+	return &gcsStateStore{
+		storage: storageService,
+		bucket:  bucket,
+		object:  object,
+	}, nil
+}
+
+func (s *gcsStateStore) String() string {
+	return "gs://" + s.bucket + "/" + s.object
+}
+
+func (s *gcsStateStore) Read() (*BuildState, error) {
+	glog.V(2).Infof("GCS Objects Get %s", s)
+	response, err := s.storage.Objects.Get(s.bucket, s.object).Download()
+	if err != nil {
+		if apiErr, ok := err.(*googleapi.Error); ok && apiErr.Code == http.StatusNotFound {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("error reading build state %s: %v", s, err)
+	}
+	defer response.Body.Close()
+
+	data, err := ioutil.ReadAll(response.Body)
+	if err != nil {
+		return nil, fmt.Errorf("error reading build state %s: %v", s, err)
+	}
+	return parseBuildState(data, s.String())
+}
+
+func (s *gcsStateStore) Write(state *BuildState) error {
+	data, err := serializeBuildState(state)
+	if err != nil {
+		return err
+	}
+
+	glog.V(2).Infof("GCS Objects Insert %s", s)
+	object := &storage.Object{
+		Name:        s.object,
+		ContentType: "application/json",
+	}
+	_, err = s.storage.Objects.Insert(s.bucket, object).Media(bytes.NewReader(data)).Do()
+	if err != nil {
+		return fmt.Errorf("error writing build state %s: %v", s, err)
+	}
+	return nil
+}
+
+func (s *gcsStateStore) Delete() error {
+	glog.V(2).Infof("GCS Objects Delete %s", s)
+	err := s.storage.Objects.Delete(s.bucket, s.object).Do()
+	if err != nil && !IsGCENotFound(err) {
+		return fmt.Errorf("error deleting build state %s: %v", s, err)
+	}
+	return nil
+}
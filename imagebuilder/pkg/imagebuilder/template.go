@@ -2,16 +2,79 @@ package imagebuilder
 
 import (
 	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
 	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"reflect"
+	"strings"
 	"text/template"
 )
 
-// ExpandTemplate executes a golang template
-func ExpandTemplate(key string, templateString string, context interface{}) (string, error) {
+// ExpandTemplate executes a golang template.
+// key is the path of the template; include and sha256file paths are relative to it.
+// If strict is set, references to undefined map keys (such as undeclared .Vars) are errors.
+func ExpandTemplate(key string, templateString string, context interface{}, strict bool) (string, error) {
 	t := template.New(key)
 
+	baseDir := path.Dir(key)
+	resolve := func(p string) string {
+		if path.IsAbs(p) {
+			return p
+		}
+		return path.Join(baseDir, p)
+	}
+
 	funcMap := make(template.FuncMap)
 
+	// default returns v, or def if v is empty
+	funcMap["default"] = func(def interface{}, v interface{}) interface{} {
+		if isEmptyValue(v) {
+			return def
+		}
+		return v
+	}
+
+	// required returns v, or fails with msg if v is empty
+	funcMap["required"] = func(msg string, v interface{}) (interface{}, error) {
+		if isEmptyValue(v) {
+			return nil, fmt.Errorf("%s", msg)
+		}
+		return v, nil
+	}
+
+	// sha256file returns the hex sha256 hash of the file
+	funcMap["sha256file"] = func(p string) (string, error) {
+		data, err := ReadFile(resolve(p))
+		if err != nil {
+			return "", err
+		}
+		hash := sha256.Sum256(data)
+		return hex.EncodeToString(hash[:]), nil
+	}
+
+	// include expands another template file with the same context, returning the result
+	funcMap["include"] = func(p string) (string, error) {
+		p = resolve(p)
+		data, err := ioutil.ReadFile(p)
+		if err != nil {
+			return "", fmt.Errorf("error reading included template %q: %v", p, err)
+		}
+		return ExpandTemplate(p, string(data), context, strict)
+	}
+
+	// replace replaces all occurrences of old in s with new
+	funcMap["replace"] = func(old string, new string, s interface{}) string {
+		return strings.Replace(fmt.Sprint(s), old, new, -1)
+	}
+
+	// env returns the value of the environment variable
+	funcMap["env"] = func(k string) string {
+		return os.Getenv(k)
+	}
+
 	t.Funcs(funcMap)
 
 	_, err := t.Parse(templateString)
@@ -19,7 +82,11 @@ func ExpandTemplate(key string, templateString string, context interface{}) (str
 		return "", fmt.Errorf("error parsing template %q: %v", key, err)
 	}
 
-	t.Option("missingkey=zero")
+	if strict {
+		t.Option("missingkey=error")
+	} else {
+		t.Option("missingkey=zero")
+	}
 
 	var buffer bytes.Buffer
 	err = t.ExecuteTemplate(&buffer, key, context)
@@ -29,3 +96,18 @@ func ExpandTemplate(key string, templateString string, context interface{}) (str
 
 	return buffer.String(), nil
 }
+
+// isEmptyValue returns true for nil and for the zero value of v's type
+func isEmptyValue(v interface{}) bool {
+	if v == nil {
+		return true
+	}
+	rv := reflect.ValueOf(v)
+	switch rv.Kind() {
+	case reflect.Map, reflect.Slice, reflect.String, reflect.Array:
+		return rv.Len() == 0
+	case reflect.Ptr, reflect.Interface:
+		return rv.IsNil()
+	}
+	return reflect.DeepEqual(v, reflect.Zero(rv.Type()).Interface())
+}
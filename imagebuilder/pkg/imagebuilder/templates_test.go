@@ -0,0 +1,81 @@
+/*
+Copyright 2016 The Kubernetes Authors All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package imagebuilder
+
+import (
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"gopkg.in/yaml.v2"
+)
+
+// TestComposedTemplatesMatchBaseline checks that the templates composed from overlays render the same manifests
+// as the copy-pasted templates they replaced (in testdata/baseline-templates), so the images don't change.
+func TestComposedTemplatesMatchBaseline(t *testing.T) {
+	for _, version := range []string{"1.2", "1.3", "1.4"} {
+		for _, cloud := range []string{"aws", "gce"} {
+			var context interface{}
+			var config *Config
+			switch cloud {
+			case "aws":
+				c := &AWSConfig{}
+				c.InitDefaults("us-east-1")
+				context, config = c, &c.Config
+			case "gce":
+				c := &GCEConfig{}
+				c.InitDefaults()
+				c.Project = "my-project"
+				c.GCSDestination = "gs://my-bucket/images"
+				context, config = c, &c.Config
+			}
+			config.Cloud = cloud
+			if err := config.ResolveTemplateVars(nil); err != nil {
+				t.Fatalf("error resolving template vars: %v", err)
+			}
+
+			expected := renderTestTemplate(t, filepath.Join("testdata", "baseline-templates", version+".yml"), context)
+			actual := renderTestTemplate(t, filepath.Join("..", "..", "templates", version+".yml"), context)
+
+			if cloud == "gce" {
+				// GCE image names can't contain dots, so the version is written with dashes since names are validated
+				name := expected["name"].(string)
+				expected["name"] = strings.Replace(name, "k8s-"+version, "k8s-"+strings.Replace(version, ".", "-", -1), 1)
+			}
+
+			if !reflect.DeepEqual(expected, actual) {
+				expectedYAML, _ := yaml.Marshal(expected)
+				actualYAML, _ := yaml.Marshal(actual)
+				t.Errorf("template %s on %s does not match the baseline\nexpected:\n%s\nactual:\n%s", version, cloud, expectedYAML, actualYAML)
+			}
+		}
+	}
+}
+
+func renderTestTemplate(t *testing.T, p string, context interface{}) map[interface{}]interface{} {
+	// Not strict: the templates use optional .Vars (e.g. k8s_version) with defaults
+	template, err := LoadTemplate(p, context, false)
+	if err != nil {
+		t.Fatalf("error loading template %q: %v", p, err)
+	}
+	manifest := make(map[interface{}]interface{})
+	if err := yaml.Unmarshal([]byte(template.Manifest), &manifest); err != nil {
+		t.Fatalf("error parsing template %q: %v", p, err)
+	}
+	return manifest
+}
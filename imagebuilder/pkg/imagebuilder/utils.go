@@ -4,7 +4,9 @@ import (
 	"fmt"
 	"io/ioutil"
 	"os"
+	"path/filepath"
 	"strings"
+	"syscall"
 )
 
 // ReadFile reads the whole file using ioutil.ReadFile, but does path expansion first
@@ -18,3 +20,48 @@ func ReadFile(p string) ([]byte, error) {
 	}
 	return data, nil
 }
+
+// writeFileAtomic replaces the file p with data, by writing a temp file in the same directory and renaming it,
+// so that readers see either the old or the new contents, even if we crash
+func writeFileAtomic(p string, data []byte, mode os.FileMode) error {
+	f, err := ioutil.TempFile(filepath.Dir(p), "."+filepath.Base(p)+".")
+	if err != nil {
+		return err
+	}
+	tmp := f.Name()
+	_, err = f.Write(data)
+	if err == nil {
+		err = f.Chmod(mode)
+	}
+	if err == nil {
+		err = f.Sync()
+	}
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(tmp, p)
+	}
+	if err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	return nil
+}
+
+// lockFile takes an exclusive lock for updating the file p (on p + ".lock"), blocking until it is available.
+// The returned function releases the lock.
+func lockFile(p string) (func(), error) {
+	f, err := os.OpenFile(p+".lock", os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, fmt.Errorf("error opening lock file for %q: %v", p, err)
+	}
+	if err := syscall.Flock(int(f.Fd()), syscall.LOCK_EX); err != nil {
+		f.Close()
+		return nil, fmt.Errorf("error locking %q: %v", p, err)
+	}
+	return func() {
+		syscall.Flock(int(f.Fd()), syscall.LOCK_UN)
+		f.Close()
+	}, nil
+}